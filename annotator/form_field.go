@@ -285,3 +285,49 @@ func NewSignatureField(signature *model.PdfSignature, lines []*SignatureLine, op
 	field.AP = apDict
 	return field, nil
 }
+
+// SetSignatureAppearance sets the visible appearance of signature field `field` containing the
+// specified signature lines and styled according to the specified options. The field can be an
+// existing empty signature field, as returned by model.PdfAppender.GetSignatureField, in which
+// case the appearance fills the rectangle of its widget unless opts.Rect is set.
+func SetSignatureAppearance(field *model.PdfFieldSignature, lines []*SignatureLine, opts *SignatureFieldOpts) error {
+	if field == nil {
+		return errors.New("signature field cannot be nil")
+	}
+	widget := field.PdfAnnotationWidget
+	if widget == nil {
+		if len(field.Annotations) == 0 {
+			return errors.New("signature field has no widget annotation")
+		}
+		widget = field.Annotations[0]
+	}
+
+	if opts == nil {
+		opts = NewSignatureFieldOpts()
+	}
+	if opts.Rect == nil {
+		// Fill the rectangle of the widget without altering the options of the caller.
+		o := *opts
+		opts = &o
+		arr, ok := core.GetArray(widget.Rect)
+		if !ok {
+			return errors.New("signature widget rectangle missing")
+		}
+		rect, err := arr.ToFloat64Array()
+		if err != nil {
+			return err
+		}
+		if len(rect) != 4 || rect[2] <= rect[0] || rect[3] <= rect[1] {
+			return errors.New("signature widget rectangle is empty")
+		}
+		opts.Rect = rect
+	}
+
+	apDict, err := genFieldSignatureAppearance(lines, opts)
+	if err != nil {
+		return err
+	}
+	widget.Rect = core.MakeArrayFromFloats(opts.Rect)
+	widget.AP = apDict
+	return nil
+}
@@ -8,6 +8,7 @@ package contentstream
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/zituocn/updf/core"
 )
@@ -111,6 +112,57 @@ func (ops *ContentStreamOperations) String() string {
 	return string(ops.Bytes())
 }
 
+// PrettyString returns `ops` in a canonical form for debugging: one operation per line with
+// single spaces between the operands, and the operations in q/Q, BT/ET, BMC/BDC/EMC and BX/EX
+// blocks indented. The data of inline images is replaced by its length, so unlike String the
+// result is not a valid content stream if there are inline images.
+func (ops *ContentStreamOperations) PrettyString() string {
+	var buf bytes.Buffer
+	depth := 0
+	for _, op := range *ops {
+		if op == nil {
+			continue
+		}
+		switch op.Operand {
+		case "Q", "ET", "EMC", "EX":
+			if depth > 0 {
+				depth--
+			}
+		}
+
+		buf.WriteString(strings.Repeat("  ", depth))
+		if img, ok := inlineImageParam(op); ok {
+			buf.WriteString("BI")
+			for _, entry := range img.entries() {
+				buf.WriteString(" /" + entry.key + " " + entry.value.WriteString())
+			}
+			fmt.Fprintf(&buf, " ID %% %d bytes\n", len(img.stream))
+			buf.WriteString(strings.Repeat("  ", depth) + "EI\n")
+			continue
+		}
+		for _, param := range op.Params {
+			buf.WriteString(param.WriteString())
+			buf.WriteString(" ")
+		}
+		buf.WriteString(op.Operand + "\n")
+
+		switch op.Operand {
+		case "q", "BT", "BMC", "BDC", "BX":
+			depth++
+		}
+	}
+	return buf.String()
+}
+
+// inlineImageParam returns the inline image of BI operation `op`.
+func inlineImageParam(op *ContentStreamOperation) (*ContentStreamInlineImage, bool) {
+	if op.Operand != "BI" || len(op.Params) != 1 {
+		return nil, false
+	}
+	img, ok := op.Params[0].(*ContentStreamInlineImage)
+	return img, ok
+}
+
 // ExtractText parses and extracts all text data in content streams and returns as a string.
 // Does not take into account Encoding table, the output is simply the character codes.
 //
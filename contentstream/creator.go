@@ -869,6 +869,20 @@ func (cc *ContentCreator) Add_BMC(tag core.PdfObjectName) *ContentCreator {
 	return cc
 }
 
+// Add_BDC appends 'BDC' operand to the content stream:
+// Begins a marked-content sequence with an associated property list terminated by a balancing EMC
+// operator. `tag` shall be a name object indicating the role or significance of the sequence.
+// `propertyName` is the name of the property list in the Properties resources.
+//
+// See section 14.6 "Marked Content" and Table 320 (p. 561 PDF32000_2008).
+func (cc *ContentCreator) Add_BDC(tag core.PdfObjectName, propertyName core.PdfObjectName) *ContentCreator {
+	op := ContentStreamOperation{}
+	op.Operand = "BDC"
+	op.Params = makeParamsFromNames([]core.PdfObjectName{tag, propertyName})
+	cc.operands = append(cc.operands, &op)
+	return cc
+}
+
 // Add_EMC appends 'EMC' operand to the content stream:
 // Ends a marked-content sequence.
 //
@@ -0,0 +1,453 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"math"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// TextState represents the text state parameters of the graphics state (9.3 - Table 104).
+type TextState struct {
+	CharSpacing  float64            // Tc: Character spacing in unscaled text space units.
+	WordSpacing  float64            // Tw: Word spacing in unscaled text space units.
+	HorizScaling float64            // Tz: Horizontal scaling in percent.
+	Leading      float64            // TL: Leading in unscaled text space units.
+	FontName     core.PdfObjectName // Tf: Font resource name. Empty if the font was set by gs.
+	Font         *model.PdfFont     // Tf: Font. nil if the font could not be loaded.
+	FontSize     float64            // Tf: Font size.
+	RenderMode   int                // Tr: Text rendering mode.
+	Rise         float64            // Ts: Text rise in unscaled text space units.
+	Knockout     bool               // TK: Text knockout.
+}
+
+// PathSegmentType is the type of a PathSegment.
+type PathSegmentType int
+
+// Path segment types.
+const (
+	PathSegmentMoveTo  PathSegmentType = iota // Begin a new subpath at Points[0].
+	PathSegmentLineTo                         // Straight line to Points[0].
+	PathSegmentCurveTo                        // Bézier curve with control points Points[0], Points[1] to Points[2].
+	PathSegmentClose                          // Close the current subpath.
+)
+
+// PathSegment is a segment of a Path.
+type PathSegment struct {
+	Type   PathSegmentType
+	Points []transform.Point // Points in device coordinates.
+}
+
+// Path is a path built by the path construction operators, in device coordinates.
+type Path []PathSegment
+
+// BBox returns the bounding box of `p`. It contains the Bézier control points so it may be larger
+// than the path. The second return value is false if `p` has no points.
+func (p Path) BBox() (model.PdfRectangle, bool) {
+	var bbox model.PdfRectangle
+	found := false
+	for _, seg := range p {
+		for _, pt := range seg.Points {
+			if !found {
+				bbox = model.PdfRectangle{Llx: pt.X, Lly: pt.Y, Urx: pt.X, Ury: pt.Y}
+				found = true
+				continue
+			}
+			bbox.Llx = math.Min(bbox.Llx, pt.X)
+			bbox.Lly = math.Min(bbox.Lly, pt.Y)
+			bbox.Urx = math.Max(bbox.Urx, pt.X)
+			bbox.Ury = math.Max(bbox.Ury, pt.Y)
+		}
+	}
+	return bbox, found
+}
+
+// ClipPath is a path that intersects the clipping region (8.5.4). Clipping by text rendered with
+// modes 4-7 isn't tracked.
+type ClipPath struct {
+	Path    Path
+	EvenOdd bool // The path's interior is determined by the even-odd rule (W*) rather than the nonzero winding number rule (W).
+}
+
+// ClipBBox returns a bounding box of the clipping region of `gs`. The clipping region lies within
+// it, but the clipping region may be smaller if it isn't an axis aligned rectangle. If the clip
+// paths don't overlap, the returned rectangle is empty (Llx > Urx or Lly > Ury).
+// The second return value is false if there is no clipping.
+func (gs *GraphicsState) ClipBBox() (model.PdfRectangle, bool) {
+	var clip model.PdfRectangle
+	found := false
+	for _, cp := range gs.Clip {
+		bbox, ok := cp.Path.BBox()
+		if !ok {
+			// An empty path clips everything.
+			return model.PdfRectangle{Llx: 0, Lly: 0, Urx: -1, Ury: -1}, true
+		}
+		if !found {
+			clip = bbox
+			found = true
+			continue
+		}
+		clip.Llx = math.Max(clip.Llx, bbox.Llx)
+		clip.Lly = math.Max(clip.Lly, bbox.Lly)
+		clip.Urx = math.Min(clip.Urx, bbox.Urx)
+		clip.Ury = math.Min(clip.Ury, bbox.Ury)
+	}
+	return clip, found
+}
+
+// CurrentPath returns the current path. Handlers of the path painting operators see the path
+// that is being painted.
+func (proc *ContentStreamProcessor) CurrentPath() Path {
+	return proc.path
+}
+
+// isPathPaintingOperand returns true if `operand` is a path painting operator (Table 60).
+func isPathPaintingOperand(operand string) bool {
+	switch operand {
+	case "S", "s", "f", "F", "f*", "B", "B*", "b", "b*", "n":
+		return true
+	}
+	return false
+}
+
+// handlePathConstruction handles the path construction operators (8.5.2).
+// Invalid operands are logged and the operation is ignored.
+func (proc *ContentStreamProcessor) handlePathConstruction(op *ContentStreamOperation) {
+	numParams := map[string]int{"m": 2, "l": 2, "c": 6, "v": 4, "y": 4, "h": 0, "re": 4}[op.Operand]
+	if len(op.Params) != numParams {
+		common.Log.Debug("ERROR: Invalid number of parameters for %s: %d", op.Operand, len(op.Params))
+		return
+	}
+	f, err := core.GetNumbersAsFloat(op.Params)
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid parameters for %s: %v", op.Operand, err)
+		return
+	}
+
+	switch op.Operand {
+	case "m":
+		proc.moveTo(transform.Point{X: f[0], Y: f[1]})
+	case "l":
+		proc.lineTo(transform.Point{X: f[0], Y: f[1]})
+	case "c":
+		proc.curveTo(transform.Point{X: f[0], Y: f[1]}, transform.Point{X: f[2], Y: f[3]},
+			transform.Point{X: f[4], Y: f[5]})
+	case "v":
+		proc.curveTo(proc.pathPoint, transform.Point{X: f[0], Y: f[1]}, transform.Point{X: f[2], Y: f[3]})
+	case "y":
+		end := transform.Point{X: f[2], Y: f[3]}
+		proc.curveTo(transform.Point{X: f[0], Y: f[1]}, end, end)
+	case "h":
+		proc.closePath()
+	case "re":
+		x, y, w, h := f[0], f[1], f[2], f[3]
+		proc.moveTo(transform.Point{X: x, Y: y})
+		proc.lineTo(transform.Point{X: x + w, Y: y})
+		proc.lineTo(transform.Point{X: x + w, Y: y + h})
+		proc.lineTo(transform.Point{X: x, Y: y + h})
+		proc.closePath()
+	}
+}
+
+// moveTo begins a new subpath at user space point `pt`.
+func (proc *ContentStreamProcessor) moveTo(pt transform.Point) {
+	proc.pathStart, proc.pathPoint = pt, pt
+	proc.addSegment(PathSegmentMoveTo, pt)
+}
+
+// lineTo appends a straight line to user space point `pt` to the current path.
+func (proc *ContentStreamProcessor) lineTo(pt transform.Point) {
+	proc.pathPoint = pt
+	proc.addSegment(PathSegmentLineTo, pt)
+}
+
+// curveTo appends a Bézier curve with user space control points `c1`, `c2` and end point `pt` to
+// the current path.
+func (proc *ContentStreamProcessor) curveTo(c1, c2, pt transform.Point) {
+	proc.pathPoint = pt
+	proc.addSegment(PathSegmentCurveTo, c1, c2, pt)
+}
+
+// closePath closes the current subpath.
+func (proc *ContentStreamProcessor) closePath() {
+	proc.pathPoint = proc.pathStart
+	proc.addSegment(PathSegmentClose)
+}
+
+// addSegment appends a segment of type `typ` with user space points `points` to the current path.
+func (proc *ContentStreamProcessor) addSegment(typ PathSegmentType, points ...transform.Point) {
+	seg := PathSegment{Type: typ}
+	for _, pt := range points {
+		x, y := proc.graphicsState.Transform(pt.X, pt.Y)
+		seg.Points = append(seg.Points, transform.Point{X: x, Y: y})
+	}
+	proc.path = append(proc.path, seg)
+}
+
+// endPath ends the current path. A pending clip is applied to the clipping path.
+func (proc *ContentStreamProcessor) endPath() {
+	if proc.clipPending {
+		gs := &proc.graphicsState
+		// The full slice expression makes append copy the clip paths so that saved graphics states
+		// aren't modified.
+		gs.Clip = append(gs.Clip[:len(gs.Clip):len(gs.Clip)], ClipPath{Path: proc.path, EvenOdd: proc.clipEvenOdd})
+	}
+	proc.path = nil
+	proc.clipPending = false
+}
+
+// handleGraphicsStateParam handles the operators that set graphics state parameters (Table 57).
+// Invalid operands are logged and the operation is ignored.
+func (proc *ContentStreamProcessor) handleGraphicsStateParam(op *ContentStreamOperation) {
+	gs := &proc.graphicsState
+	numParams := 1
+	if op.Operand == "d" {
+		numParams = 2
+	}
+	if len(op.Params) != numParams {
+		common.Log.Debug("ERROR: Invalid number of parameters for %s: %d", op.Operand, len(op.Params))
+		return
+	}
+	switch op.Operand {
+	case "ri":
+		if name, ok := core.GetNameVal(op.Params[0]); ok {
+			gs.RenderingIntent = name
+		}
+		return
+	case "d":
+		if dash, phase, ok := getDashPattern(op.Params[0], op.Params[1]); ok {
+			gs.DashArray, gs.DashPhase = dash, phase
+		}
+		return
+	}
+
+	val, err := core.GetNumberAsFloat(op.Params[0])
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid parameter for %s: %v", op.Operand, err)
+		return
+	}
+	switch op.Operand {
+	case "w":
+		gs.LineWidth = val
+	case "J":
+		gs.LineCap = int(val)
+	case "j":
+		gs.LineJoin = int(val)
+	case "M":
+		gs.MiterLimit = val
+	case "i":
+		gs.Flatness = val
+	}
+}
+
+// getDashPattern returns the dash array and phase in `array` and `phase`.
+func getDashPattern(array, phase core.PdfObject) ([]float64, float64, bool) {
+	arr, ok := core.GetArray(array)
+	if !ok {
+		common.Log.Debug("ERROR: Invalid dash array %s", array)
+		return nil, 0, false
+	}
+	dash, err := arr.ToFloat64Array()
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid dash array %s: %v", array, err)
+		return nil, 0, false
+	}
+	p, err := core.GetNumberAsFloat(phase)
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid dash phase %s: %v", phase, err)
+		return nil, 0, false
+	}
+	return dash, p, true
+}
+
+// handleTextStateParam handles the text state operators (Table 105).
+// Invalid operands are logged and the operation is ignored.
+func (proc *ContentStreamProcessor) handleTextStateParam(op *ContentStreamOperation,
+	resources *model.PdfPageResources) {
+	ts := &proc.graphicsState.Text
+	if op.Operand == "Tf" {
+		if len(op.Params) != 2 {
+			common.Log.Debug("ERROR: Invalid number of parameters for Tf: %d", len(op.Params))
+			return
+		}
+		name, ok := core.GetName(op.Params[0])
+		if !ok {
+			common.Log.Debug("ERROR: Invalid font name for Tf: %s", op.Params[0])
+			return
+		}
+		size, err := core.GetNumberAsFloat(op.Params[1])
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid font size for Tf: %v", err)
+			return
+		}
+		ts.FontName, ts.FontSize, ts.Font = *name, size, nil
+		if resources != nil {
+			if fontObj, ok := resources.GetFontByName(*name); ok {
+				ts.Font = proc.loadFont(fontObj)
+			}
+		}
+		return
+	}
+
+	if len(op.Params) != 1 {
+		common.Log.Debug("ERROR: Invalid number of parameters for %s: %d", op.Operand, len(op.Params))
+		return
+	}
+	val, err := core.GetNumberAsFloat(op.Params[0])
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid parameter for %s: %v", op.Operand, err)
+		return
+	}
+	switch op.Operand {
+	case "Tc":
+		ts.CharSpacing = val
+	case "Tw":
+		ts.WordSpacing = val
+	case "Tz":
+		ts.HorizScaling = val
+	case "TL":
+		ts.Leading = val
+	case "Tr":
+		ts.RenderMode = int(val)
+	case "Ts":
+		ts.Rise = val
+	}
+}
+
+// loadFont returns the font for font object `fontObj` or nil if it can't be loaded.
+func (proc *ContentStreamProcessor) loadFont(fontObj core.PdfObject) *model.PdfFont {
+	if font, ok := proc.fonts[fontObj]; ok {
+		return font
+	}
+	font, err := model.NewPdfFontFromPdfObject(fontObj)
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to load font %s: %v", fontObj, err)
+		font = nil
+	}
+	if proc.fonts == nil {
+		proc.fonts = map[core.PdfObject]*model.PdfFont{}
+	}
+	proc.fonts[fontObj] = font
+	return font
+}
+
+// gs: Set the graphics state parameters in an ExtGState resource (8.4.5 - Table 58).
+// Invalid operands and entries are logged and ignored.
+func (proc *ContentStreamProcessor) handleCommand_gs(op *ContentStreamOperation,
+	resources *model.PdfPageResources) {
+	if len(op.Params) != 1 {
+		common.Log.Debug("ERROR: Invalid number of parameters for gs: %d", len(op.Params))
+		return
+	}
+	name, ok := core.GetName(op.Params[0])
+	if !ok || resources == nil {
+		common.Log.Debug("ERROR: Invalid gs parameter %s", op.Params[0])
+		return
+	}
+	obj, ok := resources.GetExtGState(*name)
+	if !ok {
+		common.Log.Debug("ERROR: ExtGState %s not found", *name)
+		return
+	}
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		common.Log.Debug("ERROR: ExtGState %s is not a dictionary (%T)", *name, obj)
+		return
+	}
+
+	gs := &proc.graphicsState
+	number := func(key core.PdfObjectName, val *float64) {
+		if obj := dict.Get(key); obj != nil {
+			if f, err := core.GetNumberAsFloat(core.TraceToDirectObject(obj)); err == nil {
+				*val = f
+			}
+		}
+	}
+	integer := func(key core.PdfObjectName, val *int) {
+		f := float64(*val)
+		number(key, &f)
+		*val = int(f)
+	}
+	boolean := func(key core.PdfObjectName, val *bool) {
+		if b, ok := core.GetBoolVal(dict.Get(key)); ok {
+			*val = b
+		}
+	}
+
+	number("LW", &gs.LineWidth)
+	integer("LC", &gs.LineCap)
+	integer("LJ", &gs.LineJoin)
+	number("ML", &gs.MiterLimit)
+	if arr, ok := core.GetArray(dict.Get("D")); ok && arr.Len() == 2 {
+		if dash, phase, ok := getDashPattern(core.TraceToDirectObject(arr.Get(0)), arr.Get(1)); ok {
+			gs.DashArray, gs.DashPhase = dash, phase
+		}
+	}
+	if ri, ok := core.GetNameVal(dict.Get("RI")); ok {
+		gs.RenderingIntent = ri
+	}
+	if op, ok := core.GetBoolVal(dict.Get("OP")); ok {
+		// OP also sets the non-stroking overprint if op isn't present.
+		gs.OverprintStroke, gs.OverprintFill = op, op
+	}
+	boolean("op", &gs.OverprintFill)
+	integer("OPM", &gs.OverprintMode)
+	if arr, ok := core.GetArray(dict.Get("Font")); ok && arr.Len() == 2 {
+		if size, err := core.GetNumberAsFloat(core.TraceToDirectObject(arr.Get(1))); err == nil {
+			gs.Text.FontName, gs.Text.FontSize = "", size
+			gs.Text.Font = proc.loadFont(arr.Get(0))
+		}
+	}
+	// BG2, UCR2 and TR2 take precedence over BG, UCR and TR.
+	for _, key := range []core.PdfObjectName{"BG", "BG2"} {
+		if obj := dict.Get(key); obj != nil {
+			gs.BlackGeneration = obj
+		}
+	}
+	for _, key := range []core.PdfObjectName{"UCR", "UCR2"} {
+		if obj := dict.Get(key); obj != nil {
+			gs.UndercolorRemoval = obj
+		}
+	}
+	for _, key := range []core.PdfObjectName{"TR", "TR2"} {
+		if obj := dict.Get(key); obj != nil {
+			gs.Transfer = obj
+		}
+	}
+	if obj := dict.Get("HT"); obj != nil {
+		gs.Halftone = obj
+	}
+	number("FL", &gs.Flatness)
+	number("SM", &gs.Smoothness)
+	boolean("SA", &gs.StrokeAdjustment)
+	switch bm := core.TraceToDirectObject(dict.Get("BM")).(type) {
+	case *core.PdfObjectName:
+		gs.BlendMode = string(*bm)
+	case *core.PdfObjectArray:
+		// An array of blend modes lists alternatives in order of preference.
+		if bm.Len() > 0 {
+			if mode, ok := core.GetNameVal(bm.Get(0)); ok {
+				gs.BlendMode = mode
+			}
+		}
+	}
+	switch smask := core.TraceToDirectObject(dict.Get("SMask")).(type) {
+	case *core.PdfObjectName:
+		if *smask == "None" {
+			gs.SoftMask = nil
+		}
+	case *core.PdfObjectDictionary:
+		gs.SoftMask = smask
+	}
+	number("CA", &gs.StrokeAlpha)
+	number("ca", &gs.NonStrokeAlpha)
+	boolean("AIS", &gs.AlphaIsShape)
+	boolean("TK", &gs.Text.Knockout)
+}
@@ -104,6 +104,36 @@ func (img *ContentStreamInlineImage) String() string {
 	return s
 }
 
+// inlineImageEntry is an entry of the dictionary of an inline image.
+type inlineImageEntry struct {
+	key   string
+	value core.PdfObject
+}
+
+// entries returns the entries of the dictionary of the inline image that are set, in the order
+// written by WriteString.
+func (img *ContentStreamInlineImage) entries() []inlineImageEntry {
+	all := []inlineImageEntry{
+		{"BPC", img.BitsPerComponent},
+		{"CS", img.ColorSpace},
+		{"D", img.Decode},
+		{"DP", img.DecodeParms},
+		{"F", img.Filter},
+		{"H", img.Height},
+		{"IM", img.ImageMask},
+		{"Intent", img.Intent},
+		{"I", img.Interpolate},
+		{"W", img.Width},
+	}
+	var entries []inlineImageEntry
+	for _, entry := range all {
+		if entry.value != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
 // WriteString outputs the object as it is to be written to file.
 func (img *ContentStreamInlineImage) WriteString() string {
 	var output bytes.Buffer
@@ -202,6 +232,12 @@ func (img *ContentStreamInlineImage) GetEncoder() (core.StreamEncoder, error) {
 	return newEncoderFromInlineImage(img)
 }
 
+// GetEncodedData returns the image data of the inline image as stored in the content stream, i.e.
+// encoded with the image's filters.
+func (img *ContentStreamInlineImage) GetEncodedData() []byte {
+	return img.stream
+}
+
 // IsMask checks if an image is a mask.
 // The image mask entry in the image dictionary specifies that the image data shall be used as a stencil
 // mask for painting in the current color. The mask data is 1bpc, grayscale.
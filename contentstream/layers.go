@@ -0,0 +1,123 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// DeleteLayers removes the content of the optional content groups `ocgs` (layers) from `page`:
+// the marked-content sequences, XObjects and annotations that are hidden when the groups are OFF
+// and all other groups are ON. The page content stream is replaced by one encoded with `encoder`
+// and the unused resources are pruned as by Transformer.TransformPage.
+// Use PdfOCProperties.RemoveOCG to remove the groups from the document once the content of all
+// pages has been deleted.
+func DeleteLayers(page *model.PdfPage, ocgs []*model.PdfOCG, encoder core.StreamEncoder) error {
+	groups := ocgDicts(ocgs)
+	visible := func(ocg *core.PdfObjectDictionary) bool {
+		return !groups[ocg]
+	}
+	t := NewTransformer(DropHiddenContent()).SetOCGVisibility(visible)
+	if err := t.TransformPage(page, encoder); err != nil {
+		return err
+	}
+
+	annotations, err := page.GetAnnotations()
+	if err != nil {
+		return err
+	}
+	var kept []*model.PdfAnnotation
+	for _, annot := range annotations {
+		if IsOptionalContentVisible(annot.OC, visible) {
+			kept = append(kept, annot)
+		}
+	}
+	if len(kept) != len(annotations) {
+		page.SetAnnotations(kept)
+	}
+	return nil
+}
+
+// FlattenLayers makes the content of the optional content groups `ocgs` (layers) on `page` regular
+// content that is always visible. The marked-content sequences of the groups are unwrapped and
+// the membership of XObjects and annotations in the groups is removed. Content whose visibility
+// depends on several groups through an optional content membership dictionary is not changed.
+// The page content stream is replaced by one encoded with `encoder`.
+// To flatten a document the way it is displayed, delete its hidden layers with DeleteLayers and
+// flatten the others.
+func FlattenLayers(page *model.PdfPage, ocgs []*model.PdfOCG, encoder core.StreamEncoder) error {
+	groups := ocgDicts(ocgs)
+	if err := NewTransformer(flattenMarkedContent(groups)).TransformPage(page, encoder); err != nil {
+		return err
+	}
+
+	if page.Resources != nil {
+		if xobjects, ok := core.GetDict(page.Resources.XObject); ok {
+			for _, name := range xobjects.Keys() {
+				stream, ok := core.GetStream(xobjects.Get(name))
+				if !ok {
+					continue
+				}
+				if oc, ok := core.GetDict(stream.Get("OC")); ok && groups[oc] {
+					stream.Remove("OC")
+				}
+			}
+		}
+	}
+
+	annotations, err := page.GetAnnotations()
+	if err != nil {
+		return err
+	}
+	for _, annot := range annotations {
+		if oc, ok := core.GetDict(annot.OC); ok && groups[oc] {
+			annot.OC = nil
+		}
+	}
+	return nil
+}
+
+// flattenMarkedContent returns a TransformFunc that removes the BDC and EMC operators of the
+// optional content marked-content sequences of `groups` and keeps their content.
+func flattenMarkedContent(groups map[*core.PdfObjectDictionary]bool) TransformFunc {
+	var removed []bool // For each open marked-content sequence, whether its BDC was removed.
+	return func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		switch op.Operand {
+		case "BMC", "BDC":
+			remove := false
+			if n := len(ctx.MarkedContent); n > 0 {
+				mc := ctx.MarkedContent[n-1]
+				remove = mc.Tag == "OC" && mc.Properties != nil && groups[mc.Properties]
+			}
+			removed = append(removed, remove)
+			if remove {
+				return TransformReplace, nil, nil
+			}
+		case "EMC":
+			if len(removed) == 0 {
+				break
+			}
+			remove := removed[len(removed)-1]
+			removed = removed[:len(removed)-1]
+			if remove {
+				return TransformReplace, nil, nil
+			}
+		}
+		return TransformKeep, nil, nil
+	}
+}
+
+// ocgDicts returns the set of the dictionaries of `ocgs`.
+func ocgDicts(ocgs []*model.PdfOCG) map[*core.PdfObjectDictionary]bool {
+	groups := map[*core.PdfObjectDictionary]bool{}
+	for _, ocg := range ocgs {
+		if dict, ok := core.GetDict(ocg.GetContainingPdfObject()); ok {
+			groups[dict] = true
+		}
+	}
+	return groups
+}
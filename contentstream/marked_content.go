@@ -0,0 +1,133 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// MarkedContent is a marked-content sequence begun by BMC or BDC (14.6).
+type MarkedContent struct {
+	Tag core.PdfObjectName
+	// Properties is the property list of a BDC sequence, resolved from the Properties resources if
+	// it is given by name. nil for BMC sequences or if the property list could not be resolved.
+	// For optional content (tag OC) it is the optional content group or membership dictionary.
+	Properties *core.PdfObjectDictionary
+	// Hidden is true if the sequence is optional content that isn't visible according to
+	// ProcessorOptions.OCGVisible.
+	Hidden bool
+}
+
+// MCID returns the marked-content identifier of `mc` or -1 if it has none.
+func (mc MarkedContent) MCID() int {
+	if mc.Properties == nil {
+		return -1
+	}
+	if mcid, ok := core.GetIntVal(mc.Properties.Get("MCID")); ok {
+		return mcid
+	}
+	return -1
+}
+
+// MarkedContent returns the marked-content sequences that the current operation is in, outermost
+// first. The sequences of nested content streams follow those of the content streams that draw
+// them. The handlers of BMC and BDC see the sequence they begin and those of EMC see the sequence
+// it ends.
+func (proc *ContentStreamProcessor) MarkedContent() []MarkedContent {
+	mcs := make([]MarkedContent, len(proc.markedContent))
+	copy(mcs, proc.markedContent)
+	return mcs
+}
+
+// Visible returns false if the current operation is optional content (8.11) that isn't visible
+// according to ProcessorOptions.OCGVisible. This is the case if it is in a hidden marked-content
+// sequence, in a nested content stream that is hidden, or if it draws an XObject that is hidden.
+// Hidden operations are processed as usual. Only the painting they do should be discarded.
+func (proc *ContentStreamProcessor) Visible() bool {
+	if proc.hiddenXObject {
+		return false
+	}
+	for _, mc := range proc.markedContent {
+		if mc.Hidden {
+			return false
+		}
+	}
+	for _, level := range proc.nesting {
+		if level.Hidden {
+			return false
+		}
+	}
+	return true
+}
+
+// beginMarkedContent pushes the marked-content sequence begun by BMC or BDC operation `op`.
+func (proc *ContentStreamProcessor) beginMarkedContent(op *ContentStreamOperation,
+	resources *model.PdfPageResources) {
+	mc := newMarkedContent(op, resources)
+	if mc.Tag == "OC" {
+		mc.Hidden = !IsOptionalContentVisible(mc.Properties, proc.options.OCGVisible)
+	}
+	proc.markedContent = append(proc.markedContent, mc)
+}
+
+// endMarkedContent pops the marked-content sequence ended by EMC.
+func (proc *ContentStreamProcessor) endMarkedContent() {
+	if len(proc.markedContent) == 0 {
+		common.Log.Debug("ERROR: EMC without matching BMC or BDC. Skipping")
+		return
+	}
+	proc.markedContent = proc.markedContent[:len(proc.markedContent)-1]
+}
+
+// xobjectHidden returns true if the XObject drawn by Do operation `op` is optional content that
+// isn't visible.
+func (proc *ContentStreamProcessor) xobjectHidden(op *ContentStreamOperation,
+	resources *model.PdfPageResources) bool {
+	if resources == nil || len(op.Params) != 1 {
+		return false
+	}
+	name, ok := core.GetName(op.Params[0])
+	if !ok {
+		return false
+	}
+	stream, _ := resources.GetXObjectByName(*name)
+	if stream == nil {
+		return false
+	}
+	return !IsOptionalContentVisible(stream.Get("OC"), proc.options.OCGVisible)
+}
+
+// newMarkedContent returns the marked-content sequence begun by BMC or BDC operation `op`.
+func newMarkedContent(op *ContentStreamOperation, resources *model.PdfPageResources) MarkedContent {
+	var mc MarkedContent
+	if len(op.Params) == 0 {
+		common.Log.Debug("%s: missing tag", op.Operand)
+		return mc
+	}
+	if tag, ok := core.GetName(op.Params[0]); ok {
+		mc.Tag = *tag
+	}
+	if op.Operand != "BDC" || len(op.Params) < 2 {
+		return mc
+	}
+	switch t := op.Params[1].(type) {
+	case *core.PdfObjectDictionary:
+		mc.Properties = t
+	case *core.PdfObjectName:
+		if resources == nil {
+			break
+		}
+		if props, ok := core.GetDict(resources.Properties); ok {
+			mc.Properties, _ = core.GetDict(props.Get(*t))
+		}
+	}
+	if mc.Properties == nil {
+		common.Log.Debug("BDC %s: unresolved property list %v", mc.Tag, op.Params[1])
+	}
+	return mc
+}
@@ -0,0 +1,378 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"errors"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// ProcessorOptions controls the descent of a ContentStreamProcessor into nested content streams.
+// The handlers are called for the operations of the nested content streams with their resources
+// and a graphics state that includes their transformation and bounding box. Nesting returns the
+// nesting path of the content stream being processed.
+type ProcessorOptions struct {
+	// RecurseForms processes the content streams of form XObjects drawn by Do after the handlers
+	// of the Do operation.
+	RecurseForms bool
+
+	// RecursePatterns processes the pattern cell of a tiling pattern after the handlers of each
+	// painting operation that paints with it. The cell is processed once, not once for each tile.
+	RecursePatterns bool
+
+	// MaxDepth is the maximum nesting depth. Deeper content streams are skipped.
+	// DefaultMaxNestingDepth is used if it is 0.
+	MaxDepth int
+
+	// OCGVisible decides which optional content groups are visible for Visible, MarkedContent
+	// and NestingLevel.Hidden. All groups are visible if it is nil. Use NewOCGVisibility for the
+	// document's default configuration.
+	OCGVisible OCGVisibility
+}
+
+// DefaultMaxNestingDepth is the default maximum depth of nested content streams.
+const DefaultMaxNestingDepth = 32
+
+// NestingType is the type of a nested content stream.
+type NestingType int
+
+// Nested content stream types.
+const (
+	NestingForm       NestingType = iota // Form XObject drawn by Do.
+	NestingPattern                       // Tiling pattern cell.
+	NestingAnnotation                    // Annotation appearance stream.
+)
+
+// NestingLevel describes a nested content stream that the processor descended into.
+type NestingLevel struct {
+	Type NestingType
+	// Name is the resource name of the form XObject or pattern. It is empty for annotations.
+	Name core.PdfObjectName
+	// Object is the content stream of the form XObject, pattern or annotation appearance.
+	Object *core.PdfObjectStream
+	// Annotation is the annotation whose appearance stream is processed. It is only set for
+	// annotations.
+	Annotation *model.PdfAnnotation
+	// Hidden is true if the form XObject or annotation is optional content that isn't visible.
+	Hidden bool
+}
+
+// SetOptions sets the options that control the descent of `proc` into nested content streams.
+func (proc *ContentStreamProcessor) SetOptions(options ProcessorOptions) {
+	proc.options = options
+}
+
+// Nesting returns the nesting path of the content stream being processed, outermost first.
+// It is empty for the top level content stream.
+func (proc *ContentStreamProcessor) Nesting() []NestingLevel {
+	nesting := make([]NestingLevel, len(proc.nesting))
+	copy(nesting, proc.nesting)
+	return nesting
+}
+
+// ProcessAnnotations processes the normal appearance streams of `annotations` as they are drawn on
+// the page (12.5.5). The handlers are called as they are by Process. Hidden annotations are
+// skipped.
+func (proc *ContentStreamProcessor) ProcessAnnotations(annotations []*model.PdfAnnotation) error {
+	for _, annot := range annotations {
+		if flags, ok := core.GetIntVal(annot.F); ok && flags&0x2 != 0 {
+			continue
+		}
+		stream := appearanceStream(annot)
+		if stream == nil {
+			continue
+		}
+		arr, ok := core.GetArray(annot.Rect)
+		if !ok {
+			common.Log.Debug("ERROR: Annotation without Rect")
+			continue
+		}
+		rect, err := model.NewPdfRectangle(*arr)
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid annotation Rect: %v", err)
+			continue
+		}
+		xform, err := model.NewXObjectFormFromStream(stream)
+		if err != nil {
+			return err
+		}
+		bbox, matrix, err := formBBoxMatrix(xform)
+		if err != nil {
+			return err
+		}
+
+		ctm := appearanceMatrix(*rect, bbox, matrix)
+		ctm.Concat(matrix)
+
+		proc.initGraphicsState()
+		level := NestingLevel{Type: NestingAnnotation, Object: stream, Annotation: annot,
+			Hidden: !IsOptionalContentVisible(annot.OC, proc.options.OCGVisible)}
+		if err := proc.processNested(level, xform, nil, ctm, bbox); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appearanceMatrix returns the matrix that maps the bounding box of form bounding box `bbox`
+// transformed by form matrix `matrix` to rectangle `rect` (Algorithm 8.1).
+func appearanceMatrix(rect, bbox model.PdfRectangle, matrix transform.Matrix) transform.Matrix {
+	transformed := transformRect(matrix, bbox)
+	sx, sy := 1.0, 1.0
+	if w := transformed.Width(); w != 0 {
+		sx = rect.Width() / w
+	}
+	if h := transformed.Height(); h != 0 {
+		sy = rect.Height() / h
+	}
+	return transform.NewMatrix(sx, 0, 0, sy, rect.Llx-transformed.Llx*sx, rect.Lly-transformed.Lly*sy)
+}
+
+// appearanceStream returns the normal appearance stream of `annot` or nil if it has none.
+func appearanceStream(annot *model.PdfAnnotation) *core.PdfObjectStream {
+	ap, ok := core.GetDict(annot.AP)
+	if !ok {
+		return nil
+	}
+	n := core.TraceToDirectObject(ap.Get("N"))
+	if stream, ok := n.(*core.PdfObjectStream); ok {
+		return stream
+	}
+	// The normal appearance is a dictionary of appearance states selected by AS.
+	states, ok := n.(*core.PdfObjectDictionary)
+	if !ok {
+		return nil
+	}
+	state, ok := core.GetName(annot.AS)
+	if !ok {
+		return nil
+	}
+	stream, _ := core.GetStream(states.Get(*state))
+	return stream
+}
+
+// recurse processes the nested content stream drawn by `op` if the processor options request it.
+func (proc *ContentStreamProcessor) recurse(op *ContentStreamOperation, resources *model.PdfPageResources) error {
+	if resources == nil {
+		return nil
+	}
+	switch op.Operand {
+	case "Do":
+		if !proc.options.RecurseForms || len(op.Params) != 1 {
+			return nil
+		}
+		name, ok := core.GetName(op.Params[0])
+		if !ok {
+			return nil
+		}
+		stream, xtype := resources.GetXObjectByName(*name)
+		if xtype != model.XObjectTypeForm {
+			return nil
+		}
+		xform, err := resources.GetXObjectFormByName(*name)
+		if err != nil {
+			return err
+		}
+		bbox, matrix, err := formBBoxMatrix(xform)
+		if err != nil {
+			return err
+		}
+		ctm := proc.graphicsState.CTM
+		ctm.Concat(matrix)
+		level := NestingLevel{Type: NestingForm, Name: *name, Object: stream, Hidden: proc.hiddenXObject}
+		return proc.processNested(level, xform, resources, ctm, bbox)
+	}
+
+	if !proc.options.RecursePatterns {
+		return nil
+	}
+	fill, stroke := paintsWith(op.Operand, proc.graphicsState.Text.RenderMode)
+	if fill {
+		if err := proc.processPattern(proc.graphicsState.ColorNonStroking, resources); err != nil {
+			return err
+		}
+	}
+	if stroke {
+		return proc.processPattern(proc.graphicsState.ColorStroking, resources)
+	}
+	return nil
+}
+
+// paintsWith returns whether operation `operand` fills and whether it strokes when the text
+// rendering mode is `renderMode`.
+func paintsWith(operand string, renderMode int) (fill, stroke bool) {
+	switch operand {
+	case "f", "F", "f*":
+		return true, false
+	case "S", "s":
+		return false, true
+	case "B", "B*", "b", "b*":
+		return true, true
+	case "Tj", "TJ", "'", `"`:
+		switch renderMode {
+		case 0, 4:
+			return true, false
+		case 1, 5:
+			return false, true
+		case 2, 6:
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// processPattern processes the pattern cell of `color` if it is a tiling pattern color.
+func (proc *ContentStreamProcessor) processPattern(color model.PdfColor, resources *model.PdfPageResources) error {
+	pcolor, ok := color.(*model.PdfColorPattern)
+	if !ok {
+		return nil
+	}
+	pattern, ok := resources.GetPatternByName(pcolor.PatternName)
+	if !ok || !pattern.IsTiling() {
+		return nil
+	}
+	tiling := pattern.GetAsTilingPattern()
+	stream, ok := core.GetStream(tiling.GetContainingPdfObject())
+	if !ok {
+		return nil
+	}
+	if tiling.BBox == nil {
+		common.Log.Debug("ERROR: Tiling pattern %s without BBox", pcolor.PatternName)
+		return nil
+	}
+	matrix := transform.IdentityMatrix()
+	if tiling.Matrix != nil {
+		f, err := tiling.Matrix.ToFloat64Array()
+		if err != nil || len(f) != 6 {
+			common.Log.Debug("ERROR: Invalid pattern matrix %s", tiling.Matrix)
+			return nil
+		}
+		matrix = transform.NewMatrix(f[0], f[1], f[2], f[3], f[4], f[5])
+	}
+	content, err := tiling.GetContentStream()
+	if err != nil {
+		return err
+	}
+
+	// Pattern space is relative to the default coordinate space of the pattern's parent content
+	// stream, not to the CTM.
+	ctm := proc.baseCTM
+	ctm.Concat(matrix)
+	level := NestingLevel{Type: NestingPattern, Name: pcolor.PatternName, Object: stream}
+	return proc.processNestedContent(level, content, tiling.Resources, resources, ctm, *tiling.BBox)
+}
+
+// formBBoxMatrix returns the BBox and Matrix of `xform`.
+func formBBoxMatrix(xform *model.XObjectForm) (model.PdfRectangle, transform.Matrix, error) {
+	matrix := transform.IdentityMatrix()
+	if arr, ok := core.GetArray(xform.Matrix); ok {
+		f, err := arr.ToFloat64Array()
+		if err != nil || len(f) != 6 {
+			common.Log.Debug("ERROR: Invalid form matrix %s", xform.Matrix)
+			return model.PdfRectangle{}, matrix, errors.New("invalid form matrix")
+		}
+		matrix = transform.NewMatrix(f[0], f[1], f[2], f[3], f[4], f[5])
+	}
+	arr, ok := core.GetArray(xform.BBox)
+	if !ok {
+		common.Log.Debug("ERROR: Form XObject without BBox")
+		return model.PdfRectangle{}, matrix, errors.New("form bbox missing")
+	}
+	bbox, err := model.NewPdfRectangle(*arr)
+	if err != nil {
+		return model.PdfRectangle{}, matrix, err
+	}
+	return *bbox, matrix, nil
+}
+
+// transformRect returns the bounding box of rectangle `r` transformed by `m`.
+func transformRect(m transform.Matrix, r model.PdfRectangle) model.PdfRectangle {
+	var path Path
+	for _, pt := range []transform.Point{{X: r.Llx, Y: r.Lly}, {X: r.Urx, Y: r.Lly},
+		{X: r.Urx, Y: r.Ury}, {X: r.Llx, Y: r.Ury}} {
+		x, y := m.Transform(pt.X, pt.Y)
+		path = append(path, PathSegment{Type: PathSegmentLineTo, Points: []transform.Point{{X: x, Y: y}}})
+	}
+	bbox, _ := path.BBox()
+	return bbox
+}
+
+// processNested processes the content stream of form `xform` at nesting `level` with CTM `ctm`,
+// clipped to `bbox`. `resources` are used if the form has none.
+func (proc *ContentStreamProcessor) processNested(level NestingLevel, xform *model.XObjectForm,
+	resources *model.PdfPageResources, ctm transform.Matrix, bbox model.PdfRectangle) error {
+	content, err := xform.GetContentStream()
+	if err != nil {
+		return err
+	}
+	return proc.processNestedContent(level, content, xform.Resources, resources, ctm, bbox)
+}
+
+// processNestedContent processes content stream `content` at nesting `level` with CTM `ctm`,
+// clipped to `bbox`. `parentResources` are used if `resources` is nil. The processor state is
+// restored afterwards.
+func (proc *ContentStreamProcessor) processNestedContent(level NestingLevel, content []byte,
+	resources, parentResources *model.PdfPageResources, ctm transform.Matrix, bbox model.PdfRectangle) error {
+	for _, l := range proc.nesting {
+		if l.Object != nil && l.Object == level.Object {
+			common.Log.Debug("ERROR: Content stream cycle at %s. Skipping", level.Name)
+			return nil
+		}
+	}
+	maxDepth := proc.options.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxNestingDepth
+	}
+	if len(proc.nesting) >= maxDepth {
+		common.Log.Debug("ERROR: Content streams nested too deeply at %s. Skipping", level.Name)
+		return nil
+	}
+	if resources == nil {
+		resources = parentResources
+	}
+	if resources == nil {
+		resources = model.NewPdfPageResources()
+	}
+	ops, err := NewContentStreamParser(string(content)).Parse()
+	if err != nil {
+		return err
+	}
+
+	// The nested content stream is processed as if it was bracketed by q and Q.
+	gs, stack, baseCTM := proc.graphicsState, proc.graphicsStack, proc.baseCTM
+	path, pathStart, pathPoint := proc.path, proc.pathStart, proc.pathPoint
+	clipPending, clipEvenOdd := proc.clipPending, proc.clipEvenOdd
+	textMatrix, textLineMatrix := proc.textMatrix, proc.textLineMatrix
+	numMarked := len(proc.markedContent)
+	defer func() {
+		proc.graphicsState, proc.graphicsStack, proc.baseCTM = gs, stack, baseCTM
+		proc.path, proc.pathStart, proc.pathPoint = path, pathStart, pathPoint
+		proc.clipPending, proc.clipEvenOdd = clipPending, clipEvenOdd
+		proc.textMatrix, proc.textLineMatrix = textMatrix, textLineMatrix
+		proc.markedContent = proc.markedContent[:numMarked]
+		proc.nesting = proc.nesting[:len(proc.nesting)-1]
+	}()
+	proc.nesting = append(proc.nesting, level)
+	proc.graphicsStack = GraphicStateStack{}
+	proc.graphicsState.CTM = ctm
+	proc.baseCTM = ctm
+
+	// Clip to the bounding box.
+	proc.path = nil
+	proc.moveTo(transform.Point{X: bbox.Llx, Y: bbox.Lly})
+	proc.lineTo(transform.Point{X: bbox.Urx, Y: bbox.Lly})
+	proc.lineTo(transform.Point{X: bbox.Urx, Y: bbox.Ury})
+	proc.lineTo(transform.Point{X: bbox.Llx, Y: bbox.Ury})
+	proc.closePath()
+	proc.clipPending, proc.clipEvenOdd = true, false
+	proc.endPath()
+
+	return proc.processOperations(*ops, resources)
+}
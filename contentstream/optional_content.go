@@ -0,0 +1,184 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// maxVisibilityExpressionDepth limits the nesting of visibility expressions.
+const maxVisibilityExpressionDepth = 16
+
+// OCGVisibility returns whether the optional content group `ocg` is visible (ON).
+type OCGVisibility func(ocg *core.PdfObjectDictionary) bool
+
+// NewOCGVisibility returns the OCG visibility of the default viewing configuration (the D entry)
+// of optional content properties dictionary `ocProperties`, as returned by
+// PdfReader.GetOCProperties (8.11.4.3). All groups are visible if `ocProperties` is nil.
+func NewOCGVisibility(ocProperties core.PdfObject) OCGVisibility {
+	on := true
+	states := map[*core.PdfObjectDictionary]bool{}
+	if props, ok := core.GetDict(ocProperties); ok {
+		if config, ok := core.GetDict(props.Get("D")); ok {
+			if base, ok := core.GetName(config.Get("BaseState")); ok && *base == "OFF" {
+				on = false
+			}
+			for _, key := range []core.PdfObjectName{"ON", "OFF"} {
+				arr, ok := core.GetArray(config.Get(key))
+				if !ok {
+					continue
+				}
+				for _, obj := range arr.Elements() {
+					if ocg, ok := core.GetDict(obj); ok {
+						states[ocg] = key == "ON"
+					}
+				}
+			}
+		}
+	}
+	return func(ocg *core.PdfObjectDictionary) bool {
+		if state, ok := states[ocg]; ok {
+			return state
+		}
+		return on
+	}
+}
+
+// OCGsVisible returns an OCGVisibility that makes the optional content groups named `names` visible
+// and hides all other groups.
+func OCGsVisible(names ...string) OCGVisibility {
+	return ocgNameVisibility(names, true)
+}
+
+// OCGsHidden returns an OCGVisibility that hides the optional content groups named `names` and
+// makes all other groups visible.
+func OCGsHidden(names ...string) OCGVisibility {
+	return ocgNameVisibility(names, false)
+}
+
+// ocgNameVisibility returns an OCGVisibility that returns `listed` for the groups named `names` and
+// the opposite for all other groups.
+func ocgNameVisibility(names []string, listed bool) OCGVisibility {
+	set := map[string]struct{}{}
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return func(ocg *core.PdfObjectDictionary) bool {
+		name, _ := core.GetStringVal(ocg.Get("Name"))
+		if _, ok := set[name]; ok {
+			return listed
+		}
+		return !listed
+	}
+}
+
+// IsOptionalContentVisible returns whether content with optional content membership `oc`, an
+// optional content group or membership dictionary (8.11.2), is visible when the visibility of the
+// groups is given by `visible`. All groups are visible if `visible` is nil. Content without
+// membership (nil `oc`) is visible.
+func IsOptionalContentVisible(oc core.PdfObject, visible OCGVisibility) bool {
+	if visible == nil {
+		visible = func(*core.PdfObjectDictionary) bool { return true }
+	}
+	dict, ok := core.GetDict(oc)
+	if !ok {
+		return true
+	}
+	typ, _ := core.GetName(dict.Get("Type"))
+	if typ == nil || *typ != "OCMD" {
+		return visible(dict)
+	}
+
+	// A visibility expression takes precedence over OCGs and P.
+	if ve, ok := core.GetArray(dict.Get("VE")); ok {
+		return evalVisibilityExpression(ve, visible, 0)
+	}
+
+	var ocgs []*core.PdfObjectDictionary
+	switch t := core.TraceToDirectObject(dict.Get("OCGs")).(type) {
+	case *core.PdfObjectDictionary:
+		ocgs = append(ocgs, t)
+	case *core.PdfObjectArray:
+		for _, obj := range t.Elements() {
+			if ocg, ok := core.GetDict(obj); ok {
+				ocgs = append(ocgs, ocg)
+			}
+		}
+	}
+	if len(ocgs) == 0 {
+		return true
+	}
+	numOn := 0
+	for _, ocg := range ocgs {
+		if visible(ocg) {
+			numOn++
+		}
+	}
+
+	policy := "AnyOn"
+	if p, ok := core.GetName(dict.Get("P")); ok {
+		policy = string(*p)
+	}
+	switch policy {
+	case "AllOn":
+		return numOn == len(ocgs)
+	case "AnyOff":
+		return numOn < len(ocgs)
+	case "AllOff":
+		return numOn == 0
+	case "AnyOn":
+	default:
+		common.Log.Debug("ERROR: Invalid OCMD visibility policy %s. Using AnyOn", policy)
+	}
+	return numOn > 0
+}
+
+// evalVisibilityExpression evaluates visibility expression `ve` (8.11.2.2) at nesting `depth`.
+func evalVisibilityExpression(ve *core.PdfObjectArray, visible OCGVisibility, depth int) bool {
+	if depth > maxVisibilityExpressionDepth || ve.Len() == 0 {
+		common.Log.Debug("ERROR: Invalid visibility expression %s", ve)
+		return true
+	}
+	op, ok := core.GetName(ve.Get(0))
+	if !ok {
+		common.Log.Debug("ERROR: Visibility expression without operator %s", ve)
+		return true
+	}
+	var operands []bool
+	for _, obj := range ve.Elements()[1:] {
+		switch t := core.TraceToDirectObject(obj).(type) {
+		case *core.PdfObjectArray:
+			operands = append(operands, evalVisibilityExpression(t, visible, depth+1))
+		case *core.PdfObjectDictionary:
+			operands = append(operands, visible(t))
+		}
+	}
+	switch *op {
+	case "Not":
+		if len(operands) != 1 {
+			common.Log.Debug("ERROR: Not visibility expression with %d operands", len(operands))
+			return true
+		}
+		return !operands[0]
+	case "And":
+		for _, v := range operands {
+			if !v {
+				return false
+			}
+		}
+		return true
+	case "Or":
+		for _, v := range operands {
+			if v {
+				return true
+			}
+		}
+		return false
+	}
+	common.Log.Debug("ERROR: Unknown visibility expression operator %s", *op)
+	return true
+}
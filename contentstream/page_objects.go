@@ -0,0 +1,493 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"errors"
+	"math"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// PageContent is the content of a page as a list of objects that can be edited: text objects,
+// painted paths, images and forms. Content that isn't part of an object, such as graphics state
+// operations, clipping paths, shadings and marked content, is kept as it is. Operations returns
+// the content with the edits applied.
+type PageContent struct {
+	ops     ContentStreamOperations
+	objects []PageObject
+}
+
+// PageObject is an object of a PageContent: a *TextObject, *PathObject, *ImageObject or
+// *FormObject. The bounding boxes and transforms of objects are in device space, which is the
+// default user space of the page for page content streams.
+type PageObject interface {
+	// BBox returns the bounding box of the object with the edits applied.
+	BBox() model.PdfRectangle
+	// GraphicsState returns the graphics state in which the object is drawn with the edits
+	// applied. For text objects it is the graphics state at the start of the object.
+	GraphicsState() GraphicsState
+	// CTM returns the current transformation matrix of the object with the edits applied.
+	CTM() transform.Matrix
+	// Operations returns the original operations of the object.
+	Operations() []*ContentStreamOperation
+
+	// Translate moves the object by `dx`, `dy` in device space.
+	Translate(dx, dy float64)
+	// Scale scales the object by `sx`, `sy` about the lower left corner of its bounding box.
+	Scale(sx, sy float64)
+	// SetFillColor sets the color of the object's fills. Images and forms that set their own
+	// colors don't change. Gray, RGB and CMYK colors are supported.
+	SetFillColor(color model.PdfColor) error
+	// SetStrokeColor sets the color of the object's strokes. Forms that set their own colors
+	// don't change. Gray, RGB and CMYK colors are supported.
+	SetStrokeColor(color model.PdfColor) error
+	// Delete removes the object from the content.
+	Delete()
+	// Deleted returns true if the object has been removed from the content.
+	Deleted() bool
+
+	object() *pageObject
+}
+
+// TextObject is a text object: the operations between BT and ET.
+type TextObject struct {
+	pageObject
+
+	// Text is the text shown by the object.
+	Text string
+	// Glyphs are the glyphs shown by the object, in the original position.
+	Glyphs []Glyph
+}
+
+// PathObject is a painted path: path construction operations followed by a path painting
+// operation other than n.
+type PathObject struct {
+	pageObject
+
+	// Path is the path in the original position.
+	Path Path
+	// Operand is the path painting operator.
+	Operand string
+}
+
+// ImageObject is an image drawn by an image XObject or an inline image.
+type ImageObject struct {
+	pageObject
+
+	// Name is the XObject resource name. It is empty for inline images.
+	Name core.PdfObjectName
+	// Image is the image XObject. It is nil for inline images and invalid image XObjects.
+	Image *model.XObjectImage
+	// Inline is the inline image. It is nil for image XObjects.
+	Inline *ContentStreamInlineImage
+}
+
+// FormObject is a form XObject.
+type FormObject struct {
+	pageObject
+
+	// Name is the XObject resource name.
+	Name core.PdfObjectName
+	// Form is the form XObject.
+	Form *model.XObjectForm
+}
+
+// pageObject is the state and the edits common to page objects.
+type pageObject struct {
+	ops  []*ContentStreamOperation
+	gs   GraphicsState
+	bbox model.PdfRectangle
+
+	// keep are the operations that stay when the object is deleted and restore are the
+	// operations that restore the state the object leaves behind after it has been wrapped in q
+	// and Q.
+	keep, restore []*ContentStreamOperation
+
+	edit         transform.Matrix // Device space transform.
+	fill, stroke model.PdfColor
+	deleted      bool
+}
+
+func (o *pageObject) object() *pageObject {
+	return o
+}
+
+// BBox returns the bounding box of the object with the edits applied.
+func (o *pageObject) BBox() model.PdfRectangle {
+	return transformRect(o.edit, o.bbox)
+}
+
+// GraphicsState returns the graphics state in which the object is drawn with the edits applied.
+func (o *pageObject) GraphicsState() GraphicsState {
+	gs := o.gs
+	gs.CTM = o.CTM()
+	if o.fill != nil {
+		gs.ColorspaceNonStroking, gs.ColorNonStroking = deviceColorspace(o.fill), o.fill
+	}
+	if o.stroke != nil {
+		gs.ColorspaceStroking, gs.ColorStroking = deviceColorspace(o.stroke), o.stroke
+	}
+	return gs
+}
+
+// CTM returns the current transformation matrix of the object with the edits applied.
+func (o *pageObject) CTM() transform.Matrix {
+	return o.edit.Mult(o.gs.CTM)
+}
+
+// Operations returns the original operations of the object.
+func (o *pageObject) Operations() []*ContentStreamOperation {
+	return o.ops
+}
+
+// Translate moves the object by `dx`, `dy` in device space.
+func (o *pageObject) Translate(dx, dy float64) {
+	o.edit.Translate(dx, dy)
+}
+
+// Scale scales the object by `sx`, `sy` about the lower left corner of its bounding box.
+func (o *pageObject) Scale(sx, sy float64) {
+	bbox := o.BBox()
+	m := transform.TranslationMatrix(bbox.Llx, bbox.Lly)
+	m.Concat(transform.NewMatrix(sx, 0, 0, sy, 0, 0))
+	m.Concat(transform.TranslationMatrix(-bbox.Llx, -bbox.Lly))
+	o.edit = m.Mult(o.edit)
+}
+
+// SetFillColor sets the color of the object's fills.
+func (o *pageObject) SetFillColor(color model.PdfColor) error {
+	if deviceColorspace(color) == nil {
+		return errors.New("unsupported color")
+	}
+	o.fill = color
+	return nil
+}
+
+// SetStrokeColor sets the color of the object's strokes.
+func (o *pageObject) SetStrokeColor(color model.PdfColor) error {
+	if deviceColorspace(color) == nil {
+		return errors.New("unsupported color")
+	}
+	o.stroke = color
+	return nil
+}
+
+// Delete removes the object from the content.
+func (o *pageObject) Delete() {
+	o.deleted = true
+}
+
+// Deleted returns true if the object has been removed from the content.
+func (o *pageObject) Deleted() bool {
+	return o.deleted
+}
+
+// edited returns true if the object has been changed.
+func (o *pageObject) edited() bool {
+	return o.deleted || o.edit != transform.IdentityMatrix() || o.fill != nil || o.stroke != nil
+}
+
+// editedOperations returns the operations that draw the object with the edits applied.
+func (o *pageObject) editedOperations() []*ContentStreamOperation {
+	if o.deleted {
+		return o.keep
+	}
+	cc := NewContentCreator()
+	cc.Add_q()
+	if o.edit != transform.IdentityMatrix() {
+		// The edit is in device space. Apply it in the user space of the object.
+		if inv, ok := o.gs.CTM.Inverse(); ok {
+			m := inv.Mult(o.edit.Mult(o.gs.CTM))
+			cc.Add_cm(m[0], m[1], m[3], m[4], m[6], m[7])
+		}
+	}
+	if o.fill != nil {
+		cc.SetNonStrokingColor(o.fill)
+	}
+	if o.stroke != nil {
+		cc.SetStrokingColor(o.stroke)
+	}
+	for _, op := range o.ops {
+		if (o.fill != nil && isNonStrokingColorOperand(op.Operand)) ||
+			(o.stroke != nil && isStrokingColorOperand(op.Operand)) {
+			continue
+		}
+		cc.AddOperand(*op)
+	}
+	cc.Add_Q()
+	ops := *cc.Operations()
+	return append(ops, o.restore...)
+}
+
+// isNonStrokingColorOperand returns true if `operand` sets the non-stroking color or color space.
+func isNonStrokingColorOperand(operand string) bool {
+	switch operand {
+	case "cs", "sc", "scn", "g", "rg", "k":
+		return true
+	}
+	return false
+}
+
+// isStrokingColorOperand returns true if `operand` sets the stroking color or color space.
+func isStrokingColorOperand(operand string) bool {
+	switch operand {
+	case "CS", "SC", "SCN", "G", "RG", "K":
+		return true
+	}
+	return false
+}
+
+// deviceColorspace returns the device color space of gray, RGB or CMYK color `color`. It returns
+// nil for other colors.
+func deviceColorspace(color model.PdfColor) model.PdfColorspace {
+	switch color.(type) {
+	case *model.PdfColorDeviceGray:
+		return model.NewPdfColorspaceDeviceGray()
+	case *model.PdfColorDeviceRGB:
+		return model.NewPdfColorspaceDeviceRGB()
+	case *model.PdfColorDeviceCMYK:
+		return model.NewPdfColorspaceDeviceCMYK()
+	}
+	return nil
+}
+
+// NewPageContent returns the objects of content stream `contents` with resources `resources`.
+// Objects in forms aren't listed individually: a form is one FormObject.
+func NewPageContent(contents string, resources *model.PdfPageResources) (*PageContent, error) {
+	ops, err := NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return nil, err
+	}
+	pc := &PageContent{ops: *ops}
+
+	indexes := map[*ContentStreamOperation]int{}
+	for i, op := range pc.ops {
+		indexes[op] = i
+	}
+	var (
+		pathStart = -1 // Index of the first operation of the current path.
+		clip      bool // The current path is also a clipping path.
+		text      *TextObject
+		textStart int
+	)
+	proc := NewContentStreamProcessor(pc.ops)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			i := indexes[op]
+			switch op.Operand {
+			case "m", "l", "c", "v", "y", "h", "re":
+				if pathStart < 0 {
+					pathStart = i
+				}
+			case "W", "W*":
+				clip = true
+			case "BT":
+				text = &TextObject{pageObject: pageObject{gs: gs}}
+				textStart = i
+			case "Tj", "TJ", "'", "\"":
+				if text == nil {
+					break
+				}
+				for _, g := range proc.Glyphs() {
+					text.Text += g.Text
+					text.Glyphs = append(text.Glyphs, g)
+				}
+			case "ET":
+				if text == nil {
+					break
+				}
+				text.init(pc.ops[textStart : i+1])
+				pc.objects = append(pc.objects, text)
+				text = nil
+			case "Do":
+				if obj := newXObjectObject(op, gs, resources); obj != nil && text == nil {
+					pc.objects = append(pc.objects, obj)
+				}
+			case "BI":
+				if img, ok := inlineImageParam(op); ok && text == nil {
+					obj := &ImageObject{Inline: img}
+					obj.gs, obj.ops = gs, pc.ops[i:i+1]
+					obj.bbox = transformRect(gs.CTM, unitSquare)
+					obj.edit = transform.IdentityMatrix()
+					pc.objects = append(pc.objects, obj)
+				}
+			default:
+				if !isPathPaintingOperand(op.Operand) {
+					break
+				}
+				if pathStart >= 0 && op.Operand != "n" {
+					pc.objects = append(pc.objects, newPathObject(pc.ops[pathStart:i+1], proc.CurrentPath(), gs, clip))
+				}
+				pathStart, clip = -1, false
+			}
+			return nil
+		})
+	if err := proc.Process(resources); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// NewPageContentFromPage returns the objects of the content streams of `page`.
+func NewPageContentFromPage(page *model.PdfPage) (*PageContent, error) {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return nil, err
+	}
+	return NewPageContent(contents, page.Resources)
+}
+
+// Objects returns the objects of `pc` in the order they are drawn, including deleted objects.
+func (pc *PageContent) Objects() []PageObject {
+	return pc.objects
+}
+
+// Operations returns the operations of `pc` with the edits of the objects applied. Moved and
+// recolored objects are wrapped in q and Q with the operations that apply the edits.
+func (pc *PageContent) Operations() *ContentStreamOperations {
+	starts := map[*ContentStreamOperation]*pageObject{}
+	for _, obj := range pc.objects {
+		if o := obj.object(); o.edited() {
+			starts[o.ops[0]] = o
+		}
+	}
+	var ops ContentStreamOperations
+	for i := 0; i < len(pc.ops); i++ {
+		o, ok := starts[pc.ops[i]]
+		if !ok {
+			ops = append(ops, pc.ops[i])
+			continue
+		}
+		ops = append(ops, o.editedOperations()...)
+		i += len(o.ops) - 1
+	}
+	return &ops
+}
+
+// Bytes returns the content stream of `pc` with the edits of the objects applied.
+func (pc *PageContent) Bytes() []byte {
+	return pc.Operations().Bytes()
+}
+
+// WriteToPage replaces the content streams of `page` with the content of `pc` encoded with
+// `encoder`. The page's resources are replaced by a new resources dictionary without the resources
+// that are no longer used, as by Transformer.TransformPage.
+func (pc *PageContent) WriteToPage(page *model.PdfPage, encoder core.StreamEncoder) error {
+	ops := pc.Operations()
+	if err := page.SetContentStreams([]string{ops.String()}, encoder); err != nil {
+		return err
+	}
+	if page.Resources != nil {
+		page.Resources = PruneResources(ops, page.Resources)
+	}
+	return nil
+}
+
+// init sets the operations and bounding box of text object `t` with operations `ops`.
+func (t *TextObject) init(ops []*ContentStreamOperation) {
+	t.ops = ops
+	t.edit = transform.IdentityMatrix()
+	for i, g := range t.Glyphs {
+		if i == 0 {
+			t.bbox = g.BBox
+			continue
+		}
+		t.bbox = unionRect(t.bbox, g.BBox)
+	}
+	// The text state parameters, colors and other graphics state parameters that the text object
+	// sets apply after it.
+	for _, op := range ops {
+		switch op.Operand {
+		case "BT", "ET", "Td", "TD", "Tm", "T*", "Tj", "TJ", "'":
+			continue
+		case "\"":
+			if len(op.Params) == 3 {
+				setSpacing := []*ContentStreamOperation{
+					{Operand: "Tw", Params: op.Params[:1]},
+					{Operand: "Tc", Params: op.Params[1:2]},
+				}
+				t.keep = append(t.keep, setSpacing...)
+				t.restore = append(t.restore, setSpacing...)
+			}
+			continue
+		case "BMC", "BDC", "EMC", "MP", "DP":
+			t.keep = append(t.keep, op)
+			continue
+		}
+		t.keep = append(t.keep, op)
+		t.restore = append(t.restore, op)
+	}
+}
+
+// newPathObject returns the path object for path `path` drawn by operations `ops` in graphics
+// state `gs`. `clip` is true if the path is also a clipping path.
+func newPathObject(ops []*ContentStreamOperation, path Path, gs GraphicsState, clip bool) *PathObject {
+	last := ops[len(ops)-1]
+	obj := &PathObject{Path: path, Operand: last.Operand}
+	obj.ops, obj.gs, obj.edit = ops, gs, transform.IdentityMatrix()
+	obj.bbox, _ = path.BBox()
+	if _, stroke := paintsWith(last.Operand, 0); stroke {
+		w := gs.LineWidth * math.Max(gs.CTM.ScalingFactorX(), gs.CTM.ScalingFactorY()) / 2
+		obj.bbox = model.PdfRectangle{Llx: obj.bbox.Llx - w, Lly: obj.bbox.Lly - w, Urx: obj.bbox.Urx + w,
+			Ury: obj.bbox.Ury + w}
+	}
+	if clip {
+		// Keep the clipping path without painting it.
+		clipOps := append(ops[:len(ops)-1:len(ops)-1], &ContentStreamOperation{Operand: "n"})
+		obj.keep, obj.restore = clipOps, clipOps
+	}
+	return obj
+}
+
+// newXObjectObject returns the image or form object drawn by Do operation `op` in graphics state
+// `gs`. It returns nil if the XObject can't be loaded.
+func newXObjectObject(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) PageObject {
+	if len(op.Params) != 1 || resources == nil {
+		return nil
+	}
+	name, ok := core.GetName(op.Params[0])
+	if !ok {
+		return nil
+	}
+	ops := []*ContentStreamOperation{op}
+	switch _, xtype := resources.GetXObjectByName(*name); xtype {
+	case model.XObjectTypeImage:
+		ximg, err := resources.GetXObjectImageByName(*name)
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid image XObject %s: %v", *name, err)
+		}
+		obj := &ImageObject{Name: *name, Image: ximg}
+		obj.ops, obj.gs, obj.edit = ops, gs, transform.IdentityMatrix()
+		obj.bbox = transformRect(gs.CTM, unitSquare)
+		return obj
+	case model.XObjectTypeForm:
+		xform, err := resources.GetXObjectFormByName(*name)
+		if err != nil {
+			return nil
+		}
+		bbox, matrix, err := formBBoxMatrix(xform)
+		if err != nil {
+			return nil
+		}
+		obj := &FormObject{Name: *name, Form: xform}
+		obj.ops, obj.gs, obj.edit = ops, gs, transform.IdentityMatrix()
+		ctm := gs.CTM
+		ctm.Concat(matrix)
+		obj.bbox = transformRect(ctm, bbox)
+		return obj
+	}
+	return nil
+}
+
+// unionRect returns the smallest rectangle that contains `a` and `b`.
+func unionRect(a, b model.PdfRectangle) model.PdfRectangle {
+	return model.PdfRectangle{Llx: math.Min(a.Llx, b.Llx), Lly: math.Min(a.Lly, b.Lly),
+		Urx: math.Max(a.Urx, b.Urx), Ury: math.Max(a.Ury, b.Ury)}
+}
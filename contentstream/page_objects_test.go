@@ -0,0 +1,91 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/model"
+)
+
+func TestPageContent(t *testing.T) {
+	resources := newTransformResources(t)
+	contents := `q 1 0 0 1 10 10 cm 0 0 m 10 0 l S Q
+		BT /F1 12 Tf 10 50 Td 0 0 1 rg (Hi) Tj ET
+		BT (there) Tj ET
+		q 4 0 0 4 0 0 cm /Im1 Do Q
+		/Fm1 Do
+		0 0 5 5 re W f
+		0 0 5 5 re W n`
+	pc, err := NewPageContent(contents, resources)
+	require.NoError(t, err)
+
+	objects := pc.Objects()
+	require.Len(t, objects, 6)
+	path, ok := objects[0].(*PathObject)
+	require.True(t, ok)
+	assert.Equal(t, "S", path.Operand)
+	assert.Equal(t, model.PdfRectangle{Llx: 9.5, Lly: 9.5, Urx: 20.5, Ury: 10.5}, path.BBox())
+	text, ok := objects[1].(*TextObject)
+	require.True(t, ok)
+	assert.Equal(t, "Hi", text.Text)
+	assert.Equal(t, "there", objects[2].(*TextObject).Text)
+	img, ok := objects[3].(*ImageObject)
+	require.True(t, ok)
+	assert.Equal(t, "Im1", string(img.Name))
+	assert.Equal(t, model.PdfRectangle{Llx: 0, Lly: 0, Urx: 4, Ury: 4}, img.BBox())
+	form, ok := objects[4].(*FormObject)
+	require.True(t, ok)
+	assert.Equal(t, "Fm1", string(form.Name))
+	clipped, ok := objects[5].(*PathObject)
+	require.True(t, ok)
+	assert.Equal(t, "f", clipped.Operand)
+
+	// Unedited content is unchanged.
+	expected, err := NewContentStreamParser(contents).Parse()
+	require.NoError(t, err)
+	assert.Equal(t, expected.String(), pc.Operations().String())
+
+	path.Translate(5, 0)
+	assert.Equal(t, model.PdfRectangle{Llx: 14.5, Lly: 9.5, Urx: 25.5, Ury: 10.5}, path.BBox())
+	require.NoError(t, text.SetFillColor(model.NewPdfColorDeviceRGB(1, 0, 0)))
+	assert.Equal(t, model.NewPdfColorDeviceRGB(1, 0, 0), text.GraphicsState().ColorNonStroking)
+	img.Scale(2, 2)
+	img.Translate(4, 0)
+	assert.Equal(t, model.PdfRectangle{Llx: 4, Lly: 0, Urx: 12, Ury: 8}, img.BBox())
+	form.Delete()
+	clipped.Delete()
+	assert.True(t, form.Deleted())
+
+	// The font and color set by the edited text object still apply to the next one.
+	expected, err = NewContentStreamParser(`q 1 0 0 1 10 10 cm q 1 0 0 1 5 0 cm 0 0 m 10 0 l S Q Q
+		q 1 0 0 rg BT /F1 12 Tf 10 50 Td (Hi) Tj ET Q /F1 12 Tf 0 0 1 rg
+		BT (there) Tj ET
+		q 4 0 0 4 0 0 cm q 2 0 0 2 1 0 cm /Im1 Do Q Q
+		0 0 5 5 re W n
+		0 0 5 5 re W n`).Parse()
+	require.NoError(t, err)
+	assert.Equal(t, expected.String(), pc.Operations().String())
+}
+
+func TestPageObjectScale(t *testing.T) {
+	pc, err := NewPageContent(`q 50 0 0 20 100 100 cm /Im1 Do Q`, newTransformResources(t))
+	require.NoError(t, err)
+	objects := pc.Objects()
+	require.Len(t, objects, 1)
+	img := objects[0]
+	assert.Equal(t, model.PdfRectangle{Llx: 100, Lly: 100, Urx: 150, Ury: 120}, img.BBox())
+
+	// Scaled about the lower left corner of the bounding box.
+	img.Scale(2, 2)
+	assert.Equal(t, model.PdfRectangle{Llx: 100, Lly: 100, Urx: 200, Ury: 140}, img.BBox())
+	img.Translate(10, 0)
+	img.Scale(0.5, 0.5)
+	assert.Equal(t, model.PdfRectangle{Llx: 110, Lly: 100, Urx: 160, Ury: 120}, img.BBox())
+}
@@ -14,14 +14,48 @@ import (
 	"github.com/zituocn/updf/model"
 )
 
-// GraphicsState is a basic graphics state implementation for PDF processing.
-// Initially only implementing and tracking a portion of the information specified. Easy to add more.
+// GraphicsState is the PDF graphics state (8.4 - Tables 52 and 53) maintained by the
+// ContentStreamProcessor.
 type GraphicsState struct {
 	ColorspaceStroking    model.PdfColorspace
 	ColorspaceNonStroking model.PdfColorspace
 	ColorStroking         model.PdfColor
 	ColorNonStroking      model.PdfColor
 	CTM                   transform.Matrix
+
+	// Clip is the current clipping path. The clipping region is the intersection of the regions
+	// enclosed by the paths. An empty Clip means no clipping.
+	Clip []ClipPath
+
+	// Text is the text state (9.3).
+	Text TextState
+
+	LineWidth  float64
+	LineCap    int // 0: Butt cap, 1: Round cap, 2: Projecting square cap.
+	LineJoin   int // 0: Miter join, 1: Round join, 2: Bevel join.
+	MiterLimit float64
+	DashArray  []float64 // Dash pattern. Empty for a solid line.
+	DashPhase  float64
+
+	RenderingIntent  string
+	StrokeAdjustment bool
+	BlendMode        string
+	// SoftMask is the soft mask dictionary (11.6.5.2) or nil for no soft mask.
+	SoftMask        *core.PdfObjectDictionary
+	StrokeAlpha     float64 // Constant alpha for stroking operations (CA).
+	NonStrokeAlpha  float64 // Constant alpha for non-stroking operations (ca).
+	AlphaIsShape    bool
+	OverprintStroke bool
+	OverprintFill   bool
+	OverprintMode   int
+
+	// Device-dependent parameters. The functions and halftones are the PDF objects that specify them.
+	BlackGeneration   core.PdfObject
+	UndercolorRemoval core.PdfObject
+	Transfer          core.PdfObject
+	Halftone          core.PdfObject
+	Flatness          float64
+	Smoothness        float64
 }
 
 // GraphicStateStack represents a stack of GraphicsState.
@@ -54,6 +88,26 @@ type ContentStreamProcessor struct {
 
 	handlers     []handlerEntry
 	currentIndex int
+
+	path        Path                              // The current path in device coordinates.
+	pathStart   transform.Point                   // Start of the current subpath in user space.
+	pathPoint   transform.Point                   // Current point in user space.
+	clipPending bool                              // W or W* has been applied to the current path.
+	clipEvenOdd bool                              // The pending clip uses the even-odd rule (W*).
+	fonts       map[core.PdfObject]*model.PdfFont // Fonts loaded by Tf and gs.
+
+	options ProcessorOptions
+	nesting []NestingLevel   // The content streams being processed below the top level.
+	baseCTM transform.Matrix // CTM at the start of the current content stream. Patterns are defined relative to it.
+
+	markedContent []MarkedContent // The marked-content sequences of the current operation.
+	hiddenXObject bool            // The current operation draws a hidden XObject.
+
+	textMatrix     transform.Matrix // Tm: The text matrix of the current text object.
+	textLineMatrix transform.Matrix // Tlm: The text line matrix of the current text object.
+	textMatrixEnd  transform.Matrix // The text matrix after the text shown by the current operation.
+	showingText    bool             // The current operation is a text showing operation.
+	glyphs         []Glyph          // The glyphs shown by the current operation.
 }
 
 // HandlerFunc is the function syntax that the ContentStreamProcessor handler must implement.
@@ -213,22 +267,51 @@ func (proc *ContentStreamProcessor) getInitialColor(cs model.PdfColorspace) (mod
 
 // Process processes the entire list of operations. Maintains the graphics state that is passed to any
 // handlers that are triggered during processing (either on specific operators or all).
+// Nested content streams are processed as set by SetOptions.
 func (proc *ContentStreamProcessor) Process(resources *model.PdfPageResources) error {
-	// Initialize graphics state
+	proc.initGraphicsState()
+	proc.markedContent = nil
+	return proc.processOperations(proc.operations, resources)
+}
+
+// initGraphicsState sets the graphics state to its initial values at the start of a page.
+func (proc *ContentStreamProcessor) initGraphicsState() {
 	proc.graphicsState.ColorspaceStroking = model.NewPdfColorspaceDeviceGray()
 	proc.graphicsState.ColorspaceNonStroking = model.NewPdfColorspaceDeviceGray()
 	proc.graphicsState.ColorStroking = model.NewPdfColorDeviceGray(0)
 	proc.graphicsState.ColorNonStroking = model.NewPdfColorDeviceGray(0)
 	proc.graphicsState.CTM = transform.IdentityMatrix()
+	proc.graphicsState.Text = TextState{HorizScaling: 100, Knockout: true}
+	proc.graphicsState.LineWidth = 1
+	proc.graphicsState.MiterLimit = 10
+	proc.graphicsState.RenderingIntent = "RelativeColorimetric"
+	proc.graphicsState.BlendMode = "Normal"
+	proc.graphicsState.StrokeAlpha = 1
+	proc.graphicsState.NonStrokeAlpha = 1
+	proc.graphicsState.Flatness = 1
+	proc.baseCTM = transform.IdentityMatrix()
+	proc.textMatrix = transform.IdentityMatrix()
+	proc.textLineMatrix = transform.IdentityMatrix()
+}
 
-	for _, op := range proc.operations {
+// processOperations processes `operations` with `resources`.
+func (proc *ContentStreamProcessor) processOperations(operations []*ContentStreamOperation,
+	resources *model.PdfPageResources) error {
+	for _, op := range operations {
 		var err error
+		proc.hiddenXObject = false
+		proc.showingText = false
+		proc.glyphs = nil
 
 		// Internal handling.
 		switch op.Operand {
 		case "q":
 			proc.graphicsStack.Push(proc.graphicsState)
 		case "Q":
+			if len(proc.graphicsStack) == 0 {
+				common.Log.Debug("ERROR: Q without matching q. Skipping")
+				break
+			}
 			proc.graphicsState = proc.graphicsStack.Pop()
 
 		// Color operations (Table 74 p. 179)
@@ -258,6 +341,42 @@ func (proc *ContentStreamProcessor) Process(resources *model.PdfPageResources) e
 			err = proc.handleCommand_k(op, resources)
 		case "cm":
 			err = proc.handleCommand_cm(op, resources)
+
+		// Graphics state operations (Table 57 p. 127)
+		case "w", "J", "j", "M", "d", "ri", "i":
+			proc.handleGraphicsStateParam(op)
+		case "gs":
+			proc.handleCommand_gs(op, resources)
+
+		// Text state operations (Table 105 p. 245)
+		case "Tc", "Tw", "Tz", "TL", "Tf", "Tr", "Ts":
+			proc.handleTextStateParam(op, resources)
+
+		// Text object and positioning operations (Tables 107 and 108)
+		case "BT", "Td", "TD", "Tm", "T*":
+			proc.handleTextPositioning(op)
+
+		// Text showing operations (Table 109)
+		case "Tj", "TJ", "'", "\"":
+			proc.handleTextShowing(op, resources)
+
+		// Path construction operations (Table 59 p. 132)
+		case "m", "l", "c", "v", "y", "h", "re":
+			proc.handlePathConstruction(op)
+		case "W":
+			proc.clipPending, proc.clipEvenOdd = true, false
+		case "W*":
+			proc.clipPending, proc.clipEvenOdd = true, true
+		case "s", "b", "b*":
+			proc.handlePathConstruction(&ContentStreamOperation{Operand: "h"})
+
+		// Marked content operations (Table 320)
+		case "BMC", "BDC":
+			proc.beginMarkedContent(op, resources)
+
+		// XObject operations (Table 87)
+		case "Do":
+			proc.hiddenXObject = proc.xobjectHidden(op, resources)
 		}
 		if err != nil {
 			common.Log.Debug("Processor handling error (%s): %v", op.Operand, err)
@@ -278,6 +397,20 @@ func (proc *ContentStreamProcessor) Process(resources *model.PdfPageResources) e
 				return err
 			}
 		}
+
+		// The path painting operators end the path after the handlers have seen it. A pending clip
+		// takes effect after painting.
+		if isPathPaintingOperand(op.Operand) {
+			proc.endPath()
+		}
+		proc.advanceText()
+
+		if err := proc.recurse(op, resources); err != nil {
+			return err
+		}
+		if op.Operand == "EMC" {
+			proc.endMarkedContent()
+		}
 	}
 
 	return nil
@@ -0,0 +1,416 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// processStates processes content stream `contents` with `resources` and returns the graphics
+// state seen by the handler of each operation keyed by operand. Later operations overwrite
+// earlier ones with the same operand.
+func processStates(t *testing.T, contents string, resources *model.PdfPageResources) map[string]GraphicsState {
+	ops, err := NewContentStreamParser(contents).Parse()
+	require.NoError(t, err)
+	states := map[string]GraphicsState{}
+	proc := NewContentStreamProcessor(*ops)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			states[op.Operand] = gs
+			return nil
+		})
+	require.NoError(t, proc.Process(resources))
+	return states
+}
+
+func TestProcessorGraphicsState(t *testing.T) {
+	resources := model.NewPdfPageResources()
+	gsDict := core.MakeDict()
+	gsDict.Set("CA", core.MakeFloat(0.5))
+	gsDict.Set("ca", core.MakeFloat(0.25))
+	gsDict.Set("BM", core.MakeName("Multiply"))
+	gsDict.Set("LW", core.MakeInteger(3))
+	gsDict.Set("OP", core.MakeBool(true))
+	gsDict.Set("D", core.MakeArray(core.MakeArrayFromIntegers([]int{2, 1}), core.MakeInteger(0)))
+	require.NoError(t, resources.AddExtGState("GS1", gsDict))
+
+	states := processStates(t, `
+		q 2 w 1 J 2 j 5 M [3 1] 1 d /Perceptual ri
+		2 Tc 3 Tw 90 Tz 12 TL 1 Tr 4 Ts
+		/GS1 gs
+		0 0 m Q
+		n`, resources)
+
+	gs := states["m"]
+	assert.Equal(t, 3.0, gs.LineWidth)
+	assert.Equal(t, 1, gs.LineCap)
+	assert.Equal(t, 2, gs.LineJoin)
+	assert.Equal(t, 5.0, gs.MiterLimit)
+	assert.Equal(t, []float64{2, 1}, gs.DashArray)
+	assert.Equal(t, 0.0, gs.DashPhase)
+	assert.Equal(t, "Perceptual", gs.RenderingIntent)
+	assert.Equal(t, 0.5, gs.StrokeAlpha)
+	assert.Equal(t, 0.25, gs.NonStrokeAlpha)
+	assert.Equal(t, "Multiply", gs.BlendMode)
+	assert.True(t, gs.OverprintStroke)
+	assert.True(t, gs.OverprintFill)
+	assert.Equal(t, TextState{CharSpacing: 2, WordSpacing: 3, HorizScaling: 90, Leading: 12,
+		RenderMode: 1, Rise: 4, Knockout: true}, gs.Text)
+
+	// Q restores the initial state.
+	gs = states["n"]
+	assert.Equal(t, 1.0, gs.LineWidth)
+	assert.Equal(t, 1.0, gs.StrokeAlpha)
+	assert.Equal(t, "Normal", gs.BlendMode)
+	assert.Nil(t, gs.DashArray)
+	assert.Equal(t, 100.0, gs.Text.HorizScaling)
+}
+
+func TestProcessorText(t *testing.T) {
+	resources := newTransformResources(t)
+	ops, err := NewContentStreamParser(`2 0 0 2 0 0 cm
+		BT /F1 10 Tf 1 0 0 1 50 100 Tm (AB) Tj [(A) 1000 (B)] TJ
+		2 Tw 20 TL 0 -5 TD (A B) ' ET`).Parse()
+	require.NoError(t, err)
+
+	type shown struct {
+		text    string
+		element int
+		x, y    float64
+	}
+	var glyphs []shown
+	var origins [][2]float64
+	proc := NewContentStreamProcessor(*ops)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			for _, g := range proc.Glyphs() {
+				x, y := g.Matrix.Transform(0, 0)
+				glyphs = append(glyphs, shown{g.Text, g.Element, math.Round(x*100) / 100, y})
+			}
+			if op.Operand == "Tj" || op.Operand == "TJ" || op.Operand == "'" {
+				tm := proc.TextMatrix()
+				x, y := tm.Translation()
+				origins = append(origins, [2]float64{math.Round(x*100) / 100, y})
+			}
+			return nil
+		})
+	require.NoError(t, proc.Process(resources))
+
+	// Helvetica A and B are 667 and space 278 units wide. The CTM scales by 2.
+	assert.Equal(t, []shown{
+		{"A", 0, 100, 200}, {"B", 0, 113.34, 200},
+		{"A", 0, 126.68, 200}, {"B", 2, 120.02, 200},
+		// TD sets the leading to 5 so ' moves down by 5 more. Word spacing applies to the space.
+		{"A", 0, 100, 180}, {" ", 0, 113.34, 180}, {"B", 0, 122.9, 180},
+	}, glyphs)
+	// The handlers see the text matrix at the start of the text.
+	assert.Equal(t, [][2]float64{{50, 100}, {63.34, 100}, {50, 90}}, origins)
+}
+
+func TestProcessorClipping(t *testing.T) {
+	states := processStates(t, `
+		2 0 0 2 0 0 cm
+		q 10 10 100 50 re W n
+		q 50 0 m 200 0 l 200 200 l h W* n
+		BT ET Q
+		0 0 m 1 1 l S
+		Q
+		BI /W 1 /H 1 /BPC 8 /CS /G ID `+"\x00"+` EI`, nil)
+
+	gs := states["BT"]
+	require.Len(t, gs.Clip, 2)
+	assert.False(t, gs.Clip[0].EvenOdd)
+	assert.True(t, gs.Clip[1].EvenOdd)
+	require.Len(t, gs.Clip[1].Path, 4)
+	assert.Equal(t, PathSegmentClose, gs.Clip[1].Path[3].Type)
+	bbox, ok := gs.ClipBBox()
+	require.True(t, ok)
+	assert.Equal(t, model.PdfRectangle{Llx: 100, Lly: 20, Urx: 220, Ury: 120}, bbox)
+
+	// Q restores the clipping path.
+	gs = states["S"]
+	require.Len(t, gs.Clip, 1)
+	bbox, _ = gs.ClipBBox()
+	assert.Equal(t, model.PdfRectangle{Llx: 20, Lly: 20, Urx: 220, Ury: 120}, bbox)
+
+	gs = states["BI"]
+	_, ok = gs.ClipBBox()
+	assert.False(t, ok)
+}
+
+// nestedOp records an operation seen by a handler while processing nested content streams.
+type nestedOp struct {
+	operand string
+	nesting []NestingLevel
+	gs      GraphicsState
+}
+
+// processNested processes content stream `contents` with `resources` and `options` and returns
+// the operations seen by the handler.
+func processNested(t *testing.T, contents string, resources *model.PdfPageResources,
+	options ProcessorOptions) []nestedOp {
+	ops, err := NewContentStreamParser(contents).Parse()
+	require.NoError(t, err)
+	var seen []nestedOp
+	proc := NewContentStreamProcessor(*ops)
+	proc.SetOptions(options)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			seen = append(seen, nestedOp{op.Operand, proc.Nesting(), gs})
+			return nil
+		})
+	require.NoError(t, proc.Process(resources))
+	return seen
+}
+
+// newTestForm returns a form XObject with content stream `contents`, bounding box (0,0)-(10,10)
+// and matrix `matrix`.
+func newTestForm(t *testing.T, contents string, matrix []float64) *model.XObjectForm {
+	xform := model.NewXObjectForm()
+	xform.BBox = core.MakeArrayFromFloats([]float64{0, 0, 10, 10})
+	if matrix != nil {
+		xform.Matrix = core.MakeArrayFromFloats(matrix)
+	}
+	require.NoError(t, xform.SetContentStream([]byte(contents), nil))
+	return xform
+}
+
+func TestProcessorRecurseForms(t *testing.T) {
+	inner := newTestForm(t, "0 0 m /Fm1 Do", nil)
+	inner.Resources = model.NewPdfPageResources()
+	outer := newTestForm(t, "/Fm2 Do", []float64{2, 0, 0, 2, 0, 0})
+	outer.Resources = model.NewPdfPageResources()
+	resources := model.NewPdfPageResources()
+	require.NoError(t, resources.SetXObjectFormByName("Fm1", outer))
+	require.NoError(t, outer.Resources.SetXObjectFormByName("Fm2", inner))
+	// The inner form draws the outer form, which must not be followed.
+	require.NoError(t, inner.Resources.SetXObjectFormByName("Fm1", outer))
+
+	seen := processNested(t, "1 0 0 1 100 200 cm /Fm1 Do", resources, ProcessorOptions{})
+	require.Len(t, seen, 2)
+
+	seen = processNested(t, "1 0 0 1 100 200 cm /Fm1 Do", resources, ProcessorOptions{RecurseForms: true})
+	var operands []string
+	for _, op := range seen {
+		operands = append(operands, op.operand)
+	}
+	assert.Equal(t, []string{"cm", "Do", "Do", "m", "Do"}, operands)
+
+	m := seen[3]
+	require.Len(t, m.nesting, 2)
+	assert.Equal(t, NestingForm, m.nesting[0].Type)
+	assert.Equal(t, core.PdfObjectName("Fm1"), m.nesting[0].Name)
+	assert.Equal(t, core.PdfObjectName("Fm2"), m.nesting[1].Name)
+	x, y := m.gs.Transform(10, 10)
+	assert.Equal(t, []float64{120, 220}, []float64{x, y})
+	// Both forms clip to their bounding boxes.
+	bbox, ok := m.gs.ClipBBox()
+	require.True(t, ok)
+	assert.Equal(t, model.PdfRectangle{Llx: 100, Lly: 200, Urx: 120, Ury: 220}, bbox)
+
+	_, ok = seen[4].gs.ClipBBox()
+	assert.True(t, ok)
+	assert.Empty(t, processNested(t, "", resources, ProcessorOptions{RecurseForms: true}))
+}
+
+func TestProcessorRecursePatterns(t *testing.T) {
+	cell := core.MakeDict()
+	cell.Set("PatternType", core.MakeInteger(1))
+	cell.Set("PaintType", core.MakeInteger(1))
+	cell.Set("TilingType", core.MakeInteger(1))
+	cell.Set("BBox", core.MakeArrayFromFloats([]float64{0, 0, 5, 5}))
+	cell.Set("XStep", core.MakeFloat(5))
+	cell.Set("YStep", core.MakeFloat(5))
+	cell.Set("Matrix", core.MakeArrayFromFloats([]float64{3, 0, 0, 3, 0, 0}))
+	cell.Set("Resources", core.MakeDict())
+	stream, err := core.MakeStream([]byte("0 0 5 5 re f"), nil)
+	require.NoError(t, err)
+	stream.Merge(cell)
+	resources := model.NewPdfPageResources()
+	require.NoError(t, resources.SetPatternByName("P1", stream))
+
+	seen := processNested(t, "2 0 0 2 0 0 cm /Pattern cs /P1 scn 0 0 10 10 re f", resources,
+		ProcessorOptions{RecursePatterns: true})
+	var operands []string
+	for _, op := range seen {
+		operands = append(operands, op.operand)
+	}
+	assert.Equal(t, []string{"cm", "cs", "scn", "re", "f", "re", "f"}, operands)
+	re := seen[5]
+	require.Len(t, re.nesting, 1)
+	assert.Equal(t, NestingPattern, re.nesting[0].Type)
+	assert.Equal(t, core.PdfObjectName("P1"), re.nesting[0].Name)
+	// The pattern matrix is relative to the page's default coordinate space, not the CTM.
+	x, y := re.gs.Transform(5, 5)
+	assert.Equal(t, []float64{15, 15}, []float64{x, y})
+
+	// The text matrices of the text painted with a pattern are kept when processing its cell.
+	textCell, err := core.MakeStream([]byte("BT 1 0 0 1 100 100 Tm ET"), nil)
+	require.NoError(t, err)
+	textCell.Merge(cell)
+	resources = newTransformResources(t)
+	require.NoError(t, resources.SetPatternByName("P2", textCell))
+	ops, err := NewContentStreamParser(`BT /F1 10 Tf /Pattern cs /P2 scn 1 0 0 1 50 100 Tm
+		(A) Tj (B) Tj 0 -10 Td (A) Tj ET`).Parse()
+	require.NoError(t, err)
+	var origins [][2]float64
+	proc := NewContentStreamProcessor(*ops)
+	proc.SetOptions(ProcessorOptions{RecursePatterns: true})
+	proc.AddHandler(HandlerConditionEnumOperand, "Tj",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			tm := proc.TextMatrix()
+			x, y := tm.Translation()
+			origins = append(origins, [2]float64{math.Round(x*100) / 100, y})
+			return nil
+		})
+	require.NoError(t, proc.Process(resources))
+	assert.Equal(t, [][2]float64{{50, 100}, {56.67, 100}, {50, 90}}, origins)
+}
+
+func TestProcessorAnnotations(t *testing.T) {
+	appearance := newTestForm(t, "0 0 m", nil)
+	annot := model.NewPdfAnnotation()
+	annot.Rect = core.MakeArrayFromFloats([]float64{100, 100, 120, 140})
+	states := core.MakeDict()
+	states.Set("On", appearance.ToPdfObject())
+	ap := core.MakeDict()
+	ap.Set("N", states)
+	annot.AP = ap
+	annot.AS = core.MakeName("On")
+	hidden := model.NewPdfAnnotation()
+	hidden.Rect = annot.Rect
+	hidden.AP = ap
+	hidden.AS = annot.AS
+	hidden.F = core.MakeInteger(2)
+
+	var seen []nestedOp
+	proc := NewContentStreamProcessor(nil)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			seen = append(seen, nestedOp{op.Operand, proc.Nesting(), gs})
+			return nil
+		})
+	require.NoError(t, proc.ProcessAnnotations([]*model.PdfAnnotation{annot, hidden}))
+	require.Len(t, seen, 1)
+	require.Len(t, seen[0].nesting, 1)
+	assert.Equal(t, NestingAnnotation, seen[0].nesting[0].Type)
+	assert.Equal(t, annot, seen[0].nesting[0].Annotation)
+	// The appearance BBox is mapped to the annotation's Rect.
+	x, y := seen[0].gs.Transform(10, 10)
+	assert.Equal(t, []float64{120, 140}, []float64{x, y})
+}
+
+// newTestOCG returns an optional content group dictionary named `name`.
+func newTestOCG(name string) *core.PdfObjectDictionary {
+	ocg := core.MakeDict()
+	ocg.Set("Type", core.MakeName("OCG"))
+	ocg.Set("Name", core.MakeString(name))
+	return ocg
+}
+
+func TestProcessorOptionalContent(t *testing.T) {
+	a, b := newTestOCG("A"), newTestOCG("B")
+	ocmd := core.MakeDict()
+	ocmd.Set("Type", core.MakeName("OCMD"))
+	ocmd.Set("VE", core.MakeArray(core.MakeName("Or"), a,
+		core.MakeArray(core.MakeName("Not"), b)))
+	properties := core.MakeDict()
+	properties.Set("MC0", a)
+	properties.Set("MC1", ocmd)
+	resources := model.NewPdfPageResources()
+	resources.Properties = properties
+	form := newTestForm(t, "/Span <</MCID 3>> BDC 0 0 m EMC", nil)
+	form.OC = b
+	require.NoError(t, resources.SetXObjectFormByName("Fm1", form))
+
+	contents := `/P <</MCID 1>> BDC /OC /MC0 BDC 0 0 m EMC EMC
+		/OC /MC1 BDC 1 1 m EMC
+		/Fm1 Do 2 2 m`
+	process := func(visible OCGVisibility) (operands []string, hidden []bool, mcs [][]MarkedContent) {
+		ops, err := NewContentStreamParser(contents).Parse()
+		require.NoError(t, err)
+		proc := NewContentStreamProcessor(*ops)
+		proc.SetOptions(ProcessorOptions{RecurseForms: true, OCGVisible: visible})
+		proc.AddHandler(HandlerConditionEnumAllOperands, "",
+			func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+				operands = append(operands, op.Operand)
+				hidden = append(hidden, !proc.Visible())
+				mcs = append(mcs, proc.MarkedContent())
+				return nil
+			})
+		require.NoError(t, proc.Process(resources))
+		return operands, hidden, mcs
+	}
+
+	operands, hidden, mcs := process(nil)
+	assert.Equal(t, []string{"BDC", "BDC", "m", "EMC", "EMC", "BDC", "m", "EMC", "Do", "BDC", "m", "EMC", "m"},
+		operands)
+	assert.Equal(t, make([]bool, len(operands)), hidden)
+	require.Len(t, mcs[2], 2)
+	assert.Equal(t, 1, mcs[2][0].MCID())
+	assert.Equal(t, core.PdfObjectName("OC"), mcs[2][1].Tag)
+	assert.Equal(t, a, mcs[2][1].Properties)
+	assert.Len(t, mcs[4], 1)
+	assert.Empty(t, mcs[8])
+	assert.Equal(t, 3, mcs[10][0].MCID())
+	assert.Empty(t, mcs[12])
+
+	// A and B are hidden: the MC0 sequence and the form are hidden, the OCMD (A or not B) is shown.
+	_, hidden, mcs = process(OCGsVisible())
+	assert.Equal(t, []bool{false, true, true, true, false, false, false, false, true, true, true, true, false},
+		hidden)
+	assert.True(t, mcs[2][1].Hidden)
+
+	// Only B is visible: the OCMD and the MC0 sequence are hidden, the form is shown.
+	_, hidden, _ = process(OCGsHidden("A"))
+	assert.Equal(t, []bool{false, true, true, true, false, true, true, true, false, false, false, false, false},
+		hidden)
+
+	// Only A is visible: the form is hidden.
+	_, hidden, _ = process(OCGsHidden("B"))
+	assert.Equal(t, []bool{false, false, false, false, false, false, false, false, true, true, true, true, false},
+		hidden)
+}
+
+func TestIsOptionalContentVisible(t *testing.T) {
+	a, b := newTestOCG("A"), newTestOCG("B")
+	newOCMD := func(policy string) *core.PdfObjectDictionary {
+		ocmd := core.MakeDict()
+		ocmd.Set("Type", core.MakeName("OCMD"))
+		ocmd.Set("OCGs", core.MakeArray(a, b))
+		if policy != "" {
+			ocmd.Set("P", core.MakeName(policy))
+		}
+		return ocmd
+	}
+	onlyA := OCGsVisible("A")
+	assert.True(t, IsOptionalContentVisible(nil, onlyA))
+	assert.True(t, IsOptionalContentVisible(a, onlyA))
+	assert.False(t, IsOptionalContentVisible(b, onlyA))
+	assert.True(t, IsOptionalContentVisible(b, nil))
+	assert.True(t, IsOptionalContentVisible(newOCMD(""), onlyA))
+	assert.False(t, IsOptionalContentVisible(newOCMD("AllOn"), onlyA))
+	assert.True(t, IsOptionalContentVisible(newOCMD("AnyOff"), onlyA))
+	assert.False(t, IsOptionalContentVisible(newOCMD("AllOff"), onlyA))
+	assert.True(t, IsOptionalContentVisible(newOCMD("AllOff"), OCGsVisible()))
+
+	ocProperties := core.MakeDict()
+	config := core.MakeDict()
+	config.Set("BaseState", core.MakeName("OFF"))
+	config.Set("ON", core.MakeArray(b))
+	ocProperties.Set("D", config)
+	visible := NewOCGVisibility(ocProperties)
+	assert.False(t, visible(a))
+	assert.True(t, visible(b))
+	assert.True(t, NewOCGVisibility(nil)(a))
+}
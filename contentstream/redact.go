@@ -0,0 +1,964 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// Redaction describes content to remove from a page and what to draw in its place.
+type Redaction struct {
+	// Areas are the regions whose content is removed, in the default user space of the page.
+	Areas []model.PdfRectangle
+
+	// FillColor fills the areas after the content has been removed. The areas are left blank if
+	// it is nil. Gray, RGB and CMYK colors are supported.
+	FillColor model.PdfColor
+
+	// Overlay is a form XObject that is drawn in OverlayRect after the content has been removed.
+	Overlay *core.PdfObjectStream
+
+	// OverlayRect is the rectangle in which Overlay and OverlayText are drawn, in the default user
+	// space of the page.
+	OverlayRect model.PdfRectangle
+
+	// OverlayText is text drawn in Helvetica in OverlayRect, starting at the top.
+	OverlayText string
+	// OverlayFontSize is the font size of OverlayText. If it is 0, the size is chosen so that one
+	// line fills OverlayRect.
+	OverlayFontSize float64
+	// OverlayTextColor is the color of OverlayText. It is black if nil.
+	OverlayTextColor model.PdfColor
+	// OverlayAlign is the alignment of OverlayText: 0 for left, 1 for centered and 2 for right.
+	OverlayAlign int
+	// OverlayRepeat repeats OverlayText to fill OverlayRect.
+	OverlayRepeat bool
+}
+
+// NewRedactionFromAnnotation returns the redaction that applies Redact annotation `annot`
+// (12.5.6.23). The areas are the quadrilaterals in QuadPoints or Rect if there are none. The
+// overlay is RO if it is present and IC, OverlayText, DA, Q and Repeat otherwise.
+func NewRedactionFromAnnotation(annot *model.PdfAnnotationRedact) (*Redaction, error) {
+	arr, ok := core.GetArray(annot.Rect)
+	if !ok {
+		return nil, errors.New("redact annotation without Rect")
+	}
+	rect, err := model.NewPdfRectangle(*arr)
+	if err != nil {
+		return nil, err
+	}
+	redaction := &Redaction{OverlayRect: normalizeRect(*rect)}
+	if arr, ok := core.GetArray(annot.QuadPoints); ok {
+		f, err := arr.ToFloat64Array()
+		if err != nil {
+			return nil, err
+		}
+		if len(f)%8 != 0 {
+			return nil, fmt.Errorf("invalid QuadPoints length %d", len(f))
+		}
+		for i := 0; i < len(f); i += 8 {
+			var points []transform.Point
+			for j := i; j < i+8; j += 2 {
+				points = append(points, transform.Point{X: f[j], Y: f[j+1]})
+			}
+			redaction.Areas = append(redaction.Areas, pointsBBox(points))
+		}
+	}
+	if len(redaction.Areas) == 0 {
+		redaction.Areas = []model.PdfRectangle{redaction.OverlayRect}
+	}
+
+	if overlay, ok := core.GetStream(annot.RO); ok {
+		redaction.Overlay = overlay
+		return redaction, nil
+	}
+	redaction.FillColor, err = colorFromComponents(annot.IC)
+	if err != nil {
+		return nil, err
+	}
+	if text, ok := core.GetString(annot.OverlayText); ok {
+		redaction.OverlayText = text.Decoded()
+	}
+	redaction.OverlayRepeat, _ = core.GetBoolVal(annot.Repeat)
+	redaction.OverlayAlign, _ = core.GetIntVal(annot.Q)
+	if da, ok := core.GetStringVal(annot.DA); ok {
+		redaction.OverlayFontSize, redaction.OverlayTextColor = parseDefaultAppearance(da)
+	}
+	return redaction, nil
+}
+
+// colorFromComponents returns the gray, RGB or CMYK color with the components in array `obj`. It
+// returns nil if `obj` is nil or empty.
+func colorFromComponents(obj core.PdfObject) (model.PdfColor, error) {
+	arr, ok := core.GetArray(obj)
+	if !ok || arr.Len() == 0 {
+		return nil, nil
+	}
+	f, err := arr.ToFloat64Array()
+	if err != nil {
+		return nil, err
+	}
+	switch len(f) {
+	case 1:
+		return model.NewPdfColorDeviceGray(f[0]), nil
+	case 3:
+		return model.NewPdfColorDeviceRGB(f[0], f[1], f[2]), nil
+	case 4:
+		return model.NewPdfColorDeviceCMYK(f[0], f[1], f[2], f[3]), nil
+	}
+	return nil, fmt.Errorf("invalid number of color components %d", len(f))
+}
+
+// parseDefaultAppearance returns the font size and fill color set by default appearance string
+// `da` (12.7.3.3). Invalid operations are ignored.
+func parseDefaultAppearance(da string) (float64, model.PdfColor) {
+	ops, err := NewContentStreamParser(da).Parse()
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid default appearance %q: %v", da, err)
+		return 0, nil
+	}
+	var size float64
+	var color model.PdfColor
+	for _, op := range *ops {
+		switch op.Operand {
+		case "Tf":
+			if len(op.Params) == 2 {
+				if f, err := core.GetNumberAsFloat(op.Params[1]); err == nil {
+					size = f
+				}
+			}
+		case "g", "rg", "k":
+			if c, err := colorFromComponents(core.MakeArray(op.Params...)); err == nil {
+				color = c
+			}
+		}
+	}
+	return size, color
+}
+
+// ApplyRedactAnnotations applies the Redact annotations of `page` with RedactPage and removes
+// them, together with their pop-up annotations, from the page. It returns the number of
+// annotations applied. The page content stream is replaced by one encoded with `encoder`.
+func ApplyRedactAnnotations(page *model.PdfPage, encoder core.StreamEncoder) (int, error) {
+	annotations, err := page.GetAnnotations()
+	if err != nil {
+		return 0, err
+	}
+	var redactions []*Redaction
+	removed := map[core.PdfObject]bool{}
+	for _, annot := range annotations {
+		redact, ok := annot.GetContext().(*model.PdfAnnotationRedact)
+		if !ok {
+			continue
+		}
+		redaction, err := NewRedactionFromAnnotation(redact)
+		if err != nil {
+			return 0, err
+		}
+		redactions = append(redactions, redaction)
+		removed[annot.GetContainingPdfObject()] = true
+		if redact.PdfAnnotationMarkup != nil && redact.Popup != nil {
+			removed[redact.Popup.GetContainingPdfObject()] = true
+		}
+	}
+	if len(redactions) == 0 {
+		return 0, nil
+	}
+	if err := RedactPage(page, redactions, encoder); err != nil {
+		return 0, err
+	}
+
+	var kept []*model.PdfAnnotation
+	for _, annot := range annotations {
+		if removed[annot.GetContainingPdfObject()] {
+			continue
+		}
+		if popup, ok := annot.GetContext().(*model.PdfAnnotationPopup); ok && popup.Parent != nil {
+			parent := popup.Parent
+			if ref, ok := parent.(*core.PdfObjectReference); ok {
+				parent = ref.Resolve()
+			}
+			if removed[parent] {
+				continue
+			}
+		}
+		kept = append(kept, annot)
+	}
+	page.SetAnnotations(kept)
+	return len(redactions), nil
+}
+
+// RedactPage removes the content of `page` in the areas of `redactions` and draws their fill
+// colors and overlays. The page content stream is replaced by one encoded with `encoder` and the
+// page's resources are replaced by a new resources dictionary, as by Transformer.TransformPage.
+//
+// Glyphs whose bounding boxes overlap an area are removed from the text showing operations, with
+// the text after them keeping its position. Vector paths are cut at the borders of the areas, and
+// shadings and strokes are also clipped so that they aren't painted in the areas. The pixels of
+// images drawn in the areas are set to zero and the images are stored again without their
+// original filters. Images that can't be decoded are removed. Form XObjects that are drawn in the
+// areas are replaced by redacted copies. Alternate descriptions and replacement text of marked
+// content that includes removed content are removed.
+//
+// The removed content is irrecoverable once the document is written with PdfWriter, as long as no
+// other page uses the original objects. PdfAppender keeps the original objects in the file.
+// Annotations, including Redact annotations, are not changed. Use ApplyRedactAnnotations to apply
+// and remove Redact annotations.
+func RedactPage(page *model.PdfPage, redactions []*Redaction, encoder core.StreamEncoder) error {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return err
+	}
+	ops, err := NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+	r := &redactor{encoder: encoder}
+	for _, redaction := range redactions {
+		for _, area := range redaction.Areas {
+			r.areas = append(r.areas, normalizeRect(area))
+		}
+	}
+
+	resources := copyResources(page.Resources)
+	redacted, _, err := r.redactOperations(*ops, resources, nil)
+	if err != nil {
+		return err
+	}
+	overlays, err := drawRedactionOverlays(redactions, resources)
+	if err != nil {
+		return err
+	}
+	if len(overlays) > 0 {
+		redacted.WrapIfNeeded()
+		redacted = append(redacted, overlays...)
+	}
+	if err := page.SetContentStreams([]string{redacted.String()}, encoder); err != nil {
+		return err
+	}
+	page.Resources = PruneResources(&redacted, resources)
+	return nil
+}
+
+// redactor removes the content in areas of a page.
+type redactor struct {
+	areas   []model.PdfRectangle // In device space.
+	encoder core.StreamEncoder   // Encoder of the content streams of redacted forms.
+	forms   []*core.PdfObjectStream
+}
+
+// intersects returns true if `bbox` overlaps an area of `r`.
+func (r *redactor) intersects(bbox model.PdfRectangle) bool {
+	for _, area := range r.areas {
+		if overlaps(bbox, area) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactOperations returns `ops` with the content in the areas of `r` removed. New XObjects are
+// added to `resources`. `gs` is the graphics state at the start of `ops`. The initial graphics
+// state of a page is used if it is nil. The bool return is true if any operation was changed.
+func (r *redactor) redactOperations(ops ContentStreamOperations, resources *model.PdfPageResources,
+	gs *GraphicsState) (ContentStreamOperations, bool, error) {
+	indexes := map[*ContentStreamOperation]int{}
+	for i, op := range ops {
+		indexes[op] = i
+	}
+	replacements := map[int][]*ContentStreamOperation{}
+	var pathOps []int // The path construction and clipping operations of the current path.
+	var marked []int  // The operations that begin the current marked-content sequences.
+	scrub := map[int]bool{}
+	replace := func(i int, ops []*ContentStreamOperation) {
+		replacements[i] = ops
+		for _, j := range marked {
+			scrub[j] = true
+		}
+	}
+
+	proc := NewContentStreamProcessor(ops)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			i := indexes[op]
+			switch op.Operand {
+			case "m", "l", "c", "v", "y", "h", "re", "W", "W*":
+				pathOps = append(pathOps, i)
+			case "BMC", "BDC":
+				marked = append(marked, i)
+			case "EMC":
+				if len(marked) > 0 {
+					marked = marked[:len(marked)-1]
+				}
+			case "Tj", "TJ", "'", "\"":
+				if edits := r.glyphEdits(proc.Glyphs()); len(edits) > 0 {
+					replace(i, rewriteTextShowing(op, edits, gs.Text, ""))
+				}
+			case "Do":
+				redacted, changed, err := r.redactXObject(op, gs, resources)
+				if err != nil {
+					return err
+				}
+				if changed {
+					replace(i, redacted)
+				}
+			case "BI":
+				if redacted, changed := r.redactInlineImage(op, gs, resources); changed {
+					replace(i, redacted)
+				}
+			case "sh":
+				if redacted, changed := r.redactShading(op, gs); changed {
+					replace(i, redacted)
+				}
+			default:
+				if !isPathPaintingOperand(op.Operand) {
+					break
+				}
+				if redacted, changed := r.redactPath(op, proc.CurrentPath(), gs); changed {
+					// The path is also needed for a pending clip.
+					clip := false
+					for _, j := range pathOps {
+						replacements[j] = nil
+						clip = clip || ops[j].Operand == "W" || ops[j].Operand == "W*"
+					}
+					if clip {
+						for _, j := range pathOps {
+							redacted = append(redacted, ops[j])
+						}
+						redacted = append(redacted, &ContentStreamOperation{Operand: "n"})
+					}
+					replace(i, redacted)
+				}
+				pathOps = nil
+			}
+			return nil
+		})
+
+	var err error
+	if gs == nil {
+		err = proc.Process(resources)
+	} else {
+		proc.initGraphicsState()
+		proc.graphicsState = *gs
+		proc.baseCTM = gs.CTM
+		err = proc.processOperations(ops, resources)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var redacted ContentStreamOperations
+	for i, op := range ops {
+		if ops, ok := replacements[i]; ok {
+			redacted = append(redacted, ops...)
+			continue
+		}
+		if scrub[i] {
+			op = scrubMarkedContent(op)
+		}
+		redacted = append(redacted, op)
+	}
+	return redacted, len(replacements) > 0, nil
+}
+
+// glyphEdits returns the edits that remove the glyphs of `glyphs` that overlap the areas of `r`
+// from their text showing operation, keeping the position of the following glyphs.
+func (r *redactor) glyphEdits(glyphs []Glyph) []textEdit {
+	var edits []textEdit
+	for _, g := range glyphs {
+		if !r.intersects(g.BBox) {
+			continue
+		}
+		if n := len(edits); n > 0 && edits[n-1].element == g.Element && edits[n-1].end == g.Start {
+			edits[n-1].end = g.End
+			edits[n-1].shift -= g.Advance
+			continue
+		}
+		edits = append(edits, textEdit{element: g.Element, start: g.Start, end: g.End, shift: -g.Advance})
+	}
+	return edits
+}
+
+// redactPath returns the operations that paint the path `path` painted by path painting operation
+// `op` without the parts in the areas of `r`. `gs` is the graphics state of `op`. The bool return
+// is false if the path isn't painted in the areas and doesn't need to change.
+func (r *redactor) redactPath(op *ContentStreamOperation, path Path, gs GraphicsState) (
+	[]*ContentStreamOperation, bool) {
+	fill, stroke := paintsWith(op.Operand, 0)
+	bbox, ok := path.BBox()
+	if !ok || (!fill && !stroke) {
+		return nil, false
+	}
+	if stroke {
+		// Include the line width. Zero width lines are one device pixel wide.
+		width := math.Max(gs.LineWidth*math.Max(gs.CTM.ScalingFactorX(), gs.CTM.ScalingFactorY()), 1)
+		bbox = model.PdfRectangle{Llx: bbox.Llx - width, Lly: bbox.Lly - width, Urx: bbox.Urx + width,
+			Ury: bbox.Ury + width}
+	}
+	if !r.intersects(bbox) {
+		return nil, false
+	}
+	inv, ok := gs.CTM.Inverse()
+	if !ok {
+		// Nothing is painted with a singular CTM.
+		return nil, true
+	}
+
+	subpaths := flattenPath(path)
+	cc := NewContentCreator()
+	if fill {
+		var polys [][]transform.Point
+		for _, sp := range subpaths {
+			if len(sp.points) >= 3 {
+				polys = append(polys, sp.points)
+			}
+		}
+		for _, area := range r.areas {
+			polys = subtractArea(polys, area)
+		}
+		for _, poly := range polys {
+			addSubpath(cc, inv, poly, true)
+		}
+		if len(polys) > 0 {
+			if op.Operand == "f*" || op.Operand == "B*" || op.Operand == "b*" {
+				cc.Add_f_starred()
+			} else {
+				cc.Add_f()
+			}
+		}
+	}
+	if stroke {
+		lines := subpaths
+		for _, area := range r.areas {
+			var cut []polyline
+			for _, line := range lines {
+				cut = append(cut, cutPolyline(line, area)...)
+			}
+			lines = cut
+		}
+		var kept []polyline
+		for _, line := range lines {
+			if len(line.points) >= 2 {
+				kept = append(kept, line)
+			}
+		}
+		if len(kept) > 0 {
+			// Clip the line width that reaches into the areas.
+			cc.Add_q()
+			r.addAreaClips(cc, inv, bbox)
+			for _, line := range kept {
+				addSubpath(cc, inv, line.points, line.closed)
+			}
+			cc.Add_S().Add_Q()
+		}
+	}
+	return *cc.Operations(), true
+}
+
+// redactShading returns the operations that paint the shading of `sh` operation `op` outside the
+// areas of `r`. The bool return is false if the shading isn't painted in the areas.
+func (r *redactor) redactShading(op *ContentStreamOperation, gs GraphicsState) ([]*ContentStreamOperation, bool) {
+	bbox, clipped := gs.ClipBBox()
+	if !clipped {
+		// The shading fills the whole clipping region.
+		bbox = model.PdfRectangle{Llx: -math.MaxInt32, Lly: -math.MaxInt32, Urx: math.MaxInt32, Ury: math.MaxInt32}
+	}
+	if !r.intersects(bbox) {
+		return nil, false
+	}
+	inv, ok := gs.CTM.Inverse()
+	if !ok {
+		return nil, true
+	}
+	cc := NewContentCreator()
+	cc.Add_q()
+	r.addAreaClips(cc, inv, bbox)
+	cc.AddOperand(*op).Add_Q()
+	return *cc.Operations(), true
+}
+
+// addAreaClips adds operations that clip the areas of `r` that overlap device space rectangle
+// `bbox` out of the clipping region. `inv` maps device space to user space.
+func (r *redactor) addAreaClips(cc *ContentCreator, inv transform.Matrix, bbox model.PdfRectangle) {
+	for _, area := range r.areas {
+		if !overlaps(bbox, area) {
+			continue
+		}
+		// An even-odd clip with a rectangle around the painted region and the area.
+		outer := model.PdfRectangle{Llx: math.Min(bbox.Llx, area.Llx) - 1, Lly: math.Min(bbox.Lly, area.Lly) - 1,
+			Urx: math.Max(bbox.Urx, area.Urx) + 1, Ury: math.Max(bbox.Ury, area.Ury) + 1}
+		outerPoints, areaPoints := rectPoints(outer), rectPoints(area)
+		addSubpath(cc, inv, outerPoints[:], true)
+		addSubpath(cc, inv, areaPoints[:], true)
+		cc.Add_W_starred().Add_n()
+	}
+}
+
+// addSubpath adds path construction operations for the subpath through device space points
+// `points`, transformed to user space by `inv`.
+func addSubpath(cc *ContentCreator, inv transform.Matrix, points []transform.Point, closed bool) {
+	for i, pt := range points {
+		x, y := inv.Transform(pt.X, pt.Y)
+		x, y = math.Round(x*1e4)/1e4, math.Round(y*1e4)/1e4
+		if i == 0 {
+			cc.Add_m(x, y)
+		} else {
+			cc.Add_l(x, y)
+		}
+	}
+	if closed {
+		cc.Add_h()
+	}
+}
+
+// redactXObject returns the operations that replace Do operation `op` if it draws an image or a
+// form in the areas of `r`: a Do operation that draws a redacted copy, which is added to
+// `resources`, or nothing if the XObject can't be redacted. `gs` is the graphics state of `op`.
+// The bool return is false if the XObject doesn't need to change.
+func (r *redactor) redactXObject(op *ContentStreamOperation, gs GraphicsState,
+	resources *model.PdfPageResources) ([]*ContentStreamOperation, bool, error) {
+	if len(op.Params) != 1 || resources == nil {
+		return nil, false, nil
+	}
+	name, ok := core.GetName(op.Params[0])
+	if !ok {
+		return nil, false, nil
+	}
+	stream, xtype := resources.GetXObjectByName(*name)
+	var redacted *core.PdfObjectStream
+	switch xtype {
+	case model.XObjectTypeImage:
+		if !r.intersects(transformRect(gs.CTM, unitSquare)) {
+			return nil, false, nil
+		}
+		var changed bool
+		var err error
+		redacted, changed, err = r.redactImage(stream, gs.CTM)
+		if err != nil {
+			common.Log.Debug("ERROR: Can't redact image %s: %v. Removing it", *name, err)
+			return nil, true, nil
+		}
+		if !changed {
+			return nil, false, nil
+		}
+	case model.XObjectTypeForm:
+		xform, err := resources.GetXObjectFormByName(*name)
+		if err != nil {
+			return nil, false, err
+		}
+		bbox, matrix, err := formBBoxMatrix(xform)
+		if err != nil {
+			return nil, false, err
+		}
+		ctm := gs.CTM
+		ctm.Concat(matrix)
+		if !r.intersects(transformRect(ctm, bbox)) {
+			return nil, false, nil
+		}
+		var changed bool
+		redacted, changed, err = r.redactForm(stream, xform, resources, gs, ctm)
+		if err != nil {
+			return nil, false, err
+		}
+		if !changed {
+			return nil, false, nil
+		}
+		if redacted == nil {
+			return nil, true, nil
+		}
+	default:
+		return nil, false, nil
+	}
+
+	newName := newXObjectName(resources, "Redacted")
+	if err := resources.SetXObjectByName(newName, redacted); err != nil {
+		return nil, false, err
+	}
+	return []*ContentStreamOperation{{Operand: "Do", Params: []core.PdfObject{core.MakeName(string(newName))}}},
+		true, nil
+}
+
+// unitSquare is the rectangle that images are drawn in, in image space.
+var unitSquare = model.PdfRectangle{Llx: 0, Lly: 0, Urx: 1, Ury: 1}
+
+// redactForm returns a copy of form XObject `stream` with the content in the areas of `r` removed,
+// for the form drawn with graphics state `gs` and CTM `ctm`, the CTM of `gs` with the form matrix
+// applied. `resources` are the resources of the content stream that draws the form. It returns
+// nil if the form can't be drawn. The bool return is false if the form doesn't need to change.
+func (r *redactor) redactForm(stream *core.PdfObjectStream, xform *model.XObjectForm,
+	resources *model.PdfPageResources, gs GraphicsState, ctm transform.Matrix) (*core.PdfObjectStream, bool, error) {
+	for _, form := range r.forms {
+		if form == stream {
+			common.Log.Debug("ERROR: Form XObject cycle. Removing it")
+			return nil, true, nil
+		}
+	}
+	if len(r.forms) >= DefaultMaxNestingDepth {
+		common.Log.Debug("ERROR: Form XObjects nested too deeply. Removing them")
+		return nil, true, nil
+	}
+	content, err := xform.GetContentStream()
+	if err != nil {
+		return nil, false, err
+	}
+	ops, err := NewContentStreamParser(string(content)).Parse()
+	if err != nil {
+		return nil, false, err
+	}
+	if xform.Resources != nil {
+		resources = xform.Resources
+	}
+	resources = copyResources(resources)
+
+	r.forms = append(r.forms, stream)
+	defer func() { r.forms = r.forms[:len(r.forms)-1] }()
+	gs.CTM = ctm
+	redacted, changed, err := r.redactOperations(*ops, resources, &gs)
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	copied, err := core.MakeStream(redacted.Bytes(), r.encoder)
+	if err != nil {
+		return nil, false, err
+	}
+	copyStreamDict(copied, stream, "Resources")
+	copied.Set("Resources", PruneResources(&redacted, resources).ToPdfObject())
+	return copied, true, nil
+}
+
+// redactImage returns a copy of image XObject `stream` with the pixels drawn in the areas of `r`
+// blanked, for the image drawn with CTM `ctm`. The bool return is false if no pixel is drawn in
+// the areas. Soft masks and stencil masks are blanked too.
+func (r *redactor) redactImage(stream *core.PdfObjectStream, ctm transform.Matrix) (*core.PdfObjectStream,
+	bool, error) {
+	ximg, err := model.NewXObjectImageFromStream(stream)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		return nil, false, err
+	}
+	mask, _ := core.GetBoolVal(ximg.ImageMask)
+	bpc, components := 1, 1
+	if !mask {
+		if ximg.BitsPerComponent == nil {
+			return nil, false, errors.New("bits per component missing")
+		}
+		bpc, components = int(*ximg.BitsPerComponent), ximg.ColorSpace.GetNumComponents()
+	}
+	changed, err := blankPixels(data, int(*ximg.Width), int(*ximg.Height), components, bpc, ctm, r.areas,
+		mask && !decodeInverted(ximg.Decode))
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	redacted, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		return nil, false, err
+	}
+	copyStreamDict(redacted, stream, "SMask")
+
+	if smask, ok := core.GetStream(stream.Get("SMask")); ok {
+		redactedMask, err := r.redactMask(smask, ctm)
+		if err != nil {
+			return nil, false, err
+		}
+		redacted.Set("SMask", redactedMask)
+	}
+	// Color key masks are arrays, which are kept.
+	if stencil, ok := core.GetStream(stream.Get("Mask")); ok {
+		redactedMask, err := r.redactMask(stencil, ctm)
+		if err != nil {
+			return nil, false, err
+		}
+		redacted.Set("Mask", redactedMask)
+	}
+	return redacted, true, nil
+}
+
+// redactMask returns a copy of soft mask or stencil mask `mask` of an image drawn with CTM `ctm`,
+// with the pixels drawn in the areas of `r` masked out.
+func (r *redactor) redactMask(mask *core.PdfObjectStream, ctm transform.Matrix) (*core.PdfObjectStream, error) {
+	maskImg, err := model.NewXObjectImageFromStream(mask)
+	if err != nil {
+		return nil, err
+	}
+	bpc, ones := 1, false
+	if stencil, _ := core.GetBoolVal(maskImg.ImageMask); stencil {
+		// Stencil mask samples of 1 mask out the image, unless the Decode array inverts them.
+		ones = !decodeInverted(maskImg.Decode)
+	} else if maskImg.BitsPerComponent == nil {
+		return nil, errors.New("soft mask bits per component missing")
+	} else {
+		bpc = int(*maskImg.BitsPerComponent)
+	}
+	data, err := core.DecodeStream(mask)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blankPixels(data, int(*maskImg.Width), int(*maskImg.Height), 1, bpc, ctm, r.areas,
+		ones); err != nil {
+		return nil, err
+	}
+	redacted, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		return nil, err
+	}
+	copyStreamDict(redacted, mask)
+	return redacted, nil
+}
+
+// redactInlineImage returns the operation that replaces inline image operation `op` if the image
+// is drawn in the areas of `r`: an inline image with the pixels in the areas blanked, or nothing
+// if the image can't be decoded. The bool return is false if the image doesn't need to change.
+func (r *redactor) redactInlineImage(op *ContentStreamOperation, gs GraphicsState,
+	resources *model.PdfPageResources) ([]*ContentStreamOperation, bool) {
+	img, ok := inlineImageParam(op)
+	if !ok || !r.intersects(transformRect(gs.CTM, unitSquare)) {
+		return nil, false
+	}
+	image, err := img.ToImage(resources)
+	if err != nil {
+		common.Log.Debug("ERROR: Can't redact inline image: %v. Removing it", err)
+		return nil, true
+	}
+	mask, _ := img.IsMask()
+	changed, err := blankPixels(image.Data, int(image.Width), int(image.Height), image.ColorComponents,
+		int(image.BitsPerComponent), gs.CTM, r.areas, mask && !decodeInverted(img.Decode))
+	if err != nil {
+		common.Log.Debug("ERROR: Can't redact inline image: %v. Removing it", err)
+		return nil, true
+	}
+	if !changed {
+		return nil, false
+	}
+	// The image is stored in hexadecimal so that its data can't contain EI.
+	encoded, err := core.NewASCIIHexEncoder().EncodeBytes(image.Data)
+	if err != nil {
+		common.Log.Debug("ERROR: Can't encode inline image: %v. Removing it", err)
+		return nil, true
+	}
+	redacted := *img
+	redacted.Filter = core.MakeName("AHx")
+	redacted.DecodeParms = nil
+	redacted.stream = encoded
+	return []*ContentStreamOperation{{Operand: "BI", Params: []core.PdfObject{&redacted}}}, true
+}
+
+// decodeInverted returns true if image Decode array `decode` is [1 0], which inverts the samples of
+// an image mask.
+func decodeInverted(decode core.PdfObject) bool {
+	arr, ok := core.GetArray(decode)
+	if !ok {
+		return false
+	}
+	f, err := arr.ToFloat64Array()
+	return err == nil && len(f) == 2 && f[0] > f[1]
+}
+
+// scrubMarkedContent returns BDC operation `op` without the alternate description, replacement
+// text and expansion entries of its property list (14.9). Other operations and property lists in
+// the resources are returned as they are.
+func scrubMarkedContent(op *ContentStreamOperation) *ContentStreamOperation {
+	if op.Operand != "BDC" || len(op.Params) != 2 {
+		return op
+	}
+	props, ok := op.Params[1].(*core.PdfObjectDictionary)
+	if !ok {
+		return op
+	}
+	scrubbed := core.MakeDict()
+	for _, key := range props.Keys() {
+		switch key {
+		case "Alt", "ActualText", "E":
+		default:
+			scrubbed.Set(key, props.Get(key))
+		}
+	}
+	return &ContentStreamOperation{Operand: op.Operand, Params: []core.PdfObject{op.Params[0], scrubbed}}
+}
+
+// drawRedactionOverlays returns the operations that draw the fill colors and overlays of
+// `redactions`. The XObjects and fonts that they use are added to `resources`.
+func drawRedactionOverlays(redactions []*Redaction, resources *model.PdfPageResources) (
+	ContentStreamOperations, error) {
+	cc := NewContentCreator()
+	var fontName core.PdfObjectName
+	var font *model.PdfFont
+	for _, redaction := range redactions {
+		if redaction.FillColor != nil && len(redaction.Areas) > 0 {
+			cc.Add_q().SetNonStrokingColor(redaction.FillColor)
+			for _, area := range redaction.Areas {
+				area = normalizeRect(area)
+				cc.Add_re(area.Llx, area.Lly, area.Width(), area.Height())
+			}
+			cc.Add_f().Add_Q()
+		}
+		rect := normalizeRect(redaction.OverlayRect)
+		if redaction.Overlay != nil {
+			xform, err := model.NewXObjectFormFromStream(redaction.Overlay)
+			if err != nil {
+				return nil, err
+			}
+			bbox, matrix, err := formBBoxMatrix(xform)
+			if err != nil {
+				return nil, err
+			}
+			name := newXObjectName(resources, "Overlay")
+			if err := resources.SetXObjectByName(name, redaction.Overlay); err != nil {
+				return nil, err
+			}
+			m := appearanceMatrix(rect, bbox, matrix)
+			cc.Add_q().Add_cm(m[0], m[1], m[3], m[4], m[6], m[7]).Add_Do(name).Add_Q()
+		}
+		if redaction.OverlayText == "" {
+			continue
+		}
+		if font == nil {
+			var err error
+			if font, err = model.NewStandard14Font(model.HelveticaName); err != nil {
+				return nil, err
+			}
+			fontName = newFontName(resources, "Overlay")
+			if err := resources.SetFontByName(fontName, font.ToPdfObject()); err != nil {
+				return nil, err
+			}
+		}
+		drawOverlayText(cc, redaction, rect, font, fontName)
+	}
+	return *cc.Operations(), nil
+}
+
+// drawOverlayText adds operations that draw the overlay text of `redaction` in `rect` with `font`
+// named `fontName`. Characters that `font` can't encode are skipped.
+func drawOverlayText(cc *ContentCreator, redaction *Redaction, rect model.PdfRectangle, font *model.PdfFont,
+	fontName core.PdfObjectName) {
+	var text []byte
+	width := 0.0 // In glyph space units.
+	encoder := font.Encoder()
+	for _, r := range redaction.OverlayText {
+		code, ok := encoder.RuneToCharcode(r)
+		if !ok || code > 0xff {
+			continue
+		}
+		text = append(text, byte(code))
+		if m, ok := font.GetRuneMetrics(r); ok {
+			width += m.Wx
+		}
+	}
+	if len(text) == 0 || rect.Width() <= 0 || rect.Height() <= 0 {
+		return
+	}
+	size := redaction.OverlayFontSize
+	if size <= 0 {
+		size = rect.Height()
+		if width > 0 {
+			size = math.Min(size, rect.Width()*1000/width)
+		}
+	}
+
+	lines := 1
+	if redaction.OverlayRepeat && width > 0 {
+		// Repeat the text across the rectangle, separated by spaces, and on every line.
+		spaceWidth := 0.0
+		if m, ok := font.GetRuneMetrics(' '); ok {
+			spaceWidth = m.Wx
+		}
+		word, wordWidth := text, width
+		for width*size/1000 < rect.Width() {
+			text = append(append(text, ' '), word...)
+			width += spaceWidth + wordWidth
+		}
+		lines = int(math.Max(math.Floor(rect.Height()/size), 1))
+	}
+	x := rect.Llx
+	switch redaction.OverlayAlign {
+	case 1:
+		x += (rect.Width() - width*size/1000) / 2
+	case 2:
+		x += rect.Width() - width*size/1000
+	}
+
+	textColor := redaction.OverlayTextColor
+	if textColor == nil {
+		textColor = model.NewPdfColorDeviceGray(0)
+	}
+	cc.Add_q().Add_re(rect.Llx, rect.Lly, rect.Width(), rect.Height()).Add_W().Add_n()
+	cc.Add_BT().Add_Tf(fontName, size).SetNonStrokingColor(textColor)
+	y := rect.Ury - size
+	for i := 0; i < lines; i++ {
+		cc.Add_Tm(1, 0, 0, 1, x, y)
+		cc.Add_Tj(*core.MakeStringFromBytes(text))
+		y -= size
+	}
+	cc.Add_ET().Add_Q()
+}
+
+// copyResources returns a copy of `resources` to which XObjects and fonts can be added without
+// modifying `resources`. The other resource dictionaries are shared.
+func copyResources(resources *model.PdfPageResources) *model.PdfPageResources {
+	copied := model.NewPdfPageResources()
+	if resources == nil {
+		return copied
+	}
+	copied.ExtGState = resources.ExtGState
+	copied.ColorSpace = resources.ColorSpace
+	copied.Pattern = resources.Pattern
+	copied.Shading = resources.Shading
+	copied.XObject = copyDict(resources.XObject)
+	copied.Font = copyDict(resources.Font)
+	copied.ProcSet = resources.ProcSet
+	copied.Properties = resources.Properties
+	return copied
+}
+
+// copyDict returns a shallow copy of dictionary `obj`. Other objects are returned as they are.
+func copyDict(obj core.PdfObject) core.PdfObject {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return obj
+	}
+	copied := core.MakeDict()
+	for _, key := range dict.Keys() {
+		copied.Set(key, dict.Get(key))
+	}
+	return copied
+}
+
+// copyStreamDict copies the entries of the dictionary of stream `src` that don't describe its
+// encoding to `dst`, except for the entries `skip`.
+func copyStreamDict(dst, src *core.PdfObjectStream, skip ...core.PdfObjectName) {
+	for _, key := range src.Keys() {
+		switch key {
+		case "Filter", "DecodeParms", "Length", "DL":
+			continue
+		}
+		skipped := false
+		for _, name := range skip {
+			skipped = skipped || key == name
+		}
+		if !skipped {
+			dst.Set(key, src.Get(key))
+		}
+	}
+}
+
+// newXObjectName returns an XObject name starting with `prefix` that isn't used in `resources`.
+func newXObjectName(resources *model.PdfPageResources, prefix string) core.PdfObjectName {
+	for i := 1; ; i++ {
+		name := core.PdfObjectName(fmt.Sprintf("%s%d", prefix, i))
+		if !resources.HasXObjectByName(name) {
+			return name
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"errors"
+	"math"
+
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// maxCurveSegments is the maximum number of straight lines that a Bézier curve is flattened to.
+const maxCurveSegments = 64
+
+// polyline is a flattened subpath in device space.
+type polyline struct {
+	points []transform.Point
+	closed bool
+}
+
+// overlaps returns true if rectangles `a` and `b` overlap. Rectangles that only touch don't
+// overlap. Degenerate rectangles, such as the bounding boxes of glyphs without width, overlap the
+// rectangles that they cross.
+func overlaps(a, b model.PdfRectangle) bool {
+	return a.Llx < b.Urx && b.Llx < a.Urx && a.Lly < b.Ury && b.Lly < a.Ury
+}
+
+// normalizeRect returns `r` with its lower left corner below and left of its upper right corner.
+func normalizeRect(r model.PdfRectangle) model.PdfRectangle {
+	return model.PdfRectangle{Llx: math.Min(r.Llx, r.Urx), Lly: math.Min(r.Lly, r.Ury),
+		Urx: math.Max(r.Llx, r.Urx), Ury: math.Max(r.Lly, r.Ury)}
+}
+
+// pointsBBox returns the bounding box of `points`.
+func pointsBBox(points []transform.Point) model.PdfRectangle {
+	var bbox model.PdfRectangle
+	for i, pt := range points {
+		if i == 0 {
+			bbox = model.PdfRectangle{Llx: pt.X, Lly: pt.Y, Urx: pt.X, Ury: pt.Y}
+			continue
+		}
+		bbox.Llx = math.Min(bbox.Llx, pt.X)
+		bbox.Lly = math.Min(bbox.Lly, pt.Y)
+		bbox.Urx = math.Max(bbox.Urx, pt.X)
+		bbox.Ury = math.Max(bbox.Ury, pt.Y)
+	}
+	return bbox
+}
+
+// rectPoints returns the corners of `r` counterclockwise from the lower left corner.
+func rectPoints(r model.PdfRectangle) [4]transform.Point {
+	return [4]transform.Point{{X: r.Llx, Y: r.Lly}, {X: r.Urx, Y: r.Lly}, {X: r.Urx, Y: r.Ury}, {X: r.Llx, Y: r.Ury}}
+}
+
+// transformPoints transforms `points` by `m` in place.
+func transformPoints(m transform.Matrix, points []transform.Point) {
+	for i, pt := range points {
+		points[i].X, points[i].Y = m.Transform(pt.X, pt.Y)
+	}
+}
+
+// flattenPath returns the subpaths of `path` with the Bézier curves replaced by straight lines.
+func flattenPath(path Path) []polyline {
+	var lines []polyline
+	var start transform.Point // Start of the current subpath.
+	current := func(pt transform.Point) *polyline {
+		if n := len(lines); n > 0 && !lines[n-1].closed {
+			return &lines[n-1]
+		}
+		// A segment after a closed subpath begins a new subpath at the start of the closed one.
+		if len(lines) == 0 {
+			start = pt
+		}
+		lines = append(lines, polyline{points: []transform.Point{start}})
+		return &lines[len(lines)-1]
+	}
+	for _, seg := range path {
+		switch seg.Type {
+		case PathSegmentMoveTo:
+			start = seg.Points[0]
+			lines = append(lines, polyline{points: []transform.Point{start}})
+		case PathSegmentLineTo:
+			line := current(seg.Points[0])
+			line.points = append(line.points, seg.Points[0])
+		case PathSegmentCurveTo:
+			line := current(seg.Points[2])
+			line.points = append(line.points, flattenCurve(line.points[len(line.points)-1], seg.Points[0],
+				seg.Points[1], seg.Points[2])...)
+		case PathSegmentClose:
+			if n := len(lines); n > 0 && !lines[n-1].closed {
+				lines[n-1].closed = true
+			}
+		}
+	}
+	return lines
+}
+
+// flattenCurve returns points along the Bézier curve from `p0` with control points `c1`, `c2` to
+// `p3`, excluding `p0`.
+func flattenCurve(p0, c1, c2, p3 transform.Point) []transform.Point {
+	length := math.Hypot(c1.X-p0.X, c1.Y-p0.Y) + math.Hypot(c2.X-c1.X, c2.Y-c1.Y) +
+		math.Hypot(p3.X-c2.X, p3.Y-c2.Y)
+	n := int(math.Ceil(length / 2))
+	if n < 1 {
+		n = 1
+	} else if n > maxCurveSegments {
+		n = maxCurveSegments
+	}
+	points := make([]transform.Point, 0, n)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+		points = append(points, transform.Point{
+			X: a*p0.X + b*c1.X + c*c2.X + d*p3.X,
+			Y: a*p0.Y + b*c1.Y + c*c2.Y + d*p3.Y,
+		})
+	}
+	return points
+}
+
+// halfPlane is the region of the plane on one side of a horizontal or vertical line.
+type halfPlane struct {
+	vertical bool    // The line is x = value. It is y = value otherwise.
+	value    float64 // Position of the line.
+	below    bool    // The region is x <= value or y <= value. It is >= value otherwise.
+}
+
+// coordinate returns the coordinate of `pt` across the line of `hp`.
+func (hp halfPlane) coordinate(pt transform.Point) float64 {
+	if hp.vertical {
+		return pt.X
+	}
+	return pt.Y
+}
+
+// contains returns true if `pt` is in `hp`.
+func (hp halfPlane) contains(pt transform.Point) bool {
+	if hp.below {
+		return hp.coordinate(pt) <= hp.value
+	}
+	return hp.coordinate(pt) >= hp.value
+}
+
+// clip returns the part of polygon `poly` in `hp` (Sutherland-Hodgman). The winding numbers of
+// the points in `hp` are kept, so the result fills `hp` as `poly` does with either fill rule.
+func (hp halfPlane) clip(poly []transform.Point) []transform.Point {
+	var clipped []transform.Point
+	for i, p := range poly {
+		q := poly[(i+1)%len(poly)]
+		pin, qin := hp.contains(p), hp.contains(q)
+		if pin {
+			clipped = append(clipped, p)
+		}
+		if pin != qin {
+			t := (hp.value - hp.coordinate(p)) / (hp.coordinate(q) - hp.coordinate(p))
+			clipped = append(clipped, transform.Point{X: p.X + t*(q.X-p.X), Y: p.Y + t*(q.Y-p.Y)})
+		}
+	}
+	return clipped
+}
+
+// outsideStrips returns convex regions that together cover the plane outside `area`: the half
+// planes left and right of it and the strips below and above it.
+func outsideStrips(area model.PdfRectangle) [][]halfPlane {
+	between := []halfPlane{{vertical: true, value: area.Llx}, {vertical: true, value: area.Urx, below: true}}
+	return [][]halfPlane{
+		{{vertical: true, value: area.Llx, below: true}},
+		{{vertical: true, value: area.Urx}},
+		append(between[:2:2], halfPlane{value: area.Lly, below: true}),
+		append(between[:2:2], halfPlane{value: area.Ury}),
+	}
+}
+
+// subtractArea returns polygons that fill the plane outside `area` as `polys` fill it. Polygons
+// that don't overlap `area` are kept as they are.
+func subtractArea(polys [][]transform.Point, area model.PdfRectangle) [][]transform.Point {
+	var kept [][]transform.Point
+	for _, poly := range polys {
+		if !overlaps(pointsBBox(poly), area) {
+			kept = append(kept, poly)
+			continue
+		}
+		for _, strip := range outsideStrips(area) {
+			clipped := poly
+			for _, hp := range strip {
+				if clipped = hp.clip(clipped); len(clipped) < 3 {
+					break
+				}
+			}
+			if len(clipped) >= 3 {
+				kept = append(kept, clipped)
+			}
+		}
+	}
+	return kept
+}
+
+// cutPolyline returns the parts of `line` outside `area`. A closed polyline that is cut becomes
+// open polylines.
+func cutPolyline(line polyline, area model.PdfRectangle) []polyline {
+	if !overlaps(pointsBBox(line.points), area) && len(line.points) > 1 {
+		return []polyline{line}
+	}
+	points := line.points
+	if line.closed {
+		points = append(points[:len(points):len(points)], points[0])
+	}
+	var lines []polyline
+	var cur []transform.Point
+	cut := false
+	for i := 0; i+1 < len(points); i++ {
+		p, q := points[i], points[i+1]
+		if len(cur) == 0 {
+			cur = append(cur, p)
+		}
+		t0, t1, inside := segmentInRect(p, q, area)
+		if !inside {
+			cur = append(cur, q)
+			continue
+		}
+		cut = true
+		if t0 > 0 {
+			cur = append(cur, lerp(p, q, t0))
+		}
+		if len(cur) > 1 {
+			lines = append(lines, polyline{points: cur})
+		}
+		cur = nil
+		if t1 < 1 {
+			cur = []transform.Point{lerp(p, q, t1), q}
+		}
+	}
+	if !cut {
+		return []polyline{line}
+	}
+	if len(cur) > 1 {
+		lines = append(lines, polyline{points: cur})
+	}
+	return lines
+}
+
+// segmentInRect returns the range [`t0`, `t1`] of the parameter of the line segment from `p` to
+// `q` that is inside `r` (Liang-Barsky). `inside` is false if no part of positive length is
+// inside `r`.
+func segmentInRect(p, q transform.Point, r model.PdfRectangle) (t0, t1 float64, inside bool) {
+	dx, dy := q.X-p.X, q.Y-p.Y
+	t0, t1 = 0, 1
+	for _, c := range [][2]float64{{-dx, p.X - r.Llx}, {dx, r.Urx - p.X}, {-dy, p.Y - r.Lly}, {dy, r.Ury - p.Y}} {
+		pk, qk := c[0], c[1]
+		if pk == 0 {
+			if qk < 0 {
+				return 0, 0, false
+			}
+			continue
+		}
+		t := qk / pk
+		if pk < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+	}
+	return t0, t1, t1 > t0
+}
+
+// lerp returns the point at parameter `t` of the line segment from `p` to `q`.
+func lerp(p, q transform.Point, t float64) transform.Point {
+	return transform.Point{X: p.X + t*(q.X-p.X), Y: p.Y + t*(q.Y-p.Y)}
+}
+
+// blankPixels sets the samples of the pixels of an image that are drawn in `areas` when the image
+// is drawn with CTM `ctm`. The image has `width` × `height` pixels of `components` samples of
+// `bpc` bits in `data`, with rows starting on byte boundaries. The samples are set to 0, or to
+// their maximum value if `ones` is true. It returns true if any pixel was blanked.
+func blankPixels(data []byte, width, height, components, bpc int, ctm transform.Matrix,
+	areas []model.PdfRectangle, ones bool) (bool, error) {
+	if width <= 0 || height <= 0 || components <= 0 || bpc <= 0 {
+		return false, errors.New("invalid image dimensions")
+	}
+	rowBytes := (width*components*bpc + 7) / 8
+	if len(data) < rowBytes*height {
+		return false, errors.New("too little image data")
+	}
+	inv, ok := ctm.Inverse()
+	if !ok {
+		// The image isn't drawn.
+		return false, nil
+	}
+
+	w, h := float64(width), float64(height)
+	blanked := false
+	for _, area := range areas {
+		// Image space is the unit square with the first row at the top.
+		corners := rectPoints(area)
+		transformPoints(inv, corners[:])
+		bounds := pointsBBox(corners[:])
+		x0, x1 := clampInt(math.Floor(bounds.Llx*w), width), clampInt(math.Ceil(bounds.Urx*w), width)
+		y0, y1 := clampInt(math.Floor((1-bounds.Ury)*h), height), clampInt(math.Ceil((1-bounds.Lly)*h), height)
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				cell := model.PdfRectangle{Llx: float64(x) / w, Lly: 1 - float64(y+1)/h,
+					Urx: float64(x+1) / w, Ury: 1 - float64(y)/h}
+				pts := rectPoints(cell)
+				transformPoints(ctm, pts[:])
+				if !overlaps(pointsBBox(pts[:]), area) {
+					continue
+				}
+				offset := y*rowBytes*8 + x*components*bpc
+				for bit := offset; bit < offset+components*bpc; bit++ {
+					if ones {
+						data[bit/8] |= 0x80 >> uint(bit%8)
+					} else {
+						data[bit/8] &^= 0x80 >> uint(bit%8)
+					}
+				}
+				blanked = true
+			}
+		}
+	}
+	return blanked, nil
+}
+
+// clampInt returns `v` converted to an int clamped to the range [0, `max`].
+func clampInt(v float64, max int) int {
+	if v <= 0 {
+		return 0
+	}
+	if v >= float64(max) {
+		return max
+	}
+	return int(v)
+}
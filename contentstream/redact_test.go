@@ -0,0 +1,218 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// redactContents returns `contents` with the content in `areas` removed.
+func redactContents(t *testing.T, contents string, resources *model.PdfPageResources,
+	areas ...model.PdfRectangle) ContentStreamOperations {
+	ops, err := NewContentStreamParser(contents).Parse()
+	require.NoError(t, err)
+	r := &redactor{areas: areas, encoder: core.NewRawEncoder()}
+	redacted, _, err := r.redactOperations(*ops, resources, nil)
+	require.NoError(t, err)
+	return redacted
+}
+
+func TestRedactText(t *testing.T) {
+	resources := newTransformResources(t)
+	contents := `BT /F1 10 Tf 10 20 Td (abcdef) Tj ET`
+	ops, err := NewContentStreamParser(contents).Parse()
+	require.NoError(t, err)
+	_, origins := glyphOrigins(t, *ops, resources)
+
+	// c and d are at x 21.12 to 31.68.
+	redacted := redactContents(t, contents, resources, model.PdfRectangle{Llx: 22, Lly: 19, Urx: 30, Ury: 25})
+	text, redactedOrigins := glyphOrigins(t, redacted, resources)
+	assert.Equal(t, "abef", text)
+	assert.Equal(t, [][2]float64{origins[0], origins[1], origins[4], origins[5]}, redactedOrigins)
+
+	// Areas outside the text don't change it.
+	redacted = redactContents(t, contents, resources, model.PdfRectangle{Llx: 0, Lly: 50, Urx: 100, Ury: 60})
+	assert.Equal(t, ops.String(), redacted.String())
+}
+
+func TestRedactPaths(t *testing.T) {
+	testcases := []struct {
+		contents string
+		area     model.PdfRectangle
+		expected string
+	}{
+		// Lines are cut and the line width is clipped out of the area.
+		{`2 w 0 0 m 100 0 l S`, model.PdfRectangle{Llx: 40, Lly: -5, Urx: 60, Ury: 5},
+			`2 w q -3 -6 m 103 -6 l 103 6 l -3 6 l h 40 -5 m 60 -5 l 60 5 l 40 5 l h W* n
+			0 0 m 40 0 l 60 0 m 100 0 l S Q`},
+		// The area is cut out of filled paths.
+		{`0 0 100 100 re f`, model.PdfRectangle{Llx: 40, Lly: -10, Urx: 60, Ury: 110},
+			`0 0 m 40 0 l 40 100 l 0 100 l h 60 0 m 100 0 l 100 100 l 60 100 l h f`},
+		// Paths outside the area and clipping paths are kept.
+		{`0 0 10 10 re W n 0 0 10 10 re f`, model.PdfRectangle{Llx: 40, Lly: 40, Urx: 60, Ury: 60},
+			`0 0 10 10 re W n 0 0 10 10 re f`},
+		// Paths in the area are removed and a pending clip is kept.
+		{`q 2 0 0 2 0 0 cm 25 25 2 2 re W f Q`, model.PdfRectangle{Llx: 40, Lly: 40, Urx: 60, Ury: 60},
+			`q 2 0 0 2 0 0 cm 25 25 2 2 re W n Q`},
+	}
+	for i, tc := range testcases {
+		redacted := redactContents(t, tc.contents, nil, tc.area)
+		expected, err := NewContentStreamParser(tc.expected).Parse()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), redacted.String(), "case %d", i)
+	}
+}
+
+func TestRedactImages(t *testing.T) {
+	// A 4x4 image drawn at 0 0 to 4 4.
+	pixels := bytes.Repeat([]byte{0xff}, 16)
+	expected := []byte{
+		0xff, 0xff, 0xff, 0xff,
+		0xff, 0x00, 0x00, 0xff,
+		0xff, 0x00, 0x00, 0xff,
+		0xff, 0xff, 0xff, 0xff,
+	}
+	area := model.PdfRectangle{Llx: 1, Lly: 1, Urx: 3, Ury: 3}
+
+	resources := model.NewPdfPageResources()
+	img, err := core.MakeStream(pixels, core.NewFlateEncoder())
+	require.NoError(t, err)
+	img.Set("Subtype", core.MakeName("Image"))
+	img.Set("Width", core.MakeInteger(4))
+	img.Set("Height", core.MakeInteger(4))
+	img.Set("BitsPerComponent", core.MakeInteger(8))
+	img.Set("ColorSpace", core.MakeName("DeviceGray"))
+	require.NoError(t, resources.SetXObjectByName("Im1", img))
+
+	redacted := redactContents(t, `q 4 0 0 4 0 0 cm /Im1 Do Q`, resources, area)
+	require.Len(t, redacted, 4)
+	assert.Equal(t, "Do", redacted[2].Operand)
+	name, ok := core.GetName(redacted[2].Params[0])
+	require.True(t, ok)
+	assert.NotEqual(t, "Im1", name.String())
+	stream, xtype := resources.GetXObjectByName(*name)
+	require.Equal(t, model.XObjectTypeImage, xtype)
+	data, err := core.DecodeStream(stream)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+	assert.Equal(t, bytes.Repeat([]byte{0xff}, 16), pixels, "the original image isn't changed")
+
+	// Stencil masks are masked out in the area.
+	stencil, err := core.MakeStream(make([]byte, 4), core.NewFlateEncoder())
+	require.NoError(t, err)
+	stencil.Set("Subtype", core.MakeName("Image"))
+	stencil.Set("Width", core.MakeInteger(4))
+	stencil.Set("Height", core.MakeInteger(4))
+	stencil.Set("ImageMask", core.MakeBool(true))
+	masked, err := core.MakeStream(pixels, core.NewFlateEncoder())
+	require.NoError(t, err)
+	for _, key := range img.Keys() {
+		if key != "Filter" && key != "Length" {
+			masked.Set(key, img.Get(key))
+		}
+	}
+	masked.Set("Mask", stencil)
+	require.NoError(t, resources.SetXObjectByName("Im2", masked))
+
+	redacted = redactContents(t, `q 4 0 0 4 0 0 cm /Im2 Do Q`, resources, area)
+	require.Len(t, redacted, 4)
+	name, ok = core.GetName(redacted[2].Params[0])
+	require.True(t, ok)
+	stream, _ = resources.GetXObjectByName(*name)
+	require.NotNil(t, stream)
+	redactedStencil, ok := core.GetStream(stream.Get("Mask"))
+	require.True(t, ok)
+	data, err = core.DecodeStream(redactedStencil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x60, 0x60, 0x00}, data)
+	data, err = core.DecodeStream(stencil)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 4), data, "the original mask isn't changed")
+
+	// Inline images.
+	redacted = redactContents(t, "q 4 0 0 4 0 0 cm BI /W 4 /H 4 /BPC 8 /CS /G ID "+string(pixels)+" EI Q", nil,
+		area)
+	require.Len(t, redacted, 4)
+	inline, ok := inlineImageParam(redacted[2])
+	require.True(t, ok)
+	image, err := inline.ToImage(nil)
+	require.NoError(t, err)
+	assert.Equal(t, expected, image.Data)
+
+	// Images outside the area are kept.
+	redacted = redactContents(t, `q 4 0 0 4 10 10 cm /Im1 Do Q`, resources, area)
+	assert.Equal(t, "q\n4 0 0 4 10 10 cm\n/Im1 Do\nQ\n", redacted.String())
+}
+
+func TestApplyRedactAnnotations(t *testing.T) {
+	page := model.NewPdfPage()
+	page.MediaBox = &model.PdfRectangle{Llx: 0, Lly: 0, Urx: 200, Ury: 100}
+	page.Resources = newTransformResources(t)
+	require.NoError(t, page.SetContentStreams([]string{
+		`/Span <</ActualText (public secret)>> BDC BT /F1 10 Tf 10 50 Td (public secret) Tj ET EMC`,
+	}, core.NewRawEncoder()))
+
+	annot := model.NewPdfAnnotationRedact()
+	// "secret" is at x 43.9 to 74.5.
+	annot.Rect = core.MakeArrayFromFloats([]float64{42, 45, 80, 60})
+	annot.IC = core.MakeArrayFromFloats([]float64{0})
+	annot.OverlayText = core.MakeString("REDACTED")
+	page.AddAnnotation(annot.PdfAnnotation)
+	note := model.NewPdfAnnotationText()
+	note.Rect = core.MakeArrayFromFloats([]float64{0, 0, 10, 10})
+	page.AddAnnotation(note.PdfAnnotation)
+
+	n, err := ApplyRedactAnnotations(page, core.NewRawEncoder())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	annotations, err := page.GetAnnotations()
+	require.NoError(t, err)
+	require.Len(t, annotations, 1)
+	assert.Equal(t, note.PdfAnnotation, annotations[0])
+
+	contents, err := page.GetAllContentStreams()
+	require.NoError(t, err)
+	assert.NotContains(t, contents, "secret")
+	assert.Contains(t, contents, "(public ")
+	assert.Contains(t, contents, "42 45 38 15 re")
+	assert.Contains(t, contents, "(REDACTED) Tj")
+
+	writer := model.NewPdfWriter()
+	require.NoError(t, writer.AddPage(page))
+	var buf bytes.Buffer
+	require.NoError(t, writer.Write(&buf))
+	assert.NotContains(t, buf.String(), "secret")
+	assert.NotContains(t, buf.String(), "/Redact")
+	assert.Contains(t, buf.String(), "(public ")
+}
+
+func TestNewRedactionFromAnnotation(t *testing.T) {
+	annot := model.NewPdfAnnotationRedact()
+	annot.Rect = core.MakeArrayFromFloats([]float64{100, 100, 0, 0})
+	annot.QuadPoints = core.MakeArrayFromFloats([]float64{0, 20, 50, 20, 0, 10, 50, 10, 60, 50, 70, 50, 60, 40, 70, 40})
+	annot.IC = core.MakeArrayFromFloats([]float64{1, 0, 0})
+	annot.OverlayText = core.MakeString("X")
+	annot.DA = core.MakeString("/Helv 8 Tf 0 0 1 rg")
+	annot.Q = core.MakeInteger(1)
+
+	redaction, err := NewRedactionFromAnnotation(annot)
+	require.NoError(t, err)
+	assert.Equal(t, []model.PdfRectangle{{Llx: 0, Lly: 10, Urx: 50, Ury: 20}, {Llx: 60, Lly: 40, Urx: 70, Ury: 50}},
+		redaction.Areas)
+	assert.Equal(t, model.PdfRectangle{Llx: 0, Lly: 0, Urx: 100, Ury: 100}, redaction.OverlayRect)
+	assert.Equal(t, model.NewPdfColorDeviceRGB(1, 0, 0), redaction.FillColor)
+	assert.Equal(t, "X", redaction.OverlayText)
+	assert.Equal(t, 8.0, redaction.OverlayFontSize)
+	assert.Equal(t, model.NewPdfColorDeviceRGB(0, 0, 1), redaction.OverlayTextColor)
+	assert.Equal(t, 1, redaction.OverlayAlign)
+}
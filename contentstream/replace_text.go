@@ -0,0 +1,448 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/textmetrics"
+	"github.com/zituocn/updf/model"
+)
+
+// ReplaceTextOptions define how ReplaceText replaces text.
+type ReplaceTextOptions struct {
+	// SubstituteFont shows replacement text that the font of the replaced text has no glyphs for.
+	// It is added to the page resources if it is used. Helvetica is used if it is nil.
+	SubstituteFont *model.PdfFont
+	// Limit is the maximum number of occurrences to replace. All occurrences are replaced if it
+	// is 0.
+	Limit int
+}
+
+// ReplaceText replaces the occurrences of `old` in the text shown on `page` by `new` and returns
+// the number of occurrences replaced. The page content stream is replaced by one encoded with
+// `encoder`. To save the change to the file `page` was read from, update the page with
+// PdfAppender.UpdatePage.
+//
+// The text is matched in the order it is shown within each text object, so occurrences that are
+// shown by several Tj or TJ operators are found. Glyphs on the same line that are separated by a
+// gap wider than a space match a space in `old`. The replacement is shown in the font of the
+// first replaced glyph if it has glyphs for all of `new` and in opts.SubstituteFont otherwise.
+// The text after an occurrence keeps its position, so a longer replacement may overlap it.
+// Text in forms and annotation appearances isn't replaced.
+func ReplaceText(page *model.PdfPage, old, new string, opts *ReplaceTextOptions,
+	encoder core.StreamEncoder) (int, error) {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return 0, err
+	}
+	ops, err := NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return 0, err
+	}
+	if page.Resources == nil {
+		page.Resources = model.NewPdfPageResources()
+	}
+	replaced, n, err := replaceText(*ops, page.Resources, old, new, opts)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if err := page.SetContentStreams([]string{replaced.String()}, encoder); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// shownGlyph is a glyph shown by a text showing operation of a content stream.
+type shownGlyph struct {
+	Glyph
+	op         int // Index of the operation that shows the glyph.
+	textObject int // Number of the text object (BT ... ET) that the glyph is in.
+	text       TextState
+}
+
+// textEdit replaces the character codes in a string of a text showing operation.
+type textEdit struct {
+	element    int    // Index of the string in the elements of the operation.
+	start, end int    // Range of the removed bytes in the string.
+	insert     []byte // Character codes inserted at start.
+	substitute bool   // `insert` is shown in the substitute font.
+	// shift is the displacement of the text position after the edit relative to the original
+	// text, in text space.
+	shift float64
+}
+
+// replaceText replaces `old` by `new` in the text shown by `ops` with `resources`, adding the
+// substitute font to `resources` if it is used. It returns the new operations and the number of
+// occurrences replaced.
+func replaceText(ops ContentStreamOperations, resources *model.PdfPageResources, old, new string,
+	opts *ReplaceTextOptions) (*ContentStreamOperations, int, error) {
+	if old == "" {
+		return nil, 0, errors.New("empty text to replace")
+	}
+	if opts == nil {
+		opts = &ReplaceTextOptions{}
+	}
+	glyphs, err := shownGlyphs(ops, resources)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Match the text of the glyphs with separators between glyphs that aren't adjacent.
+	var text []rune
+	var owners []int // Index in `glyphs` of each rune in `text`. -1 for separators.
+	for i, g := range glyphs {
+		if i > 0 {
+			if sep := glyphSeparator(glyphs[i-1], g); sep != 0 {
+				text = append(text, sep)
+				owners = append(owners, -1)
+			}
+		}
+		for _, r := range g.Text {
+			text = append(text, r)
+			owners = append(owners, i)
+		}
+	}
+
+	substitute := opts.SubstituteFont
+	substituteName := core.PdfObjectName("")
+	edits := map[int][]textEdit{}
+	count := 0
+	pattern := []rune(old)
+	for pos := 0; pos+len(pattern) <= len(text); {
+		if string(text[pos:pos+len(pattern)]) != old {
+			pos++
+			continue
+		}
+		var matched []int
+		for _, owner := range owners[pos : pos+len(pattern)] {
+			if owner >= 0 && (len(matched) == 0 || matched[len(matched)-1] != owner) {
+				matched = append(matched, owner)
+			}
+		}
+		pos += len(pattern)
+		if len(matched) == 0 {
+			continue
+		}
+
+		first := glyphs[matched[0]]
+		font := first.text.Font
+		insert, ok := encodeText(font, new)
+		useSubstitute := !ok
+		if useSubstitute {
+			if substitute == nil {
+				substitute, err = model.NewStandard14Font(model.HelveticaName)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			if substituteName == "" {
+				// Load the font as it is written to the resources so that its widths match the
+				// character codes shown.
+				substitute, err = model.NewPdfFontFromPdfObject(substitute.ToPdfObject())
+				if err != nil {
+					return nil, 0, err
+				}
+				substituteName = newFontName(resources, "SubF")
+			}
+			if first.text.FontName == "" {
+				return nil, 0, fmt.Errorf("can't restore the font of %q after the substitute font", old)
+			}
+			if insert, ok = encodeText(substitute, new); !ok {
+				return nil, 0, fmt.Errorf("substitute font %s has no glyphs for %q", substitute, new)
+			}
+			font = substitute
+		}
+		// One edit per string that shows matched glyphs. The replacement is inserted by the first.
+		for i, index := range matched {
+			g := glyphs[index]
+			list := edits[g.op]
+			if n := len(list); i > 0 && n > 0 && list[n-1].element == g.Element && list[n-1].end == g.Start {
+				list[n-1].end = g.End
+				list[n-1].shift -= g.Advance
+				continue
+			}
+			edit := textEdit{element: g.Element, start: g.Start, end: g.End, shift: -g.Advance}
+			if i == 0 {
+				edit.insert = insert
+				edit.substitute = useSubstitute
+				edit.shift += textWidth(font, insert, first.text)
+			}
+			edits[g.op] = append(list, edit)
+		}
+		count++
+		if opts.Limit > 0 && count >= opts.Limit {
+			break
+		}
+	}
+	if count == 0 {
+		return &ops, 0, nil
+	}
+
+	textStates := map[int]TextState{}
+	for _, g := range glyphs {
+		textStates[g.op] = g.text
+	}
+	var replaced ContentStreamOperations
+	for i, op := range ops {
+		list, ok := edits[i]
+		if !ok {
+			replaced = append(replaced, op)
+			continue
+		}
+		replaced = append(replaced, rewriteTextShowing(op, list, textStates[i], substituteName)...)
+	}
+	if substituteName != "" {
+		if err := resources.SetFontByName(substituteName, substitute.ToPdfObject()); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &replaced, count, nil
+}
+
+// shownGlyphs returns the glyphs shown by `ops` with `resources` in content stream order.
+func shownGlyphs(ops ContentStreamOperations, resources *model.PdfPageResources) ([]shownGlyph, error) {
+	indexes := map[*ContentStreamOperation]int{}
+	for i, op := range ops {
+		indexes[op] = i
+	}
+	var glyphs []shownGlyph
+	textObject := 0
+	proc := NewContentStreamProcessor(ops)
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			switch op.Operand {
+			case "BT":
+				textObject++
+			case "Tj", "TJ", "'", "\"":
+				for _, g := range proc.Glyphs() {
+					glyphs = append(glyphs, shownGlyph{Glyph: g, op: indexes[op], textObject: textObject,
+						text: gs.Text})
+				}
+			}
+			return nil
+		})
+	if err := proc.Process(resources); err != nil {
+		return nil, err
+	}
+	return glyphs, nil
+}
+
+// glyphSeparator returns the rune that separates glyph `g` from the preceding glyph `prev` in the
+// matched text: a newline if they are in different text objects or lines, a space if there is a
+// gap between them on the same line and 0 if they are adjacent.
+func glyphSeparator(prev, g shownGlyph) rune {
+	if prev.textObject != g.textObject {
+		return '\n'
+	}
+	scale := prev.text.FontSize * prev.text.HorizScaling / 100
+	if scale == 0 {
+		return 0
+	}
+	x0, y0 := prev.Matrix.Transform(0, 0)
+	x1, y1 := prev.Matrix.Transform(prev.Advance/scale, 0)
+	x2, y2 := g.Matrix.Transform(0, 0)
+	em := prev.Matrix.ScalingFactorY()
+	if em == 0 {
+		return 0
+	}
+
+	// The offset of `g` from the end of `prev` along and across the direction of the text.
+	dx, dy := x1-x0, y1-y0
+	if length := math.Hypot(dx, dy); length > 0 {
+		dx, dy = dx/length, dy/length
+	} else {
+		dx, dy = prev.Matrix[0]/em, prev.Matrix[1]/em
+		if length := math.Hypot(dx, dy); length > 0 {
+			dx, dy = dx/length, dy/length
+		}
+	}
+	along := ((x2-x1)*dx + (y2-y1)*dy) / em
+	across := math.Abs((x2-x1)*dy-(y2-y1)*dx) / em
+	switch {
+	case across > 0.5 || along < -0.5 || along > 3:
+		return '\n'
+	case along > 0.15 && !isSpaceText(prev.Text) && !isSpaceText(g.Text):
+		return ' '
+	}
+	return 0
+}
+
+// isSpaceText returns true if `text` is white space.
+func isSpaceText(text string) bool {
+	return strings.TrimSpace(text) == ""
+}
+
+// encodeText returns the character codes that show `text` in `font`. The bool return is false if
+// `font` has no glyph for some rune of `text`: no code or no width.
+func encodeText(font *model.PdfFont, text string) ([]byte, bool) {
+	if font == nil {
+		return nil, false
+	}
+	var data []byte
+	for _, r := range text {
+		code, ok := font.RuneToCharcode(r)
+		if !ok {
+			return nil, false
+		}
+		m, ok := font.GetCharMetrics(code)
+		if !ok || (m.Wx <= 0 && !unicode.IsSpace(r)) {
+			return nil, false
+		}
+		if font.IsCID() {
+			data = append(data, byte(code>>8), byte(code))
+		} else if code <= 0xff {
+			data = append(data, byte(code))
+		} else {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// textWidth returns the horizontal displacement of showing the character codes `data` in `font`
+// with text state `ts`, in text space.
+func textWidth(font *model.PdfFont, data []byte, ts TextState) float64 {
+	width := 0.0
+	for _, g := range decodeGlyphs(font, data) {
+		w := 0.0
+		if m, ok := font.GetCharMetrics(g.Code); ok {
+			w = m.Wx * textmetrics.GlyphTextRatio
+		}
+		width += w*ts.FontSize + ts.CharSpacing
+		if g.End-g.Start == 1 && data[g.Start] == ' ' {
+			width += ts.WordSpacing
+		}
+	}
+	return width * ts.HorizScaling / 100
+}
+
+// newFontName returns a font name starting with `prefix` that isn't used in `resources`.
+func newFontName(resources *model.PdfPageResources, prefix string) core.PdfObjectName {
+	for i := 1; ; i++ {
+		name := core.PdfObjectName(fmt.Sprintf("%s%d", prefix, i))
+		if !resources.HasFontByName(name) {
+			return name
+		}
+	}
+}
+
+// textRun is a sequence of TJ elements shown in the same font.
+type textRun struct {
+	substitute bool
+	elements   []core.PdfObject
+}
+
+// rewriteTextShowing returns the operations that replace text showing operation `op` with `edits`
+// applied. `ts` is the text state of `op`. Replacement text shown in the substitute font, named
+// `substituteName`, is enclosed in Tf operations that select it and restore the font of `op`.
+func rewriteTextShowing(op *ContentStreamOperation, edits []textEdit, ts TextState,
+	substituteName core.PdfObjectName) []*ContentStreamOperation {
+	cc := NewContentCreator()
+	var elements []core.PdfObject
+	switch op.Operand {
+	case "TJ":
+		arr, _ := core.GetArray(op.Params[0])
+		elements = arr.Elements()
+	case "Tj":
+		elements = op.Params
+	case "'":
+		cc.Add_Tstar()
+		elements = op.Params
+	case "\"":
+		cc.Add_Tw(ts.WordSpacing).Add_Tc(ts.CharSpacing).Add_Tstar()
+		elements = op.Params[2:]
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].element != edits[j].element {
+			return edits[i].element < edits[j].element
+		}
+		return edits[i].start < edits[j].start
+	})
+	scale := ts.FontSize * ts.HorizScaling / 100
+	runs := []textRun{{}}
+	add := func(substitute bool, obj core.PdfObject) {
+		if runs[len(runs)-1].substitute != substitute {
+			runs = append(runs, textRun{substitute: substitute})
+		}
+		run := &runs[len(runs)-1]
+		run.elements = append(run.elements, obj)
+	}
+	addString := func(substitute bool, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		// Merge with a preceding string in the same font.
+		if run := &runs[len(runs)-1]; run.substitute == substitute && len(run.elements) > 0 {
+			if last, ok := core.GetStringBytes(run.elements[len(run.elements)-1]); ok {
+				run.elements[len(run.elements)-1] = core.MakeStringFromBytes(append(last[:len(last):len(last)], data...))
+				return
+			}
+		}
+		add(substitute, core.MakeStringFromBytes(data))
+	}
+	addAdjustment := func(adjustment float64) {
+		run := &runs[len(runs)-1]
+		if n := len(run.elements); !run.substitute && n > 0 {
+			if last, err := core.GetNumberAsFloat(run.elements[n-1]); err == nil {
+				run.elements = run.elements[:n-1]
+				adjustment += last
+			}
+		}
+		// Round off the errors of the width calculations.
+		adjustment = math.Round(adjustment*1000) / 1000
+		if adjustment != 0 {
+			add(false, core.MakeFloat(adjustment))
+		}
+	}
+	for i, element := range elements {
+		data, ok := core.GetStringBytes(element)
+		if !ok {
+			add(false, element)
+			continue
+		}
+		pos := 0
+		for _, edit := range edits {
+			if edit.element != i {
+				continue
+			}
+			addString(false, data[pos:edit.start])
+			addString(edit.substitute, edit.insert)
+			if scale != 0 {
+				// Restore the position of the text after the edit.
+				addAdjustment(edit.shift * 1000 / scale)
+			}
+			pos = edit.end
+		}
+		addString(false, data[pos:])
+	}
+
+	for _, run := range runs {
+		if len(run.elements) == 0 {
+			continue
+		}
+		if run.substitute {
+			cc.Add_Tf(substituteName, ts.FontSize)
+		}
+		if _, ok := run.elements[0].(*core.PdfObjectString); ok && len(run.elements) == 1 {
+			cc.AddOperand(ContentStreamOperation{Operand: "Tj", Params: run.elements})
+		} else {
+			cc.AddOperand(ContentStreamOperation{Operand: "TJ",
+				Params: []core.PdfObject{core.MakeArray(run.elements...)}})
+		}
+		if run.substitute {
+			cc.Add_Tf(ts.FontName, ts.FontSize)
+		}
+	}
+	return *cc.Operations()
+}
@@ -0,0 +1,136 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// glyphOrigins returns the text of the glyphs shown by `ops` and their device space origins.
+func glyphOrigins(t *testing.T, ops ContentStreamOperations, resources *model.PdfPageResources) (string,
+	[][2]float64) {
+	glyphs, err := shownGlyphs(ops, resources)
+	require.NoError(t, err)
+	text := ""
+	var origins [][2]float64
+	for _, g := range glyphs {
+		x, y := g.Matrix.Transform(0, 0)
+		text += g.Text
+		origins = append(origins, [2]float64{math.Round(x*1000) / 1000, math.Round(y*1000) / 1000})
+	}
+	return text, origins
+}
+
+func TestReplaceText(t *testing.T) {
+	testcases := []struct {
+		contents string
+		old, new string
+		limit    int
+		expected string
+		count    int
+	}{
+		// Digits have the same width so no adjustment is needed.
+		{`BT /F1 12 Tf 10 10 Td (Date: 2020-01-01) Tj ET`, "2020-01-01", "2021-12-31", 0,
+			"BT\n/F1 12 Tf\n10 10 Td\n(Date: 2021-12-31) Tj\nET\n", 1},
+		// Split over operators. The text after the replacement keeps its position.
+		{`BT /F1 12 Tf [(Jo) -20 (hn)] TJ ( Smith) Tj ET`, "John", "Bill", 0,
+			"BT\n/F1 12 Tf\n[(Bill) 277 -1132] TJ\n( Smith) Tj\nET\n", 1},
+		// Separate Tj at a distance match a space.
+		{`BT /F1 12 Tf (John) Tj 30 0 Td (Smith) Tj ET`, "John Smith", "J. S.", 0,
+			"BT\n/F1 12 Tf\n[(J. S.) -167] TJ\n30 0 Td\n[-2556] TJ\nET\n", 1},
+		// Separate text objects don't match.
+		{`BT /F1 12 Tf (ab) Tj ET BT /F1 12 Tf (cd) Tj ET`, "bc", "x", 0,
+			"BT /F1 12 Tf (ab) Tj ET BT /F1 12 Tf (cd) Tj ET", 0},
+		{`BT /F1 12 Tf (aXbXc) Tj ET`, "X", "Y", 1,
+			"BT\n/F1 12 Tf\n(aYbXc) Tj\nET\n", 1},
+		{`BT /F1 12 Tf 2 Tw (a b) ' ET`, "b", "cc", 0,
+			"BT\n/F1 12 Tf\n2 Tw\nT*\n[(a cc) 444] TJ\nET\n", 1},
+		// Symbol has no glyph for p so the substitute font is used.
+		{`BT /F3 12 Tf (pa) Tj ET`, "π", "pi", 0,
+			"BT\n/F3 12 Tf\n/SubF1 12 Tf\n(pi) Tj\n/F3 12 Tf\n[229 (a)] TJ\nET\n", 1},
+	}
+
+	for _, tc := range testcases {
+		resources := newTransformResources(t)
+		font, err := model.NewStandard14Font(model.SymbolName)
+		require.NoError(t, err)
+		require.NoError(t, resources.SetFontByName("F3", font.ToPdfObject()))
+
+		ops, err := NewContentStreamParser(tc.contents).Parse()
+		require.NoError(t, err)
+		replaced, count, err := replaceText(*ops, resources, tc.old, tc.new, &ReplaceTextOptions{Limit: tc.limit})
+		require.NoError(t, err, tc.contents)
+		assert.Equal(t, tc.count, count, tc.contents)
+		if count == 0 {
+			continue
+		}
+		assert.Equal(t, tc.expected, replaced.String(), tc.contents)
+	}
+}
+
+func TestReplaceTextKeepsPositions(t *testing.T) {
+	resources := newTransformResources(t)
+	ops, err := NewContentStreamParser(`BT /F1 12 Tf 1 0 0 1 20 700 Tm [(Nam) 30 (e: Jo) -15 (hn Smith,)] TJ
+		( born 1970) Tj ET`).Parse()
+	require.NoError(t, err)
+	text, origins := glyphOrigins(t, *ops, resources)
+	require.Equal(t, "Name: John Smith, born 1970", text)
+
+	replaced, count, err := replaceText(*ops, resources, "John Smith", "Maximilian Mustermann", nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	newText, newOrigins := glyphOrigins(t, *replaced, resources)
+	assert.Equal(t, "Name: Maximilian Mustermann, born 1970", newText)
+	// The text before and after the replacement is where it was.
+	assert.Equal(t, origins[:6], newOrigins[:6])
+	assert.Equal(t, origins[16:], newOrigins[27:])
+}
+
+func TestReplaceTextAppender(t *testing.T) {
+	// Write a document with one page showing text.
+	page := model.NewPdfPage()
+	font, err := model.NewStandard14Font(model.HelveticaName)
+	require.NoError(t, err)
+	page.Resources = model.NewPdfPageResources()
+	require.NoError(t, page.Resources.SetFontByName("F1", font.ToPdfObject()))
+	require.NoError(t, page.SetContentStreams([]string{`BT /F1 12 Tf 50 700 Td (Invoice date: 2020-01-01) Tj ET`},
+		core.NewRawEncoder()))
+	writer := model.NewPdfWriter()
+	require.NoError(t, writer.AddPage(page))
+	var buf bytes.Buffer
+	require.NoError(t, writer.Write(&buf))
+
+	reader, err := model.NewPdfReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	appender, err := model.NewPdfAppender(reader)
+	require.NoError(t, err)
+	page, err = reader.GetPage(1)
+	require.NoError(t, err)
+	count, err := ReplaceText(page, "2020-01-01", "2024-06-30", nil, core.NewFlateEncoder())
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	appender.UpdatePage(page)
+	var updated bytes.Buffer
+	require.NoError(t, appender.Write(&updated))
+
+	// The update is appended to the original file.
+	require.True(t, bytes.HasPrefix(updated.Bytes(), buf.Bytes()))
+	reader, err = model.NewPdfReader(bytes.NewReader(updated.Bytes()))
+	require.NoError(t, err)
+	page, err = reader.GetPage(1)
+	require.NoError(t, err)
+	contents, err := page.GetAllContentStreams()
+	require.NoError(t, err)
+	assert.Contains(t, contents, "(Invoice date: 2024-06-30) Tj")
+}
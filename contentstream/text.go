@@ -0,0 +1,215 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/textencoding"
+	"github.com/zituocn/updf/internal/textmetrics"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// Glyph is a glyph shown by a text showing operator (9.4.3).
+type Glyph struct {
+	Code textencoding.CharCode
+	// Text is the Unicode text of the glyph. It is empty if the font doesn't map Code to Unicode.
+	Text string
+	// Element is the index of the string that shows the glyph in the array operand of a TJ
+	// operation. It is 0 for the other text showing operators.
+	Element int
+	// Start and End are the offsets of the character code bytes in the string.
+	Start, End int
+	// Matrix is the text rendering matrix (Trm) at the glyph's origin. It maps unscaled text space
+	// to device space.
+	Matrix transform.Matrix
+	// Advance is the horizontal displacement of the text position by the glyph in text space,
+	// including character and word spacing.
+	Advance float64
+	// BBox is the bounding box of the glyph in device space. It spans the glyph's advance width
+	// and the font's ascent and descent.
+	BBox model.PdfRectangle
+}
+
+// TextMatrix returns the text matrix (Tm) of the current text object. Handlers of the text showing
+// operators see the text matrix at the start of the text they show.
+func (proc *ContentStreamProcessor) TextMatrix() transform.Matrix {
+	return proc.textMatrix
+}
+
+// Glyphs returns the glyphs shown by the current operation if it is a text showing operation
+// (Tj, TJ, ' or "). The glyphs of fonts that can't be loaded have no Text and zero width.
+func (proc *ContentStreamProcessor) Glyphs() []Glyph {
+	return proc.glyphs
+}
+
+// handleTextPositioning handles the text object and text positioning operators (Tables 107
+// and 108). Invalid operands are logged and the operation is ignored.
+func (proc *ContentStreamProcessor) handleTextPositioning(op *ContentStreamOperation) {
+	switch op.Operand {
+	case "BT":
+		proc.textMatrix = transform.IdentityMatrix()
+		proc.textLineMatrix = transform.IdentityMatrix()
+		return
+	case "T*":
+		proc.nextLine()
+		return
+	}
+
+	f, err := core.GetNumbersAsFloat(op.Params)
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid parameters for %s: %v", op.Operand, err)
+		return
+	}
+	switch op.Operand {
+	case "Td", "TD":
+		if len(f) != 2 {
+			common.Log.Debug("ERROR: Invalid number of parameters for %s: %d", op.Operand, len(f))
+			return
+		}
+		if op.Operand == "TD" {
+			proc.graphicsState.Text.Leading = -f[1]
+		}
+		proc.moveText(f[0], f[1])
+	case "Tm":
+		if len(f) != 6 {
+			common.Log.Debug("ERROR: Invalid number of parameters for Tm: %d", len(f))
+			return
+		}
+		proc.textMatrix = transform.NewMatrix(f[0], f[1], f[2], f[3], f[4], f[5])
+		proc.textLineMatrix = proc.textMatrix
+	}
+}
+
+// moveText moves to the start of the next line, offset from the start of the current line by
+// `tx`,`ty` in unscaled text space units.
+func (proc *ContentStreamProcessor) moveText(tx, ty float64) {
+	proc.textLineMatrix.Concat(transform.TranslationMatrix(tx, ty))
+	proc.textMatrix = proc.textLineMatrix
+}
+
+// nextLine moves to the start of the next line (T*).
+func (proc *ContentStreamProcessor) nextLine() {
+	proc.moveText(0, -proc.graphicsState.Text.Leading)
+}
+
+// handleTextShowing handles the text showing operators (Table 109). It applies the line moves and
+// spacing of ' and " and computes the glyphs that the operation shows. The text matrix is
+// advanced past the glyphs by advanceText after the handlers have seen the operation.
+func (proc *ContentStreamProcessor) handleTextShowing(op *ContentStreamOperation,
+	resources *model.PdfPageResources) {
+	var elements []core.PdfObject
+	switch op.Operand {
+	case "Tj", "'":
+		if len(op.Params) != 1 {
+			common.Log.Debug("ERROR: Invalid number of parameters for %s: %d", op.Operand, len(op.Params))
+			return
+		}
+		elements = op.Params
+	case "\"":
+		if len(op.Params) != 3 {
+			common.Log.Debug("ERROR: Invalid number of parameters for \": %d", len(op.Params))
+			return
+		}
+		proc.handleTextStateParam(&ContentStreamOperation{Operand: "Tw", Params: op.Params[:1]}, resources)
+		proc.handleTextStateParam(&ContentStreamOperation{Operand: "Tc", Params: op.Params[1:2]}, resources)
+		elements = op.Params[2:]
+	case "TJ":
+		if len(op.Params) != 1 {
+			common.Log.Debug("ERROR: Invalid number of parameters for TJ: %d", len(op.Params))
+			return
+		}
+		arr, ok := core.GetArray(op.Params[0])
+		if !ok {
+			common.Log.Debug("ERROR: Invalid parameter for TJ: %s", op.Params[0])
+			return
+		}
+		elements = arr.Elements()
+	}
+	if op.Operand == "'" || op.Operand == "\"" {
+		proc.nextLine()
+	}
+
+	ts := proc.graphicsState.Text
+	th := ts.HorizScaling / 100
+	stateMatrix := transform.NewMatrix(ts.FontSize*th, 0, 0, ts.FontSize, 0, ts.Rise)
+	ascent, descent := textmetrics.FontExtent(ts.Font)
+	tm := proc.textMatrix
+	for i, element := range elements {
+		if num, err := core.GetNumberAsFloat(element); err == nil {
+			tm.Concat(transform.TranslationMatrix(-num*textmetrics.GlyphTextRatio*ts.FontSize*th, 0))
+			continue
+		}
+		data, ok := core.GetStringBytes(element)
+		if !ok {
+			common.Log.Debug("ERROR: Invalid element for %s: %s", op.Operand, element)
+			continue
+		}
+		for _, glyph := range decodeGlyphs(ts.Font, data) {
+			glyph.Element = i
+			width := 0.0
+			if ts.Font != nil {
+				if m, ok := ts.Font.GetCharMetrics(glyph.Code); ok {
+					width = m.Wx * textmetrics.GlyphTextRatio
+				}
+			}
+			// Word spacing applies to single byte code 32 (9.3.3).
+			wordSpacing := 0.0
+			if glyph.End-glyph.Start == 1 && data[glyph.Start] == ' ' {
+				wordSpacing = ts.WordSpacing
+			}
+			trm := proc.graphicsState.CTM.Mult(tm).Mult(stateMatrix)
+			glyph.Matrix = trm
+			glyph.Advance = (width*ts.FontSize + ts.CharSpacing + wordSpacing) * th
+			glyph.BBox = textmetrics.GlyphBBox(trm, width, ascent, descent)
+			proc.glyphs = append(proc.glyphs, glyph)
+			tm.Concat(transform.TranslationMatrix(glyph.Advance, 0))
+		}
+	}
+	proc.textMatrixEnd = tm
+	proc.showingText = true
+}
+
+// advanceText moves the text matrix past the glyphs shown by the current operation.
+func (proc *ContentStreamProcessor) advanceText() {
+	if proc.showingText {
+		proc.textMatrix = proc.textMatrixEnd
+	}
+}
+
+// decodeGlyphs returns the glyphs of the character codes in string `data` shown with `font`,
+// without their positions. The codes of composite fonts are 2 bytes long. If `font` is nil, each
+// byte is a code.
+func decodeGlyphs(font *model.PdfFont, data []byte) []Glyph {
+	codeLen := 1
+	if font != nil && font.IsCID() {
+		codeLen = 2
+	}
+	var glyphs []Glyph
+	var codes []textencoding.CharCode
+	for start := 0; start < len(data); start += codeLen {
+		end := start + codeLen
+		if end > len(data) {
+			end = len(data)
+		}
+		var code textencoding.CharCode
+		for _, b := range data[start:end] {
+			code = code<<8 | textencoding.CharCode(b)
+		}
+		codes = append(codes, code)
+		glyphs = append(glyphs, Glyph{Code: code, Start: start, End: end})
+	}
+	if font == nil {
+		return glyphs
+	}
+	for i, r := range font.CharcodesToUnicode(codes) {
+		if r != textencoding.MissingCodeRune {
+			glyphs[i].Text = string(r)
+		}
+	}
+	return glyphs
+}
@@ -0,0 +1,354 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// TransformAction is the action a TransformFunc takes on a content stream operation.
+type TransformAction int
+
+// Transform actions.
+const (
+	// TransformKeep keeps the operation.
+	TransformKeep TransformAction = iota
+
+	// TransformDrop removes the operation. Dropping an operation that begins a block (q, BT, BMC or
+	// BDC) removes the whole block up to and including the matching Q, ET or EMC.
+	TransformDrop
+
+	// TransformReplace replaces the operation with the operations returned by the TransformFunc.
+	// An empty replacement removes just the operation.
+	TransformReplace
+)
+
+// TransformContext is the state in which a TransformFunc is called for an operation.
+type TransformContext struct {
+	// GraphicsState is the graphics state after the operation has been processed. It reflects the
+	// original content stream, not the transformed one.
+	GraphicsState GraphicsState
+	Resources     *model.PdfPageResources
+
+	// InText is true for operations inside a text object (between BT and ET), including BT and ET.
+	InText bool
+
+	// MarkedContent is the stack of marked-content sequences the operation is in, outermost first.
+	// It includes the sequence begun or ended by BMC, BDC or EMC operations.
+	MarkedContent []MarkedContent
+
+	// Visible is false if the operation is optional content that is hidden according to the
+	// OCG visibility set by SetOCGVisibility.
+	Visible bool
+}
+
+// TransformFunc decides what to do with content stream operation `op`. `ops` is the replacement
+// for TransformReplace and is ignored otherwise.
+type TransformFunc func(op *ContentStreamOperation, ctx TransformContext) (action TransformAction,
+	ops []*ContentStreamOperation, err error)
+
+// Transformer rewrites content streams by applying TransformFuncs to their operations.
+type Transformer struct {
+	funcs   []TransformFunc
+	visible OCGVisibility
+}
+
+// NewTransformer returns a Transformer that applies `funcs` to each operation in order. The first
+// function that doesn't keep an operation decides its fate. Replacement operations are not passed
+// to the functions.
+func NewTransformer(funcs ...TransformFunc) *Transformer {
+	return &Transformer{funcs: funcs}
+}
+
+// SetOCGVisibility sets the visibility of optional content groups that determines
+// TransformContext.Visible. All groups are visible by default.
+func (t *Transformer) SetOCGVisibility(visible OCGVisibility) *Transformer {
+	t.visible = visible
+	return t
+}
+
+// Transform applies the transform functions of `t` to the operations of content stream `contents`
+// with resources `resources` and returns the operations that are kept.
+func (t *Transformer) Transform(contents string, resources *model.PdfPageResources) (
+	*ContentStreamOperations, error) {
+	ops, err := NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out      ContentStreamOperations
+		inText   bool
+		skipping string // Operand that began the block being dropped. Empty when not dropping.
+		depth    int    // Nesting depth of the block being dropped.
+	)
+	proc := NewContentStreamProcessor(*ops)
+	proc.SetOptions(ProcessorOptions{OCGVisible: t.visible})
+	proc.AddHandler(HandlerConditionEnumAllOperands, "",
+		func(op *ContentStreamOperation, gs GraphicsState, resources *model.PdfPageResources) error {
+			ctx := TransformContext{GraphicsState: gs, Resources: resources, InText: inText || op.Operand == "BT",
+				MarkedContent: proc.MarkedContent(), Visible: proc.Visible()}
+			switch op.Operand {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+			}
+
+			if skipping != "" {
+				if blockBegins(skipping, op.Operand) {
+					depth++
+				} else if blockEnds(skipping, op.Operand) {
+					depth--
+					if depth == 0 {
+						skipping = ""
+					}
+				}
+				return nil
+			}
+
+			action, replacement, err := t.apply(op, ctx)
+			if err != nil {
+				return err
+			}
+			switch action {
+			case TransformDrop:
+				if blockBegins(op.Operand, op.Operand) {
+					skipping, depth = op.Operand, 1
+				}
+			case TransformReplace:
+				out = append(out, replacement...)
+			default:
+				out = append(out, op)
+			}
+			return nil
+		})
+	if err := proc.Process(resources); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// apply returns the action of the first transform function that doesn't keep `op`.
+func (t *Transformer) apply(op *ContentStreamOperation, ctx TransformContext) (TransformAction,
+	[]*ContentStreamOperation, error) {
+	for _, f := range t.funcs {
+		action, ops, err := f(op, ctx)
+		if err != nil {
+			return TransformKeep, nil, err
+		}
+		if action != TransformKeep {
+			return action, ops, nil
+		}
+	}
+	return TransformKeep, nil, nil
+}
+
+// TransformPage applies the transform functions of `t` to the content streams of `page` and
+// replaces them with a single content stream encoded with `encoder`. The page's resources are
+// replaced by a new resources dictionary without the resources that are no longer used. The
+// original resources are not modified as they may be shared with other pages.
+func (t *Transformer) TransformPage(page *model.PdfPage, encoder core.StreamEncoder) error {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return err
+	}
+	ops, err := t.Transform(contents, page.Resources)
+	if err != nil {
+		return err
+	}
+	if err := page.SetContentStreams([]string{ops.String()}, encoder); err != nil {
+		return err
+	}
+	if page.Resources != nil {
+		page.Resources = PruneResources(ops, page.Resources)
+	}
+	return nil
+}
+
+// PruneResources returns a new resources object holding only the entries of `resources` that are
+// referenced by `ops`. The resource objects themselves are shared with `resources`.
+func PruneResources(ops *ContentStreamOperations, resources *model.PdfPageResources) *model.PdfPageResources {
+	used := map[string]map[core.PdfObjectName]struct{}{}
+	use := func(category string, obj core.PdfObject) {
+		name, ok := core.GetName(obj)
+		if !ok {
+			return
+		}
+		if used[category] == nil {
+			used[category] = map[core.PdfObjectName]struct{}{}
+		}
+		used[category][*name] = struct{}{}
+	}
+	for _, op := range *ops {
+		if len(op.Params) == 0 {
+			continue
+		}
+		last := op.Params[len(op.Params)-1]
+		switch op.Operand {
+		case "Tf":
+			use("Font", op.Params[0])
+		case "Do":
+			use("XObject", op.Params[0])
+		case "gs":
+			use("ExtGState", op.Params[0])
+		case "cs", "CS":
+			use("ColorSpace", op.Params[0])
+		case "scn", "SCN":
+			use("Pattern", last)
+		case "sh":
+			use("Shading", op.Params[0])
+		case "BDC", "DP":
+			use("Properties", last)
+		case "BI":
+			if img, ok := op.Params[0].(*ContentStreamInlineImage); ok {
+				use("ColorSpace", img.ColorSpace)
+			}
+		}
+	}
+
+	pruned := model.NewPdfPageResources()
+	prune := func(category string, obj core.PdfObject) core.PdfObject {
+		dict, ok := core.GetDict(obj)
+		if !ok || len(used[category]) == 0 {
+			return nil
+		}
+		kept := core.MakeDict()
+		for _, name := range dict.Keys() {
+			if _, ok := used[category][name]; ok {
+				kept.Set(name, dict.Get(name))
+			}
+		}
+		if len(kept.Keys()) == 0 {
+			return nil
+		}
+		common.Log.Trace("Pruned %s resources: %d -> %d", category, len(dict.Keys()), len(kept.Keys()))
+		return kept
+	}
+	pruned.ExtGState = prune("ExtGState", resources.ExtGState)
+	pruned.ColorSpace = prune("ColorSpace", resources.ColorSpace)
+	pruned.Pattern = prune("Pattern", resources.Pattern)
+	pruned.Shading = prune("Shading", resources.Shading)
+	pruned.XObject = prune("XObject", resources.XObject)
+	pruned.Font = prune("Font", resources.Font)
+	pruned.Properties = prune("Properties", resources.Properties)
+	pruned.ProcSet = resources.ProcSet
+	return pruned
+}
+
+// blockBegins returns true if operand `operand` begins a block of the same kind as the block begun
+// by operand `begin`.
+func blockBegins(begin, operand string) bool {
+	switch begin {
+	case "q", "BT":
+		return operand == begin
+	case "BMC", "BDC":
+		return operand == "BMC" || operand == "BDC"
+	}
+	return false
+}
+
+// blockEnds returns true if operand `operand` ends a block begun by operand `begin`.
+func blockEnds(begin, operand string) bool {
+	switch begin {
+	case "q":
+		return operand == "Q"
+	case "BT":
+		return operand == "ET"
+	case "BMC", "BDC":
+		return operand == "EMC"
+	}
+	return false
+}
+
+// DropImages returns a TransformFunc that drops image XObjects and inline images.
+func DropImages() TransformFunc {
+	return func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		switch op.Operand {
+		case "BI":
+			return TransformDrop, nil, nil
+		case "Do":
+			if ctx.Resources == nil || len(op.Params) == 0 {
+				break
+			}
+			name, ok := core.GetName(op.Params[0])
+			if !ok {
+				break
+			}
+			if _, xtype := ctx.Resources.GetXObjectByName(*name); xtype == model.XObjectTypeImage {
+				return TransformDrop, nil, nil
+			}
+		}
+		return TransformKeep, nil, nil
+	}
+}
+
+// DropTextWithFont returns a TransformFunc that drops text shown with the font with base font name
+// `baseFont`. Subset prefixes (e.g. "ABCDEF+") of font names are ignored. The text positioning
+// effects of the ' and " operators are kept.
+func DropTextWithFont(baseFont string) TransformFunc {
+	return func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		switch op.Operand {
+		case "Tj", "TJ", "'", `"`:
+		default:
+			return TransformKeep, nil, nil
+		}
+		font := ctx.GraphicsState.Text.Font
+		if font == nil || stripSubsetPrefix(font.BaseFont()) != stripSubsetPrefix(baseFont) {
+			return TransformKeep, nil, nil
+		}
+		var ops []*ContentStreamOperation
+		if op.Operand == `"` && len(op.Params) == 3 {
+			ops = append(ops,
+				&ContentStreamOperation{Operand: "Tw", Params: op.Params[:1]},
+				&ContentStreamOperation{Operand: "Tc", Params: op.Params[1:2]})
+		}
+		if op.Operand == "'" || op.Operand == `"` {
+			ops = append(ops, &ContentStreamOperation{Operand: "T*"})
+		}
+		return TransformReplace, ops, nil
+	}
+}
+
+// DropWatermarks returns a TransformFunc that drops watermark artifacts: marked-content sequences
+// tagged Artifact with a property list of subtype Watermark (14.8.2.2.2).
+func DropWatermarks() TransformFunc {
+	return func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		if op.Operand != "BDC" || len(ctx.MarkedContent) == 0 {
+			return TransformKeep, nil, nil
+		}
+		mc := ctx.MarkedContent[len(ctx.MarkedContent)-1]
+		if mc.Tag != "Artifact" || mc.Properties == nil {
+			return TransformKeep, nil, nil
+		}
+		if subtype, ok := core.GetName(mc.Properties.Get("Subtype")); ok && *subtype == "Watermark" {
+			return TransformDrop, nil, nil
+		}
+		return TransformKeep, nil, nil
+	}
+}
+
+// DropHiddenContent returns a TransformFunc that drops optional content that isn't visible: the
+// marked-content sequences of hidden optional content groups and XObjects that are hidden. Use it
+// with SetOCGVisibility to delete layers.
+func DropHiddenContent() TransformFunc {
+	return func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		if !ctx.Visible && (op.Operand == "BDC" || op.Operand == "Do") {
+			return TransformDrop, nil, nil
+		}
+		return TransformKeep, nil, nil
+	}
+}
+
+// stripSubsetPrefix returns font name `name` without a subset prefix such as "ABCDEF+".
+func stripSubsetPrefix(name string) string {
+	if len(name) > 7 && name[6] == '+' {
+		return name[7:]
+	}
+	return name
+}
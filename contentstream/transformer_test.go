@@ -0,0 +1,170 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// newTransformResources returns resources with fonts F1 (Helvetica) and F2 (Courier), image
+// XObject Im1, form XObject Fm1, ExtGState GS1 and property list MC0 for a watermark artifact.
+func newTransformResources(t *testing.T) *model.PdfPageResources {
+	resources := model.NewPdfPageResources()
+	for name, basefont := range map[core.PdfObjectName]model.StdFontName{
+		"F1": model.HelveticaName,
+		"F2": model.CourierName,
+	} {
+		font, err := model.NewStandard14Font(basefont)
+		require.NoError(t, err)
+		require.NoError(t, resources.SetFontByName(name, font.ToPdfObject()))
+	}
+	img, err := core.MakeStream([]byte{0}, nil)
+	require.NoError(t, err)
+	img.Set("Subtype", core.MakeName("Image"))
+	require.NoError(t, resources.SetXObjectByName("Im1", img))
+	require.NoError(t, resources.SetXObjectFormByName("Fm1", newTestForm(t, "0 0 m", nil)))
+	require.NoError(t, resources.AddExtGState("GS1", core.MakeDict()))
+	props := core.MakeDict()
+	props.Set("Type", core.MakeName("Pagination"))
+	props.Set("Subtype", core.MakeName("Watermark"))
+	properties := core.MakeDict()
+	properties.Set("MC0", props)
+	resources.Properties = properties
+	return resources
+}
+
+func TestTransformer(t *testing.T) {
+	resources := newTransformResources(t)
+	contents := `q 10 0 0 10 0 0 cm /Im1 Do Q
+		/Fm1 Do
+		BI /W 1 /H 1 /BPC 8 /CS /G ID ` + "\x00" + ` EI
+		BT /F1 12 Tf (keep) Tj /F2 10 Tf (drop) Tj (line) ' 1 2 (quote) " ET
+		/Artifact /MC0 BDC q /GS1 gs BT /F1 48 Tf (DRAFT) Tj ET Q EMC`
+
+	testcases := []struct {
+		funcs    []TransformFunc
+		expected string
+	}{
+		{nil, `q 10 0 0 10 0 0 cm /Im1 Do Q
+			/Fm1 Do
+			BI /W 1 /H 1 /BPC 8 /CS /G ID ` + "\x00" + ` EI
+			BT /F1 12 Tf (keep) Tj /F2 10 Tf (drop) Tj (line) ' 1 2 (quote) " ET
+			/Artifact /MC0 BDC q /GS1 gs BT /F1 48 Tf (DRAFT) Tj ET Q EMC`},
+		{[]TransformFunc{DropImages()}, `q 10 0 0 10 0 0 cm Q
+			/Fm1 Do
+			BT /F1 12 Tf (keep) Tj /F2 10 Tf (drop) Tj (line) ' 1 2 (quote) " ET
+			/Artifact /MC0 BDC q /GS1 gs BT /F1 48 Tf (DRAFT) Tj ET Q EMC`},
+		{[]TransformFunc{DropTextWithFont("Courier")}, `q 10 0 0 10 0 0 cm /Im1 Do Q
+			/Fm1 Do
+			BI /W 1 /H 1 /BPC 8 /CS /G ID ` + "\x00" + ` EI
+			BT /F1 12 Tf (keep) Tj /F2 10 Tf T* 1 Tw 2 Tc T* ET
+			/Artifact /MC0 BDC q /GS1 gs BT /F1 48 Tf (DRAFT) Tj ET Q EMC`},
+		{[]TransformFunc{DropWatermarks(), DropImages()}, `q 10 0 0 10 0 0 cm Q
+			/Fm1 Do
+			BT /F1 12 Tf (keep) Tj /F2 10 Tf (drop) Tj (line) ' 1 2 (quote) " ET`},
+	}
+	for i, tc := range testcases {
+		ops, err := NewTransformer(tc.funcs...).Transform(contents, resources)
+		require.NoError(t, err, "case %d", i)
+		expected, err := NewContentStreamParser(tc.expected).Parse()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), ops.String(), "case %d", i)
+	}
+}
+
+func TestTransformerContext(t *testing.T) {
+	var contexts []TransformContext
+	record := func(op *ContentStreamOperation, ctx TransformContext) (TransformAction, []*ContentStreamOperation, error) {
+		contexts = append(contexts, ctx)
+		if op.Operand == "re" {
+			replacement := &ContentStreamOperation{Operand: "re", Params: makeParamsFromFloats([]float64{1, 2, 3, 4})}
+			return TransformReplace, []*ContentStreamOperation{replacement}, nil
+		}
+		return TransformKeep, nil, nil
+	}
+
+	ops, err := NewTransformer(record).Transform(`/Span <</ActualText (x)>> BDC BT /F1 12 Tf ET EMC
+		2 0 0 2 0 0 cm 0 0 10 10 re f`, newTransformResources(t))
+	require.NoError(t, err)
+	require.Len(t, contexts, 8)
+	assert.Equal(t, "/Span <</ActualText (x)>> BDC\nBT\n/F1 12 Tf\nET\nEMC\n2 0 0 2 0 0 cm\n1 2 3 4 re\nf\n",
+		ops.String())
+
+	for i, inText := range []bool{false, true, true, true, false} {
+		assert.Equal(t, inText, contexts[i].InText, "op %d", i)
+		require.Len(t, contexts[i].MarkedContent, 1)
+		assert.Equal(t, core.PdfObjectName("Span"), contexts[i].MarkedContent[0].Tag)
+	}
+	assert.Equal(t, "Helvetica", contexts[2].GraphicsState.Text.Font.BaseFont())
+	assert.Empty(t, contexts[5].MarkedContent)
+	x, y := contexts[6].GraphicsState.Transform(1, 1)
+	assert.Equal(t, []float64{2, 2}, []float64{x, y})
+}
+
+func TestTransformPage(t *testing.T) {
+	page := model.NewPdfPage()
+	resources := newTransformResources(t)
+	page.Resources = resources
+	require.NoError(t, page.SetContentStreams([]string{
+		"q /GS1 gs /Im1 Do Q",
+		"BT /F1 12 Tf (text) Tj ET /Fm1 Do",
+	}, nil))
+
+	require.NoError(t, NewTransformer(DropImages()).TransformPage(page, core.NewFlateEncoder()))
+	contents, err := page.GetAllContentStreams()
+	require.NoError(t, err)
+	assert.Equal(t, "q\n/GS1 gs\nQ\nBT\n/F1 12 Tf\n(text) Tj\nET\n/Fm1 Do\n", contents)
+
+	// The resources are pruned into a new object.
+	require.NotEqual(t, resources, page.Resources)
+	fonts, ok := core.GetDict(page.Resources.Font)
+	require.True(t, ok)
+	assert.Equal(t, []core.PdfObjectName{"F1"}, fonts.Keys())
+	xobjs, ok := core.GetDict(page.Resources.XObject)
+	require.True(t, ok)
+	assert.Equal(t, []core.PdfObjectName{"Fm1"}, xobjs.Keys())
+	_, ok = page.Resources.GetExtGState("GS1")
+	assert.True(t, ok)
+	assert.Nil(t, page.Resources.Properties)
+
+	// The original resources are untouched.
+	fonts, _ = core.GetDict(resources.Font)
+	assert.Len(t, fonts.Keys(), 2)
+	assert.True(t, resources.HasXObjectByName("Im1"))
+
+	// Marked content points use their property lists too.
+	ops, err := NewContentStreamParser("/Artifact /MC0 DP").Parse()
+	require.NoError(t, err)
+	properties, ok := core.GetDict(PruneResources(ops, resources).Properties)
+	require.True(t, ok)
+	assert.Equal(t, []core.PdfObjectName{"MC0"}, properties.Keys())
+}
+
+func TestTransformerDropHiddenContent(t *testing.T) {
+	resources := newTransformResources(t)
+	ocg := newTestOCG("Notes")
+	properties, _ := core.GetDict(resources.Properties)
+	properties.Set("OC0", ocg)
+	form, err := resources.GetXObjectFormByName("Fm1")
+	require.NoError(t, err)
+	form.OC = ocg
+	require.NoError(t, resources.SetXObjectFormByName("Fm1", form))
+
+	contents := "/OC /OC0 BDC 0 0 m q Q EMC /Fm1 Do /Im1 Do"
+	ops, err := NewTransformer(DropHiddenContent()).Transform(contents, resources)
+	require.NoError(t, err)
+	assert.Equal(t, "/OC /OC0 BDC\n0 0 m\nq\nQ\nEMC\n/Fm1 Do\n/Im1 Do\n", ops.String())
+
+	ops, err = NewTransformer(DropHiddenContent()).SetOCGVisibility(OCGsHidden("Notes")).Transform(contents, resources)
+	require.NoError(t, err)
+	assert.Equal(t, "/Im1 Do\n", ops.String())
+}
@@ -0,0 +1,515 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"fmt"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// ValidationIssue is a problem found in a content stream by Validate.
+type ValidationIssue struct {
+	// Index is the index of the operation with the problem or the number of operations for
+	// problems found at the end of the content stream, such as unbalanced q/Q.
+	Index int
+	// Operation is the operation with the problem. nil for problems at the end of the stream.
+	Operation *ContentStreamOperation
+	Message   string
+}
+
+// String returns a description of `issue` for logging.
+func (issue ValidationIssue) String() string {
+	if issue.Operation == nil {
+		return fmt.Sprintf("end of stream: %s", issue.Message)
+	}
+	return fmt.Sprintf("operation %d (%s): %s", issue.Index, issue.Operation.Operand, issue.Message)
+}
+
+// operatorCategory is the category of a content stream operator (Table 51).
+type operatorCategory int
+
+const (
+	categoryGeneralState operatorCategory = iota
+	categorySpecialState
+	categoryPathConstruction
+	categoryPathPainting
+	categoryClipping
+	categoryTextObject
+	categoryTextState
+	categoryTextPositioning
+	categoryTextShowing
+	categoryType3Font
+	categoryColor
+	categoryShading
+	categoryInlineImage
+	categoryXObject
+	categoryMarkedContent
+	categoryCompatibility
+)
+
+// operandKind is the type of an operand of a content stream operator.
+type operandKind int
+
+const (
+	operandNumber operandKind = iota
+	operandName
+	operandString
+	operandArray
+	operandDict
+	operandNameOrDict
+)
+
+// String returns the name of the operand type for messages.
+func (kind operandKind) String() string {
+	switch kind {
+	case operandNumber:
+		return "number"
+	case operandName:
+		return "name"
+	case operandString:
+		return "string"
+	case operandArray:
+		return "array"
+	case operandDict:
+		return "dictionary"
+	}
+	return "name or dictionary"
+}
+
+// operatorSpec describes the operands and category of a content stream operator.
+type operatorSpec struct {
+	category operatorCategory
+	// operands are the types of the operands. The operands of sc, SC, scn and SCN depend on the
+	// color space and are checked separately.
+	operands []operandKind
+}
+
+// Shorthands for the operand lists of operatorSpecs.
+var (
+	noOperands   = []operandKind{}
+	oneNumber    = []operandKind{operandNumber}
+	twoNumbers   = []operandKind{operandNumber, operandNumber}
+	threeNumbers = []operandKind{operandNumber, operandNumber, operandNumber}
+	fourNumbers  = []operandKind{operandNumber, operandNumber, operandNumber, operandNumber}
+	sixNumbers   = []operandKind{operandNumber, operandNumber, operandNumber, operandNumber, operandNumber,
+		operandNumber}
+	oneName = []operandKind{operandName}
+)
+
+// operatorSpecs holds the operators of Table A.1 PDF32000_2008.
+var operatorSpecs = map[string]operatorSpec{
+	"w":   {categoryGeneralState, oneNumber},
+	"J":   {categoryGeneralState, oneNumber},
+	"j":   {categoryGeneralState, oneNumber},
+	"M":   {categoryGeneralState, oneNumber},
+	"d":   {categoryGeneralState, []operandKind{operandArray, operandNumber}},
+	"ri":  {categoryGeneralState, oneName},
+	"i":   {categoryGeneralState, oneNumber},
+	"gs":  {categoryGeneralState, oneName},
+	"q":   {categorySpecialState, noOperands},
+	"Q":   {categorySpecialState, noOperands},
+	"cm":  {categorySpecialState, sixNumbers},
+	"m":   {categoryPathConstruction, twoNumbers},
+	"l":   {categoryPathConstruction, twoNumbers},
+	"c":   {categoryPathConstruction, sixNumbers},
+	"v":   {categoryPathConstruction, fourNumbers},
+	"y":   {categoryPathConstruction, fourNumbers},
+	"h":   {categoryPathConstruction, noOperands},
+	"re":  {categoryPathConstruction, fourNumbers},
+	"S":   {categoryPathPainting, noOperands},
+	"s":   {categoryPathPainting, noOperands},
+	"f":   {categoryPathPainting, noOperands},
+	"F":   {categoryPathPainting, noOperands},
+	"f*":  {categoryPathPainting, noOperands},
+	"B":   {categoryPathPainting, noOperands},
+	"B*":  {categoryPathPainting, noOperands},
+	"b":   {categoryPathPainting, noOperands},
+	"b*":  {categoryPathPainting, noOperands},
+	"n":   {categoryPathPainting, noOperands},
+	"W":   {categoryClipping, noOperands},
+	"W*":  {categoryClipping, noOperands},
+	"BT":  {categoryTextObject, noOperands},
+	"ET":  {categoryTextObject, noOperands},
+	"Tc":  {categoryTextState, oneNumber},
+	"Tw":  {categoryTextState, oneNumber},
+	"Tz":  {categoryTextState, oneNumber},
+	"TL":  {categoryTextState, oneNumber},
+	"Tf":  {categoryTextState, []operandKind{operandName, operandNumber}},
+	"Tr":  {categoryTextState, oneNumber},
+	"Ts":  {categoryTextState, oneNumber},
+	"Td":  {categoryTextPositioning, twoNumbers},
+	"TD":  {categoryTextPositioning, twoNumbers},
+	"Tm":  {categoryTextPositioning, sixNumbers},
+	"T*":  {categoryTextPositioning, noOperands},
+	"Tj":  {categoryTextShowing, []operandKind{operandString}},
+	"TJ":  {categoryTextShowing, []operandKind{operandArray}},
+	"'":   {categoryTextShowing, []operandKind{operandString}},
+	"\"":  {categoryTextShowing, []operandKind{operandNumber, operandNumber, operandString}},
+	"d0":  {categoryType3Font, twoNumbers},
+	"d1":  {categoryType3Font, sixNumbers},
+	"CS":  {categoryColor, oneName},
+	"cs":  {categoryColor, oneName},
+	"SC":  {categoryColor, nil},
+	"sc":  {categoryColor, nil},
+	"SCN": {categoryColor, nil},
+	"scn": {categoryColor, nil},
+	"G":   {categoryColor, oneNumber},
+	"g":   {categoryColor, oneNumber},
+	"RG":  {categoryColor, threeNumbers},
+	"rg":  {categoryColor, threeNumbers},
+	"K":   {categoryColor, fourNumbers},
+	"k":   {categoryColor, fourNumbers},
+	"sh":  {categoryShading, oneName},
+	"BI":  {categoryInlineImage, nil},
+	"Do":  {categoryXObject, oneName},
+	"MP":  {categoryMarkedContent, oneName},
+	"DP":  {categoryMarkedContent, []operandKind{operandName, operandNameOrDict}},
+	"BMC": {categoryMarkedContent, oneName},
+	"BDC": {categoryMarkedContent, []operandKind{operandName, operandNameOrDict}},
+	"EMC": {categoryMarkedContent, noOperands},
+	"BX":  {categoryCompatibility, noOperands},
+	"EX":  {categoryCompatibility, noOperands},
+}
+
+// validator holds the state of the validation of a content stream.
+type validator struct {
+	resources *model.PdfPageResources
+	issues    []ValidationIssue
+
+	index int
+	op    *ContentStreamOperation
+
+	qDepth        int
+	inText        bool
+	inPath        bool
+	clipping      bool // A clipping operator was applied to the current path.
+	markedContent int
+	compatibility int // Depth of BX/EX sections in which unknown operators are allowed.
+}
+
+// Validate checks the content stream operations `ops` and returns the problems found, in the order
+// of the operations. It reports unbalanced q/Q, BT/ET, BMC/BDC/EMC and BX/EX pairs, operators
+// with the wrong number or types of operands, operators used where they aren't allowed (8.2,
+// Figure 9), such as path construction in a text object or text showing outside of one, and
+// unknown operators outside of BX/EX compatibility sections. Unless `resources` is nil, it also
+// reports names of fonts, XObjects, graphics states, color spaces, shadings, patterns and property
+// lists that aren't defined in `resources`.
+// Only `ops` are checked, not the content streams of the forms and patterns they draw.
+func (ops *ContentStreamOperations) Validate(resources *model.PdfPageResources) []ValidationIssue {
+	v := validator{resources: resources}
+	for i, op := range *ops {
+		if op == nil {
+			continue
+		}
+		v.index = i
+		v.op = op
+		v.validate()
+	}
+
+	v.index = len(*ops)
+	v.op = nil
+	if v.inPath {
+		v.report("path not painted")
+	}
+	if v.inText {
+		v.report("BT without matching ET")
+	}
+	if v.qDepth > 0 {
+		v.report("%d q without matching Q", v.qDepth)
+	}
+	if v.markedContent > 0 {
+		v.report("%d BMC/BDC without matching EMC", v.markedContent)
+	}
+	if v.compatibility > 0 {
+		v.report("%d BX without matching EX", v.compatibility)
+	}
+	return v.issues
+}
+
+// ValidatePage validates the content streams of `page` against its resources as Validate does.
+func ValidatePage(page *model.PdfPage) ([]ValidationIssue, error) {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return nil, err
+	}
+	ops, err := NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return ops.Validate(page.Resources), nil
+}
+
+// report records a problem with the current operation.
+func (v *validator) report(format string, args ...interface{}) {
+	v.issues = append(v.issues, ValidationIssue{
+		Index:     v.index,
+		Operation: v.op,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// validate checks the current operation.
+func (v *validator) validate() {
+	op := v.op
+	spec, ok := operatorSpecs[op.Operand]
+	if !ok {
+		if v.compatibility == 0 {
+			v.report("unknown operator")
+		}
+		return
+	}
+	v.checkOperands(spec)
+	v.checkContext(spec.category)
+	v.checkResources()
+}
+
+// checkOperands checks the number and types of the operands of the current operation.
+func (v *validator) checkOperands(spec operatorSpec) {
+	params := v.op.Params
+	switch v.op.Operand {
+	case "BI":
+		if _, ok := inlineImageParam(v.op); !ok {
+			v.report("inline image without data")
+		}
+		return
+	case "SC", "sc":
+		if len(params) == 0 || len(params) > 4 {
+			v.report("%d operands, expected 1 to 4", len(params))
+		}
+		v.checkOperandKinds(params, operandNumber)
+		return
+	case "SCN", "scn":
+		if len(params) == 0 {
+			v.report("no operands")
+			return
+		}
+		// The last operand is the name of a pattern for Pattern color spaces.
+		if _, ok := params[len(params)-1].(*core.PdfObjectName); ok {
+			params = params[:len(params)-1]
+		}
+		if len(params) > 32 {
+			v.report("%d color components", len(params))
+		}
+		v.checkOperandKinds(params, operandNumber)
+		return
+	}
+
+	if len(params) != len(spec.operands) {
+		v.report("%d operands, expected %d", len(params), len(spec.operands))
+		return
+	}
+	for i, param := range params {
+		if !isOperandKind(param, spec.operands[i]) {
+			v.report("operand %d is %s, expected %s", i+1, param.WriteString(), spec.operands[i])
+		}
+	}
+}
+
+// checkOperandKinds checks that `params` are all of type `kind`.
+func (v *validator) checkOperandKinds(params []core.PdfObject, kind operandKind) {
+	for i, param := range params {
+		if !isOperandKind(param, kind) {
+			v.report("operand %d is %s, expected %s", i+1, param.WriteString(), kind)
+		}
+	}
+}
+
+// isOperandKind returns true if `obj` is an operand of type `kind`.
+func isOperandKind(obj core.PdfObject, kind operandKind) bool {
+	switch obj.(type) {
+	case *core.PdfObjectInteger, *core.PdfObjectFloat:
+		return kind == operandNumber
+	case *core.PdfObjectName:
+		return kind == operandName || kind == operandNameOrDict
+	case *core.PdfObjectString:
+		return kind == operandString
+	case *core.PdfObjectArray:
+		return kind == operandArray
+	case *core.PdfObjectDictionary:
+		return kind == operandDict || kind == operandNameOrDict
+	}
+	return false
+}
+
+// checkContext checks that the current operation, of category `category`, is allowed where it
+// is used and updates the q/Q, text object, path object and marked-content state.
+func (v *validator) checkContext(category operatorCategory) {
+	operand := v.op.Operand
+
+	// Path objects consist of path construction operators, optionally a clipping operator and
+	// end with a path painting operator.
+	if v.inPath {
+		switch category {
+		case categoryPathConstruction:
+			if v.clipping {
+				v.report("path construction after clipping operator")
+			}
+			return
+		case categoryClipping:
+			v.clipping = true
+			return
+		case categoryPathPainting:
+			v.inPath = false
+			v.clipping = false
+			return
+		}
+		v.report("path not painted before %s", operand)
+		v.inPath = false
+		v.clipping = false
+	}
+
+	switch category {
+	case categoryPathConstruction:
+		if v.inText {
+			v.report("path construction in text object")
+		}
+		if operand != "m" && operand != "re" {
+			v.report("no current point")
+		}
+		v.inPath = true
+	case categoryClipping, categoryPathPainting:
+		v.report("no current path")
+	case categorySpecialState:
+		if v.inText {
+			v.report("%s in text object", operand)
+		}
+		switch operand {
+		case "q":
+			v.qDepth++
+		case "Q":
+			if v.qDepth == 0 {
+				v.report("Q without matching q")
+			} else {
+				v.qDepth--
+			}
+		}
+	case categoryTextObject:
+		if operand == "BT" {
+			if v.inText {
+				v.report("nested BT")
+			}
+			v.inText = true
+		} else {
+			if !v.inText {
+				v.report("ET without matching BT")
+			}
+			v.inText = false
+		}
+	case categoryTextPositioning, categoryTextShowing:
+		if !v.inText {
+			v.report("%s outside of text object", operand)
+		}
+	case categoryShading, categoryInlineImage, categoryXObject:
+		if v.inText {
+			v.report("%s in text object", operand)
+		}
+	case categoryType3Font:
+		if v.index != 0 {
+			v.report("%s is not the first operation of a glyph description", operand)
+		}
+	case categoryMarkedContent:
+		switch operand {
+		case "BMC", "BDC":
+			v.markedContent++
+		case "EMC":
+			if v.markedContent == 0 {
+				v.report("EMC without matching BMC or BDC")
+			} else {
+				v.markedContent--
+			}
+		}
+	case categoryCompatibility:
+		if operand == "BX" {
+			v.compatibility++
+		} else if v.compatibility == 0 {
+			v.report("EX without matching BX")
+		} else {
+			v.compatibility--
+		}
+	}
+}
+
+// checkResources checks that the resources named by the current operation are defined.
+func (v *validator) checkResources() {
+	if v.resources == nil {
+		return
+	}
+	params := v.op.Params
+	name := func(i int) (core.PdfObjectName, bool) {
+		if i >= len(params) {
+			return "", false
+		}
+		n, ok := params[i].(*core.PdfObjectName)
+		if !ok {
+			return "", false
+		}
+		return *n, true
+	}
+
+	switch v.op.Operand {
+	case "Tf":
+		if n, ok := name(0); ok && !v.resources.HasFontByName(n) {
+			v.report("undefined font %s", n)
+		}
+	case "Do":
+		if n, ok := name(0); ok && !v.resources.HasXObjectByName(n) {
+			v.report("undefined XObject %s", n)
+		}
+	case "gs":
+		if n, ok := name(0); ok {
+			if _, has := v.resources.GetExtGState(n); !has {
+				v.report("undefined graphics state %s", n)
+			}
+		}
+	case "CS", "cs":
+		if n, ok := name(0); ok && !isDeviceColorspace(n) && n != "Pattern" &&
+			!v.resources.HasColorspaceByName(n) {
+			v.report("undefined color space %s", n)
+		}
+	case "sh":
+		if n, ok := name(0); ok {
+			if _, has := v.resources.GetShadingByName(n); !has {
+				v.report("undefined shading %s", n)
+			}
+		}
+	case "SCN", "scn":
+		if n, ok := name(len(params) - 1); ok {
+			if _, has := v.resources.GetPatternByName(n); !has {
+				v.report("undefined pattern %s", n)
+			}
+		}
+	case "BDC", "DP":
+		if n, ok := name(1); ok {
+			if _, has := v.resources.GetPropertiesByName(n); !has {
+				v.report("undefined property list %s", n)
+			}
+		}
+	case "BI":
+		img, ok := inlineImageParam(v.op)
+		if !ok {
+			return
+		}
+		n, ok := img.ColorSpace.(*core.PdfObjectName)
+		if !ok {
+			return
+		}
+		switch *n {
+		case "G", "RGB", "CMYK", "I", "Indexed":
+			return
+		}
+		if !isDeviceColorspace(*n) && !v.resources.HasColorspaceByName(*n) {
+			v.report("undefined color space %s", *n)
+		}
+	}
+}
+
+// isDeviceColorspace returns true if `name` is the name of a device color space, which is not
+// defined in the resources.
+func isDeviceColorspace(name core.PdfObjectName) bool {
+	return name == "DeviceGray" || name == "DeviceRGB" || name == "DeviceCMYK"
+}
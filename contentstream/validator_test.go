@@ -0,0 +1,98 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package contentstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	resources := newTransformResources(t)
+
+	testcases := []struct {
+		contents string
+		expected []string
+	}{
+		{`q 10 0 0 10 0 0 cm /Im1 Do Q /GS1 gs
+			BT /F1 12 Tf 1 0 0 rg 10 10 Td (text) Tj [(a) -10 (b)] TJ ET
+			/Artifact /MC0 BDC 0 0 m 10 10 l 0 0 10 10 re W n EMC
+			/Pattern cs /DeviceRGB CS 1 0 0 SC
+			BX 1 2 foo EX
+			BI /W 1 /H 1 /BPC 8 /CS /G ID ` + "\x00" + ` EI`, nil},
+		{`q q Q BT ET ET EMC Q Q`, []string{
+			"operation 5 (ET): ET without matching BT",
+			"operation 6 (EMC): EMC without matching BMC or BDC",
+			"operation 8 (Q): Q without matching q",
+		}},
+		{`q BT /F1 Tf (a) 1 Td /F1 12 Tf 0 0 m 10 10 l S ET 1 2 Tj Q 0 0 m BT`, []string{
+			"operation 2 (Tf): 1 operands, expected 2",
+			"operation 3 (Td): operand 1 is (a), expected number",
+			"operation 5 (m): path construction in text object",
+			"operation 9 (Tj): 2 operands, expected 1",
+			"operation 9 (Tj): Tj outside of text object",
+			"operation 12 (BT): path not painted before BT",
+			"end of stream: BT without matching ET",
+		}},
+		{`10 10 l S f 0 0 m W 1 1 l n foo BT q`, []string{
+			"operation 0 (l): no current point",
+			"operation 2 (f): no current path",
+			"operation 5 (l): path construction after clipping operator",
+			"operation 7 (foo): unknown operator",
+			"operation 9 (q): q in text object",
+			"end of stream: BT without matching ET",
+			"end of stream: 1 q without matching Q",
+		}},
+		{`/F9 1 Tf /Im9 Do /GS9 gs /CS9 cs /Sh9 sh /P9 scn /OC /MC9 BDC EMC
+			BI /W 1 /H 1 /BPC 8 /CS /CS9 ID ` + "\x00" + ` EI`, []string{
+			"operation 0 (Tf): undefined font F9",
+			"operation 1 (Do): undefined XObject Im9",
+			"operation 2 (gs): undefined graphics state GS9",
+			"operation 3 (cs): undefined color space CS9",
+			"operation 4 (sh): undefined shading Sh9",
+			"operation 5 (scn): undefined pattern P9",
+			"operation 6 (BDC): undefined property list MC9",
+			"operation 8 (BI): undefined color space CS9",
+		}},
+	}
+
+	for _, tc := range testcases {
+		ops, err := NewContentStreamParser(tc.contents).Parse()
+		require.NoError(t, err)
+		var issues []string
+		for _, issue := range ops.Validate(resources) {
+			issues = append(issues, issue.String())
+		}
+		assert.Equal(t, tc.expected, issues, tc.contents)
+	}
+
+	// Resource names are not checked without resources.
+	ops, err := NewContentStreamParser(`BT /F9 1 Tf ET /Im9 Do`).Parse()
+	require.NoError(t, err)
+	assert.Empty(t, ops.Validate(nil))
+}
+
+func TestPrettyString(t *testing.T) {
+	ops, err := NewContentStreamParser(`q 1   0 0 1 10.50 20 cm
+		/Artifact <</Type /Pagination>> BDC BT /F1 12 Tf [(a)-10(b)]TJ ET EMC
+		BI /W 1 /H 1 /BPC 8 /CS /G ID ` + "\x00" + ` EI Q`).Parse()
+	require.NoError(t, err)
+	expected := `q
+  1 0 0 1 10.5 20 cm
+  /Artifact <</Type /Pagination>> BDC
+    BT
+      /F1 12 Tf
+      [(a) -10 (b)] TJ
+    ET
+  EMC
+  BI /BPC 8 /CS /G /H 1 /W 1 ID % 2 bytes
+  EI
+Q
+`
+	assert.Equal(t, expected, ops.PrettyString())
+}
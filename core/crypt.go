@@ -6,10 +6,13 @@
 package core
 
 import (
+	gocrypto "crypto"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/zituocn/updf/common"
@@ -28,36 +31,176 @@ type EncryptInfo struct {
 	ID0, ID1 string
 }
 
+// CryptOptions defines the crypt filters of the classes of objects of a document encrypted with
+// crypt filters (V>=4), and whether its metadata is encrypted. The zero value encrypts every
+// object with the crypt filter of the document. A document with a 128-bit RC4 crypt filter (V2)
+// is encrypted with crypt filters (V4) if the options are not zero.
+type CryptOptions struct {
+	// StreamFilter, StringFilter and EmbeddedFileFilter are the crypt filters of the streams,
+	// the strings and the embedded file streams (StmF, StrF and EFF), if not nil. The Identity
+	// crypt filter leaves them unencrypted. Other filters must have the key length of the crypt
+	// filter of the document, as they use its encryption key.
+	StreamFilter       crypto.Filter
+	StringFilter       crypto.Filter
+	EmbeddedFileFilter crypto.Filter
+
+	// UnencryptedMetadata leaves the document-level metadata stream unencrypted (EncryptMetadata
+	// false).
+	UnencryptedMetadata bool
+}
+
+// isZero returns true if the options encrypt every object with the crypt filter of the document.
+func (opts *CryptOptions) isZero() bool {
+	return opts.StreamFilter == nil && opts.StringFilter == nil && opts.EmbeddedFileFilter == nil &&
+		!opts.UnencryptedMetadata
+}
+
 // PdfCryptNewEncrypt makes the document crypt handler based on a specified crypt filter.
 func PdfCryptNewEncrypt(cf crypto.Filter, userPass, ownerPass []byte, perm security.Permissions) (*PdfCrypt, *EncryptInfo, error) {
+	return PdfCryptNewEncryptWithOptions(cf, userPass, ownerPass, perm, nil)
+}
+
+// PdfCryptNewEncryptWithOptions makes the document crypt handler based on a specified crypt
+// filter, with the crypt filters of the classes of objects defined by `opts`, which may be nil.
+func PdfCryptNewEncryptWithOptions(cf crypto.Filter, userPass, ownerPass []byte, perm security.Permissions, opts *CryptOptions) (*PdfCrypt, *EncryptInfo, error) {
+	crypter, info, err := newPdfCryptEncrypt(stdFilter, cf, stdCryptFilter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	crypter.encryptStd = security.StdEncryptDict{
+		P:               perm,
+		EncryptMetadata: opts == nil || !opts.UnencryptedMetadata,
+	}
+	if cf != nil {
+		_, R := cf.HandlerVersion()
+		if crypter.encrypt.V == 4 {
+			// RC4 crypt filters are used with revision 4 too.
+			R = 4
+		}
+		crypter.encryptStd.R = R
+	}
+	ed := crypter.newEncryptDict()
+
+	err = crypter.generateParams(userPass, ownerPass)
+	if err != nil {
+		return nil, nil, err
+	}
+	// encode parameters generated by the Standard security handler
+	encodeEncryptStd(&crypter.encryptStd, ed)
+	if crypter.encrypt.V >= 4 {
+		if err := crypter.saveCryptFilters(ed); err != nil {
+			return nil, nil, err
+		}
+	}
+	info.Encrypt = ed
+	return crypter, info, nil
+}
+
+// PdfCryptNewEncryptPubSec makes the document crypt handler of the public-key security handler
+// based on a specified crypt filter. The document is encrypted for the certificates of the
+// recipients, which are granted the permissions of their recipient. Filters with V<4 use the
+// adbe.pkcs7.s4 sub-filter, other filters the adbe.pkcs7.s5 sub-filter.
+func PdfCryptNewEncryptPubSec(cf crypto.Filter, recipients []security.Recipient) (*PdfCrypt, *EncryptInfo, error) {
+	return PdfCryptNewEncryptPubSecWithOptions(cf, recipients, nil)
+}
+
+// PdfCryptNewEncryptPubSecWithOptions makes the document crypt handler of the public-key security
+// handler like PdfCryptNewEncryptPubSec, with the crypt filters of the classes of objects defined
+// by `opts`, which may be nil.
+func PdfCryptNewEncryptPubSecWithOptions(cf crypto.Filter, recipients []security.Recipient, opts *CryptOptions) (*PdfCrypt, *EncryptInfo, error) {
+	if cf == nil {
+		return nil, nil, errors.New("crypt filter required")
+	}
+	crypter, info, err := newPdfCryptEncrypt(pubSecFilter, cf, pubSecCryptFilter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	crypter.encryptPubSec = security.PubSecEncryptDict{
+		SubFilter:       security.SubFilterPKCS7S4,
+		EncryptMetadata: opts == nil || !opts.UnencryptedMetadata,
+	}
+	if crypter.encrypt.V >= 4 {
+		crypter.encryptPubSec.SubFilter = security.SubFilterPKCS7S5
+	}
+	crypter.encrypt.SubFilter = crypter.encryptPubSec.SubFilter
+	crypter.perm = security.PermOwner
+
+	ekey, err := crypter.pubSecHandler().GenerateParams(&crypter.encryptPubSec, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	crypter.encryptionKey = ekey
+
+	ed := crypter.newEncryptDict()
+	if crypter.encrypt.V >= 4 {
+		if err := crypter.saveCryptFilters(ed); err != nil {
+			return nil, nil, err
+		}
+	}
+	// encode parameters generated by the public-key security handler
+	encodeEncryptPubSec(&crypter.encryptPubSec, ed)
+	info.Encrypt = ed
+	return crypter, info, nil
+}
+
+// newPdfCryptEncrypt makes a document crypt handler for security handler `filter` with crypt
+// filter `cf`, named `cfName` for V>=4, and the encryption information without the Encrypt
+// dictionary. The options `opts`, which may be nil, require V>=4 unless zero, which 128-bit RC4
+// crypt filters are upgraded to. The other crypt filters of the options are named by their
+// methods.
+func newPdfCryptEncrypt(filter string, cf crypto.Filter, cfName string, opts *CryptOptions) (*PdfCrypt, *EncryptInfo, error) {
 	crypter := &PdfCrypt{
 		encryptedObjects: make(map[PdfObject]bool),
 		cryptFilters:     make(cryptFilters),
-		encryptStd: security.StdEncryptDict{
-			P:               perm,
-			EncryptMetadata: true,
-		},
 	}
+	crypter.encrypt.Filter = filter
 	var vers Version
 	if cf != nil {
 		v := cf.PDFVersion()
 		vers.Major, vers.Minor = v[0], v[1]
 
-		V, R := cf.HandlerVersion()
+		V, _ := cf.HandlerVersion()
 		crypter.encrypt.V = V
-		crypter.encryptStd.R = R
 
 		crypter.encrypt.Length = cf.KeyLength() * 8
 	}
-	const (
-		defaultFilter = stdCryptFilter
-	)
-	crypter.cryptFilters[defaultFilter] = cf
+	if opts == nil {
+		opts = &CryptOptions{}
+	}
+	if crypter.encrypt.V == 2 && cf.KeyLength() == 16 && !opts.isZero() {
+		// 128-bit RC4 with crypt filters (PDF 1.5).
+		crypter.encrypt.V = 4
+		vers.Major, vers.Minor = 1, 5
+	}
 	if crypter.encrypt.V >= 4 {
-		crypter.streamFilter = defaultFilter
-		crypter.stringFilter = defaultFilter
+		crypter.cryptFilters[cfName] = cf
+		crypter.cryptFilters["Identity"] = crypto.NewIdentity()
+		for _, f := range []struct {
+			filter crypto.Filter
+			name   *string
+		}{
+			{opts.StreamFilter, &crypter.streamFilter},
+			{opts.StringFilter, &crypter.stringFilter},
+			{opts.EmbeddedFileFilter, &crypter.embeddedFileFilter},
+		} {
+			*f.name = cfName
+			switch {
+			case f.filter == nil:
+			case f.filter.Name() == "Identity":
+				*f.name = "Identity"
+			case f.filter.KeyLength() != cf.KeyLength():
+				return nil, nil, fmt.Errorf("crypt filter %s key length (%d) differs from %s key length (%d)",
+					f.filter.Name(), f.filter.KeyLength(), cf.Name(), cf.KeyLength())
+			case f.filter.Name() != cf.Name():
+				*f.name = f.filter.Name()
+				crypter.cryptFilters[*f.name] = f.filter
+			}
+		}
+	} else if !opts.isZero() {
+		return nil, nil, errors.New("crypt filter options require crypt filters (V>=4)")
+	} else {
+		crypter.cryptFilters[stdCryptFilter] = cf
 	}
-	ed := crypter.newEncryptDict()
 
 	// Prepare the ID object for the trailer.
 	hashcode := md5.Sum([]byte(time.Now().Format(time.RFC850)))
@@ -72,21 +215,8 @@ func PdfCryptNewEncrypt(cf crypto.Filter, userPass, ownerPass []byte, perm secur
 
 	crypter.id0 = string(id0)
 
-	err := crypter.generateParams(userPass, ownerPass)
-	if err != nil {
-		return nil, nil, err
-	}
-	// encode parameters generated by the Standard security handler
-	encodeEncryptStd(&crypter.encryptStd, ed)
-	if crypter.encrypt.V >= 4 {
-		if err := crypter.saveCryptFilters(ed); err != nil {
-			return nil, nil, err
-		}
-	}
-
 	return crypter, &EncryptInfo{
 		Version: vers,
-		Encrypt: ed,
 		ID0:     id0, ID1: id1,
 	}, nil
 }
@@ -94,8 +224,12 @@ func PdfCryptNewEncrypt(cf crypto.Filter, userPass, ownerPass []byte, perm secur
 // PdfCrypt provides PDF encryption/decryption support.
 // The PDF standard supports encryption of strings and streams (Section 7.6).
 type PdfCrypt struct {
-	encrypt    encryptDict
-	encryptStd security.StdEncryptDict
+	encrypt       encryptDict
+	encryptStd    security.StdEncryptDict
+	encryptPubSec security.PubSecEncryptDict
+
+	// Permissions granted to the authenticated recipient of the public-key security handler.
+	perm security.Permissions
 
 	id0              string
 	encryptionKey    []byte
@@ -103,9 +237,17 @@ type PdfCrypt struct {
 	encryptedObjects map[PdfObject]bool
 	authenticated    bool
 	// Crypt filters (V4).
-	cryptFilters cryptFilters
-	streamFilter string
-	stringFilter string
+	cryptFilters       cryptFilters
+	streamFilter       string
+	stringFilter       string
+	embeddedFileFilter string
+
+	// Document metadata stream of a document being written.
+	metadata *PdfObjectStream
+
+	// Numbers of the embedded file streams, referenced from the EF dictionaries of the file
+	// specifications. Loaded on demand for a document being read.
+	embeddedFiles map[int64]bool
 
 	parser *PdfParser
 
@@ -126,6 +268,8 @@ func encodeEncryptStd(d *security.StdEncryptDict, ed *PdfObjectDictionary) {
 		if d.R > 5 {
 			ed.Set("Perms", MakeStringFromBytes(d.Perms))
 		}
+	} else if d.R == 4 && !d.EncryptMetadata {
+		ed.Set("EncryptMetadata", MakeBool(false))
 	}
 }
 
@@ -215,6 +359,85 @@ func decodeEncryptStd(d *security.StdEncryptDict, ed *PdfObjectDictionary) error
 	return nil
 }
 
+// encodeEncryptPubSec encodes fields of public-key security handler to an Encrypt dictionary.
+// The recipients of the adbe.pkcs7.s5 sub-filter are set in the crypt filters of the dictionary.
+func encodeEncryptPubSec(d *security.PubSecEncryptDict, ed *PdfObjectDictionary) {
+	ed.Set("SubFilter", MakeName(d.SubFilter))
+
+	recipients := MakeArray()
+	for _, r := range d.Recipients {
+		recipients.Append(MakeHexString(string(r)))
+	}
+	if d.SubFilter != security.SubFilterPKCS7S5 {
+		ed.Set("Recipients", recipients)
+		return
+	}
+	cf, ok := GetDict(ed.Get("CF"))
+	if !ok {
+		return
+	}
+	for _, name := range cf.Keys() {
+		if filter, ok := GetDict(cf.Get(name)); ok {
+			filter.Set("Recipients", recipients)
+			filter.Set("EncryptMetadata", MakeBool(d.EncryptMetadata))
+		}
+	}
+}
+
+// decodeEncryptPubSec decodes fields of public-key security handler from an Encrypt dictionary.
+// The recipients of the adbe.pkcs7.s5 sub-filter are loaded from the default crypt filter of
+// the streams, or of the strings if streams are not encrypted.
+func (crypt *PdfCrypt) decodeEncryptPubSec(ed *PdfObjectDictionary) error {
+	d := &crypt.encryptPubSec
+	d.SubFilter = crypt.encrypt.SubFilter
+	d.EncryptMetadata = true
+
+	resolve := func(obj PdfObject) PdfObject {
+		if crypt.parser != nil {
+			if o, err := crypt.parser.Resolve(obj); err == nil {
+				obj = o
+			}
+		}
+		return TraceToDirectObject(obj)
+	}
+
+	src := ed
+	if crypt.encrypt.V >= 4 {
+		name := crypt.streamFilter
+		if name == "Identity" {
+			name = crypt.stringFilter
+		}
+		cf, ok := GetDict(resolve(ed.Get("CF")))
+		if !ok {
+			return errors.New("encrypt dictionary missing CF")
+		}
+		src, ok = GetDict(resolve(cf.Get(PdfObjectName(name))))
+		if !ok {
+			return fmt.Errorf("crypt filter with recipients not specified in CF dictionary (%s)", name)
+		}
+	}
+	if em, ok := GetBoolVal(resolve(src.Get("EncryptMetadata"))); ok {
+		d.EncryptMetadata = em
+	}
+
+	recipients, ok := GetArray(resolve(src.Get("Recipients")))
+	if !ok {
+		return errors.New("encrypt dictionary missing Recipients")
+	}
+	d.Recipients = nil
+	for _, obj := range recipients.Elements() {
+		r, ok := GetString(resolve(obj))
+		if !ok {
+			return errors.New("invalid Recipients entry")
+		}
+		d.Recipients = append(d.Recipients, r.Bytes())
+	}
+	if len(d.Recipients) == 0 {
+		return errors.New("encrypt dictionary missing Recipients")
+	}
+	return nil
+}
+
 func decodeCryptFilter(cf *crypto.FilterDict, d *PdfObjectDictionary) error {
 	// If Type present, should be CryptFilter.
 	if typename, ok := d.Get("Type").(*PdfObjectName); ok {
@@ -246,7 +469,7 @@ func decodeCryptFilter(cf *crypto.FilterDict, d *PdfObjectDictionary) error {
 func (crypt *PdfCrypt) newEncryptDict() *PdfObjectDictionary {
 	// Generate the encryption dictionary.
 	ed := MakeDict()
-	ed.Set("Filter", MakeName("Standard"))
+	ed.Set("Filter", MakeName(crypt.encrypt.Filter))
 	ed.Set("V", MakeInteger(int64(crypt.encrypt.V)))
 	ed.Set("Length", MakeInteger(int64(crypt.encrypt.Length)))
 	return ed
@@ -300,6 +523,15 @@ type encryptDict struct {
 // stdCryptFilter is a default name for a standard crypt filter.
 const stdCryptFilter = "StdCF"
 
+// pubSecCryptFilter is a default name for a crypt filter of the public-key security handler.
+const pubSecCryptFilter = "DefaultCryptFilter"
+
+// Names of the supported security handlers.
+const (
+	stdFilter    = "Standard"
+	pubSecFilter = "Adobe.PubSec"
+)
+
 func newCryptFiltersV2(length int) cryptFilters {
 	return cryptFilters{
 		stdCryptFilter: crypto.NewFilterV2(length),
@@ -383,6 +615,15 @@ func (crypt *PdfCrypt) loadCryptFilters(ed *PdfObjectDictionary) error {
 		crypt.streamFilter = string(*stmf)
 	}
 
+	// EFF embedded file streams filter, StmF by default.
+	crypt.embeddedFileFilter = crypt.streamFilter
+	if eff, ok := ed.Get("EFF").(*PdfObjectName); ok {
+		if _, exists := crypt.cryptFilters[string(*eff)]; !exists {
+			return fmt.Errorf("crypt filter for EFF not specified in CF dictionary (%s)", *eff)
+		}
+		crypt.embeddedFileFilter = string(*eff)
+	}
+
 	return nil
 }
 
@@ -406,15 +647,22 @@ func (crypt *PdfCrypt) saveCryptFilters(ed *PdfObjectDictionary) error {
 	cf := MakeDict()
 	ed.Set("CF", cf)
 
-	for name, filter := range crypt.cryptFilters {
-		if name == "Identity" {
-			continue
+	names := make([]string, 0, len(crypt.cryptFilters))
+	for name := range crypt.cryptFilters {
+		if name != "Identity" {
+			names = append(names, name)
 		}
-		v := encodeCryptFilter(filter, "")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := encodeCryptFilter(crypt.cryptFilters[name], "")
 		cf.Set(PdfObjectName(name), v)
 	}
 	ed.Set("StrF", MakeName(crypt.stringFilter))
 	ed.Set("StmF", MakeName(crypt.streamFilter))
+	if crypt.embeddedFileFilter != "" && crypt.embeddedFileFilter != crypt.streamFilter {
+		ed.Set("EFF", MakeName(crypt.embeddedFileFilter))
+	}
 	return nil
 }
 
@@ -434,7 +682,7 @@ func PdfCryptNewDecrypt(parser *PdfParser, ed, trailer *PdfObjectDictionary) (*P
 		common.Log.Debug("ERROR Crypt dictionary missing required Filter field!")
 		return crypter, errors.New("required crypt field Filter missing")
 	}
-	if *filter != "Standard" {
+	if *filter != stdFilter && *filter != pubSecFilter {
 		common.Log.Debug("ERROR Unsupported filter (%s)", *filter)
 		return crypter, errors.New("unsupported Filter")
 	}
@@ -443,6 +691,9 @@ func PdfCryptNewDecrypt(parser *PdfParser, ed, trailer *PdfObjectDictionary) (*P
 	if subfilter, ok := ed.Get("SubFilter").(*PdfObjectString); ok {
 		crypter.encrypt.SubFilter = subfilter.Str()
 		common.Log.Debug("Using subfilter %s", subfilter)
+	} else if subfilter, ok := GetNameVal(ed.Get("SubFilter")); ok {
+		crypter.encrypt.SubFilter = subfilter
+		common.Log.Debug("Using subfilter %s", subfilter)
 	}
 
 	if L, ok := ed.Get("Length").(*PdfObjectInteger); ok {
@@ -472,8 +723,13 @@ func PdfCryptNewDecrypt(parser *PdfParser, ed, trailer *PdfObjectDictionary) (*P
 		}
 	}
 
-	// decode Standard security handler parameters
-	if err := decodeEncryptStd(&crypter.encryptStd, ed); err != nil {
+	if crypter.isPubSec() {
+		// decode public-key security handler parameters
+		if err := crypter.decodeEncryptPubSec(ed); err != nil {
+			return crypter, err
+		}
+	} else if err := decodeEncryptStd(&crypter.encryptStd, ed); err != nil {
+		// decode Standard security handler parameters
 		return crypter, err
 	}
 
@@ -496,10 +752,35 @@ func PdfCryptNewDecrypt(parser *PdfParser, ed, trailer *PdfObjectDictionary) (*P
 }
 
 // GetAccessPermissions returns the PDF access permissions as an AccessPermissions object.
+// For the public-key security handler, these are the permissions of the authenticated recipient.
 func (crypt *PdfCrypt) GetAccessPermissions() security.Permissions {
+	if crypt.isPubSec() {
+		return crypt.perm
+	}
 	return crypt.encryptStd.P
 }
 
+// isPubSec returns true if the document is encrypted with the public-key security handler.
+func (crypt *PdfCrypt) isPubSec() bool {
+	return crypt.encrypt.Filter == pubSecFilter
+}
+
+// pubSecHandler returns the public-key security handler with the key length of the default
+// crypt filter.
+func (crypt *PdfCrypt) pubSecHandler() security.PubSecHandler {
+	length := crypt.encrypt.Length / 8
+	if crypt.encrypt.V >= 4 {
+		name := crypt.streamFilter
+		if name == "Identity" {
+			name = crypt.stringFilter
+		}
+		if cf, ok := crypt.cryptFilters[name]; ok && cf.KeyLength() > 0 {
+			length = cf.KeyLength()
+		}
+	}
+	return security.NewHandlerPubSec(length)
+}
+
 func (crypt *PdfCrypt) securityHandler() security.StdHandler {
 	if crypt.encryptStd.R >= 5 {
 		return security.NewHandlerR6()
@@ -510,6 +791,9 @@ func (crypt *PdfCrypt) securityHandler() security.StdHandler {
 // Check whether the specified password can be used to decrypt the document.
 // Also build the encryption/decryption key.
 func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
+	if crypt.isPubSec() {
+		return false, errors.New("document encrypted for certificates, use a certificate and private key")
+	}
 	crypt.authenticated = false
 	h := crypt.securityHandler()
 	fkey, perm, err := h.Authenticate(&crypt.encryptStd, password)
@@ -523,6 +807,25 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 	return true, nil
 }
 
+// Check whether the certificate `cert` with private key `key` can be used to decrypt the document
+// encrypted with the public-key security handler. Also build the encryption/decryption key.
+func (crypt *PdfCrypt) authenticateCertificate(cert *x509.Certificate, key gocrypto.Decrypter) (bool, error) {
+	if !crypt.isPubSec() {
+		return false, errors.New("document not encrypted for certificates")
+	}
+	crypt.authenticated = false
+	fkey, perm, err := crypt.pubSecHandler().Authenticate(&crypt.encryptPubSec, cert, key)
+	if err != nil {
+		return false, err
+	} else if len(fkey) == 0 {
+		return false, nil
+	}
+	crypt.authenticated = true
+	crypt.encryptionKey = fkey
+	crypt.perm = perm
+	return true, nil
+}
+
 // Check access rights and permissions for a specified password.  If either user/owner password is specified,
 // full rights are granted, otherwise the access rights are specified by the Permissions flag.
 //
@@ -530,6 +833,13 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 // The AccessPermissions shows what access the user has for editing etc.
 // An error is returned if there was a problem performing the authentication.
 func (crypt *PdfCrypt) checkAccessRights(password []byte) (bool, security.Permissions, error) {
+	if crypt.isPubSec() {
+		// Passwords are not used, the rights are granted to the authenticated recipient.
+		if !crypt.authenticated {
+			return false, 0, nil
+		}
+		return true, crypt.perm, nil
+	}
 	h := crypt.securityHandler()
 	// TODO(dennwc): it computes an encryption key as well; if necessary, define a new interface method to optimize this
 	fkey, perm, err := h.Authenticate(&crypt.encryptStd, password)
@@ -596,6 +906,264 @@ func (crypt *PdfCrypt) isDecrypted(obj PdfObject) bool {
 	return false
 }
 
+// getStreamFilter returns the name of the crypt filter of stream `stream`. With crypt filters
+// (V>=4), it is the filter of its Crypt filter, if any, or the default filter of its class:
+// the embedded files filter for embedded files, Identity for the document metadata when it is
+// not encrypted, and the streams filter otherwise.
+func (crypt *PdfCrypt) getStreamFilter(stream *PdfObjectStream) string {
+	if crypt.encrypt.V < 4 {
+		return stdCryptFilter // Default RC4.
+	}
+	dict := stream.PdfObjectDictionary
+
+	// The Crypt filter shall be the first filter in the Filter array entry.
+	if filters, ok := dict.Get("Filter").(*PdfObjectArray); ok {
+		if firstFilter, ok := GetName(filters.Get(0)); ok && *firstFilter == "Crypt" {
+			// Crypt filter overriding the default.
+			// Default option is Identity.
+			streamFilter := "Identity"
+
+			// Check if valid crypt filter specified in the decode params.
+			decodeParams, ok := dict.Get("DecodeParms").(*PdfObjectDictionary)
+			if arr, isArr := dict.Get("DecodeParms").(*PdfObjectArray); isArr {
+				decodeParams, ok = GetDict(arr.Get(0))
+			}
+			if ok {
+				if filterName, ok := decodeParams.Get("Name").(*PdfObjectName); ok {
+					if _, ok := crypt.cryptFilters[string(*filterName)]; ok {
+						common.Log.Trace("Using stream filter %s", *filterName)
+						streamFilter = string(*filterName)
+					}
+				}
+			}
+			return streamFilter
+		}
+	}
+
+	typ, _ := GetNameVal(dict.Get("Type"))
+	switch {
+	case crypt.embeddedFileFilter != "" && crypt.embeddedFileFilter != crypt.streamFilter && crypt.isEmbeddedFile(stream):
+		return crypt.embeddedFileFilter
+	case typ == "Metadata" && !crypt.encryptMetadata() && crypt.isDocumentMetadata(stream):
+		return "Identity"
+	}
+	return crypt.streamFilter
+}
+
+// isEmbeddedFile returns true if `stream` is an embedded file stream. The Type of embedded file
+// streams is optional, so they are also identified by the EF dictionaries of the file
+// specifications referencing them.
+func (crypt *PdfCrypt) isEmbeddedFile(stream *PdfObjectStream) bool {
+	if typ, _ := GetNameVal(stream.Get("Type")); typ == "EmbeddedFile" {
+		return true
+	}
+	if crypt.embeddedFiles == nil {
+		crypt.embeddedFiles = map[int64]bool{}
+		if crypt.parser != nil {
+			crypt.loadEmbeddedFiles()
+		}
+	}
+	return crypt.embeddedFiles[stream.ObjectNumber]
+}
+
+// loadEmbeddedFiles loads the numbers of the embedded file streams of the document being read,
+// referenced from the file specifications of the EmbeddedFiles name tree and of the annotations
+// of the pages. The objects are looked up without being decrypted, as only names and references
+// are needed, and are not left in the cache of the parser, which holds decrypted objects.
+func (crypt *PdfCrypt) loadEmbeddedFiles() {
+	parser := crypt.parser
+	visited := map[int64]bool{}
+	// lookup returns the direct object of `obj`, or nil for objects already looked up, which
+	// stops on cycles.
+	lookup := func(obj PdfObject) PdfObject {
+		ref, ok := obj.(*PdfObjectReference)
+		if !ok {
+			return obj
+		}
+		if visited[ref.ObjectNumber] {
+			return nil
+		}
+		visited[ref.ObjectNumber] = true
+		num := int(ref.ObjectNumber)
+		_, cached := parser.ObjCache[num]
+		obj, _, err := parser.lookupByNumber(num, false)
+		if !cached {
+			delete(parser.ObjCache, num)
+		}
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load object %d: %v", num, err)
+			return nil
+		}
+		if ind, ok := obj.(*PdfIndirectObject); ok {
+			return ind.PdfObject
+		}
+		return obj
+	}
+	addFileSpec := func(obj PdfObject) {
+		fs, ok := GetDict(lookup(obj))
+		if !ok {
+			return
+		}
+		ef, ok := GetDict(lookup(fs.Get("EF")))
+		if !ok {
+			return
+		}
+		for _, name := range ef.Keys() {
+			if ref, ok := ef.Get(name).(*PdfObjectReference); ok {
+				crypt.embeddedFiles[ref.ObjectNumber] = true
+			}
+		}
+	}
+
+	root, ok := GetDict(lookup(parser.trailer.Get("Root")))
+	if !ok {
+		return
+	}
+	var walkNames func(node PdfObject)
+	walkNames = func(node PdfObject) {
+		dict, ok := GetDict(lookup(node))
+		if !ok {
+			return
+		}
+		if kids, ok := GetArray(lookup(dict.Get("Kids"))); ok {
+			for _, kid := range kids.Elements() {
+				walkNames(kid)
+			}
+		}
+		if names, ok := GetArray(lookup(dict.Get("Names"))); ok {
+			for i := 1; i < names.Len(); i += 2 {
+				addFileSpec(names.Get(i))
+			}
+		}
+	}
+	if names, ok := GetDict(lookup(root.Get("Names"))); ok {
+		walkNames(names.Get("EmbeddedFiles"))
+	}
+
+	var walkPages func(node PdfObject)
+	walkPages = func(node PdfObject) {
+		dict, ok := GetDict(lookup(node))
+		if !ok {
+			return
+		}
+		if kids, ok := GetArray(lookup(dict.Get("Kids"))); ok {
+			for _, kid := range kids.Elements() {
+				walkPages(kid)
+			}
+		}
+		if annots, ok := GetArray(lookup(dict.Get("Annots"))); ok {
+			for _, obj := range annots.Elements() {
+				if annot, ok := GetDict(lookup(obj)); ok {
+					addFileSpec(annot.Get("FS"))
+				}
+			}
+		}
+	}
+	walkPages(root.Get("Pages"))
+}
+
+// SetDocumentObjects sets the objects of a document being encrypted, whose file specifications
+// identify the embedded file streams, which are encrypted with the embedded files filter.
+func (crypt *PdfCrypt) SetDocumentObjects(objects []PdfObject) {
+	crypt.embeddedFiles = map[int64]bool{}
+	for _, obj := range objects {
+		if streams, ok := obj.(*PdfObjectStreams); ok {
+			for _, o := range streams.Elements() {
+				crypt.addEmbeddedFiles(o)
+			}
+			continue
+		}
+		crypt.addEmbeddedFiles(obj)
+	}
+}
+
+// addEmbeddedFiles adds the numbers of the streams referenced from the EF dictionaries of the
+// file specifications in object `obj`. Indirect objects other than `obj` are not traversed.
+func (crypt *PdfCrypt) addEmbeddedFiles(obj PdfObject) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		crypt.addEmbeddedFiles(t.PdfObject)
+	case *PdfObjectStream:
+		crypt.addEmbeddedFiles(t.PdfObjectDictionary)
+	case *PdfObjectArray:
+		for _, o := range t.Elements() {
+			crypt.addDirectEmbeddedFiles(o)
+		}
+	case *PdfObjectDictionary:
+		for _, key := range t.Keys() {
+			if key != "EF" {
+				crypt.addDirectEmbeddedFiles(t.Get(key))
+				continue
+			}
+			ef, ok := GetDict(t.Get(key))
+			if !ok {
+				continue
+			}
+			for _, name := range ef.Keys() {
+				switch f := ef.Get(name).(type) {
+				case *PdfObjectReference:
+					crypt.embeddedFiles[f.ObjectNumber] = true
+				case *PdfObjectStream:
+					crypt.embeddedFiles[f.ObjectNumber] = true
+				}
+			}
+		}
+	}
+}
+
+// addDirectEmbeddedFiles adds the embedded file streams of `obj` if it is a direct dictionary
+// or array.
+func (crypt *PdfCrypt) addDirectEmbeddedFiles(obj PdfObject) {
+	switch obj.(type) {
+	case *PdfObjectDictionary, *PdfObjectArray:
+		crypt.addEmbeddedFiles(obj)
+	}
+}
+
+// encryptMetadata returns false if the document metadata stream is not encrypted.
+func (crypt *PdfCrypt) encryptMetadata() bool {
+	if crypt.encrypt.V < 4 {
+		return true
+	}
+	if crypt.isPubSec() {
+		return crypt.encryptPubSec.EncryptMetadata
+	}
+	return crypt.encryptStd.EncryptMetadata
+}
+
+// SetDocumentMetadata sets the document metadata stream of a document being encrypted, which is
+// left unencrypted if the document metadata is not encrypted.
+func (crypt *PdfCrypt) SetDocumentMetadata(stream *PdfObjectStream) {
+	crypt.metadata = stream
+}
+
+// isDocumentMetadata returns true if `stream` is the document metadata stream (Metadata of the
+// catalog).
+func (crypt *PdfCrypt) isDocumentMetadata(stream *PdfObjectStream) bool {
+	if crypt.metadata != nil {
+		return stream == crypt.metadata
+	}
+	if crypt.parser == nil || crypt.parser.trailer == nil {
+		return false
+	}
+	root, err := crypt.parser.Resolve(crypt.parser.trailer.Get("Root"))
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to load the catalog: %v", err)
+		return false
+	}
+	catalog, ok := GetDict(root)
+	if !ok {
+		return false
+	}
+	switch metadata := catalog.Get("Metadata").(type) {
+	case *PdfObjectReference:
+		return metadata.ObjectNumber == stream.ObjectNumber
+	case *PdfObjectStream:
+		return metadata == stream
+	}
+	return false
+}
+
 // Decrypt a buffer with a selected crypt filter.
 func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]byte, error) {
 	common.Log.Trace("Decrypt bytes")
@@ -646,47 +1214,19 @@ func (crypt *PdfCrypt) Decrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 		genNum := obj.GenerationNumber
 		common.Log.Trace("Decrypting stream %d %d !", objNum, genNum)
 
-		// TODO: Check for crypt filter (V4).
-		// The Crypt filter shall be the first filter in the Filter array entry.
-
-		streamFilter := stdCryptFilter // Default RC4.
-		if crypt.encrypt.V >= 4 {
-			streamFilter = crypt.streamFilter
-			common.Log.Trace("this.streamFilter = %s", crypt.streamFilter)
-
-			if filters, ok := dict.Get("Filter").(*PdfObjectArray); ok {
-				// Crypt filter can only be the first entry.
-				if firstFilter, ok := GetName(filters.Get(0)); ok {
-					if *firstFilter == "Crypt" {
-						// Crypt filter overriding the default.
-						// Default option is Identity.
-						streamFilter = "Identity"
-
-						// Check if valid crypt filter specified in the decode params.
-						if decodeParams, ok := dict.Get("DecodeParms").(*PdfObjectDictionary); ok {
-							if filterName, ok := decodeParams.Get("Name").(*PdfObjectName); ok {
-								if _, ok := crypt.cryptFilters[string(*filterName)]; ok {
-									common.Log.Trace("Using stream filter %s", *filterName)
-									streamFilter = string(*filterName)
-								}
-							}
-						}
-					}
-				}
-			}
-
-			common.Log.Trace("with %s filter", streamFilter)
-			if streamFilter == "Identity" {
-				// Identity: pass unchanged.
-				return nil
-			}
-		}
-
+		// The strings of the dictionary are decrypted with the strings filter.
 		err := crypt.Decrypt(dict, objNum, genNum)
 		if err != nil {
 			return err
 		}
 
+		streamFilter := crypt.getStreamFilter(obj)
+		common.Log.Trace("with %s filter", streamFilter)
+		if streamFilter == "Identity" {
+			// Identity: pass unchanged.
+			return nil
+		}
+
 		okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.encryptionKey)
 		if err != nil {
 			return err
@@ -829,49 +1369,19 @@ func (crypt *PdfCrypt) Encrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 		genNum := obj.GenerationNumber
 		common.Log.Trace("Encrypting stream %d %d !", objNum, genNum)
 
-		// TODO: Check for crypt filter (V4).
-		// The Crypt filter shall be the first filter in the Filter array entry.
-
-		streamFilter := stdCryptFilter // Default RC4.
-		if crypt.encrypt.V >= 4 {
-			// For now.  Need to change when we add support for more than
-			// Identity / RC4.
-			streamFilter = crypt.streamFilter
-			common.Log.Trace("this.streamFilter = %s", crypt.streamFilter)
-
-			if filters, ok := dict.Get("Filter").(*PdfObjectArray); ok {
-				// Crypt filter can only be the first entry.
-				if firstFilter, ok := GetName(filters.Get(0)); ok {
-					if *firstFilter == "Crypt" {
-						// Crypt filter overriding the default.
-						// Default option is Identity.
-						streamFilter = "Identity"
-
-						// Check if valid crypt filter specified in the decode params.
-						if decodeParams, ok := dict.Get("DecodeParms").(*PdfObjectDictionary); ok {
-							if filterName, ok := decodeParams.Get("Name").(*PdfObjectName); ok {
-								if _, ok := crypt.cryptFilters[string(*filterName)]; ok {
-									common.Log.Trace("Using stream filter %s", *filterName)
-									streamFilter = string(*filterName)
-								}
-							}
-						}
-					}
-				}
-			}
-
-			common.Log.Trace("with %s filter", streamFilter)
-			if streamFilter == "Identity" {
-				// Identity: pass unchanged.
-				return nil
-			}
-		}
-
+		// The strings of the dictionary are encrypted with the strings filter.
 		err := crypt.Encrypt(obj.PdfObjectDictionary, objNum, genNum)
 		if err != nil {
 			return err
 		}
 
+		streamFilter := crypt.getStreamFilter(obj)
+		common.Log.Trace("with %s filter", streamFilter)
+		if streamFilter == "Identity" {
+			// Identity: pass unchanged.
+			return nil
+		}
+
 		okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.encryptionKey)
 		if err != nil {
 			return err
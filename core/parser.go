@@ -8,6 +8,8 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -1815,6 +1817,17 @@ func (parser *PdfParser) Decrypt(password []byte) (bool, error) {
 	return authenticated, err
 }
 
+// DecryptWithCertificate attempts to decrypt the PDF file encrypted with the public-key security
+// handler with certificate `cert` and its private key `key`. Returns true if successful, false
+// if the document has no recipient for the certificate. An error is returned when there is a
+// problem with decrypting.
+func (parser *PdfParser) DecryptWithCertificate(cert *x509.Certificate, key crypto.Decrypter) (bool, error) {
+	if parser.crypter == nil {
+		return false, errors.New("check encryption first")
+	}
+	return parser.crypter.authenticateCertificate(cert, key)
+}
+
 // CheckAccessRights checks access rights and permissions for a specified password. If either user/owner password is
 // specified, full rights are granted, otherwise the access rights are specified by the Permissions flag.
 //
@@ -0,0 +1,251 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Object identifiers of the PKCS#7 enveloped data objects of the public-key security handlers.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidEncryptionRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+
+	oidEncryptionDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidEncryptionAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidEncryptionAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidEncryptionAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// envelopeContentInfo is the ContentInfo wrapping an enveloped data object (RFC 5652).
+type envelopeContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, parsed by the caller.
+}
+
+// envelopedData is the EnvelopedData content of an enveloped data object (RFC 5652 6.1).
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+// keyTransRecipientInfo is the recipient information of a recipient using key transport
+// (RFC 5652 6.2.1). The recipient identifier is either an IssuerAndSerialNumber or a
+// [0] SubjectKeyIdentifier.
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+// issuerAndSerialNumber identifies a certificate by its issuer and serial number.
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// encryptedContentInfo is the encrypted content of an enveloped data object.
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// envelope encrypts `content` with AES-256 in an enveloped data object for each of the
+// certificates `certs`, whose public keys must be RSA keys.
+func envelope(content []byte, certs []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	data := envelopedData{
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType: oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidEncryptionAES256CBC,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	}
+	for _, cert := range certs {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported public key of certificate %q: %T", cert.Subject.CommonName, cert.PublicKey)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		rid, err := asn1.Marshal(issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+			SerialNumber: cert.SerialNumber,
+		})
+		if err != nil {
+			return nil, err
+		}
+		info, err := asn1.Marshal(keyTransRecipientInfo{
+			RID:                    asn1.RawValue{FullBytes: rid},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidEncryptionRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		data.RecipientInfos = append(data.RecipientInfos, asn1.RawValue{FullBytes: info})
+	}
+
+	inner, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(envelopeContentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// errNoRecipient is returned by openEnvelope when the enveloped data object has no recipient
+// for the certificate.
+var errNoRecipient = errors.New("no recipient for certificate")
+
+// openEnvelope decrypts the content of enveloped data object `der` for the recipient with
+// certificate `cert` using the private key `key`.
+func openEnvelope(der []byte, cert *x509.Certificate, key crypto.Decrypter) ([]byte, error) {
+	var info envelopeContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.ContentType.Equal(oidEnvelopedData) || info.Content.Class != asn1.ClassContextSpecific || info.Content.Tag != 0 {
+		return nil, fmt.Errorf("unsupported content type %v", info.ContentType)
+	}
+	var data envelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &data); err != nil {
+		return nil, err
+	}
+
+	var recipient *keyTransRecipientInfo
+	for _, raw := range data.RecipientInfos {
+		var ri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(raw.FullBytes, &ri); err != nil {
+			// Other kinds of recipients are not supported.
+			continue
+		}
+		if matchRecipient(ri.RID, cert) {
+			recipient = &ri
+			break
+		}
+	}
+	if recipient == nil {
+		return nil, errNoRecipient
+	}
+	if !recipient.KeyEncryptionAlgorithm.Algorithm.Equal(oidEncryptionRSA) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm %v", recipient.KeyEncryptionAlgorithm.Algorithm)
+	}
+	contentKey, err := key.Decrypt(rand.Reader, recipient.EncryptedKey, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return data.EncryptedContentInfo.decrypt(contentKey)
+}
+
+// matchRecipient returns true if recipient identifier `rid` identifies certificate `cert`.
+func matchRecipient(rid asn1.RawValue, cert *x509.Certificate) bool {
+	if rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(rid.Bytes, cert.SubjectKeyId)
+	}
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// decrypt decrypts the content with content encryption key `key`.
+func (eci encryptedContentInfo) decrypt(key []byte) ([]byte, error) {
+	var block cipher.Block
+	var err error
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	switch {
+	case alg.Equal(oidEncryptionAES128CBC), alg.Equal(oidEncryptionAES192CBC), alg.Equal(oidEncryptionAES256CBC):
+		block, err = aes.NewCipher(key)
+	case alg.Equal(oidEncryptionDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(key)
+	default:
+		return nil, fmt.Errorf("unsupported content encryption algorithm %v", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid content encryption IV")
+	}
+
+	content := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		// Constructed encoding: concatenate the octet string segments.
+		var segments []byte
+		for rest := content; len(rest) > 0; {
+			var segment []byte
+			var err error
+			rest, err = asn1.Unmarshal(rest, &segment)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment...)
+		}
+		content = segments
+	}
+	if len(content) == 0 || len(content)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted content length")
+	}
+
+	decrypted := make([]byte, len(content))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, content)
+	n := int(decrypted[len(decrypted)-1])
+	if n == 0 || n > block.BlockSize() || n > len(decrypted) {
+		return nil, errors.New("invalid content padding")
+	}
+	return decrypted[:len(decrypted)-n], nil
+}
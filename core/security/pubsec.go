@@ -0,0 +1,148 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"github.com/zituocn/updf/common"
+)
+
+// Public-key security handler sub-filters.
+const (
+	// SubFilterPKCS7S4 stores the recipients in the encryption dictionary (V 1-2).
+	SubFilterPKCS7S4 = "adbe.pkcs7.s4"
+	// SubFilterPKCS7S5 stores the recipients in the crypt filters (V 4-5).
+	SubFilterPKCS7S5 = "adbe.pkcs7.s5"
+)
+
+// PubSecHandler is an interface for public-key security handlers.
+type PubSecHandler interface {
+	// GenerateParams encrypts a random seed and the permissions of each recipient for the
+	// certificates of the recipient, sets the Recipients of `d` and generates an encryption key.
+	// It assumes that EncryptMetadata is already set.
+	GenerateParams(d *PubSecEncryptDict, recipients []Recipient) ([]byte, error)
+
+	// Authenticate decrypts the seed of the recipient with certificate `cert` using its private
+	// key `key` to calculate the document encryption key. It also returns the permissions granted
+	// to the recipient. In case no recipient matches the certificate, it returns empty key and
+	// zero permissions with no error.
+	Authenticate(d *PubSecEncryptDict, cert *x509.Certificate, key crypto.Decrypter) ([]byte, Permissions, error)
+}
+
+// PubSecEncryptDict is a set of additional fields used in the encryption dictionary and crypt
+// filters of public-key security handlers.
+type PubSecEncryptDict struct {
+	SubFilter string // The format of the recipients (adbe.pkcs7.s4 or adbe.pkcs7.s5).
+
+	EncryptMetadata bool // Indicates whether the document-level metadata stream shall be encrypted.
+
+	// set by security handlers:
+
+	Recipients [][]byte // PKCS#7 enveloped data objects (DER), one per recipient.
+}
+
+// Recipient is a recipient of a document encrypted with a public-key security handler.
+type Recipient struct {
+	// Certificates of the recipient. The document can be decrypted with the private key of any
+	// of them. Only RSA keys are supported.
+	Certificates []*x509.Certificate
+
+	// Permissions granted to the recipient.
+	Permissions Permissions
+}
+
+// seedLength is the length of the seed encrypted for the recipients.
+const seedLength = 20
+
+var _ PubSecHandler = pubSecHandler{}
+
+// NewHandlerPubSec creates a new public-key security handler generating encryption keys of
+// `length` bytes. Keys of 32 bytes (AESV3) are calculated with SHA-256, shorter keys with SHA-1.
+func NewHandlerPubSec(length int) PubSecHandler {
+	return pubSecHandler{Length: length}
+}
+
+// pubSecHandler is a public-key security handler (Section 7.6.4 PDF32000_2008).
+type pubSecHandler struct {
+	Length int
+}
+
+// GenerateParams implements PubSecHandler interface.
+func (sh pubSecHandler) GenerateParams(d *PubSecEncryptDict, recipients []Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	seed := make([]byte, seedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+
+	d.Recipients = nil
+	for _, r := range recipients {
+		if len(r.Certificates) == 0 {
+			return nil, errors.New("recipient without certificates")
+		}
+		content := make([]byte, seedLength+4)
+		copy(content, seed)
+		binary.BigEndian.PutUint32(content[seedLength:], uint32(r.Permissions))
+
+		der, err := envelope(content, r.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		d.Recipients = append(d.Recipients, der)
+	}
+	return sh.fileKey(d, seed), nil
+}
+
+// Authenticate implements PubSecHandler interface.
+func (sh pubSecHandler) Authenticate(d *PubSecEncryptDict, cert *x509.Certificate, key crypto.Decrypter) ([]byte, Permissions, error) {
+	for _, der := range d.Recipients {
+		content, err := openEnvelope(der, cert, key)
+		if err == errNoRecipient {
+			continue
+		} else if err != nil {
+			common.Log.Debug("ERROR: Unable to decrypt the recipient: %v", err)
+			return nil, 0, err
+		}
+		if len(content) < seedLength+4 {
+			return nil, 0, errInvalidField{Func: "Authenticate", Field: "recipient", Exp: seedLength + 4, Got: len(content)}
+		}
+		perm := Permissions(binary.BigEndian.Uint32(content[seedLength:]))
+		return sh.fileKey(d, content[:seedLength]), perm, nil
+	}
+	return nil, 0, nil
+}
+
+// fileKey computes the document encryption key from the seed and the recipients.
+func (sh pubSecHandler) fileKey(d *PubSecEncryptDict, seed []byte) []byte {
+	var h hash.Hash
+	if sh.Length > sha1.Size {
+		h = sha256.New()
+	} else {
+		h = sha1.New()
+	}
+	h.Write(seed)
+	for _, der := range d.Recipients {
+		h.Write(der)
+	}
+	if !d.EncryptMetadata {
+		h.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+	key := h.Sum(nil)
+	if sh.Length < len(key) {
+		key = key[:sh.Length]
+	}
+	return key
+}
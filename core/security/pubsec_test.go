@@ -0,0 +1,100 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestRecipient returns a self-signed certificate and its private key.
+func newTestRecipient(t *testing.T, serial int64, name string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestPubSecHandler(t *testing.T) {
+	cert1, key1 := newTestRecipient(t, 1, "Recipient 1")
+	cert2, key2 := newTestRecipient(t, 2, "Recipient 2")
+	cert3, key3 := newTestRecipient(t, 3, "Recipient 3")
+
+	const perms = PermPrinting | PermFillForms
+	recipients := []Recipient{
+		{Certificates: []*x509.Certificate{cert1}, Permissions: PermOwner},
+		{Certificates: []*x509.Certificate{cert2, cert3}, Permissions: perms},
+	}
+
+	for _, length := range []int{5, 16, 32} {
+		for _, encMeta := range []bool{true, false} {
+			sh := NewHandlerPubSec(length)
+			d := &PubSecEncryptDict{SubFilter: SubFilterPKCS7S5, EncryptMetadata: encMeta}
+			ekey, err := sh.GenerateParams(d, recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ekey) != length {
+				t.Fatalf("wrong key length: %d", len(ekey))
+			} else if len(d.Recipients) != len(recipients) {
+				t.Fatalf("wrong number of recipients: %d", len(d.Recipients))
+			}
+
+			cases := []struct {
+				cert *x509.Certificate
+				key  *rsa.PrivateKey
+				perm Permissions
+			}{
+				{cert1, key1, PermOwner},
+				{cert2, key2, perms},
+				{cert3, key3, perms},
+			}
+			for _, c := range cases {
+				fkey, perm, err := sh.Authenticate(d, c.cert, c.key)
+				if err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(fkey, ekey) {
+					t.Fatalf("wrong encryption key for %q", c.cert.Subject.CommonName)
+				} else if perm != c.perm {
+					t.Fatalf("wrong permissions for %q: %x", c.cert.Subject.CommonName, perm)
+				}
+			}
+
+			other, otherKey := newTestRecipient(t, 4, "Other")
+			fkey, perm, err := sh.Authenticate(d, other, otherKey)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(fkey) != 0 || perm != 0 {
+				t.Fatal("authenticated with a certificate which is not a recipient")
+			}
+		}
+	}
+
+	if _, err := NewHandlerPubSec(16).GenerateParams(&PubSecEncryptDict{}, nil); err == nil {
+		t.Fatal("expected an error without recipients")
+	}
+}
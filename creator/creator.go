@@ -62,6 +62,9 @@ type Creator struct {
 	// Forms.
 	acroForm *model.PdfAcroForm
 
+	// Optional content properties. nil if no layers have been created.
+	ocProperties *model.PdfOCProperties
+
 	optimizer model.Optimizer
 
 	// Default fonts used by all components instantiated through the creator.
@@ -561,6 +564,11 @@ func (c *Creator) MoveDown(dy float64) {
 // Draw draws the Drawable widget to the document.  This can span over 1 or more pages. Additional
 // pages are added if the contents go over the current Page.
 func (c *Creator) Draw(d Drawable) error {
+	return c.draw(d, nil)
+}
+
+// draw draws Drawable `d` to the document in optional content group `layer`. `layer` may be nil.
+func (c *Creator) draw(d Drawable, layer *model.PdfOCG) error {
 	if c.getActivePage() == nil {
 		// Add a new Page if none added already.
 		c.NewPage()
@@ -575,6 +583,11 @@ func (c *Creator) Draw(d Drawable) error {
 		if idx > 0 {
 			c.NewPage()
 		}
+		if layer != nil {
+			if err := block.setLayer(layer); err != nil {
+				return err
+			}
+		}
 
 		page := c.getActivePage()
 		if pageBlock, ok := c.pageBlocks[page]; ok {
@@ -615,6 +628,14 @@ func (c *Creator) Write(ws io.Writer) error {
 		}
 	}
 
+	// Layers.
+	if c.ocProperties != nil {
+		if err := pdfWriter.SetOptionalContentProperties(c.ocProperties); err != nil {
+			common.Log.Debug("Failure: %v", err)
+			return err
+		}
+	}
+
 	// Outlines.
 	if c.externalOutline != nil {
 		pdfWriter.AddOutlineTree(c.externalOutline)
@@ -0,0 +1,50 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package creator
+
+import (
+	"github.com/zituocn/updf/contentstream"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// NewLayer creates a layer (optional content group) named `name` that viewers can show or hide.
+// Drawables are drawn in it with DrawInLayer. The layer is visible when the document is opened
+// unless it is turned off in the default configuration of GetOptionalContentProperties.
+func (c *Creator) NewLayer(name string) *model.PdfOCG {
+	layer := model.NewPdfOCG(name)
+	c.GetOptionalContentProperties().AddOCG(layer)
+	return layer
+}
+
+// GetOptionalContentProperties returns the optional content properties of the document, which
+// hold the layers created by NewLayer and their initial visibility.
+func (c *Creator) GetOptionalContentProperties() *model.PdfOCProperties {
+	if c.ocProperties == nil {
+		c.ocProperties = model.NewPdfOCProperties()
+	}
+	return c.ocProperties
+}
+
+// DrawInLayer draws the Drawable widget to the document in `layer` as Draw does. `layer` is
+// normally created by NewLayer.
+func (c *Creator) DrawInLayer(layer *model.PdfOCG, d Drawable) error {
+	return c.draw(d, layer)
+}
+
+// setLayer makes the contents of the block optional content of `layer` by enclosing them in an
+// optional content marked-content sequence.
+func (blk *Block) setLayer(layer *model.PdfOCG) error {
+	name := core.PdfObjectName("OC0")
+	if err := blk.resources.SetPropertiesByName(name, layer.ToPdfObject()); err != nil {
+		return err
+	}
+	blk.contents.WrapIfNeeded()
+	ops := contentstream.NewContentCreator().Add_BDC("OC", name).Operations()
+	*blk.contents = append(*ops, *blk.contents...)
+	*blk.contents = append(*blk.contents, *contentstream.NewContentCreator().Add_EMC().Operations()...)
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package creator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/contentstream"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+func TestLayers(t *testing.T) {
+	c := New()
+	c.NewPage()
+	shapes := c.NewLayer("Shapes")
+	notes := c.NewLayer("Notes")
+	c.GetOptionalContentProperties().D.SetVisible(notes, false)
+
+	require.NoError(t, c.Draw(c.NewRectangle(10, 10, 100, 100)))
+	require.NoError(t, c.DrawInLayer(shapes, c.NewRectangle(200, 200, 50, 50)))
+	require.NoError(t, c.DrawInLayer(notes, c.NewParagraph("Review this")))
+
+	var buf bytes.Buffer
+	require.NoError(t, c.Write(&buf))
+
+	reader, err := model.NewPdfReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	props, err := reader.GetOptionalContentProperties()
+	require.NoError(t, err)
+	require.NotNil(t, props)
+	require.Len(t, props.OCGs, 2)
+	require.Equal(t, "Shapes", props.OCGs[0].Name)
+	require.False(t, props.D.IsVisible(props.GetOCGByName("Notes")))
+
+	page, err := reader.GetPage(1)
+	require.NoError(t, err)
+	contents, err := page.GetAllContentStreams()
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(contents, "/OC /OC"))
+	require.Contains(t, contents, "(Review)")
+
+	require.NoError(t, contentstream.DeleteLayers(page, []*model.PdfOCG{props.GetOCGByName("Notes")},
+		core.NewRawEncoder()))
+	contents, err = page.GetAllContentStreams()
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(contents, "/OC /OC"))
+	require.NotContains(t, contents, "(Review)")
+
+	require.NoError(t, contentstream.FlattenLayers(page, []*model.PdfOCG{props.GetOCGByName("Shapes")},
+		core.NewRawEncoder()))
+	contents, err = page.GetAllContentStreams()
+	require.NoError(t, err)
+	require.NotContains(t, contents, "BDC")
+	require.NotContains(t, contents, "EMC")
+	require.Contains(t, contents, "200")
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"math"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/contentstream"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// clipped returns true if `bbox` lies entirely outside the visible region of the content stream
+// `pageBox` or outside the clipping region of `gs`. `pageBox` may be nil, in which case it is not
+// checked. The clipping region is approximated by its bounding box so text that lies inside it may
+// still be clipped by a non-rectangular clipping path.
+func clipped(bbox model.PdfRectangle, gs contentstream.GraphicsState, pageBox *model.PdfRectangle) bool {
+	bbox = normalizeRect(bbox)
+	if pageBox != nil && !overlaps(bbox, normalizeRect(*pageBox)) {
+		return true
+	}
+	if clip, ok := gs.ClipBBox(); ok && !overlaps(bbox, clip) {
+		return true
+	}
+	return false
+}
+
+// formRegion returns the visible region of form `xform` drawn with graphics state `gs` in a
+// content stream with visible region `pageBox`, in the coordinate system of the form. This is the
+// intersection of `pageBox` and the clipping region of `gs`. It returns nil if neither is known.
+func formRegion(xform *model.XObjectForm, gs contentstream.GraphicsState,
+	pageBox *model.PdfRectangle) *model.PdfRectangle {
+	clip, ok := gs.ClipBBox()
+	if pageBox != nil {
+		box := normalizeRect(*pageBox)
+		if ok {
+			clip = model.PdfRectangle{
+				Llx: math.Max(clip.Llx, box.Llx),
+				Lly: math.Max(clip.Lly, box.Lly),
+				Urx: math.Min(clip.Urx, box.Urx),
+				Ury: math.Min(clip.Ury, box.Ury),
+			}
+		} else {
+			clip = box
+		}
+	} else if !ok {
+		return nil
+	}
+	if clip.Llx > clip.Urx || clip.Lly > clip.Ury {
+		return &clip
+	}
+
+	// Map the region from the coordinate system of the content stream to that of the form.
+	m := gs.CTM
+	if arr, ok := core.GetArray(xform.Matrix); ok {
+		f, err := arr.ToFloat64Array()
+		if err == nil && len(f) == 6 {
+			m.Concat(transform.NewMatrix(f[0], f[1], f[2], f[3], f[4], f[5]))
+		} else {
+			common.Log.Debug("ERROR: Invalid form matrix %s", xform.Matrix)
+		}
+	}
+	inv, ok := m.Inverse()
+	if !ok {
+		// The form is drawn with a singular matrix so none of it is visible.
+		return &model.PdfRectangle{Llx: 1, Lly: 1}
+	}
+	region := model.PdfRectangle{Llx: math.Inf(1), Lly: math.Inf(1), Urx: math.Inf(-1), Ury: math.Inf(-1)}
+	for _, pt := range []transform.Point{{X: clip.Llx, Y: clip.Lly}, {X: clip.Urx, Y: clip.Lly},
+		{X: clip.Urx, Y: clip.Ury}, {X: clip.Llx, Y: clip.Ury}} {
+		x, y := inv.Transform(pt.X, pt.Y)
+		region.Llx, region.Urx = math.Min(region.Llx, x), math.Max(region.Urx, x)
+		region.Lly, region.Ury = math.Min(region.Lly, y), math.Max(region.Ury, y)
+	}
+	return &region
+}
+
+// overlaps returns true if `bbox` overlaps `clip`. Nothing overlaps an empty `clip`
+// (Llx > Urx or Lly > Ury).
+func overlaps(bbox, clip model.PdfRectangle) bool {
+	if clip.Llx > clip.Urx || clip.Lly > clip.Ury {
+		return false
+	}
+	return !(bbox.Urx < clip.Llx || bbox.Llx > clip.Urx || bbox.Ury < clip.Lly || bbox.Lly > clip.Ury)
+}
+
+// normalizeRect returns `r` with its corners ordered so that Llx <= Urx and Lly <= Ury.
+func normalizeRect(r model.PdfRectangle) model.PdfRectangle {
+	return model.PdfRectangle{
+		Llx: math.Min(r.Llx, r.Urx),
+		Lly: math.Min(r.Lly, r.Ury),
+		Urx: math.Max(r.Llx, r.Urx),
+		Ury: math.Max(r.Lly, r.Ury),
+	}
+}
@@ -0,0 +1,451 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/zituocn/updf/model"
+)
+
+// TextWord represents a word on a page: a run of text marks on a line that is not interrupted by
+// spaces.
+type TextWord struct {
+	// Text is the text of the word.
+	Text string `json:"text"`
+	// BBox is the bounding box of the word in PDF coordinates.
+	BBox model.PdfRectangle `json:"bbox"`
+	// Font is the name of the font the first character of the word was drawn with.
+	Font string `json:"font,omitempty"`
+	// FontSize is the font size the first character of the word was drawn with.
+	FontSize float64 `json:"fontSize,omitempty"`
+}
+
+// TextLine represents a line of text on a page.
+type TextLine struct {
+	// Text is the text of the line. The words are separated by single spaces.
+	Text string `json:"text"`
+	// BBox is the bounding box of the line in PDF coordinates.
+	BBox model.PdfRectangle `json:"bbox"`
+	// Words are the words in the line in reading order.
+	Words []TextWord `json:"words"`
+}
+
+// TextBlock represents a block of text on a page: a run of vertically adjacent lines, typically a
+// paragraph or a heading.
+type TextBlock struct {
+	// BBox is the bounding box of the block in PDF coordinates.
+	BBox model.PdfRectangle `json:"bbox"`
+	// Lines are the lines in the block in reading order.
+	Lines []TextLine `json:"lines"`
+}
+
+// blockGapRatio is the largest vertical gap between two lines, as a multiple of the height of the
+// upper line, for the lines to be in the same TextBlock.
+// NOTE: 1.0 is a guess. It separates most paragraphs that are set with a blank line between them.
+const blockGapRatio = 1.0
+
+// Blocks returns the text on the page `pt` grouped into blocks, lines and words in reading order.
+func (pt PageText) Blocks() []TextBlock {
+	var blocks []TextBlock
+	for _, tl := range pt.viewLines {
+		line, ok := newTextLine(tl)
+		if !ok {
+			continue
+		}
+		n := len(blocks)
+		if n == 0 || !blocks[n-1].continuedBy(line) {
+			blocks = append(blocks, TextBlock{BBox: line.BBox})
+			n++
+		}
+		b := &blocks[n-1]
+		b.Lines = append(b.Lines, line)
+		b.BBox = rectUnion(b.BBox, line.BBox)
+	}
+	return blocks
+}
+
+// continuedBy returns true if `line` belongs in block `b`. This is the case if `line` is just below
+// the last line in `b` and overlaps `b` horizontally.
+func (b TextBlock) continuedBy(line TextLine) bool {
+	last := b.Lines[len(b.Lines)-1].BBox
+	h := last.Height()
+	gap := last.Lly - line.BBox.Ury
+	if gap > blockGapRatio*h || gap < -h {
+		return false
+	}
+	return line.BBox.Urx >= b.BBox.Llx && line.BBox.Llx <= b.BBox.Urx
+}
+
+// newTextLine returns the TextLine for `tl`, split into words at the spaces. It returns false if
+// `tl` contains no words.
+func newTextLine(tl textLine) (TextLine, bool) {
+	var line TextLine
+	var word TextWord
+	var parts []string
+	flush := func() {
+		if len(parts) == 0 {
+			return
+		}
+		word.Text = strings.Join(parts, "")
+		line.Words = append(line.Words, word)
+		parts = nil
+	}
+	for _, tm := range tl.marks {
+		if isTextSpace(tm.Text) {
+			flush()
+			continue
+		}
+		bbox := normalizeRect(tm.BBox)
+		if len(parts) == 0 {
+			word = TextWord{BBox: bbox, FontSize: tm.FontSize}
+			if tm.Font != nil {
+				word.Font = tm.Font.BaseFont()
+			}
+		} else {
+			word.BBox = rectUnion(word.BBox, bbox)
+		}
+		parts = append(parts, tm.Text)
+	}
+	flush()
+	if len(line.Words) == 0 {
+		return line, false
+	}
+
+	texts := make([]string, len(line.Words))
+	line.BBox = line.Words[0].BBox
+	for i, w := range line.Words {
+		texts[i] = w.Text
+		line.BBox = rectUnion(line.BBox, w.BBox)
+	}
+	line.Text = strings.Join(texts, " ")
+	return line, true
+}
+
+// box returns the visible region of the page `pt`. If it is not known, the bounding box of the
+// text on the page is returned.
+func (pt PageText) box() model.PdfRectangle {
+	if pt.pageBox != nil {
+		return normalizeRect(*pt.pageBox)
+	}
+	var bbox model.PdfRectangle
+	for i, tm := range pt.marks {
+		if i == 0 {
+			bbox = normalizeRect(tm.bbox)
+		} else {
+			bbox = rectUnion(bbox, normalizeRect(tm.bbox))
+		}
+	}
+	return bbox
+}
+
+// WriteHOCR writes `pt` to `w` as a single page hOCR document.
+func (pt *PageText) WriteHOCR(w io.Writer) error {
+	return WriteHOCR(w, []*PageText{pt})
+}
+
+// WriteALTO writes `pt` to `w` as a single page ALTO XML document.
+func (pt *PageText) WriteALTO(w io.Writer) error {
+	return WriteALTO(w, []*PageText{pt})
+}
+
+// WriteJSON writes `pt` to `w` as a single page JSON document. See WriteJSON for the schema.
+func (pt *PageText) WriteJSON(w io.Writer) error {
+	return WriteJSON(w, []*PageText{pt})
+}
+
+// topLeftBox returns the coordinates of the corners of `bbox` relative to the top left corner of
+// `page` with the y axis pointing down, as used by hOCR and ALTO.
+func topLeftBox(page, bbox model.PdfRectangle) (x0, y0, x1, y1 float64) {
+	return bbox.Llx - page.Llx, page.Ury - bbox.Ury, bbox.Urx - page.Llx, page.Ury - bbox.Lly
+}
+
+// WriteHOCR writes `pages` to `w` as an hOCR document (http://kba.cloud/hocr-spec/1.2/).
+// Each page is written as an ocr_page containing an ocr_carea and an ocr_par for each TextBlock,
+// an ocr_line for each TextLine and an ocrx_word for each TextWord. Bounding boxes are in points
+// relative to the top left corner of the page. Words have x_font and x_fsize properties.
+func WriteHOCR(w io.Writer, pages []*PageText) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"` +
+		` "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">` + "\n")
+	b.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">` + "\n")
+	b.WriteString("<head>\n<title></title>\n")
+	b.WriteString(`<meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>` + "\n")
+	b.WriteString(`<meta name="ocr-system" content="updf"/>` + "\n")
+	b.WriteString(`<meta name="ocr-capabilities"` +
+		` content="ocr_page ocr_carea ocr_par ocr_line ocrx_word ocrp_font"/>` + "\n")
+	b.WriteString("</head>\n<body>\n")
+
+	hocrBox := func(page, bbox model.PdfRectangle) string {
+		x0, y0, x1, y1 := topLeftBox(page, bbox)
+		return fmt.Sprintf("bbox %d %d %d %d", int(math.Floor(x0)), int(math.Floor(y0)),
+			int(math.Ceil(x1)), int(math.Ceil(y1)))
+	}
+	for i, pt := range pages {
+		pageNum := i + 1
+		page := pt.box()
+		fmt.Fprintf(&b, "<div class=\"ocr_page\" id=\"page_%d\" title=\"%s; ppageno %d\">\n",
+			pageNum, hocrBox(page, page), i)
+		numLines, numWords := 0, 0
+		for j, block := range pt.Blocks() {
+			bbox := hocrBox(page, block.BBox)
+			fmt.Fprintf(&b, "<div class=\"ocr_carea\" id=\"block_%d_%d\" title=\"%s\">\n",
+				pageNum, j+1, bbox)
+			fmt.Fprintf(&b, "<p class=\"ocr_par\" id=\"par_%d_%d\" title=\"%s\">\n",
+				pageNum, j+1, bbox)
+			for _, line := range block.Lines {
+				numLines++
+				fmt.Fprintf(&b, "<span class=\"ocr_line\" id=\"line_%d_%d\" title=\"%s\">",
+					pageNum, numLines, hocrBox(page, line.BBox))
+				for k, word := range line.Words {
+					numWords++
+					if k > 0 {
+						b.WriteString(" ")
+					}
+					fmt.Fprintf(&b, "<span class=\"ocrx_word\" id=\"word_%d_%d\" title=\"%s",
+						pageNum, numWords, hocrBox(page, word.BBox))
+					if word.Font != "" {
+						fmt.Fprintf(&b, "; x_font %s", html.EscapeString(word.Font))
+					}
+					if word.FontSize > 0 {
+						fmt.Fprintf(&b, "; x_fsize %g", round2(word.FontSize))
+					}
+					fmt.Fprintf(&b, "\">%s</span>", html.EscapeString(word.Text))
+				}
+				b.WriteString("</span>\n")
+			}
+			b.WriteString("</p>\n</div>\n")
+		}
+		b.WriteString("</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ALTO XML elements. See https://www.loc.gov/standards/alto/
+type altoDocument struct {
+	XMLName     xml.Name        `xml:"alto"`
+	Xmlns       string          `xml:"xmlns,attr"`
+	Description altoDescription `xml:"Description"`
+	Styles      altoStyles      `xml:"Styles"`
+	Layout      altoLayout      `xml:"Layout"`
+}
+
+type altoDescription struct {
+	MeasurementUnit string `xml:"MeasurementUnit"`
+}
+
+type altoStyles struct {
+	TextStyles []altoTextStyle `xml:"TextStyle"`
+}
+
+type altoTextStyle struct {
+	ID         string  `xml:"ID,attr"`
+	FontFamily string  `xml:"FONTFAMILY,attr,omitempty"`
+	FontSize   float64 `xml:"FONTSIZE,attr"`
+}
+
+type altoLayout struct {
+	Pages []altoPage `xml:"Page"`
+}
+
+type altoPage struct {
+	ID            string         `xml:"ID,attr"`
+	PhysicalImgNr int            `xml:"PHYSICAL_IMG_NR,attr"`
+	Width         float64        `xml:"WIDTH,attr"`
+	Height        float64        `xml:"HEIGHT,attr"`
+	PrintSpace    altoPrintSpace `xml:"PrintSpace"`
+}
+
+type altoPrintSpace struct {
+	altoBox
+	TextBlocks []altoTextBlock `xml:"TextBlock"`
+}
+
+type altoBox struct {
+	HPos   float64 `xml:"HPOS,attr"`
+	VPos   float64 `xml:"VPOS,attr"`
+	Width  float64 `xml:"WIDTH,attr"`
+	Height float64 `xml:"HEIGHT,attr"`
+}
+
+type altoTextBlock struct {
+	ID string `xml:"ID,attr"`
+	altoBox
+	TextLines []altoTextLine `xml:"TextLine"`
+}
+
+type altoTextLine struct {
+	ID string `xml:"ID,attr"`
+	altoBox
+	Items []interface{}
+}
+
+type altoString struct {
+	XMLName xml.Name `xml:"String"`
+	ID      string   `xml:"ID,attr"`
+	altoBox
+	StyleRefs string `xml:"STYLEREFS,attr,omitempty"`
+	Content   string `xml:"CONTENT,attr"`
+}
+
+type altoSpace struct {
+	XMLName xml.Name `xml:"SP"`
+	HPos    float64  `xml:"HPOS,attr"`
+	VPos    float64  `xml:"VPOS,attr"`
+	Width   float64  `xml:"WIDTH,attr"`
+}
+
+// newAltoBox returns the ALTO position and size of `bbox` on page `page`.
+func newAltoBox(page, bbox model.PdfRectangle) altoBox {
+	x0, y0, x1, y1 := topLeftBox(page, bbox)
+	return altoBox{
+		HPos:   round2(x0),
+		VPos:   round2(y0),
+		Width:  round2(x1 - x0),
+		Height: round2(y1 - y0),
+	}
+}
+
+// WriteALTO writes `pages` to `w` as an ALTO v4 XML document (https://www.loc.gov/standards/alto/).
+// Each page is written as a Page containing a TextBlock for each TextBlock, a TextLine for each
+// TextLine and a String for each TextWord. Positions are in points (MeasurementUnit "pixel" at
+// 72 dpi) relative to the top left corner of the page. Fonts are written as TextStyles that are
+// referenced by the Strings.
+func WriteALTO(w io.Writer, pages []*PageText) error {
+	doc := altoDocument{
+		Xmlns:       "http://www.loc.gov/standards/alto/ns-v4#",
+		Description: altoDescription{MeasurementUnit: "pixel"},
+	}
+	styleIDs := map[altoTextStyle]string{}
+	styleRef := func(word TextWord) string {
+		key := altoTextStyle{FontFamily: word.Font, FontSize: round2(word.FontSize)}
+		if id, ok := styleIDs[key]; ok {
+			return id
+		}
+		id := fmt.Sprintf("font%d", len(styleIDs)+1)
+		styleIDs[key] = id
+		key.ID = id
+		doc.Styles.TextStyles = append(doc.Styles.TextStyles, key)
+		return id
+	}
+
+	numWords := 0
+	for i, pt := range pages {
+		pageNum := i + 1
+		page := pt.box()
+		ap := altoPage{
+			ID:            fmt.Sprintf("page_%d", pageNum),
+			PhysicalImgNr: pageNum,
+			Width:         round2(page.Width()),
+			Height:        round2(page.Height()),
+		}
+		ap.PrintSpace.altoBox = newAltoBox(page, page)
+		numLines := 0
+		for j, block := range pt.Blocks() {
+			ab := altoTextBlock{
+				ID:      fmt.Sprintf("block_%d_%d", pageNum, j+1),
+				altoBox: newAltoBox(page, block.BBox),
+			}
+			for _, line := range block.Lines {
+				numLines++
+				al := altoTextLine{
+					ID:      fmt.Sprintf("line_%d_%d", pageNum, numLines),
+					altoBox: newAltoBox(page, line.BBox),
+				}
+				for k, word := range line.Words {
+					numWords++
+					if k > 0 {
+						prev := line.Words[k-1].BBox
+						sp := newAltoBox(page, model.PdfRectangle{
+							Llx: prev.Urx, Lly: line.BBox.Lly,
+							Urx: math.Max(prev.Urx, word.BBox.Llx), Ury: line.BBox.Ury,
+						})
+						al.Items = append(al.Items, altoSpace{HPos: sp.HPos, VPos: sp.VPos, Width: sp.Width})
+					}
+					al.Items = append(al.Items, altoString{
+						ID:        fmt.Sprintf("string_%d", numWords),
+						altoBox:   newAltoBox(page, word.BBox),
+						StyleRefs: styleRef(word),
+						Content:   word.Text,
+					})
+				}
+				ab.TextLines = append(ab.TextLines, al)
+			}
+			ap.PrintSpace.TextBlocks = append(ap.PrintSpace.TextBlocks, ab)
+		}
+		doc.Layout.Pages = append(doc.Layout.Pages, ap)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// JSONDocument is the document written by WriteJSON.
+type JSONDocument struct {
+	Pages []JSONPage `json:"pages"`
+}
+
+// JSONPage is a page in a JSONDocument.
+type JSONPage struct {
+	// Number is the (1-offset) position of the page in the pages passed to WriteJSON.
+	Number int `json:"number"`
+	// BBox is the visible region of the page in PDF coordinates.
+	BBox model.PdfRectangle `json:"bbox"`
+	// Text is the extracted text of the page, as returned by PageText.Text().
+	Text string `json:"text"`
+	// Blocks are the blocks of text on the page, as returned by PageText.Blocks().
+	Blocks []TextBlock `json:"blocks"`
+}
+
+// WriteJSON writes `pages` to `w` as a JSONDocument. The schema is
+//
+//	{"pages": [{"number": 1,
+//	            "bbox": {"Llx": 0, "Lly": 0, "Urx": 612, "Ury": 792},
+//	            "text": "...",
+//	            "blocks": [{"bbox": {...},
+//	                        "lines": [{"text": "...", "bbox": {...},
+//	                                   "words": [{"text": "...", "bbox": {...},
+//	                                              "font": "Helvetica", "fontSize": 12}]}]}]}]}
+//
+// All bounding boxes are in PDF coordinates, which have their origin at the bottom left of the
+// page. "font" and "fontSize" are omitted for words where they are not known.
+func WriteJSON(w io.Writer, pages []*PageText) error {
+	doc := JSONDocument{Pages: make([]JSONPage, len(pages))}
+	for i, pt := range pages {
+		doc.Pages[i] = JSONPage{
+			Number: i + 1,
+			BBox:   pt.box(),
+			Text:   pt.Text(),
+			Blocks: pt.Blocks(),
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// round2 returns `x` rounded to 2 decimal places.
+func round2(x float64) float64 {
+	return math.Round(x*100) / 100
+}
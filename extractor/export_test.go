@@ -0,0 +1,152 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/model"
+)
+
+// exportTestPage returns the PageText of a page with a heading block and a two line paragraph.
+func exportTestPage(t *testing.T) *PageText {
+	contents := `
+        BT
+        /UniDocHelvetica 20 Tf
+        72 700 Td
+        (Title & <Intro>)Tj
+        /UniDocHelvetica 10 Tf
+        0 -60 Td
+        (First line)Tj
+        0 -12 Td
+        (Second line)Tj
+        ET
+        `
+	resources := model.NewPdfPageResources()
+	helvetica := model.NewStandard14FontMustCompile(model.HelveticaName)
+	resources.SetFontByName("UniDocHelvetica", helvetica.ToPdfObject())
+	e := Extractor{
+		resources: resources,
+		contents:  contents,
+		pageBox:   &model.PdfRectangle{Llx: 0, Lly: 0, Urx: 612, Ury: 792},
+	}
+	pageText, _, _, err := e.ExtractPageText()
+	require.NoError(t, err)
+	return pageText
+}
+
+func TestTextBlocks(t *testing.T) {
+	blocks := exportTestPage(t).Blocks()
+	require.Len(t, blocks, 2)
+	require.Len(t, blocks[0].Lines, 1)
+	require.Len(t, blocks[1].Lines, 2)
+
+	title := blocks[0].Lines[0]
+	assert.Equal(t, "Title & <Intro>", title.Text)
+	require.Len(t, title.Words, 3)
+	assert.Equal(t, "Helvetica", title.Words[0].Font)
+	assert.Equal(t, 20.0, title.Words[0].FontSize)
+	assert.InDelta(t, 72, title.Words[0].BBox.Llx, 0.01)
+	assert.InDelta(t, 700, title.Words[0].BBox.Lly, 0.01)
+
+	assert.Equal(t, "First line", blocks[1].Lines[0].Text)
+	assert.Equal(t, "Second line", blocks[1].Lines[1].Text)
+	assert.InDelta(t, 628, blocks[1].BBox.Lly, 0.01)
+	assert.InDelta(t, 650, blocks[1].BBox.Ury, 0.01)
+}
+
+func TestWriteHOCR(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, exportTestPage(t).WriteHOCR(&buf))
+	hocr := buf.String()
+
+	assert.Contains(t, hocr, `<div class="ocr_page" id="page_1" title="bbox 0 0 612 792; ppageno 0">`)
+	assert.Equal(t, 2, strings.Count(hocr, `class="ocr_carea"`))
+	assert.Equal(t, 3, strings.Count(hocr, `class="ocr_line"`))
+	assert.Equal(t, 7, strings.Count(hocr, `class="ocrx_word"`))
+	// The word "First" is 10 points high with its top at 792 - 650 = 142.
+	assert.Contains(t, hocr, `title="bbox 72 142 92 152; x_font Helvetica; x_fsize 10">First</span>`)
+	assert.Contains(t, hocr, `>&amp;</span>`)
+	assert.Contains(t, hocr, `>&lt;Intro&gt;</span>`)
+
+	// hOCR is XHTML so it must be well-formed XML.
+	dec := xml.NewDecoder(strings.NewReader(hocr))
+	dec.Strict = false
+	for {
+		_, err := dec.Token()
+		if err != nil {
+			assert.Equal(t, "EOF", err.Error())
+			break
+		}
+	}
+}
+
+func TestWriteALTO(t *testing.T) {
+	var buf bytes.Buffer
+	pt := exportTestPage(t)
+	require.NoError(t, WriteALTO(&buf, []*PageText{pt, pt}))
+
+	var doc struct {
+		Styles []struct {
+			ID       string  `xml:"ID,attr"`
+			Family   string  `xml:"FONTFAMILY,attr"`
+			FontSize float64 `xml:"FONTSIZE,attr"`
+		} `xml:"Styles>TextStyle"`
+		Pages []struct {
+			ID     string  `xml:"ID,attr"`
+			Height float64 `xml:"HEIGHT,attr"`
+			Blocks []struct {
+				Lines []struct {
+					Strings []struct {
+						Content   string  `xml:"CONTENT,attr"`
+						StyleRefs string  `xml:"STYLEREFS,attr"`
+						VPos      float64 `xml:"VPOS,attr"`
+					} `xml:"String"`
+					Spaces []struct{} `xml:"SP"`
+				} `xml:"TextLine"`
+			} `xml:"PrintSpace>TextBlock"`
+		} `xml:"Layout>Page"`
+	}
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &doc))
+
+	require.Len(t, doc.Styles, 2)
+	assert.Equal(t, "Helvetica", doc.Styles[0].Family)
+	assert.Equal(t, 20.0, doc.Styles[0].FontSize)
+	assert.Equal(t, 10.0, doc.Styles[1].FontSize)
+
+	require.Len(t, doc.Pages, 2)
+	assert.Equal(t, "page_2", doc.Pages[1].ID)
+	assert.Equal(t, 792.0, doc.Pages[0].Height)
+	require.Len(t, doc.Pages[0].Blocks, 2)
+	line := doc.Pages[0].Blocks[1].Lines[0]
+	require.Len(t, line.Strings, 2)
+	assert.Len(t, line.Spaces, 1)
+	assert.Equal(t, "First", line.Strings[0].Content)
+	assert.Equal(t, doc.Styles[1].ID, line.Strings[0].StyleRefs)
+	assert.Equal(t, 142.0, line.Strings[0].VPos)
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, exportTestPage(t).WriteJSON(&buf))
+
+	var doc JSONDocument
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	require.Len(t, doc.Pages, 1)
+	page := doc.Pages[0]
+	assert.Equal(t, 1, page.Number)
+	assert.Equal(t, 612.0, page.BBox.Urx)
+	assert.Equal(t, "Title & <Intro>\nFirst line\nSecond line", page.Text)
+	require.Len(t, page.Blocks, 2)
+	assert.Equal(t, "Second", page.Blocks[1].Lines[1].Words[0].Text)
+}
@@ -6,6 +6,7 @@
 package extractor
 
 import (
+	"github.com/zituocn/updf/contentstream"
 	"github.com/zituocn/updf/model"
 )
 
@@ -15,6 +16,13 @@ type Extractor struct {
 	contents  string
 	resources *model.PdfPageResources
 
+	// pageBox is the visible region of the page (the crop box if there is one, otherwise the media
+	// box). It is nil if the page has neither.
+	pageBox *model.PdfRectangle
+
+	// options control the text extraction.
+	options Options
+
 	// fontCache is a simple LRU cache that is used to prevent redundant constructions of PdfFont's from
 	// PDF objects. NOTE: This is not a conventional glyph cache. It only caches PdfFont's.
 	fontCache map[string]fontEntry
@@ -30,8 +38,39 @@ type Extractor struct {
 	textCount int64
 }
 
+// Options controls the behaviour of an Extractor.
+type Options struct {
+	// SkipInvisibleText excludes text that is drawn with a text rendering mode that neither fills
+	// nor strokes the glyphs (Tr 3 and Tr 7). This is how OCR text layers are usually drawn over
+	// scanned page images.
+	SkipInvisibleText bool
+
+	// SkipClippedText excludes text that lies entirely outside the visible region of the page or
+	// outside the current clipping path, including the clipping paths form XObjects are drawn in.
+	SkipClippedText bool
+
+	// GlyphMarks makes each TextMark correspond to exactly one glyph drawn on the page, which is
+	// what is needed for precise redaction and character-level highlighting. The mark bounding
+	// boxes span the glyph's advance width and the font's ascent and descent, and exclude character
+	// and word spacing. Overlapping duplicate glyphs, which are sometimes used to simulate bold
+	// text and are normally removed, are kept.
+	GlyphMarks bool
+
+	// OptionalContent decides which optional content groups (layers) are visible. Text and images
+	// in optional content that isn't visible are excluded. All optional content is extracted if it
+	// is nil. contentstream.NewOCGVisibility gives the layers a viewer shows by default.
+	OptionalContent contentstream.OCGVisibility
+}
+
 // New returns an Extractor instance for extracting content from the input PDF page.
 func New(page *model.PdfPage) (*Extractor, error) {
+	return NewWithOptions(page, nil)
+}
+
+// NewWithOptions returns an Extractor instance for extracting content from the input PDF page
+// with the extraction behaviour controlled by `options`. If `options` is nil, the default
+// options are used.
+func NewWithOptions(page *model.PdfPage, options *Options) (*Extractor, error) {
 	contents, err := page.GetAllContentStreams()
 	if err != nil {
 		return nil, err
@@ -48,5 +87,13 @@ func New(page *model.PdfPage) (*Extractor, error) {
 		fontCache:   map[string]fontEntry{},
 		formResults: map[string]textResult{},
 	}
+	if options != nil {
+		e.options = *options
+	}
+	if page.CropBox != nil {
+		e.pageBox = page.CropBox
+	} else if mbox, err := page.GetMediaBox(); err == nil {
+		e.pageBox = mbox
+	}
 	return e, nil
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/zituocn/updf/common"
 	"github.com/zituocn/updf/contentstream"
 	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/sampling"
 	"github.com/zituocn/updf/model"
 )
 
@@ -16,6 +17,17 @@ import (
 // PDF pages.
 type ImageExtractOptions struct {
 	IncludeInlineStencilMasks bool
+
+	// IncludeEncodedData sets ImageMark.Encoded, Filter and DecodeParms to the image data as stored
+	// in the PDF. This allows e.g. DCTDecode images to be saved as JPEG files without re-encoding.
+	IncludeEncodedData bool
+
+	// CompositeMasks composites the transparency given by the soft mask (SMask) or mask (Mask) of
+	// image XObjects into the alpha channel of ImageMark.Image.
+	CompositeMasks bool
+
+	// IncludeResourceInfo sets ImageMark.Name and ColorSpace.
+	IncludeResourceInfo bool
 }
 
 // ExtractPageImages returns the image contents of the page extractor, including data
@@ -25,7 +37,8 @@ type ImageExtractOptions struct {
 // are not extracted.
 func (e *Extractor) ExtractPageImages(options *ImageExtractOptions) (*PageImages, error) {
 	ctx := &imageExtractContext{
-		options: options,
+		options:         options,
+		optionalContent: e.options.OptionalContent,
 	}
 
 	err := ctx.extractContentStreamImages(e.contents, e.resources)
@@ -59,6 +72,25 @@ type ImageMark struct {
 
 	// Angle in degrees, if rotated.
 	Angle float64
+
+	// Name is the resource name of the image XObject. It is empty for inline images.
+	// It is only set if ImageExtractOptions.IncludeResourceInfo is set.
+	Name string
+
+	// ColorSpace is the colorspace of the image as stored in the PDF. Image has been converted to
+	// RGB from this colorspace. It is only set if ImageExtractOptions.IncludeResourceInfo is set.
+	ColorSpace model.PdfColorspace
+
+	// Encoded is the image data as stored in the PDF, encoded with the filters in Filter.
+	// It is only set if ImageExtractOptions.IncludeEncodedData is set.
+	Encoded []byte
+
+	// Filter is the space separated names of the filters the Encoded data is encoded with, e.g.
+	// "DCTDecode". It is empty for unencoded data.
+	Filter string
+
+	// DecodeParms are the filter parameters for decoding the Encoded data, if any.
+	DecodeParms core.PdfObject
 }
 
 // Provide context for image extraction content stream processing.
@@ -73,11 +105,15 @@ type imageExtractContext struct {
 
 	// Extract options.
 	options *ImageExtractOptions
+
+	// Visibility of optional content groups. Images in hidden optional content are skipped.
+	optionalContent contentstream.OCGVisibility
 }
 
 type cachedImage struct {
 	image *model.Image
 	cs    model.PdfColorspace
+	alpha []byte // 8 bit alpha channel if the image's masks are composited.
 }
 
 func (ctx *imageExtractContext) extractContentStreamImages(contents string, resources *model.PdfPageResources) error {
@@ -95,8 +131,12 @@ func (ctx *imageExtractContext) extractContentStreamImages(contents string, reso
 	}
 
 	processor := contentstream.NewContentStreamProcessor(*operations)
+	processor.SetOptions(contentstream.ProcessorOptions{RecurseForms: true, OCGVisible: ctx.optionalContent})
 	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
 		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState, resources *model.PdfPageResources) error {
+			if !processor.Visible() {
+				return nil
+			}
 			return ctx.processOperand(op, gs, resources)
 		})
 
@@ -132,7 +172,8 @@ func (ctx *imageExtractContext) processOperand(op *contentstream.ContentStreamOp
 		case model.XObjectTypeImage:
 			return ctx.extractXObjectImage(name, gs, resources)
 		case model.XObjectTypeForm:
-			return ctx.extractFormImages(name, gs, resources)
+			// The processor descends into the form's content stream.
+			ctx.xObjectForms++
 		}
 	}
 	return nil
@@ -166,6 +207,20 @@ func (ctx *imageExtractContext) extractInlineImage(iimg *contentstream.ContentSt
 	}
 	imgMark.X, imgMark.Y = gs.CTM.Translation()
 
+	if ctx.options.IncludeResourceInfo {
+		imgMark.ColorSpace = cs
+	}
+
+	if ctx.options.IncludeEncodedData {
+		encoder, err := iimg.GetEncoder()
+		if err != nil {
+			return err
+		}
+		imgMark.Encoded = iimg.GetEncodedData()
+		imgMark.Filter = filterName(encoder)
+		imgMark.DecodeParms = iimg.DecodeParms
+	}
+
 	ctx.extractedImages = append(ctx.extractedImages, imgMark)
 	ctx.inlineImages++
 	return nil
@@ -197,6 +252,12 @@ func (ctx *imageExtractContext) extractXObjectImage(name *core.PdfObjectName, gs
 			image: img,
 			cs:    ximg.ColorSpace,
 		}
+		if ctx.options.CompositeMasks {
+			cimg.alpha, err = imageAlpha(ximg, img)
+			if err != nil {
+				return err
+			}
+		}
 		ctx.cacheXObjectImages[stream] = cimg
 	}
 	img := cimg.image
@@ -206,6 +267,9 @@ func (ctx *imageExtractContext) extractXObjectImage(name *core.PdfObjectName, gs
 	if err != nil {
 		return err
 	}
+	if cimg.alpha != nil {
+		setAlpha(&rgbImg, cimg.alpha)
+	}
 
 	common.Log.Debug("@Do CTM: %s", gs.CTM.String())
 	imgMark := ImageMark{
@@ -216,37 +280,168 @@ func (ctx *imageExtractContext) extractXObjectImage(name *core.PdfObjectName, gs
 	}
 	imgMark.X, imgMark.Y = gs.CTM.Translation()
 
+	if ctx.options.IncludeResourceInfo {
+		imgMark.Name = string(*name)
+		imgMark.ColorSpace = cs
+	}
+
+	if ctx.options.IncludeEncodedData {
+		encoder, err := core.NewEncoderFromStream(stream)
+		if err != nil {
+			return err
+		}
+		imgMark.Encoded = stream.Stream
+		imgMark.Filter = filterName(encoder)
+		imgMark.DecodeParms = core.ResolveReference(stream.Get("DecodeParms"))
+	}
+
 	ctx.extractedImages = append(ctx.extractedImages, imgMark)
 	ctx.xObjectImages++
 	return nil
 }
 
-// Go through the XObject Form content stream (recursive processing).
-func (ctx *imageExtractContext) extractFormImages(name *core.PdfObjectName, gs contentstream.GraphicsState, resources *model.PdfPageResources) error {
-	xform, err := resources.GetXObjectFormByName(*name)
-	if err != nil {
-		return err
+// filterName returns the names of the filters of `encoder` or "" if it doesn't encode.
+func filterName(encoder core.StreamEncoder) string {
+	name := encoder.GetFilterName()
+	if name == core.StreamEncodingFilterNameRaw {
+		return ""
 	}
-	if xform == nil {
-		return nil
+	return name
+}
+
+// imageAlpha returns the 8 bit alpha channel of image XObject `ximg` with decoded image `img`,
+// given by its soft mask (SMask) or mask (Mask). It returns nil if the image has neither.
+func imageAlpha(ximg *model.XObjectImage, img *model.Image) ([]byte, error) {
+	if stream, ok := core.GetStream(ximg.SMask); ok {
+		// Soft mask: a grayscale image whose samples are the alpha values (11.6.5.3).
+		mask, err := maskImage(stream)
+		if err != nil {
+			return nil, err
+		}
+		maxVal := uint32(1)<<uint(mask.BitsPerComponent) - 1
+		samples := imageSamples(mask)
+		alpha := make([]byte, len(samples))
+		for i, val := range samples {
+			alpha[i] = byte(val * 255 / maxVal)
+		}
+		return scaleAlpha(alpha, mask.Width, mask.Height, img.Width, img.Height), nil
 	}
 
-	formContent, err := xform.GetContentStream()
+	switch t := core.ResolveReference(ximg.Mask).(type) {
+	case *core.PdfObjectStream:
+		// Explicit mask: a stencil mask where samples of 1 are masked out (8.9.6.3).
+		mask, err := maskImage(t)
+		if err != nil {
+			return nil, err
+		}
+		opaque := uint32(0)
+		if decode, ok := core.GetArray(t.Get("Decode")); ok {
+			if d, err := decode.ToFloat64Array(); err == nil && len(d) == 2 && d[0] == 1 {
+				opaque = 1
+			}
+		}
+		samples := imageSamples(mask)
+		alpha := make([]byte, len(samples))
+		for i, val := range samples {
+			if val == opaque {
+				alpha[i] = 0xff
+			}
+		}
+		return scaleAlpha(alpha, mask.Width, mask.Height, img.Width, img.Height), nil
+	case *core.PdfObjectArray:
+		// Color key mask: pixels with all components in the ranges are masked out (8.9.6.4).
+		ranges, err := t.ToIntegerArray()
+		if err != nil {
+			return nil, err
+		}
+		n := img.ColorComponents
+		if len(ranges) != 2*n {
+			common.Log.Debug("ERROR: Invalid color key mask %s for %d components", t, n)
+			return nil, nil
+		}
+		samples := imageSamples(img)
+		alpha := make([]byte, len(samples)/n)
+		for i := range alpha {
+			alpha[i] = 0xff
+			masked := true
+			for j := 0; j < n && masked; j++ {
+				val := int(samples[i*n+j])
+				masked = val >= ranges[2*j] && val <= ranges[2*j+1]
+			}
+			if masked {
+				alpha[i] = 0
+			}
+		}
+		return alpha, nil
+	}
+	return nil, nil
+}
+
+// maskImage returns the decoded mask image in `stream`.
+func maskImage(stream *core.PdfObjectStream) (*model.Image, error) {
+	mask, err := model.NewXObjectImageFromStream(stream)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if mask.BitsPerComponent == nil {
+		// Stencil masks have 1 bit per component and may omit BitsPerComponent.
+		bpc := int64(1)
+		mask.BitsPerComponent = &bpc
 	}
+	return mask.ToImage()
+}
 
-	// Process the content stream in the Form object too:
-	formResources := xform.Resources
-	if formResources == nil {
-		formResources = resources
+// imageSamples returns the samples of `img`. Unlike Image.GetSamples it accounts for the padding
+// of rows to whole bytes.
+func imageSamples(img *model.Image) []uint32 {
+	n := img.ColorComponents
+	if n < 1 {
+		n = 1
 	}
+	bpc := int(img.BitsPerComponent)
+	rowLen := int(img.Width) * n
+	stride := (rowLen*bpc + 7) / 8
+	samples := make([]uint32, 0, rowLen*int(img.Height))
+	for y := 0; y < int(img.Height); y++ {
+		if (y+1)*stride > len(img.Data) {
+			break
+		}
+		row := sampling.ResampleBytes(img.Data[y*stride:(y+1)*stride], bpc)
+		samples = append(samples, row[:rowLen]...)
+	}
+	return samples
+}
 
-	// Process the content stream in the Form object too:
-	err = ctx.extractContentStreamImages(string(formContent), formResources)
-	if err != nil {
-		return err
+// scaleAlpha returns the `width` x `height` alpha channel that results from scaling the
+// `w` x `h` alpha channel `alpha` with nearest neighbor sampling.
+func scaleAlpha(alpha []byte, w, h, width, height int64) []byte {
+	if w == width && h == height {
+		return alpha
+	}
+	scaled := make([]byte, width*height)
+	for y := int64(0); y < height; y++ {
+		sy := y * h / height
+		for x := int64(0); x < width; x++ {
+			if i := sy*w + x*w/width; i < int64(len(alpha)) {
+				scaled[y*width+x] = alpha[i]
+			}
+		}
+	}
+	return scaled
+}
+
+// setAlpha sets the alpha channel of `img` to 8 bit alpha channel `alpha`.
+func setAlpha(img *model.Image, alpha []byte) {
+	switch img.BitsPerComponent {
+	case 8:
+		img.SetAlpha(alpha)
+	case 16:
+		alpha16 := make([]byte, 2*len(alpha))
+		for i, a := range alpha {
+			alpha16[2*i], alpha16[2*i+1] = a, a
+		}
+		img.SetAlpha(alpha16)
+	default:
+		common.Log.Debug("Unable to composite mask with %d bit image", img.BitsPerComponent)
 	}
-	ctx.xObjectForms++
-	return nil
 }
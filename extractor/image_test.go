@@ -357,3 +357,112 @@ func BenchmarkImageExtraction(b *testing.B) {
 
 	assert.Equal(b, b.N, cnt)
 }
+
+// Test extraction of encoded image data, resource information and soft mask transparency.
+func TestImageExtractionOptions(t *testing.T) {
+	rgb := &model.Image{
+		Width:            2,
+		Height:           2,
+		BitsPerComponent: 8,
+		ColorComponents:  3,
+		Data:             []byte{255, 0, 0, 0, 255, 0, 0, 0, 255, 255, 255, 255},
+	}
+	ximg, err := model.NewXObjectImageFromImage(rgb, nil, core.NewFlateEncoder())
+	require.NoError(t, err)
+
+	// A 1x1 soft mask that is scaled to the size of the image.
+	smask := &model.Image{
+		Width:            1,
+		Height:           1,
+		BitsPerComponent: 8,
+		ColorComponents:  1,
+		Data:             []byte{0x80},
+	}
+	smaskImg, err := model.NewXObjectImageFromImage(smask, model.NewPdfColorspaceDeviceGray(), nil)
+	require.NoError(t, err)
+	ximg.SMask = smaskImg.ToPdfObject()
+
+	page := model.NewPdfPage()
+	require.NoError(t, page.Resources.SetXObjectImageByName("Im1", ximg))
+	require.NoError(t, page.SetContentStreams([]string{"q 20 0 0 20 10 10 cm /Im1 Do Q"}, nil))
+	e, err := New(page)
+	require.NoError(t, err)
+
+	pageImages, err := e.ExtractPageImages(nil)
+	require.NoError(t, err)
+	require.Len(t, pageImages.Images, 1)
+	img := pageImages.Images[0]
+	assert.Equal(t, "", img.Name)
+	assert.Nil(t, img.ColorSpace)
+	assert.Nil(t, img.Encoded)
+	goimg, err := img.Image.ToGoImage()
+	require.NoError(t, err)
+	_, _, _, a := goimg.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), a)
+
+	pageImages, err = e.ExtractPageImages(&ImageExtractOptions{
+		IncludeEncodedData:  true,
+		CompositeMasks:      true,
+		IncludeResourceInfo: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, pageImages.Images, 1)
+	img = pageImages.Images[0]
+	assert.Equal(t, "Im1", img.Name)
+	assert.Equal(t, "DeviceRGB", img.ColorSpace.String())
+	assert.Equal(t, core.StreamEncodingFilterNameFlate, img.Filter)
+	decoded, err := core.NewFlateEncoder().DecodeBytes(img.Encoded)
+	require.NoError(t, err)
+	assert.Equal(t, rgb.Data, decoded)
+
+	goimg, err = img.Image.ToGoImage()
+	require.NoError(t, err)
+	for _, p := range [][2]int{{0, 0}, {1, 1}} {
+		r, _, _, a := goimg.At(p[0], p[1]).RGBA()
+		assert.Equal(t, uint32(0x8080), a)
+		if p[0] == 0 {
+			assert.Equal(t, uint32(0xffff), r)
+		}
+	}
+}
+
+// Test that stencil masks (Mask) and color key masks are composited into the alpha channel.
+func TestImageAlphaMasks(t *testing.T) {
+	img := &model.Image{
+		Width:            3,
+		Height:           1,
+		BitsPerComponent: 8,
+		ColorComponents:  1,
+		Data:             []byte{10, 100, 200},
+	}
+	ximg := model.NewXObjectImage()
+
+	ximg.Mask = core.MakeArrayFromIntegers([]int{90, 150})
+	alpha, err := imageAlpha(ximg, img)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0, 0xff}, alpha)
+
+	stencil, err := core.MakeStream([]byte{0x40}, nil)
+	require.NoError(t, err)
+	stencil.Set("Width", core.MakeInteger(3))
+	stencil.Set("Height", core.MakeInteger(1))
+	stencil.Set("ImageMask", core.MakeBool(true))
+	ximg.Mask = stencil
+	alpha, err = imageAlpha(ximg, img)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0, 0xff}, alpha)
+
+	// Rows of color key masked images with less than 8 bits per component are padded to whole
+	// bytes.
+	img = &model.Image{
+		Width:            3,
+		Height:           2,
+		BitsPerComponent: 4,
+		ColorComponents:  1,
+		Data:             []byte{0x1f, 0x10, 0xf1, 0xf0},
+	}
+	ximg.Mask = core.MakeArrayFromIntegers([]int{15, 15})
+	alpha, err = imageAlpha(ximg, img)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0, 0xff, 0, 0xff, 0}, alpha)
+}
@@ -0,0 +1,195 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"strings"
+
+	"github.com/zituocn/updf/contentstream"
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// StructElement represents a structure element of a tagged PDF together with the text of the page
+// content that belongs to it.
+type StructElement struct {
+	// Type is the standard structure type of the element, e.g. "H1", "P", "Table", "TD", "L", "LI"
+	// or "Figure". Non-standard types are mapped to standard types via the document's role map.
+	Type string
+	// Alt is the alternate description of the element, e.g. the description of a figure.
+	Alt string
+	// ActualText is the replacement text of the element's content.
+	ActualText string
+	// Lang is the language of the element's content.
+	Lang string
+	// Content is the element's content in logical order.
+	Content []StructContent
+}
+
+// StructContent is an item of a StructElement's content. It is either the text of a
+// marked-content sequence (Element is nil) or a child structure element.
+type StructContent struct {
+	// Text is the text of a marked-content sequence.
+	Text string
+	// Element is a child structure element.
+	Element *StructElement
+}
+
+// Elements returns the child structure elements of `se`.
+func (se *StructElement) Elements() []*StructElement {
+	var elements []*StructElement
+	for _, c := range se.Content {
+		if c.Element != nil {
+			elements = append(elements, c.Element)
+		}
+	}
+	return elements
+}
+
+// Text returns the text of `se` and its descendants in logical order. If `se` has ActualText,
+// that is returned. Figures, formulas and forms without text return their Alt text.
+// Block-level children are separated by line breaks and the cells of table rows by tabs.
+func (se *StructElement) Text() string {
+	if se.ActualText != "" {
+		return se.ActualText
+	}
+	var b strings.Builder
+	prevBlock := false
+	for _, c := range se.Content {
+		text, block := c.Text, false
+		if c.Element != nil {
+			text = c.Element.Text()
+			block = blockLevelTypes[c.Element.Type]
+		}
+		if text == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			if se.Type == "TR" && c.Element != nil && (c.Element.Type == "TD" || c.Element.Type == "TH") {
+				b.WriteString("\t")
+			} else if (block || prevBlock) && !strings.HasSuffix(b.String(), "\n") {
+				b.WriteString("\n")
+			}
+		}
+		b.WriteString(text)
+		prevBlock = block
+	}
+	if b.Len() == 0 && illustrationTypes[se.Type] {
+		return se.Alt
+	}
+	return b.String()
+}
+
+// blockLevelTypes are the standard block-level structure types (14.8.4.2 - 14.8.4.3).
+var blockLevelTypes = map[string]bool{
+	"Document": true, "Part": true, "Art": true, "Sect": true, "Div": true, "BlockQuote": true,
+	"Caption": true, "TOC": true, "TOCI": true, "Index": true, "NonStruct": true, "Private": true,
+	"P": true, "H": true, "H1": true, "H2": true, "H3": true, "H4": true, "H5": true, "H6": true,
+	"L": true, "LI": true, "Lbl": true, "LBody": true, "Table": true, "TR": true, "TH": true,
+	"TD": true, "THead": true, "TBody": true, "TFoot": true, "Figure": true, "Formula": true,
+	"Form": true,
+}
+
+// illustrationTypes are the standard illustration structure types (14.8.4.5).
+var illustrationTypes = map[string]bool{"Figure": true, "Formula": true, "Form": true}
+
+// ExtractStructure returns the text of the tagged PDF read by `reader` grouped by the elements of
+// its structure tree in logical order. It returns nil if the document has no structure tree.
+// `options` control the text extraction as in NewWithOptions. It may be nil.
+//
+// Only marked content drawn in the pages' content streams and in form XObjects drawn by them is
+// attributed to structure elements. The marked-content sequences of form XObjects are referenced
+// by their streams, and form XObject text outside them belongs to the sequence the form is drawn
+// in.
+func ExtractStructure(reader *model.PdfReader, options *Options) ([]*StructElement, error) {
+	root, err := reader.GetStructTreeRoot()
+	if err != nil || root == nil {
+		return nil, err
+	}
+
+	// pageTexts maps page objects to the texts of the marked-content sequences on those pages.
+	pageTexts := map[*core.PdfIndirectObject]map[markedContentKey]string{}
+	for _, page := range reader.PageList {
+		e, err := NewWithOptions(page, options)
+		if err != nil {
+			return nil, err
+		}
+		texts, err := e.markedContentTexts()
+		if err != nil {
+			return nil, err
+		}
+		pageTexts[page.GetPageAsIndirectObject()] = texts
+	}
+
+	var elements []*StructElement
+	for _, elem := range root.Kids {
+		elements = append(elements, newStructElement(root, elem, pageTexts))
+	}
+	return elements, nil
+}
+
+// newStructElement returns the StructElement for `elem` in structure tree `root`. `pageTexts`
+// contains the marked-content sequence texts for each page.
+func newStructElement(root *model.PdfStructTreeRoot, elem *model.PdfStructElement,
+	pageTexts map[*core.PdfIndirectObject]map[markedContentKey]string) *StructElement {
+	se := &StructElement{
+		Type:       root.StandardType(elem.S),
+		Alt:        elem.Alt,
+		ActualText: elem.ActualText,
+		Lang:       elem.Lang,
+	}
+	for _, kid := range elem.Kids {
+		switch {
+		case kid.Element != nil:
+			se.Content = append(se.Content, StructContent{Element: newStructElement(root, kid.Element, pageTexts)})
+		case kid.MCID >= 0 && kid.Page != nil:
+			if text, ok := pageTexts[kid.Page][markedContentKey{stream: kid.Stream, mcid: kid.MCID}]; ok {
+				se.Content = append(se.Content, StructContent{Text: text})
+			}
+		}
+	}
+	return se
+}
+
+// markedContentKey identifies a marked-content sequence on a page by the form XObject stream
+// containing it, nil for the page's content stream, and its marked-content identifier (MCID).
+type markedContentKey struct {
+	stream core.PdfObject
+	mcid   int
+}
+
+// markedContentTexts returns the texts of the marked-content sequences on the page of `e`.
+func (e *Extractor) markedContentTexts() (map[markedContentKey]string, error) {
+	pt, _, _, err := e.extractPageText(e.contents, e.resources, e.pageBox, 0)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[markedContentKey][]textMark{}
+	for _, tm := range pt.marks {
+		if tm.mcid >= 0 {
+			key := markedContentKey{stream: tm.mcStream, mcid: tm.mcid}
+			groups[key] = append(groups[key], tm)
+		}
+	}
+	texts := make(map[markedContentKey]string, len(groups))
+	for key, marks := range groups {
+		group := PageText{marks: marks, keepDuplicates: e.options.GlyphMarks}
+		group.computeViews()
+		texts[key] = group.viewText
+	}
+	return texts, nil
+}
+
+// markedContentID returns the marked-content identifier of the innermost marked-content sequence
+// of `mcs` that has one, or -1 if there is none.
+func markedContentID(mcs []contentstream.MarkedContent) int {
+	for i := len(mcs) - 1; i >= 0; i-- {
+		if mcid := mcs[i].MCID(); mcid >= 0 {
+			return mcid
+		}
+	}
+	return -1
+}
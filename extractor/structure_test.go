@@ -0,0 +1,122 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/model"
+)
+
+// taggedPDF returns a one page tagged PDF whose structure tree orders the page content differently
+// from the content stream. The page draws a form XObject with marked content of its own.
+func taggedPDF() []byte {
+	contents := `/H1 <</MCID 0>> BDC BT /F1 20 Tf 72 700 Td (Title) Tj ET EMC
+/P <</MCID 1>> BDC BT /F1 10 Tf 72 650 Td (Body text) Tj ET EMC
+/TD /P0 BDC BT 72 600 Td (A) Tj ET EMC
+/TD <</MCID 3>> BDC BT 200 600 Td (B) Tj ET EMC
+/Artifact BMC BT 72 50 Td (Footer) Tj ET EMC
+/Fm1 Do`
+	form := `/Caption <</MCID 0>> BDC BT /F1 10 Tf 72 500 Td (Caption) Tj ET EMC`
+	objects := []string{
+		`<< /Type /Catalog /Pages 2 0 R /StructTreeRoot 5 0 R /MarkInfo << /Marked true >> >>`,
+		`<< /Type /Pages /Kids [3 0 R] /Count 1 >>`,
+		`<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R
+   /Resources << /Font << /F1 6 0 R >> /Properties << /P0 << /MCID 2 >> >> /XObject << /Fm1 12 0 R >> >> >>`,
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(contents)+1, contents),
+		`<< /Type /StructTreeRoot /K 7 0 R /RoleMap << /Heading /H1 /Cell /TD >> >>`,
+		`<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>`,
+		`<< /Type /StructElem /S /Document /P 5 0 R /K [8 0 R 9 0 R 10 0 R 11 0 R 13 0 R] >>`,
+		`<< /Type /StructElem /S /Heading /P 7 0 R /Pg 3 0 R /K 0 >>`,
+		`<< /Type /StructElem /S /Table /P 7 0 R /Pg 3 0 R /K << /Type /StructElem /S /TR /K [
+   << /Type /StructElem /S /Cell /K << /Type /MCR /MCID 2 >> >>
+   << /Type /StructElem /S /TD /K 3 >> ] >> >>`,
+		`<< /Type /StructElem /S /P /P 7 0 R /Pg 3 0 R /Lang (en-US) /K [1] >>`,
+		`<< /Type /StructElem /S /Figure /P 7 0 R /Alt (Logo) >>`,
+		fmt.Sprintf("<< /Type /XObject /Subtype /Form /BBox [0 0 612 792] /Resources << /Font << /F1 6 0 R >> >>"+
+			" /Length %d >>\nstream\n%s\nendstream", len(form)+1, form),
+		`<< /Type /StructElem /S /Caption /P 7 0 R /Pg 3 0 R /K << /Type /MCR /Stm 12 0 R /MCID 0 >> >>`,
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestStructTreeRoot(t *testing.T) {
+	reader, err := model.NewPdfReader(bytes.NewReader(taggedPDF()))
+	require.NoError(t, err)
+	root, err := reader.GetStructTreeRoot()
+	require.NoError(t, err)
+	require.NotNil(t, root)
+
+	require.Len(t, root.Kids, 1)
+	doc := root.Kids[0]
+	assert.Equal(t, "Document", doc.S)
+	require.Len(t, doc.Kids, 5)
+	heading := doc.Kids[0].Element
+	require.NotNil(t, heading)
+	assert.Equal(t, "Heading", heading.S)
+	assert.Equal(t, "H1", root.StandardType(heading.S))
+	assert.Equal(t, doc, heading.Parent)
+	require.Len(t, heading.Kids, 1)
+	assert.Equal(t, 0, heading.Kids[0].MCID)
+	assert.NotNil(t, heading.Kids[0].Page)
+	assert.Equal(t, "en-US", doc.Kids[2].Element.Lang)
+
+	// The table cells inherit the page of the table.
+	cell := doc.Kids[1].Element.Kids[0].Element.Kids[0].Element
+	require.NotNil(t, cell)
+	require.Len(t, cell.Kids, 1)
+	assert.Equal(t, doc.Kids[1].Element.Page, cell.Kids[0].Page)
+	assert.NotNil(t, cell.Kids[0].Page)
+
+	caption := doc.Kids[4].Element
+	require.Len(t, caption.Kids, 1)
+	assert.Equal(t, 0, caption.Kids[0].MCID)
+	assert.NotNil(t, caption.Kids[0].Stream)
+}
+
+func TestExtractStructure(t *testing.T) {
+	reader, err := model.NewPdfReader(bytes.NewReader(taggedPDF()))
+	require.NoError(t, err)
+	elements, err := ExtractStructure(reader, nil)
+	require.NoError(t, err)
+	require.Len(t, elements, 1)
+
+	doc := elements[0]
+	kids := doc.Elements()
+	require.Len(t, kids, 5)
+	assert.Equal(t, "H1", kids[0].Type)
+	assert.Equal(t, "Title", kids[0].Text())
+	assert.Equal(t, "Table", kids[1].Type)
+	assert.Equal(t, "TD", kids[1].Elements()[0].Elements()[0].Type)
+	assert.Equal(t, "A\tB", kids[1].Text())
+	assert.Equal(t, "Body text", kids[2].Text())
+	assert.Equal(t, "Logo", kids[3].Text())
+	// The marked content of the form doesn't mix with the page's marked content with the same MCID.
+	assert.Equal(t, "Caption", kids[4].Text())
+
+	// The artifact isn't part of the structure and the structure order is used.
+	assert.Equal(t, "Title\nA\tB\nBody text\nLogo\nCaption", doc.Text())
+}
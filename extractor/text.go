@@ -8,6 +8,7 @@ package extractor
 import (
 	"errors"
 	"fmt"
+	"image/color"
 	"math"
 	"sort"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/zituocn/updf/common"
 	"github.com/zituocn/updf/contentstream"
 	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/textmetrics"
 	"github.com/zituocn/updf/internal/transform"
 	"github.com/zituocn/updf/model"
 	"golang.org/x/text/unicode/norm"
@@ -42,10 +44,12 @@ func (e *Extractor) ExtractTextWithStats() (extracted string, numChars int, numM
 
 // ExtractPageText returns the text contents of `e` (an Extractor for a page) as a PageText.
 func (e *Extractor) ExtractPageText() (*PageText, int, int, error) {
-	pt, numChars, numMisses, err := e.extractPageText(e.contents, e.resources, 0)
+	pt, numChars, numMisses, err := e.extractPageText(e.contents, e.resources, e.pageBox, 0)
 	if err != nil {
 		return nil, numChars, numMisses, err
 	}
+	pt.keepDuplicates = e.options.GlyphMarks
+	pt.pageBox = e.pageBox
 	pt.computeViews()
 	procBuf(pt)
 
@@ -53,10 +57,11 @@ func (e *Extractor) ExtractPageText() (*PageText, int, int, error) {
 }
 
 // extractPageText returns the text contents of content stream `e` and resouces `resources` as a
-// PageText.
+// PageText. `pageBox` is the visible region of the content stream in its own coordinate system.
+// It is nil if it is not known.
 // This can be called on a page or a form XObject.
-func (e *Extractor) extractPageText(contents string, resources *model.PdfPageResources, level int) (
-	*PageText, int, int, error) {
+func (e *Extractor) extractPageText(contents string, resources *model.PdfPageResources,
+	pageBox *model.PdfRectangle, level int) (*PageText, int, int, error) {
 	common.Log.Trace("extractPageText: level=%d", level)
 	pageText := &PageText{}
 	state := newTextState()
@@ -71,12 +76,21 @@ func (e *Extractor) extractPageText(contents string, resources *model.PdfPageRes
 	}
 
 	processor := contentstream.NewContentStreamProcessor(*operations)
+	processor.SetOptions(contentstream.ProcessorOptions{OCGVisible: e.options.OptionalContent})
 
 	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
 		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
 			resources *model.PdfPageResources) error {
 
 			operand := op.Operand
+			mcid := markedContentID(processor.MarkedContent())
+			if to != nil {
+				// Colors and marked content may be changed inside a text object so we keep them
+				// current.
+				to.gs = gs
+				to.mcid = mcid
+				to.hidden = !processor.Visible()
+			}
 
 			switch operand {
 			case "q":
@@ -108,7 +122,9 @@ func (e *Extractor) extractPageText(contents string, resources *model.PdfPageRes
 				if to != nil {
 					common.Log.Debug("BT called while in a text object")
 				}
-				to = newTextObject(e, resources, gs, &state, &fontStack)
+				to = newTextObject(e, resources, gs, &state, &fontStack, pageBox)
+				to.mcid = mcid
+				to.hidden = !processor.Visible()
 			case "ET": // End Text
 				pageText.marks = append(pageText.marks, to.marks...)
 				to = nil
@@ -204,7 +220,7 @@ func (e *Extractor) extractPageText(contents string, resources *model.PdfPageRes
 			case "Tf": // Set font.
 				if to == nil {
 					// This is needed for 26-Hazard-Thermal-environment.pdf
-					to = newTextObject(e, resources, gs, &state, &fontStack)
+					to = newTextObject(e, resources, gs, &state, &fontStack, pageBox)
 				}
 				if ok, err := to.checkOp(op, 2, true); !ok {
 					common.Log.Debug("ERROR: Tf err=%v", err)
@@ -284,17 +300,22 @@ func (e *Extractor) extractPageText(contents string, resources *model.PdfPageRes
 				// Handle XObjects by recursing through form XObjects.
 				name := *op.Params[0].(*core.PdfObjectName)
 				_, xtype := resources.GetXObjectByName(name)
-				if xtype != model.XObjectTypeForm {
+				if xtype != model.XObjectTypeForm || !processor.Visible() {
 					break
 				}
-				// Only process each form once.
+				xform, err := resources.GetXObjectFormByName(name)
+				if err != nil {
+					common.Log.Debug("ERROR: %v", err)
+					return err
+				}
+				// The text of the form that is skipped depends on the region it is drawn in so
+				// forms are only processed once if no region is known.
+				var region *model.PdfRectangle
+				if e.options.SkipClippedText {
+					region = formRegion(xform, gs, pageBox)
+				}
 				formResult, ok := e.formResults[string(name)]
-				if !ok {
-					xform, err := resources.GetXObjectFormByName(name)
-					if err != nil {
-						common.Log.Debug("ERROR: %v", err)
-						return err
-					}
+				if !ok || region != nil {
 					formContent, err := xform.GetContentStream()
 					if err != nil {
 						common.Log.Debug("ERROR: %v", err)
@@ -305,16 +326,29 @@ func (e *Extractor) extractPageText(contents string, resources *model.PdfPageRes
 						formResources = resources
 					}
 					tList, numChars, numMisses, err := e.extractPageText(string(formContent),
-						formResources, level+1)
+						formResources, region, level+1)
 					if err != nil {
 						common.Log.Debug("ERROR: %v", err)
 						return err
 					}
 					formResult = textResult{*tList, numChars, numMisses}
-					e.formResults[string(name)] = formResult
+					if region == nil {
+						e.formResults[string(name)] = formResult
+					}
 				}
 
-				pageText.marks = append(pageText.marks, formResult.pageText.marks...)
+				// Form XObject text that isn't in a marked-content sequence of its own belongs to
+				// the marked-content sequence the form is drawn in. The marked-content identifiers
+				// of the form's own sequences are those of the form's content stream.
+				stream, _ := resources.GetXObjectByName(name)
+				for _, tm := range formResult.pageText.marks {
+					if tm.mcid < 0 {
+						tm.mcid = mcid
+					} else if tm.mcStream == nil {
+						tm.mcStream = stream
+					}
+					pageText.marks = append(pageText.marks, tm)
+				}
 				state.numChars += formResult.numChars
 				state.numMisses += formResult.numMisses
 			}
@@ -461,7 +495,7 @@ func (to *textObject) setTextRenderMode(mode int) {
 	if to == nil {
 		return
 	}
-	to.state.tmode = RenderMode(mode)
+	to.state.tmode = newRenderMode(mode)
 }
 
 // setTextRise "Ts". Set text rise.
@@ -632,9 +666,12 @@ type textObject struct {
 	gs        contentstream.GraphicsState
 	fontStack *fontStacker
 	state     *textState
-	tm        transform.Matrix // Text matrix. For the character pointer.
-	tlm       transform.Matrix // Text line matrix. For the start of line pointer.
-	marks     []textMark       // Text marks get written here.
+	pageBox   *model.PdfRectangle // Visible region of the content stream. nil if not known.
+	mcid      int                 // Marked-content identifier of the current marked-content sequence.
+	hidden    bool                // The current text is in optional content that isn't visible.
+	tm        transform.Matrix    // Text matrix. For the character pointer.
+	tlm       transform.Matrix    // Text line matrix. For the start of line pointer.
+	marks     []textMark          // Text marks get written here.
 }
 
 // newTextState returns a default textState.
@@ -647,13 +684,15 @@ func newTextState() textState {
 
 // newTextObject returns a default textObject.
 func newTextObject(e *Extractor, resources *model.PdfPageResources, gs contentstream.GraphicsState,
-	state *textState, fontStack *fontStacker) *textObject {
+	state *textState, fontStack *fontStacker, pageBox *model.PdfRectangle) *textObject {
 	return &textObject{
 		e:         e,
 		resources: resources,
 		gs:        gs,
 		fontStack: fontStack,
 		state:     state,
+		pageBox:   pageBox,
+		mcid:      -1,
 		tm:        transform.IdentityMatrix(),
 		tlm:       transform.IdentityMatrix(),
 	}
@@ -681,7 +720,7 @@ func (to *textObject) renderText(data []byte) error {
 	if !ok {
 		spaceMetrics, _ = model.DefaultFont().GetRuneMetrics(' ')
 	}
-	spaceWidth := spaceMetrics.Wx * glyphTextRatio
+	spaceWidth := spaceMetrics.Wx * textmetrics.GlyphTextRatio
 	common.Log.Trace("spaceWidth=%.2f text=%q font=%s fontSize=%.1f", spaceWidth, runes, font, tfs)
 
 	stateMatrix := transform.NewMatrix(
@@ -691,6 +730,10 @@ func (to *textObject) renderText(data []byte) error {
 
 	common.Log.Trace("renderText: %d codes=%+v runes=%q", len(charcodes), charcodes, runes)
 
+	ascent, descent := textmetrics.FontExtent(font)
+	fillColor := toGoColor(to.gs.ColorspaceNonStroking, to.gs.ColorNonStroking)
+	strokeColor := toGoColor(to.gs.ColorspaceStroking, to.gs.ColorStroking)
+
 	for i, r := range runes {
 		// TODO(peterwilliams97): Need to find and fix cases where this happens.
 		if r == '\x00' {
@@ -718,7 +761,7 @@ func (to *textObject) renderText(data []byte) error {
 		}
 
 		// c is the character size in unscaled text units.
-		c := transform.Point{X: m.Wx * glyphTextRatio, Y: m.Wy * glyphTextRatio}
+		c := transform.Point{X: m.Wx * textmetrics.GlyphTextRatio, Y: m.Wy * textmetrics.GlyphTextRatio}
 
 		// t0 is the end of this character.
 		// t is the displacement of the text cursor when the character is rendered.
@@ -751,8 +794,16 @@ func (to *textObject) renderText(data []byte) error {
 				mark.original = string(original)
 			}
 		}
+		mark.fillColor = fillColor
+		mark.strokeColor = strokeColor
+		mark.advance = c.X * trm.ScalingFactorX()
+		if to.e.options.GlyphMarks {
+			mark.bbox = textmetrics.GlyphBBox(trm, c.X, ascent, descent)
+		}
 		common.Log.Trace("i=%d code=%d mark=%s trm=%s", i, code, mark, trm)
-		to.marks = append(to.marks, mark)
+		if to.include(mark) {
+			to.marks = append(to.marks, mark)
+		}
 
 		// update the text matrix by the displacement of the text location.
 		to.tm.Concat(td)
@@ -762,8 +813,21 @@ func (to *textObject) renderText(data []byte) error {
 	return nil
 }
 
-// glyphTextRatio converts Glyph metrics units to unscaled text space units.
-const glyphTextRatio = 1.0 / 1000.0
+// include returns true if `mark` should be included in the extracted text given the extractor's
+// options.
+func (to *textObject) include(mark textMark) bool {
+	opts := to.e.options
+	if to.hidden {
+		return false
+	}
+	if opts.SkipInvisibleText && !mark.renderMode.Visible() {
+		return false
+	}
+	if opts.SkipClippedText && clipped(mark.bbox, to.gs, to.pageBox) {
+		return false
+	}
+	return true
+}
 
 // translation returns the translation part of `m`.
 func translation(m transform.Matrix) transform.Point {
@@ -798,7 +862,13 @@ type textMark struct {
 	spaceWidth    float64            // Best guess at the width of a space in the font the text was rendered with.
 	font          *model.PdfFont     // The font the mark was drawn with.
 	fontsize      float64            // The font size the mark was drawn with.
-	charspacing   float64            // TODO (peterwilliams97: Should this be exposed in TextMark?
+	charspacing   float64            // Character spacing (Tc) in unscaled text space units.
+	renderMode    RenderMode         // The text rendering mode the mark was drawn with.
+	fillColor     color.Color        // The fill color the mark was drawn with.
+	strokeColor   color.Color        // The stroke color the mark was drawn with.
+	advance       float64            // The advance width of the glyph in device coordinates.
+	mcid          int                // Marked-content identifier of the mark's marked-content sequence or -1.
+	mcStream      core.PdfObject     // Form XObject containing the marked-content sequence, nil for the page.
 	trm           transform.Matrix   // The current text rendering matrix (TRM above).
 	end           transform.Point    // The end of character device coordinates.
 	count         int64              // To help with reading debug logs.
@@ -842,6 +912,8 @@ func (to *textObject) newTextMark(text string, trm transform.Matrix, end transfo
 		font:          font,
 		fontsize:      to.state.tfs,
 		charspacing:   charspacing,
+		renderMode:    to.state.tmode,
+		mcid:          to.mcid,
 		trm:           trm,
 		end:           end,
 		count:         to.e.textCount,
@@ -886,11 +958,17 @@ func (tm textMark) Width() float64 {
 // ToTextMark returns the public view of `tm`.
 func (tm textMark) ToTextMark() TextMark {
 	return TextMark{
-		Text:     tm.text,
-		Original: tm.original,
-		BBox:     tm.bbox,
-		Font:     tm.font,
-		FontSize: tm.fontsize,
+		Text:        tm.text,
+		Original:    tm.original,
+		BBox:        tm.bbox,
+		Font:        tm.font,
+		FontSize:    tm.fontsize,
+		CharSpacing: tm.charspacing,
+		RenderMode:  tm.renderMode,
+		FillColor:   tm.fillColor,
+		StrokeColor: tm.strokeColor,
+		Angle:       tm.trm.Angle(),
+		Advance:     tm.advance,
 	}
 }
 
@@ -899,6 +977,13 @@ type PageText struct {
 	marks     []textMark // Texts and their positions on a PDF page.
 	viewText  string     // Extracted page text.
 	viewMarks []TextMark // Public view of `marks`.
+	viewLines []textLine // The lines of `viewMarks` in reading order.
+
+	// pageBox is the visible region of the page. It is nil if it is not known.
+	pageBox *model.PdfRectangle
+
+	// keepDuplicates stops overlapping duplicate characters from being removed from the lines.
+	keepDuplicates bool
 }
 
 // String returns a string describing `pt`.
@@ -1063,6 +1148,25 @@ type TextMark struct {
 	Font *model.PdfFont
 	// FontSize is the font size the text was drawn with.
 	FontSize float64
+	// CharSpacing is the character spacing (Tc) the text was drawn with in unscaled text space
+	// units.
+	CharSpacing float64
+	// RenderMode is the text rendering mode the text was drawn with. Text with a RenderMode that
+	// is not Visible() is typically the OCR text layer of a scanned page.
+	RenderMode RenderMode
+	// FillColor is the fill color the text was drawn with, converted to RGB. It is nil for marks
+	// that we insert (Meta is true) and for text filled with a pattern.
+	FillColor color.Color
+	// StrokeColor is the stroke color the text was drawn with, converted to RGB. It is nil for
+	// marks that we insert (Meta is true) and for text stroked with a pattern.
+	StrokeColor color.Color
+	// Angle is the clockwise rotation of the text in degrees in the range [0, 360). It is 0 for
+	// horizontal left-to-right text and 270 for text running upwards, e.g. with the text matrix
+	// `0 1 -1 0 x y`.
+	Angle float64
+	// Advance is the advance width of the glyph in device coordinates taken from the font metrics.
+	// It excludes character and word spacing.
+	Advance float64
 	// Offset is the offset of the start of TextMark.Text in the extracted text. If you do this
 	//   text, textMarks := pageText.Text(), pageText.Marks()
 	//   marks := textMarks.Elements()
@@ -1146,6 +1250,7 @@ func (pt *PageText) computeViews() {
 	}
 	pt.viewText = text
 	pt.viewMarks = marks
+	pt.viewLines = lines
 }
 
 // height returns the max height of the elements in `pt.marks`.
@@ -1223,7 +1328,7 @@ func (pt PageText) toLines(tol float64) []textLine {
 	}
 	var lines []textLine
 	for _, o := range orientKeys(tlOrient) {
-		lns := PageText{marks: tlOrient[o]}.toLinesOrient(tol)
+		lns := PageText{marks: tlOrient[o], keepDuplicates: pt.keepDuplicates}.toLinesOrient(tol)
 		lines = append(lines, lns...)
 	}
 	return lines
@@ -1253,7 +1358,7 @@ func (pt PageText) toLinesOrient(tol float64) []textLine {
 		if tm.orientedStart.Y+tol < y {
 			if len(marks) > 0 {
 				tl := newLine(y, xx, marks)
-				if averageCharWidth.running {
+				if averageCharWidth.running && !pt.keepDuplicates {
 					// FIXME(peterwilliams97): Fix and reinstate combineDiacritics.
 					// tl = combineDiacritics(tl, averageCharWidth.ave)
 					tl = removeDuplicates(tl, averageCharWidth.ave)
@@ -1307,7 +1412,7 @@ func (pt PageText) toLinesOrient(tol float64) []textLine {
 	}
 	if len(marks) > 0 {
 		tl := newLine(y, xx, marks)
-		if averageCharWidth.running {
+		if averageCharWidth.running && !pt.keepDuplicates {
 			tl = removeDuplicates(tl, averageCharWidth.ave)
 		}
 		lines = append(lines, tl)
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"math"
@@ -21,6 +22,8 @@ import (
 	"testing"
 
 	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/contentstream"
+	"github.com/zituocn/updf/core"
 	"github.com/zituocn/updf/creator"
 	"github.com/zituocn/updf/model"
 	"golang.org/x/text/unicode/norm"
@@ -140,6 +143,253 @@ func TestTextExtractionFragments(t *testing.T) {
 	}
 }
 
+// TestTextExtractionMarkAttributes tests the color, render mode and angle of extracted text marks
+// and the options for skipping invisible and clipped text.
+func TestTextExtractionMarkAttributes(t *testing.T) {
+	contents := `
+        BT
+        /UniDocCourier 24 Tf
+        1 0 0 rg 0 0 1 RG
+        10 700 Td
+        (Red)Tj
+        3 Tr
+        0 -30 Td
+        (Hidden)Tj
+        ET
+        q
+        0 0 100 100 re W n
+        BT
+        /UniDocCourier 24 Tf
+        0 Tr
+        0 1 -1 0 300 300 Tm
+        (Clipped)Tj
+        ET
+        Q
+        `
+	resources := model.NewPdfPageResources()
+	courier := model.NewStandard14FontMustCompile(model.CourierName)
+	resources.SetFontByName("UniDocCourier", courier.ToPdfObject())
+	pageBox := &model.PdfRectangle{Llx: 0, Lly: 0, Urx: 612, Ury: 792}
+
+	extract := func(options Options) (string, []TextMark) {
+		e := Extractor{resources: resources, contents: contents, pageBox: pageBox, options: options}
+		pageText, _, _, err := e.ExtractPageText()
+		if err != nil {
+			t.Fatalf("ExtractPageText failed. err=%v", err)
+		}
+		return pageText.Text(), pageText.Marks().Elements()
+	}
+
+	text, marks := extract(Options{})
+	if text != "Red\nHidden\nClipped" {
+		t.Fatalf("Text mismatch. Got %q", text)
+	}
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	for _, tm := range marks {
+		if tm.Meta {
+			continue
+		}
+		if tm.FillColor != red || tm.StrokeColor != blue {
+			t.Fatalf("Color mismatch. mark=%s fill=%v stroke=%v", tm, tm.FillColor, tm.StrokeColor)
+		}
+	}
+	if marks[0].RenderMode != RenderModeFill || !marks[0].RenderMode.Visible() {
+		t.Fatalf("Expected visible fill mode. Got %d", marks[0].RenderMode)
+	}
+	if marks[0].Angle != 0 {
+		t.Fatalf("Expected horizontal text. Got %.1f", marks[0].Angle)
+	}
+	var hidden, clipped *TextMark
+	for i, tm := range marks {
+		switch tm.Text {
+		case "H":
+			hidden = &marks[i]
+		case "C":
+			clipped = &marks[i]
+		}
+	}
+	if hidden == nil || hidden.RenderMode != RenderModeInvisible || hidden.RenderMode.Visible() {
+		t.Fatalf("Expected invisible mark. Got %v", hidden)
+	}
+	// The angle is clockwise: text running upwards is rotated by 270 degrees.
+	if clipped == nil || math.Abs(clipped.Angle-270) > 1e-6 {
+		t.Fatalf("Expected rotated mark. Got %v", clipped)
+	}
+
+	text, _ = extract(Options{SkipInvisibleText: true})
+	if text != "Red\nClipped" {
+		t.Fatalf("SkipInvisibleText mismatch. Got %q", text)
+	}
+	text, _ = extract(Options{SkipClippedText: true})
+	if text != "Red\nHidden" {
+		t.Fatalf("SkipClippedText mismatch. Got %q", text)
+	}
+}
+
+// TestTextExtractionClippedForms tests that the SkipClippedText option excludes form XObject text
+// that lies outside the clipping region the form is drawn in.
+func TestTextExtractionClippedForms(t *testing.T) {
+	resources := model.NewPdfPageResources()
+	courier := model.NewStandard14FontMustCompile(model.CourierName)
+	resources.SetFontByName("UniDocCourier", courier.ToPdfObject())
+	addForm := func(name, contents string, matrix []float64) {
+		xform := model.NewXObjectForm()
+		xform.BBox = core.MakeArrayFromFloats([]float64{0, 0, 1000, 792})
+		if matrix != nil {
+			xform.Matrix = core.MakeArrayFromFloats(matrix)
+		}
+		xform.Resources = resources
+		if err := xform.SetContentStream([]byte(contents), nil); err != nil {
+			t.Fatalf("SetContentStream failed. err=%v", err)
+		}
+		if err := resources.SetXObjectFormByName(core.PdfObjectName(name), xform); err != nil {
+			t.Fatalf("SetXObjectFormByName failed. err=%v", err)
+		}
+	}
+	text := "BT /UniDocCourier 24 Tf 10 700 Td (Left)Tj ET BT /UniDocCourier 24 Tf 400 600 Td (Right)Tj ET"
+	addForm("Fm0", text, nil)
+	addForm("Fm1", text, []float64{1, 0, 0, 1, -390, 0})
+	addForm("Fm2", "0 0 300 792 re W n "+text, nil)
+	pageBox := &model.PdfRectangle{Llx: 0, Lly: 0, Urx: 612, Ury: 792}
+
+	testcases := []struct {
+		contents string
+		expected string
+	}{
+		{"/Fm0 Do", "Left\nRight"},
+		{"0 0 300 792 re W n /Fm0 Do", "Left"},
+		{"1 0 0 1 400 0 cm 0 0 300 792 re W n /Fm0 Do", "Left"},
+		{"0 0 300 792 re W n /Fm1 Do", "Right"},
+		{"/Fm1 Do", "Right"},
+		{"200 0 412 792 re W n /Fm2 Do", ""},
+		{"q 0 0 300 792 re W n /Fm0 Do Q q 300 0 312 792 re W n /Fm0 Do Q", "Left\nRight"},
+	}
+	for i, tc := range testcases {
+		e := Extractor{resources: resources, contents: tc.contents, pageBox: pageBox,
+			formResults: map[string]textResult{}, options: Options{SkipClippedText: true}}
+		pageText, _, _, err := e.ExtractPageText()
+		if err != nil {
+			t.Fatalf("ExtractPageText failed. err=%v", err)
+		}
+		if text := pageText.Text(); text != tc.expected {
+			t.Fatalf("%d: Text mismatch. Got %q expected %q", i, text, tc.expected)
+		}
+	}
+}
+
+// TestTextExtractionOptionalContent tests that the OptionalContent option excludes text in hidden
+// layers, both in marked-content sequences and in form XObjects.
+func TestTextExtractionOptionalContent(t *testing.T) {
+	contents := `
+        BT /UniDocCourier 24 Tf 10 700 Td (Base)Tj ET
+        /OC /MC0 BDC
+        BT /UniDocCourier 24 Tf 10 650 Td (Notes)Tj ET
+        EMC
+        /Fm0 Do
+        `
+	newOCG := func(name string) *core.PdfObjectDictionary {
+		ocg := core.MakeDict()
+		ocg.Set("Type", core.MakeName("OCG"))
+		ocg.Set("Name", core.MakeString(name))
+		return ocg
+	}
+	notes, dims := newOCG("Notes"), newOCG("Dimensions")
+
+	resources := model.NewPdfPageResources()
+	courier := model.NewStandard14FontMustCompile(model.CourierName)
+	resources.SetFontByName("UniDocCourier", courier.ToPdfObject())
+	properties := core.MakeDict()
+	properties.Set("MC0", notes)
+	resources.Properties = properties
+	xform := model.NewXObjectForm()
+	xform.BBox = core.MakeArrayFromFloats([]float64{0, 0, 612, 792})
+	xform.OC = dims
+	xform.Resources = resources
+	if err := xform.SetContentStream([]byte("BT /UniDocCourier 24 Tf 10 600 Td (Dims)Tj ET"), nil); err != nil {
+		t.Fatalf("SetContentStream failed. err=%v", err)
+	}
+	if err := resources.SetXObjectFormByName("Fm0", xform); err != nil {
+		t.Fatalf("SetXObjectFormByName failed. err=%v", err)
+	}
+
+	ocProperties := core.MakeDict()
+	config := core.MakeDict()
+	config.Set("OFF", core.MakeArray(notes))
+	ocProperties.Set("D", config)
+
+	testcases := []struct {
+		visible  contentstream.OCGVisibility
+		expected string
+	}{
+		{nil, "Base\nNotes\nDims"},
+		{contentstream.NewOCGVisibility(ocProperties), "Base\nDims"},
+		{contentstream.OCGsHidden("Dimensions"), "Base\nNotes"},
+		{contentstream.OCGsVisible(), "Base"},
+	}
+	for i, tc := range testcases {
+		e := Extractor{resources: resources, contents: contents, formResults: map[string]textResult{},
+			options: Options{OptionalContent: tc.visible}}
+		pageText, _, _, err := e.ExtractPageText()
+		if err != nil {
+			t.Fatalf("ExtractPageText failed. err=%v", err)
+		}
+		if text := pageText.Text(); text != tc.expected {
+			t.Fatalf("%d: Text mismatch. Got %q expected %q", i, text, tc.expected)
+		}
+	}
+}
+
+// TestTextExtractionGlyphMarks tests that the GlyphMarks option gives one mark per glyph with
+// bounding boxes computed from the font metrics.
+func TestTextExtractionGlyphMarks(t *testing.T) {
+	// The second "B" is drawn over the first one to simulate bold text.
+	contents := `
+        BT
+        /UniDocCourier 10 Tf
+        0.5 Tc
+        100 100 Td
+        [(AB) 650 (B)]TJ
+        ET
+        `
+	resources := model.NewPdfPageResources()
+	courier := model.NewStandard14FontMustCompile(model.CourierName)
+	resources.SetFontByName("UniDocCourier", courier.ToPdfObject())
+
+	extract := func(options Options) []TextMark {
+		e := Extractor{resources: resources, contents: contents, options: options}
+		pageText, _, _, err := e.ExtractPageText()
+		if err != nil {
+			t.Fatalf("ExtractPageText failed. err=%v", err)
+		}
+		return pageText.Marks().Elements()
+	}
+
+	if marks := extract(Options{}); len(marks) != 2 {
+		t.Fatalf("Expected duplicate glyph to be removed. Got %d marks", len(marks))
+	}
+
+	marks := extract(Options{GlyphMarks: true})
+	if len(marks) != 3 {
+		t.Fatalf("Expected 3 glyph marks. Got %d", len(marks))
+	}
+	// Courier glyphs are 600 units wide with ascent 629 and descent -157. The advance is 6 points
+	// at 10 point font size and the 0.5 point character spacing is not part of the glyph.
+	expected := []model.PdfRectangle{
+		r(100, 98.43, 106, 106.29),
+		r(106.5, 98.43, 112.5, 106.29),
+		r(106.5, 98.43, 112.5, 106.29),
+	}
+	for i, tm := range marks {
+		if !rectEquals(tm.BBox, expected[i]) {
+			t.Fatalf("i=%d BBox mismatch. Got %+v. Expected %+v", i, tm.BBox, expected[i])
+		}
+		if math.Abs(tm.Advance-6) > 1e-6 {
+			t.Fatalf("i=%d Advance mismatch. Got %.3f", i, tm.Advance)
+		}
+	}
+}
+
 // TestTextExtractionFiles tests text extraction on a set of PDF files.
 // It checks for the existence of specified strings of words on specified pages.
 // We currently only check within lines as our line order is still improving.
@@ -8,9 +8,12 @@ package extractor
 import (
 	"bytes"
 	"fmt"
+	"image/color"
 
+	"github.com/zituocn/updf/common"
 	"github.com/zituocn/updf/common/license"
 	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
 )
 
 // RenderMode specifies the text rendering mode (Tmode), which determines whether showing text shall cause
@@ -26,6 +29,38 @@ const (
 	RenderModeClip                          // Clip
 )
 
+// RenderModeInvisible is the render mode of text that is neither filled nor stroked (Tr 3).
+const RenderModeInvisible RenderMode = 0
+
+// renderModes maps the text rendering mode operand of the Tr operator to a RenderMode
+// (Table 106 - Text Rendering Modes).
+var renderModes = []RenderMode{
+	RenderModeFill,
+	RenderModeStroke,
+	RenderModeFill | RenderModeStroke,
+	RenderModeInvisible,
+	RenderModeFill | RenderModeClip,
+	RenderModeStroke | RenderModeClip,
+	RenderModeFill | RenderModeStroke | RenderModeClip,
+	RenderModeClip,
+}
+
+// newRenderMode returns the RenderMode for Tr operand `mode`. Invalid modes are treated as fill,
+// the default text rendering mode.
+func newRenderMode(mode int) RenderMode {
+	if mode < 0 || mode >= len(renderModes) {
+		common.Log.Debug("ERROR: Invalid text rendering mode %d. Using fill.", mode)
+		return RenderModeFill
+	}
+	return renderModes[mode]
+}
+
+// Visible returns true if text drawn with render mode `rm` is painted on the page, i.e. it is
+// filled or stroked.
+func (rm RenderMode) Visible() bool {
+	return rm&(RenderModeFill|RenderModeStroke) != 0
+}
+
 // toFloatXY returns `objs` as 2 floats, if that's what `objs` is, or an error if it isn't.
 func toFloatXY(objs []core.PdfObject) (x, y float64, err error) {
 	if len(objs) != 2 {
@@ -38,6 +73,25 @@ func toFloatXY(objs []core.PdfObject) (x, y float64, err error) {
 	return floats[0], floats[1], nil
 }
 
+// toGoColor returns the RGB equivalent of color `col` in colorspace `cs` as a Go color, or nil if
+// `col` can't be converted. Pattern colors can't be converted.
+func toGoColor(cs model.PdfColorspace, col model.PdfColor) color.Color {
+	if cs == nil || col == nil {
+		return nil
+	}
+	rgbColor, err := cs.ColorToRGB(col)
+	if err != nil {
+		common.Log.Debug("toGoColor: cs=%s col=%v err=%v", cs, col, err)
+		return nil
+	}
+	rgb, ok := rgbColor.(*model.PdfColorDeviceRGB)
+	if !ok {
+		return nil
+	}
+	c := rgb.ToInteger(8)
+	return color.RGBA{R: uint8(c[0]), G: uint8(c[1]), B: uint8(c[2]), A: 255}
+}
+
 // minFloat returns the lesser of `a` and `b`.
 func minFloat(a, b float64) float64 {
 	if a < b {
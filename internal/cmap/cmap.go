@@ -198,6 +198,21 @@ func (cmap *CMap) CharcodeToUnicode(code CharCode) (rune, bool) {
 	return MissingCodeRune, false
 }
 
+// UnicodeToCharcode returns the character code that maps to rune `r`. If several codes map to
+// `r`, the lowest is returned. The bool return flag is false if no code maps to `r`.
+// NOTE: This only works for ToUnicode cmaps.
+func (cmap *CMap) UnicodeToCharcode(r rune) (CharCode, bool) {
+	var code CharCode
+	found := false
+	for c, s := range cmap.codeToUnicode {
+		if s == r && (!found || c < code) {
+			code = c
+			found = true
+		}
+	}
+	return code, found
+}
+
 // bytesToCharcodes attempts to convert the entire byte array `data` to a list of character codes
 // from the ranges specified by `cmap`'s codespaces.
 // Returns:
@@ -0,0 +1,219 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package icc
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildProfile returns a profile of class `class` with data color space `colorSpace`, profile
+// connection space `pcs` and tags `tags`.
+func buildProfile(class, colorSpace, pcs string, tags map[string][]byte) []byte {
+	var sigs []string
+	for sig := range tags {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+	data := make([]byte, headerSize+4+12*len(sigs))
+	data[8] = 4
+	copy(data[12:], class)
+	copy(data[16:], colorSpace)
+	copy(data[20:], pcs)
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[headerSize:], uint32(len(sigs)))
+	for i, sig := range sigs {
+		entry := data[headerSize+4+12*i:]
+		copy(entry, sig)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[sig])))
+		data = append(data, tags[sig]...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+func fixed(v float64) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+	return b
+}
+
+func xyzTag(x, y, z float64) []byte {
+	tag := append([]byte("XYZ \x00\x00\x00\x00"), fixed(x)...)
+	return append(append(tag, fixed(y)...), fixed(z)...)
+}
+
+func paraTag(params ...float64) []byte {
+	types := map[int]byte{1: 0, 3: 1, 4: 2, 5: 3, 7: 4}
+	tag := []byte{'p', 'a', 'r', 'a', 0, 0, 0, 0, 0, types[len(params)], 0, 0}
+	for _, p := range params {
+		tag = append(tag, fixed(p)...)
+	}
+	return tag
+}
+
+func gammaTag(gamma float64) []byte {
+	return []byte{'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 1, byte(gamma), byte(math.Round((gamma - math.Floor(gamma)) * 256))}
+}
+
+func u16(v float64) []byte {
+	return []byte{byte(uint16(math.Round(v)) >> 8), byte(uint16(math.Round(v)))}
+}
+
+func assertColor(t *testing.T, expected []float64, actual [3]float64, msg string) {
+	for i := range expected {
+		assert.InDelta(t, expected[i], actual[i], 0.005, "%s component %d", msg, i)
+	}
+}
+
+func TestMatrixTRC(t *testing.T) {
+	srgbCurve := paraTag(2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+	data := buildProfile("mntr", ColorSpaceRGB, ColorSpaceXYZ, map[string][]byte{
+		"rXYZ": xyzTag(0.4361, 0.2225, 0.0139),
+		"gXYZ": xyzTag(0.3851, 0.7169, 0.0971),
+		"bXYZ": xyzTag(0.1431, 0.0606, 0.7141),
+		"rTRC": srgbCurve,
+		"gTRC": srgbCurve,
+		"bTRC": srgbCurve,
+	})
+	p, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, 3, p.NumComponents())
+	tr, err := p.NewTransform(IntentRelativeColorimetric)
+	require.NoError(t, err)
+	for _, c := range [][]float64{{0, 0, 0}, {1, 1, 1}, {0.2, 0.5, 0.8}, {1, 0, 0}} {
+		assertColor(t, c, tr.ToSRGB(c), "sRGB")
+	}
+	assertColor(t, D50[:], tr.ToXYZ([]float64{1, 1, 1}), "white")
+
+	gray, err := Parse(buildProfile("mntr", ColorSpaceGray, ColorSpaceXYZ, map[string][]byte{"kTRC": gammaTag(1)}))
+	require.NoError(t, err)
+	tr, err = gray.NewTransform(IntentPerceptual)
+	require.NoError(t, err)
+	assertColor(t, []float64{0.735, 0.735, 0.735}, tr.ToSRGB([]float64{0.5}), "linear gray")
+}
+
+func TestLUT16(t *testing.T) {
+	// A CMYK profile with a 2 point grid. The lightness is 100 for white, 10 for K and 50 for the
+	// other inks. The tables are identities.
+	tag := []byte{'m', 'f', 't', '2', 0, 0, 0, 0, 4, 3, 2, 0}
+	for i := 0; i < 9; i++ {
+		v := 0.0
+		if i%4 == 0 {
+			v = 1
+		}
+		tag = append(tag, fixed(v)...)
+	}
+	tag = append(tag, 0, 2, 0, 2)
+	for i := 0; i < 4; i++ {
+		tag = append(tag, 0, 0, 0xff, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		c, m, y, k := i>>3&1, i>>2&1, i>>1&1, i&1
+		l := 100.0
+		switch {
+		case k == 1:
+			l = 10
+		case c+m+y > 0:
+			l = 50
+		}
+		tag = append(tag, u16(l*652.8)...)
+		tag = append(tag, 0x80, 0, 0x80, 0)
+	}
+	for i := 0; i < 3; i++ {
+		tag = append(tag, 0, 0, 0xff, 0xff)
+	}
+	p, err := Parse(buildProfile("prtr", ColorSpaceCMYK, ColorSpaceLab, map[string][]byte{"A2B0": tag}))
+	require.NoError(t, err)
+	tr, err := p.NewTransform(IntentRelativeColorimetric)
+	require.NoError(t, err)
+
+	assertColor(t, D50[:], tr.ToXYZ([]float64{0, 0, 0, 0}), "white")
+	black := LabToXYZ([3]float64{10, 0, 0})
+	assertColor(t, black[:], tr.ToXYZ([]float64{0, 0, 0, 1}), "black")
+	assertColor(t, []float64{1, 1, 1}, tr.ToSRGB([]float64{0, 0, 0, 0}), "white")
+	// Black point compensation maps the profile's black to sRGB black.
+	assertColor(t, []float64{0, 0, 0}, tr.ToSRGB([]float64{1, 1, 1, 1}), "black")
+	lab55 := XYZToSRGB(LabToXYZ([3]float64{55, 0, 0}))
+	assert.Less(t, tr.ToSRGB([]float64{0, 0, 0, 0.5})[0], lab55[0])
+}
+
+func TestLUTAToB(t *testing.T) {
+	// An identity Lab profile with B curves only.
+	tag := []byte{'m', 'A', 'B', ' ', 0, 0, 0, 0, 3, 3, 0, 0, 0, 0, 0, 32}
+	tag = append(tag, make([]byte, 16)...)
+	for i := 0; i < 3; i++ {
+		tag = append(tag, []byte{'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 0}...)
+	}
+	p, err := Parse(buildProfile("spac", ColorSpaceLab, ColorSpaceLab, map[string][]byte{"A2B0": tag}))
+	require.NoError(t, err)
+	tr, err := p.NewTransform(IntentPerceptual)
+	require.NoError(t, err)
+	for _, lab := range [][3]float64{{50, 0, 0}, {70, 20, -30}, {100, 0, 0}} {
+		xyz := LabToXYZ(lab)
+		assertColor(t, xyz[:], tr.ToXYZ(lab[:]), "Lab")
+	}
+}
+
+// clutAToBTag returns an RGB to Lab mAB tag with identity curves and a 2x2x2 color lookup table
+// of precision `precision`.
+func clutAToBTag(precision byte) []byte {
+	identity := []byte{'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 0}
+	tag := []byte{'m', 'A', 'B', ' ', 0, 0, 0, 0, 3, 3, 0, 0}
+	// Offsets of the B curves, matrix, M curves, CLUT and A curves.
+	for _, offset := range []uint32{32, 0, 0, 68, 136} {
+		tag = append(tag, byte(offset>>24), byte(offset>>16), byte(offset>>8), byte(offset))
+	}
+	for i := 0; i < 3; i++ {
+		tag = append(tag, identity...)
+	}
+	grid := make([]byte, 20)
+	grid[0], grid[1], grid[2], grid[16] = 2, 2, 2, precision
+	tag = append(tag, grid...)
+	tag = append(tag, make([]byte, 2*2*2*3*2)...)
+	for i := 0; i < 3; i++ {
+		tag = append(tag, identity...)
+	}
+	return tag
+}
+
+func TestLUTAToBInvalidPrecision(t *testing.T) {
+	for _, precision := range []byte{1, 2} {
+		p, err := Parse(buildProfile("mntr", ColorSpaceRGB, ColorSpaceLab, map[string][]byte{"A2B0": clutAToBTag(precision)}))
+		require.NoError(t, err)
+		tr, err := p.NewTransform(IntentPerceptual)
+		require.NoError(t, err)
+		tr.ToSRGB([]float64{0.5, 0.5, 0.5})
+	}
+	for _, precision := range []byte{0, 3} {
+		p, err := Parse(buildProfile("mntr", ColorSpaceRGB, ColorSpaceLab, map[string][]byte{"A2B0": clutAToBTag(precision)}))
+		if err == nil {
+			_, err = p.NewTransform(IntentPerceptual)
+		}
+		assert.Error(t, err, "precision %d", precision)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte("short"))
+	assert.Error(t, err)
+	data := buildProfile("mntr", ColorSpaceRGB, ColorSpaceXYZ, map[string][]byte{"rXYZ": xyzTag(1, 1, 1)})
+	_, err = Parse(data[:len(data)-4])
+	assert.Error(t, err)
+	p, err := Parse(data)
+	require.NoError(t, err)
+	_, err = p.NewTransform(IntentPerceptual)
+	assert.Error(t, err)
+}
@@ -0,0 +1,410 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// curve is a one-dimensional transform of values in the range 0 to 1.
+type curve func(x float64) float64
+
+// identityCurve returns its input.
+func identityCurve(x float64) float64 {
+	return x
+}
+
+// parseCurve parses the curveType (10.5) or parametricCurveType (10.16) element at the start of
+// `data`. It returns the curve and the size of the element.
+func parseCurve(data []byte) (curve, int, error) {
+	if len(data) < 12 {
+		return nil, 0, errors.New("curve too short")
+	}
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:]))
+		size := 12 + 2*n
+		if n < 0 || size > len(data) {
+			return nil, 0, errors.New("curve table out of range")
+		}
+		switch n {
+		case 0:
+			return identityCurve, size, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(x float64) float64 { return math.Pow(clamp01(x), gamma) }, size, nil
+		}
+		return tableCurve(u16Table(data[12:size])), size, nil
+	case "para":
+		numParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		n, ok := numParams[binary.BigEndian.Uint16(data[8:])]
+		size := 12 + 4*n
+		if !ok || size > len(data) {
+			return nil, 0, errors.New("invalid parametric curve")
+		}
+		var p [7]float64
+		for i := 0; i < n; i++ {
+			p[i] = s15Fixed16(data[12+4*i:])
+		}
+		return parametricCurve(n, p), size, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported curve type %q", data[:4])
+}
+
+// parametricCurve returns the parametric curve with `n` parameters `p` (Table 65).
+func parametricCurve(n int, p [7]float64) curve {
+	g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+	pow := func(x float64) float64 {
+		if x <= 0 {
+			return 0
+		}
+		return math.Pow(x, g)
+	}
+	return func(x float64) float64 {
+		switch n {
+		case 1:
+			return pow(x)
+		case 3:
+			if a != 0 && x >= -b/a {
+				return pow(a*x + b)
+			}
+			return 0
+		case 4:
+			if a != 0 && x >= -b/a {
+				return pow(a*x+b) + c
+			}
+			return c
+		case 5:
+			if x >= d {
+				return pow(a*x + b)
+			}
+			return c * x
+		default:
+			if x >= d {
+				return pow(a*x+b) + e
+			}
+			return c*x + f
+		}
+	}
+}
+
+// tableCurve returns the curve that interpolates `table`, whose entries are evenly spaced over
+// the range 0 to 1.
+func tableCurve(table []float64) curve {
+	if len(table) == 0 {
+		return identityCurve
+	}
+	return func(x float64) float64 {
+		if len(table) == 1 {
+			return table[0]
+		}
+		x = clamp01(x) * float64(len(table)-1)
+		i := int(x)
+		if i >= len(table)-1 {
+			return table[len(table)-1]
+		}
+		return table[i] + (x-float64(i))*(table[i+1]-table[i])
+	}
+}
+
+// u16Table returns the 16-bit big endian values of `b` normalized to the range 0 to 1.
+func u16Table(b []byte) []float64 {
+	table := make([]float64, len(b)/2)
+	for i := range table {
+		table[i] = float64(binary.BigEndian.Uint16(b[2*i:])) / 65535
+	}
+	return table
+}
+
+// u8Table returns the 8-bit values of `b` normalized to the range 0 to 1.
+func u8Table(b []byte) []float64 {
+	table := make([]float64, len(b))
+	for i, v := range b {
+		table[i] = float64(v) / 255
+	}
+	return table
+}
+
+// clut is a multidimensional color lookup table.
+type clut struct {
+	grid    []int     // Number of grid points of each input.
+	outputs int       // Number of outputs.
+	data    []float64 // Output values in the range 0 to 1. The first input varies the slowest.
+}
+
+// newCLUT returns the color lookup table with `grid` points for each input and `outputs` outputs
+// from `data`, whose values have `precision` bytes. It returns the table and its size in bytes.
+func newCLUT(grid []int, outputs, precision int, data []byte) (*clut, int, error) {
+	if precision != 1 && precision != 2 {
+		return nil, 0, fmt.Errorf("invalid color lookup table precision %d", precision)
+	}
+	n := outputs
+	for _, g := range grid {
+		if g < 1 {
+			return nil, 0, errors.New("invalid color lookup table grid")
+		}
+		n *= g
+		if n > 1<<24 {
+			return nil, 0, errors.New("color lookup table too large")
+		}
+	}
+	size := n * precision
+	if size > len(data) {
+		return nil, 0, errors.New("color lookup table out of range")
+	}
+	c := &clut{grid: grid, outputs: outputs}
+	if precision == 1 {
+		c.data = u8Table(data[:size])
+	} else {
+		c.data = u16Table(data[:size])
+	}
+	return c, size, nil
+}
+
+// lookup returns the outputs of `c` for inputs `in` by multilinear interpolation.
+func (c *clut) lookup(in []float64) []float64 {
+	n := len(c.grid)
+	base := make([]int, n)
+	frac := make([]float64, n)
+	strides := make([]int, n)
+	stride := c.outputs
+	for i := n - 1; i >= 0; i-- {
+		strides[i] = stride
+		stride *= c.grid[i]
+	}
+	for i := 0; i < n; i++ {
+		x := clamp01(in[i]) * float64(c.grid[i]-1)
+		b := int(x)
+		if b > c.grid[i]-2 {
+			b = c.grid[i] - 2
+		}
+		if b < 0 {
+			b = 0
+		}
+		base[i], frac[i] = b, x-float64(b)
+	}
+
+	out := make([]float64, c.outputs)
+	for corner := 0; corner < 1<<uint(n); corner++ {
+		w, offset := 1.0, 0
+		for i := 0; i < n && w != 0; i++ {
+			if corner&(1<<uint(i)) != 0 {
+				w *= frac[i]
+				offset += (base[i] + 1) * strides[i]
+			} else {
+				w *= 1 - frac[i]
+				offset += base[i] * strides[i]
+			}
+		}
+		if w == 0 {
+			continue
+		}
+		for j := range out {
+			out[j] += w * c.data[offset+j]
+		}
+	}
+	return out
+}
+
+// lut is the transform of a lut8Type, lut16Type or lutAToBType element. Its outputs are
+// normalized PCS values.
+type lut struct {
+	inputs, outputs int
+	stages          []func([]float64) []float64
+	legacyLab       bool // The PCS encoding is the legacy 16-bit PCSLab encoding.
+}
+
+// apply returns the outputs of `l` for inputs `in`.
+func (l *lut) apply(in []float64) []float64 {
+	values := append([]float64(nil), in...)
+	for _, stage := range l.stages {
+		values = stage(values)
+	}
+	return values
+}
+
+// curvesStage returns a stage that applies `curves` to its inputs.
+func curvesStage(curves []curve) func([]float64) []float64 {
+	return func(in []float64) []float64 {
+		for i, c := range curves {
+			in[i] = c(in[i])
+		}
+		return in
+	}
+}
+
+// parseLUT parses the lut8Type (10.9), lut16Type (10.10) or lutAToBType (10.11) element `data`.
+func parseLUT(data []byte) (*lut, error) {
+	if len(data) < 12 {
+		return nil, errors.New("lut too short")
+	}
+	switch string(data[:4]) {
+	case "mft1", "mft2":
+		return parseLegacyLUT(data)
+	case "mAB ":
+		return parseLUTAToB(data)
+	}
+	return nil, fmt.Errorf("unsupported lut type %q", data[:4])
+}
+
+// parseLegacyLUT parses the lut8Type or lut16Type element `data`. The matrix is ignored as it's
+// only used for XYZ inputs.
+func parseLegacyLUT(data []byte) (*lut, error) {
+	if len(data) < 52 {
+		return nil, errors.New("lut too short")
+	}
+	wide := string(data[:4]) == "mft2"
+	l := &lut{inputs: int(data[8]), outputs: int(data[9]), legacyLab: wide}
+	grid := int(data[10])
+	if l.inputs < 1 || l.inputs > 15 || l.outputs < 1 || l.outputs > 15 {
+		return nil, errors.New("invalid number of lut channels")
+	}
+
+	precision, inEntries, outEntries, offset := 1, 256, 256, 48
+	if wide {
+		precision, offset = 2, 52
+		inEntries, outEntries = int(binary.BigEndian.Uint16(data[48:])), int(binary.BigEndian.Uint16(data[50:]))
+	}
+	table := func(entries int) (curve, error) {
+		size := entries * precision
+		if offset+size > len(data) {
+			return nil, errors.New("lut table out of range")
+		}
+		b := data[offset : offset+size]
+		offset += size
+		if wide {
+			return tableCurve(u16Table(b)), nil
+		}
+		return tableCurve(u8Table(b)), nil
+	}
+
+	var curves []curve
+	for i := 0; i < l.inputs; i++ {
+		c, err := table(inEntries)
+		if err != nil {
+			return nil, err
+		}
+		curves = append(curves, c)
+	}
+	grids := make([]int, l.inputs)
+	for i := range grids {
+		grids[i] = grid
+	}
+	c, size, err := newCLUT(grids, l.outputs, precision, data[offset:])
+	if err != nil {
+		return nil, err
+	}
+	offset += size
+	var outCurves []curve
+	for i := 0; i < l.outputs; i++ {
+		c, err := table(outEntries)
+		if err != nil {
+			return nil, err
+		}
+		outCurves = append(outCurves, c)
+	}
+	l.stages = append(l.stages, curvesStage(curves), c.lookup, curvesStage(outCurves))
+	return l, nil
+}
+
+// parseLUTAToB parses the lutAToBType element `data`. The elements are applied in the order A
+// curves, CLUT, M curves, matrix and B curves.
+func parseLUTAToB(data []byte) (*lut, error) {
+	if len(data) < 32 {
+		return nil, errors.New("lut too short")
+	}
+	l := &lut{inputs: int(data[8]), outputs: int(data[9])}
+	if l.inputs < 1 || l.inputs > 15 || l.outputs < 1 || l.outputs > 15 {
+		return nil, errors.New("invalid number of lut channels")
+	}
+	offsets := make([]int, 5) // B, matrix, M, CLUT, A.
+	for i := range offsets {
+		offsets[i] = int(binary.BigEndian.Uint32(data[12+4*i:]))
+		if offsets[i] >= len(data) {
+			return nil, errors.New("lut element out of range")
+		}
+	}
+	curves := func(offset, n int) ([]curve, error) {
+		var curves []curve
+		for i := 0; i < n; i++ {
+			if offset >= len(data) {
+				return nil, errors.New("lut curve out of range")
+			}
+			c, size, err := parseCurve(data[offset:])
+			if err != nil {
+				return nil, err
+			}
+			curves = append(curves, c)
+			offset += (size + 3) &^ 3
+		}
+		return curves, nil
+	}
+
+	if offsets[4] != 0 {
+		a, err := curves(offsets[4], l.inputs)
+		if err != nil {
+			return nil, err
+		}
+		l.stages = append(l.stages, curvesStage(a))
+	}
+	if offsets[3] != 0 {
+		b := data[offsets[3]:]
+		if len(b) < 20 {
+			return nil, errors.New("color lookup table too short")
+		}
+		grids := make([]int, l.inputs)
+		for i := range grids {
+			grids[i] = int(b[i])
+		}
+		c, _, err := newCLUT(grids, l.outputs, int(b[16]), b[20:])
+		if err != nil {
+			return nil, err
+		}
+		l.stages = append(l.stages, c.lookup)
+	} else if l.inputs != l.outputs {
+		return nil, errors.New("lut without color lookup table changes the number of channels")
+	}
+	if offsets[2] != 0 {
+		m, err := curves(offsets[2], l.outputs)
+		if err != nil {
+			return nil, err
+		}
+		l.stages = append(l.stages, curvesStage(m))
+	}
+	if offsets[1] != 0 && l.outputs == 3 {
+		if offsets[1]+48 > len(data) {
+			return nil, errors.New("lut matrix out of range")
+		}
+		var e [12]float64
+		for i := range e {
+			e[i] = s15Fixed16(data[offsets[1]+4*i:])
+		}
+		l.stages = append(l.stages, func(in []float64) []float64 {
+			return []float64{
+				e[0]*in[0] + e[1]*in[1] + e[2]*in[2] + e[9],
+				e[3]*in[0] + e[4]*in[1] + e[5]*in[2] + e[10],
+				e[6]*in[0] + e[7]*in[1] + e[8]*in[2] + e[11],
+			}
+		})
+	}
+	if offsets[0] == 0 {
+		return nil, errors.New("lut without B curves")
+	}
+	b, err := curves(offsets[0], l.outputs)
+	if err != nil {
+		return nil, err
+	}
+	l.stages = append(l.stages, curvesStage(b))
+	return l, nil
+}
+
+// clamp01 returns `x` clamped to the range 0 to 1.
+func clamp01(x float64) float64 {
+	return math.Min(math.Max(x, 0), 1)
+}
@@ -0,0 +1,142 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package icc parses ICC color profiles (ICC.1:2004-10 and ICC.1:2010) and converts colors
+// described by them to the profile connection space and sRGB.
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Color space signatures (Table 19).
+const (
+	ColorSpaceXYZ  = "XYZ "
+	ColorSpaceLab  = "Lab "
+	ColorSpaceGray = "GRAY"
+	ColorSpaceRGB  = "RGB "
+	ColorSpaceCMYK = "CMYK"
+)
+
+// Rendering intents (Table 23).
+const (
+	IntentPerceptual = iota
+	IntentRelativeColorimetric
+	IntentSaturation
+	IntentAbsoluteColorimetric
+)
+
+// headerSize is the size of the profile header (7.2).
+const headerSize = 128
+
+// Profile is an ICC profile.
+type Profile struct {
+	Major, Minor int    // Version.
+	Class        string // Device class signature, e.g. "mntr" or "prtr".
+	ColorSpace   string // Data color space signature.
+	PCS          string // Profile connection space signature: ColorSpaceXYZ or ColorSpaceLab.
+	Intent       int    // Rendering intent.
+
+	tags map[string][]byte
+}
+
+// Parse parses ICC profile `data`.
+func Parse(data []byte) (*Profile, error) {
+	if len(data) < headerSize+4 {
+		return nil, errors.New("profile too short")
+	}
+	if string(data[36:40]) != "acsp" {
+		return nil, errors.New("invalid profile signature")
+	}
+	if size := binary.BigEndian.Uint32(data); size >= headerSize+4 && int64(size) < int64(len(data)) {
+		data = data[:size]
+	}
+	p := &Profile{
+		Major:      int(data[8]),
+		Minor:      int(data[9] >> 4),
+		Class:      string(data[12:16]),
+		ColorSpace: string(data[16:20]),
+		PCS:        string(data[20:24]),
+		Intent:     int(binary.BigEndian.Uint32(data[64:])),
+		tags:       map[string][]byte{},
+	}
+	if p.PCS != ColorSpaceXYZ && p.PCS != ColorSpaceLab {
+		return nil, fmt.Errorf("unsupported profile connection space %q", p.PCS)
+	}
+
+	count := int64(binary.BigEndian.Uint32(data[headerSize:]))
+	if headerSize+4+12*count > int64(len(data)) {
+		return nil, errors.New("tag table out of range")
+	}
+	for i := int64(0); i < count; i++ {
+		entry := data[headerSize+4+12*i:]
+		offset := int64(binary.BigEndian.Uint32(entry[4:]))
+		size := int64(binary.BigEndian.Uint32(entry[8:]))
+		if offset+size > int64(len(data)) {
+			return nil, fmt.Errorf("tag %q out of range", entry[:4])
+		}
+		p.tags[string(entry[:4])] = data[offset : offset+size]
+	}
+	return p, nil
+}
+
+// NumComponents returns the number of components of the data color space of `p`. It returns 0 if
+// the color space isn't known.
+func (p *Profile) NumComponents() int {
+	switch p.ColorSpace {
+	case ColorSpaceGray:
+		return 1
+	case ColorSpaceRGB, ColorSpaceLab, ColorSpaceXYZ, "YCbr", "Yxy ", "Luv ", "HSV ", "HLS ", "CMY ":
+		return 3
+	case ColorSpaceCMYK:
+		return 4
+	}
+	// nCLR for 2 to 15 colors.
+	if p.ColorSpace[1:] == "CLR" {
+		var n int
+		if _, err := fmt.Sscanf(p.ColorSpace[:1], "%X", &n); err == nil && n >= 2 {
+			return n
+		}
+	}
+	return 0
+}
+
+// HasTag returns true if `p` has a tag with signature `sig`.
+func (p *Profile) HasTag(sig string) bool {
+	_, ok := p.tags[sig]
+	return ok
+}
+
+// xyz returns the value of XYZType tag `sig` (10.31).
+func (p *Profile) xyz(sig string) ([3]float64, error) {
+	data, ok := p.tags[sig]
+	if !ok {
+		return [3]float64{}, fmt.Errorf("missing tag %q", sig)
+	}
+	if len(data) < 20 || string(data[:4]) != "XYZ " {
+		return [3]float64{}, fmt.Errorf("invalid tag %q", sig)
+	}
+	return [3]float64{s15Fixed16(data[8:]), s15Fixed16(data[12:]), s15Fixed16(data[16:])}, nil
+}
+
+// curve returns the value of curveType or parametricCurveType tag `sig`.
+func (p *Profile) curve(sig string) (curve, error) {
+	data, ok := p.tags[sig]
+	if !ok {
+		return nil, fmt.Errorf("missing tag %q", sig)
+	}
+	c, _, err := parseCurve(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag %q: %v", sig, err)
+	}
+	return c, nil
+}
+
+// s15Fixed16 returns the s15Fixed16Number at the start of `b` (4.6).
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
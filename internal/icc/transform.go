@@ -0,0 +1,187 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package icc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// D50 is the XYZ value of the illuminant of the profile connection space (7.2.16).
+var D50 = [3]float64{0.9642, 1.0, 0.8249}
+
+// Transform converts colors in the data color space of a profile to the profile connection space
+// and to sRGB.
+type Transform struct {
+	inputs int
+	inLab  bool // The input is Lab. It is normalized as in the v4 PCSLab encoding.
+	toXYZ  func(in []float64) [3]float64
+	black  [3]float64 // The darkest color of the profile in XYZ for black point compensation.
+}
+
+// NewTransform returns the transform from the data color space of `p` to its profile connection
+// space for rendering intent `intent`. The AToB tag for the intent is used if the profile has one,
+// then the AToB0 tag and the matrix and tone reproduction curve tags of RGB and gray profiles.
+func (p *Profile) NewTransform(intent int) (*Transform, error) {
+	n := p.NumComponents()
+	if n == 0 {
+		return nil, fmt.Errorf("unsupported color space %q", p.ColorSpace)
+	}
+	if p.Class == "link" || p.Class == "abst" {
+		return nil, fmt.Errorf("unsupported profile class %q", p.Class)
+	}
+	t := &Transform{inputs: n, inLab: p.ColorSpace == ColorSpaceLab}
+
+	sig := fmt.Sprintf("A2B%d", intent)
+	if intent < IntentPerceptual || intent > IntentSaturation || !p.HasTag(sig) {
+		sig = "A2B0"
+	}
+	switch {
+	case p.HasTag(sig):
+		l, err := parseLUT(p.tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %v", sig, err)
+		}
+		if l.inputs != n || l.outputs != 3 {
+			return nil, fmt.Errorf("tag %q has %d inputs and %d outputs", sig, l.inputs, l.outputs)
+		}
+		lab := p.PCS == ColorSpaceLab
+		t.toXYZ = func(in []float64) [3]float64 {
+			if t.inLab && l.legacyLab {
+				in = []float64{in[0] * 65280 / 65535, in[1] * 65280 / 65535, in[2] * 65280 / 65535}
+			}
+			return decodePCS(l.apply(in), lab, l.legacyLab)
+		}
+	case p.ColorSpace == ColorSpaceRGB:
+		var columns [3][3]float64
+		var trcs [3]curve
+		for i, c := range []string{"r", "g", "b"} {
+			var err error
+			if columns[i], err = p.xyz(c + "XYZ"); err != nil {
+				return nil, err
+			}
+			if trcs[i], err = p.curve(c + "TRC"); err != nil {
+				return nil, err
+			}
+		}
+		t.toXYZ = func(in []float64) [3]float64 {
+			var xyz [3]float64
+			for i := range columns {
+				v := trcs[i](clamp01(in[i]))
+				for j := range xyz {
+					xyz[j] += v * columns[i][j]
+				}
+			}
+			return xyz
+		}
+	case p.ColorSpace == ColorSpaceGray:
+		trc, err := p.curve("kTRC")
+		if err != nil {
+			return nil, err
+		}
+		t.toXYZ = func(in []float64) [3]float64 {
+			y := trc(clamp01(in[0]))
+			return [3]float64{D50[0] * y, D50[1] * y, D50[2] * y}
+		}
+	default:
+		return nil, errors.New("profile has no supported transform")
+	}
+
+	// The darkest of the all 0 and all 1 inputs is black.
+	zeros, ones := make([]float64, n), make([]float64, n)
+	for i := range ones {
+		ones[i] = 1
+	}
+	if t.inLab {
+		zeros[1], zeros[2], ones[1], ones[2] = 0.5, 0.5, 0.5, 0.5
+	}
+	t.black = t.toXYZ(zeros)
+	if b := t.toXYZ(ones); b[1] < t.black[1] {
+		t.black = b
+	}
+	return t, nil
+}
+
+// NumComponents returns the number of input components of `t`.
+func (t *Transform) NumComponents() int {
+	return t.inputs
+}
+
+// ToXYZ returns the XYZ value relative to D50 of the color with components `in`. Components are in
+// the range 0 to 1, except for Lab colors, whose components are L* in the range 0 to 100 and a*
+// and b* in the range -128 to 127.
+func (t *Transform) ToXYZ(in []float64) [3]float64 {
+	if len(in) < t.inputs {
+		in = append(in, make([]float64, t.inputs-len(in))...)
+	}
+	in = in[:t.inputs]
+	if t.inLab {
+		in = []float64{in[0] / 100, (in[1] + 128) / 255, (in[2] + 128) / 255}
+	}
+	return t.toXYZ(in)
+}
+
+// ToSRGB returns the sRGB components in the range 0 to 1 of the color with components `in`, as for
+// ToXYZ. Black point compensation maps the darkest color of the profile to sRGB black, as PDF
+// viewers do.
+func (t *Transform) ToSRGB(in []float64) [3]float64 {
+	xyz := t.ToXYZ(in)
+	for i := range xyz {
+		if b := t.black[i]; b > 0 && b < D50[i]/2 {
+			xyz[i] = (xyz[i] - b) * D50[i] / (D50[i] - b)
+		}
+	}
+	return XYZToSRGB(xyz)
+}
+
+// XYZToSRGB returns the sRGB components in the range 0 to 1 of D50 relative XYZ value `xyz`. The
+// white point is adapted to D65 with the Bradford transform. Colors outside the sRGB gamut are
+// clipped.
+func XYZToSRGB(xyz [3]float64) [3]float64 {
+	m := [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	var rgb [3]float64
+	for i := range rgb {
+		v := clamp01(m[i][0]*xyz[0] + m[i][1]*xyz[1] + m[i][2]*xyz[2])
+		if v <= 0.0031308 {
+			rgb[i] = 12.92 * v
+		} else {
+			rgb[i] = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+	}
+	return rgb
+}
+
+// LabToXYZ returns the XYZ value relative to D50 of CIELAB color `lab`.
+func LabToXYZ(lab [3]float64) [3]float64 {
+	f := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+	fy := (lab[0] + 16) / 116
+	return [3]float64{D50[0] * f(fy+lab[1]/500), D50[1] * f(fy), D50[2] * f(fy-lab[2]/200)}
+}
+
+// decodePCS returns the XYZ value of normalized PCS value `v`. `lab` is true for a Lab PCS.
+// `legacy` is true for the legacy 16-bit PCSLab encoding, where 100 is encoded as 0xFF00.
+func decodePCS(v []float64, lab, legacy bool) [3]float64 {
+	if !lab {
+		// u1Fixed15Number: 1.0 is encoded as 0x8000.
+		k := 65535.0 / 32768
+		return [3]float64{v[0] * k, v[1] * k, v[2] * k}
+	}
+	scale := 1.0
+	if legacy {
+		scale = 65535.0 / 65280
+	}
+	return LabToXYZ([3]float64{v[0] * scale * 100, v[1]*scale*255 - 128, v[2]*scale*255 - 128})
+}
@@ -0,0 +1,57 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package textmetrics provides the glyph metrics computations shared by the content stream
+// editing and text extraction packages.
+package textmetrics
+
+import (
+	"math"
+
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+// GlyphTextRatio converts glyph metrics units to unscaled text space units.
+const GlyphTextRatio = 1.0 / 1000.0
+
+// FontExtent returns the ascent and descent of `font` in unscaled text space units. It falls back
+// to an ascent of 1 and descent of 0, the vertical extent used for text marks, if `font` has no
+// usable font descriptor.
+func FontExtent(font *model.PdfFont) (ascent, descent float64) {
+	ascent, descent = 1.0, 0.0
+	if font == nil {
+		return ascent, descent
+	}
+	desc := font.FontDescriptor()
+	if desc == nil {
+		return ascent, descent
+	}
+	a, err := desc.GetAscent()
+	if err != nil {
+		return ascent, descent
+	}
+	d, err := desc.GetDescent()
+	if err != nil || a <= d {
+		return ascent, descent
+	}
+	return a * GlyphTextRatio, d * GlyphTextRatio
+}
+
+// GlyphBBox returns the device space bounding box of a glyph with advance width `width`, ascent
+// `ascent` and descent `descent`, all in unscaled text space units, drawn with text rendering
+// matrix `trm`.
+func GlyphBBox(trm transform.Matrix, width, ascent, descent float64) model.PdfRectangle {
+	x0, y0 := trm.Transform(0, descent)
+	bbox := model.PdfRectangle{Llx: x0, Lly: y0, Urx: x0, Ury: y0}
+	for _, p := range []transform.Point{{X: width, Y: descent}, {X: 0, Y: ascent}, {X: width, Y: ascent}} {
+		x, y := trm.Transform(p.X, p.Y)
+		bbox.Llx = math.Min(bbox.Llx, x)
+		bbox.Lly = math.Min(bbox.Lly, y)
+		bbox.Urx = math.Max(bbox.Urx, x)
+		bbox.Ury = math.Max(bbox.Ury, y)
+	}
+	return bbox
+}
@@ -0,0 +1,37 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textmetrics
+
+import (
+	"testing"
+
+	"github.com/zituocn/updf/internal/transform"
+	"github.com/zituocn/updf/model"
+)
+
+func TestFontExtent(t *testing.T) {
+	if ascent, descent := FontExtent(nil); ascent != 1 || descent != 0 {
+		t.Fatalf("Expected fallback extent. Got %g %g", ascent, descent)
+	}
+	font, err := model.NewStandard14Font(model.HelveticaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ascent, descent := FontExtent(font)
+	if ascent <= 0 || descent >= 0 || ascent > 1 {
+		t.Fatalf("Unexpected Helvetica extent %g %g", ascent, descent)
+	}
+}
+
+func TestGlyphBBox(t *testing.T) {
+	// Text drawn with a 10 point font at (100, 100).
+	trm := transform.NewMatrix(10, 0, 0, 10, 100, 100)
+	bbox := GlyphBBox(trm, 0.5, 0.75, -0.25)
+	expected := model.PdfRectangle{Llx: 100, Lly: 97.5, Urx: 105, Ury: 107.5}
+	if bbox != expected {
+		t.Fatalf("Expected %v. Got %v", expected, bbox)
+	}
+}
@@ -74,6 +74,16 @@ func (m Matrix) Mult(b Matrix) Matrix {
 	return m
 }
 
+// Inverse returns the inverse of `m`. The bool return flag is false if `m` is singular.
+func (m Matrix) Inverse() (Matrix, bool) {
+	det := m[0]*m[4] - m[1]*m[3]
+	if det == 0 {
+		return Matrix{}, false
+	}
+	a, b, c, d := m[4]/det, -m[1]/det, -m[3]/det, m[0]/det
+	return NewMatrix(a, b, c, d, -(a*m[6] + b*m[7]), -(c*m[6] + d*m[7])), true
+}
+
 // Translate appends a translation of `dx`,`dy` to `m`.
 // m.Translate(dx, dy) is equivalent to m.Concat(NewMatrix(1, 0, 0, 1, dx, dy))
 func (m *Matrix) Translate(dx, dy float64) {
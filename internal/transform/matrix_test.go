@@ -61,3 +61,23 @@ func makeAngleCase(r, theta float64) angleCase {
 	d := a
 	return angleCase{params{a, b, c, d, 0, 0}, theta}
 }
+
+// TestInverse tests that Matrix.Inverse() undoes Matrix.Transform().
+func TestInverse(t *testing.T) {
+	for _, test := range angleTests {
+		p := test.params
+		m := NewMatrix(2*p.a, 3*p.b, p.c, p.d, 10, -20)
+		inv, ok := m.Inverse()
+		if !ok {
+			t.Fatalf("No inverse: m=%s", m)
+		}
+		x, y := m.Transform(5, 7)
+		x, y = inv.Transform(x, y)
+		if math.Abs(x-5) > 1e-9 || math.Abs(y-7) > 1e-9 {
+			t.Fatalf("Bad inverse: m=%s inv=%s (5,7) -> (%g,%g)", m, inv, x, y)
+		}
+	}
+	if _, ok := NewMatrix(1, 2, 2, 4, 0, 0).Inverse(); ok {
+		t.Fatalf("Singular matrix has an inverse")
+	}
+}
@@ -26,6 +26,12 @@ type PdfAppender struct {
 	Reader   *PdfReader
 	pages    []*PdfPage
 	acroForm *PdfAcroForm
+	dss      *DSS
+	docMDP   *PdfSignature
+
+	// fieldMDPs are the signatures with FieldMDP transforms, whose signature references are
+	// set to the catalog.
+	fieldMDPs []*PdfSignature
 
 	xrefs          core.XrefTable
 	xrefOffset     int64
@@ -476,6 +482,10 @@ func (a *PdfAppender) Sign(pageNum int, field *PdfFieldSignature) error {
 		return errors.New("signature dictionary cannot be nil")
 	}
 
+	if err := a.prepareSignature(field); err != nil {
+		return err
+	}
+
 	// Get a copy of the selected page.
 	pageIndex := pageNum - 1
 	if pageIndex < 0 || pageIndex > len(a.pages)-1 {
@@ -490,7 +500,122 @@ func (a *PdfAppender) Sign(pageNum int, field *PdfFieldSignature) error {
 	}
 	page.AddAnnotation(field.PdfAnnotationWidget.PdfAnnotation)
 
-	// Add signature field to the form.
+	// Add signature field to the form. The fields of the form are kept as is, including the
+	// signature fields of the earlier signatures.
+	acroForm := a.signatureForm()
+	var fields []*PdfField
+	if acroForm.Fields != nil {
+		fields = *acroForm.Fields
+	}
+	fields = append(fields, field.PdfField)
+	acroForm.Fields = &fields
+	a.ReplaceAcroForm(acroForm)
+
+	// Replace original page.
+	a.UpdatePage(page)
+	a.pages[pageIndex] = page
+
+	return nil
+}
+
+// GetSignatureField returns the unsigned signature field with fully qualified name `name` of the
+// form of the document. The field is signed with SignField.
+func (a *PdfAppender) GetSignatureField(name string) (*PdfFieldSignature, error) {
+	if a.acroForm == a.roReader.AcroForm {
+		a.acroForm = a.Reader.AcroForm
+	}
+	if a.acroForm == nil {
+		return nil, errors.New("document has no form")
+	}
+	for _, field := range a.acroForm.AllFields() {
+		fieldName, err := field.FullName()
+		if err != nil {
+			return nil, err
+		}
+		if fieldName != name {
+			continue
+		}
+		sigField, ok := field.GetContext().(*PdfFieldSignature)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not a signature field", name)
+		}
+		if sigField.V != nil {
+			return nil, fmt.Errorf("signature field %s is already signed", name)
+		}
+		return sigField, nil
+	}
+	return nil, fmt.Errorf("signature field %s not found", name)
+}
+
+// SignField signs the existing signature field `field` of the document, returned by
+// GetSignatureField, with the signature specified by its V field. The appearance of the widget
+// of the field is kept, unless replaced, e.g. with annotator.SetSignatureAppearance.
+func (a *PdfAppender) SignField(field *PdfFieldSignature) error {
+	if field == nil {
+		return errors.New("signature field cannot be nil")
+	}
+	if field.V == nil {
+		return errors.New("signature dictionary cannot be nil")
+	}
+
+	acroForm := a.signatureForm()
+	found := false
+	for _, f := range acroForm.signatureFields() {
+		if f == field {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("signature field not found in the form")
+	}
+	name, err := field.FullName()
+	if err != nil {
+		return err
+	}
+	if a.roReader.AcroForm != nil {
+		for _, f := range a.roReader.AcroForm.signatureFields() {
+			if fieldName, _ := f.FullName(); fieldName == name && f.V != nil {
+				return fmt.Errorf("signature field %s is already signed", name)
+			}
+		}
+	}
+	if err := a.prepareSignature(field); err != nil {
+		return err
+	}
+
+	// The widgets merged in the field dictionary are not updated with the field.
+	for _, widget := range field.Annotations {
+		widget.ToPdfObject()
+	}
+	a.ReplaceAcroForm(acroForm)
+	return nil
+}
+
+// prepareSignature sets up the document for signing signature field `field`: a certification
+// signature is set as the DocMDP signature of the document, and the fields locked by the
+// signature are set as the Lock of the field. The FieldMDP signature references are set to the
+// catalog when writing.
+func (a *PdfAppender) prepareSignature(field *PdfFieldSignature) error {
+	signature := field.V
+	if _, ok := signature.GetDocMDPPermission(); ok {
+		if err := a.checkCertification(); err != nil {
+			return err
+		}
+		a.docMDP = signature
+	}
+	if lock, ok := signature.GetFieldMDP(); ok {
+		if field.Lock == nil {
+			field.Lock = core.MakeIndirectObject(lock.ToPdfObject())
+		}
+		a.fieldMDPs = append(a.fieldMDPs, signature)
+	}
+	return nil
+}
+
+// signatureForm returns the form of the appended revision for adding a signature, with the
+// signature flags set.
+func (a *PdfAppender) signatureForm() *PdfAcroForm {
 	if a.acroForm == a.roReader.AcroForm {
 		a.acroForm = a.Reader.AcroForm
 	}
@@ -498,16 +623,34 @@ func (a *PdfAppender) Sign(pageNum int, field *PdfFieldSignature) error {
 	if acroForm == nil {
 		acroForm = NewPdfAcroForm()
 	}
-	acroForm.SigFlags = core.MakeInteger(3)
 
-	fields := append(acroForm.AllFields(), field.PdfField)
-	acroForm.Fields = &fields
-	a.ReplaceAcroForm(acroForm)
-
-	// Replace original page.
-	a.UpdatePage(page)
-	a.pages[pageIndex] = page
+	// The document contains signatures and must be updated incrementally (Table 219
+	// PDF32000_2008).
+	flags := int64(sigFlagSignaturesExist | sigFlagAppendOnly)
+	if acroForm.SigFlags != nil {
+		flags |= int64(*acroForm.SigFlags)
+	}
+	acroForm.SigFlags = core.MakeInteger(flags)
+	return acroForm
+}
 
+// checkCertification checks that a certification signature can be added to the document: the
+// certification signature must be the first signature of the document.
+func (a *PdfAppender) checkCertification() error {
+	if a.docMDP != nil {
+		return errors.New("document already has a certification signature")
+	}
+	if perms, ok := core.GetDict(a.roReader.catalog.Get("Perms")); ok && perms.Get("DocMDP") != nil {
+		return errors.New("document already has a certification signature")
+	}
+	if a.roReader.AcroForm == nil {
+		return nil
+	}
+	for _, field := range a.roReader.AcroForm.AllFields() {
+		if sigField, ok := field.GetContext().(*PdfFieldSignature); ok && sigField.V != nil {
+			return errors.New("certification signature must be the first signature of the document")
+		}
+	}
 	return nil
 }
 
@@ -520,6 +663,12 @@ func (a *PdfAppender) ReplaceAcroForm(acroForm *PdfAcroForm) {
 	a.acroForm = acroForm
 }
 
+// SetDSS sets the Document Security Store of the document to `dss` in the appended revision.
+// The validation data of the DSS applies to the signatures of the previous revisions.
+func (a *PdfAppender) SetDSS(dss *DSS) {
+	a.dss = dss
+}
+
 // Write writes the Appender output to io.Writer.
 // It can only be called once and further invocations will result in an error.
 func (a *PdfAppender) Write(w io.Writer) error {
@@ -569,6 +718,22 @@ func (a *PdfAppender) Write(w io.Writer) error {
 		writer.catalog.Set("AcroForm", a.acroForm.ToPdfObject())
 		a.updateObjectsDeep(a.acroForm.ToPdfObject(), nil)
 	}
+	if a.docMDP != nil {
+		perms := core.MakeDict()
+		perms.Set("DocMDP", a.docMDP.ToPdfObject())
+		writer.catalog.Set("Perms", perms)
+	}
+	for _, signature := range a.fieldMDPs {
+		// The changes to the fields are analyzed from the catalog.
+		if ref, ok := signature.getReference("FieldMDP"); ok {
+			ref.Set("Data", writer.root)
+		}
+	}
+	if a.dss != nil {
+		dssObj := a.dss.ToPdfObject()
+		writer.catalog.Set("DSS", dssObj)
+		a.updateObjectsDeep(dssObj, nil)
+	}
 
 	a.addNewObject(writer.infoObj)
 	a.addNewObject(writer.root)
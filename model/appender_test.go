@@ -7,17 +7,32 @@ package model_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/gunnsth/pkcs7"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
 	"golang.org/x/crypto/pkcs12"
 
 	"github.com/zituocn/updf/annotator"
@@ -920,7 +935,8 @@ func validateFile(t *testing.T, fileName string) {
 
 	handler, _ := sighandler.NewAdobeX509RSASHA1(nil, nil)
 	handler2, _ := sighandler.NewAdobePKCS7Detached(nil, nil)
-	handlers := []model.SignatureHandler{handler, handler2}
+	handler3, _ := sighandler.NewEtsiCAdESDetached(nil, nil, 0)
+	handlers := []model.SignatureHandler{handler, handler2, handler3}
 
 	res, err := reader.ValidateSignatures(handlers)
 	if err != nil {
@@ -1577,3 +1593,1303 @@ func TestAppenderAttemptMultiWrite(t *testing.T) {
 		t.Fatalf("Second invokation of appender.Write should yield an error")
 	}
 }
+
+func TestAppenderSignPAdES(t *testing.T) {
+	pfxData, err := ioutil.ReadFile(testPKS12Key)
+	require.NoError(t, err)
+	privateKey, cert, err := pkcs12.Decode(pfxData, testPKS12KeyPassword)
+	require.NoError(t, err)
+
+	for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		f, err := os.Open(testPdfFile1)
+		require.NoError(t, err)
+		defer f.Close()
+		reader, err := model.NewPdfReader(f)
+		require.NoError(t, err)
+		appender, err := model.NewPdfAppender(reader)
+		require.NoError(t, err)
+
+		handler, err := sighandler.NewEtsiCAdESDetached(privateKey.(*rsa.PrivateKey), cert, hash)
+		require.NoError(t, err)
+		signature := model.NewPdfSignature(handler)
+		signature.SetName("Test PAdES")
+		signature.SetReason("TestAppenderSignPAdES")
+		signature.SetDate(time.Now(), "")
+		require.NoError(t, signature.Initialize())
+		require.Equal(t, "ETSI.CAdES.detached", signature.SubFilter.String())
+
+		sigField := model.NewPdfFieldSignature(signature)
+		sigField.T = core.MakeString("Signature1")
+		sigField.Rect = core.MakeArray(core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0))
+		require.NoError(t, appender.Sign(1, sigField))
+
+		var buf bytes.Buffer
+		require.NoError(t, appender.Write(&buf))
+		outPath := tempFile(fmt.Sprintf("appender_sign_pades_%d.pdf", hash.Size()*8))
+		require.NoError(t, ioutil.WriteFile(outPath, buf.Bytes(), 0644))
+		validateFile(t, outPath)
+
+		// Modifying the signed bytes invalidates the signature.
+		byteRange, err := parseByteRange(signature.ByteRange)
+		require.NoError(t, err)
+		data := buf.Bytes()
+		data[byteRange[2]+10]++
+		reader, err = model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		validator, err := sighandler.NewEtsiCAdESDetached(nil, nil, 0)
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].IsSigned)
+		require.False(t, res[0].IsVerified)
+		require.NotEmpty(t, res[0].Errors)
+	}
+
+	_, err = sighandler.NewEtsiCAdESDetached(nil, nil, crypto.MD5)
+	require.Error(t, err)
+}
+
+// newTestTimestampAuthority returns an in-process timestamp authority with a self-signed
+// certificate, issuing timestamps at time `now`.
+func newTestTimestampAuthority(t *testing.T, now time.Time) *sighandler.LocalTimestampAuthority {
+	return newTestTimestampAuthorityWithEKU(t, now, true)
+}
+
+// newTestTimestampAuthorityWithEKU returns an in-process timestamp authority with a self-signed
+// certificate having the time stamping extended key usage in a critical extension if `critical`,
+// issuing timestamps at time `now`.
+func newTestTimestampAuthorityWithEKU(t *testing.T, now time.Time, critical bool) *sighandler.LocalTimestampAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	eku, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Critical: critical, Value: eku},
+		},
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certData)
+	require.NoError(t, err)
+
+	tsa := sighandler.NewLocalTimestampAuthority(key, cert)
+	tsa.Now = func() time.Time { return now }
+	return tsa
+}
+
+// signWithHandler signs the first page of PDF `data` with `handler` in a field named `name`,
+// after applying `setup` to the signature if not nil, and returns the output and the signature.
+func signWithHandler(t *testing.T, data []byte, handler model.SignatureHandler, name string, setup func(sig *model.PdfSignature) error) ([]byte, *model.PdfSignature, error) {
+	signature := model.NewPdfSignature(handler)
+	signature.SetName(name)
+	out, err := appendPdf(t, data, func(appender *model.PdfAppender) error {
+		if err := signature.Initialize(); err != nil {
+			return err
+		}
+		if setup != nil {
+			if err := setup(signature); err != nil {
+				return err
+			}
+		}
+		sigField := model.NewPdfFieldSignature(signature)
+		sigField.T = core.MakeString(name)
+		sigField.Rect = core.MakeArray(core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0))
+		return appender.Sign(1, sigField)
+	})
+	return out, signature, err
+}
+
+// countingTimestampClient counts the timestamps requested from a timestamp client.
+type countingTimestampClient struct {
+	sighandler.TimestampClient
+	requests int
+}
+
+func (c *countingTimestampClient) GetTimestamp(digest []byte, hash crypto.Hash) ([]byte, error) {
+	c.requests++
+	return c.TimestampClient.GetTimestamp(digest, hash)
+}
+
+func TestAppenderSignatureTimestamp(t *testing.T) {
+	pfxData, err := ioutil.ReadFile(testPKS12Key)
+	require.NoError(t, err)
+	privateKey, cert, err := pkcs12.Decode(pfxData, testPKS12KeyPassword)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(newTestTimestampAuthority(t, time.Now()))
+	defer server.Close()
+	client := sighandler.NewHTTPTimestampClient(server.URL)
+
+	pkcs7Handler, err := sighandler.NewAdobePKCS7Detached(privateKey.(*rsa.PrivateKey), cert)
+	require.NoError(t, err)
+	cadesHandler, err := sighandler.NewEtsiCAdESDetached(privateKey.(*rsa.PrivateKey), cert, crypto.SHA384)
+	require.NoError(t, err)
+	tokenOID, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14})
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfFile1)
+	require.NoError(t, err)
+
+	for i, handler := range []model.SignatureHandler{pkcs7Handler, cadesHandler} {
+		// A single timestamp is requested, when signing.
+		counter := &countingTimestampClient{TimestampClient: client}
+		handler, err := sighandler.NewSignatureTimestamper(handler, counter, 0)
+		require.NoError(t, err)
+		data, signature, err := signWithHandler(t, input, handler, "Signature1", nil)
+		require.NoError(t, err)
+		require.True(t, bytes.Contains(signature.Contents.Bytes(), tokenOID))
+		require.Equal(t, 1, counter.requests)
+
+		outPath := tempFile(fmt.Sprintf("appender_sign_timestamp_%d.pdf", i+1))
+		require.NoError(t, ioutil.WriteFile(outPath, data, 0644))
+		validateFile(t, outPath)
+	}
+
+	xrsa, err := sighandler.NewAdobeX509RSASHA1(privateKey.(*rsa.PrivateKey), cert)
+	require.NoError(t, err)
+	handler, err := sighandler.NewSignatureTimestamper(xrsa, client, 0)
+	require.NoError(t, err)
+	require.Error(t, model.NewPdfSignature(handler).Initialize())
+}
+
+func TestAppenderDocTimeStamp(t *testing.T) {
+	pfxData, err := ioutil.ReadFile(testPKS12Key)
+	require.NoError(t, err)
+	privateKey, cert, err := pkcs12.Decode(pfxData, testPKS12KeyPassword)
+	require.NoError(t, err)
+	cadesHandler, err := sighandler.NewEtsiCAdESDetached(privateKey.(*rsa.PrivateKey), cert, 0)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfFile1)
+	require.NoError(t, err)
+	signed, _, err := signWithHandler(t, input, cadesHandler, "Signature1", nil)
+	require.NoError(t, err)
+	signedPath := tempFile("appender_doc_timestamp_signed.pdf")
+	require.NoError(t, ioutil.WriteFile(signedPath, signed, 0644))
+
+	// Timestamp the signed document in a new revision.
+	tsTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	counter := &countingTimestampClient{TimestampClient: newTestTimestampAuthority(t, tsTime)}
+	tsHandler, err := sighandler.NewDocTimeStamp(counter, crypto.SHA512)
+	require.NoError(t, err)
+	data, signature, err := signWithHandler(t, signed, tsHandler, "Timestamp1", nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, counter.requests)
+	require.Equal(t, "DocTimeStamp", signature.Type.String())
+	require.Equal(t, "ETSI.RFC3161", signature.SubFilter.String())
+
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	cadesValidator, err := sighandler.NewEtsiCAdESDetached(nil, nil, 0)
+	require.NoError(t, err)
+	tsValidator, err := sighandler.NewDocTimeStamp(nil, 0)
+	require.NoError(t, err)
+	res, err := reader.ValidateSignatures([]model.SignatureHandler{cadesValidator, tsValidator})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for _, r := range res {
+		require.True(t, r.IsVerified, "%v", r.Errors)
+	}
+	require.Equal(t, tsTime, res[1].Date.ToGoTime().UTC())
+
+	// Modifying the header comment invalidates the signature and the timestamp.
+	data[10]++
+	reader, err = model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	res, err = reader.ValidateSignatures([]model.SignatureHandler{cadesValidator, tsValidator})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.False(t, res[0].IsVerified)
+	require.False(t, res[1].IsVerified)
+}
+
+// testRevocationClient is a revocation client issuing OCSP responses and CRLs signed by the
+// issuer of the certificates, for the tests without network access.
+type testRevocationClient struct {
+	issuerKey crypto.Signer
+	revoked   map[string]bool
+	noOCSP    bool
+	noCRL     bool
+
+	// revokedAt is the revocation time of the revoked certificates, an hour ago when zero.
+	revokedAt time.Time
+
+	// validity shifts the validity period of the OCSP responses and CRLs, from an hour ago to
+	// in an hour by default.
+	validity time.Duration
+}
+
+// revocationTime returns the revocation time of the revoked certificates.
+func (c *testRevocationClient) revocationTime() time.Time {
+	if c.revokedAt.IsZero() {
+		return time.Now().Add(-time.Hour)
+	}
+	return c.revokedAt
+}
+
+func (c *testRevocationClient) GetOCSP(cert, issuer *x509.Certificate) ([]byte, error) {
+	if c.noOCSP {
+		return nil, errors.New("OCSP not available")
+	}
+	now := time.Now().Add(c.validity)
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if c.revoked[cert.SerialNumber.String()] {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = c.revocationTime()
+	}
+	return ocsp.CreateResponse(issuer, issuer, template, c.issuerKey)
+}
+
+func (c *testRevocationClient) GetCRL(cert, issuer *x509.Certificate) ([]byte, error) {
+	if c.noCRL {
+		return nil, errors.New("CRL not available")
+	}
+	now := time.Now().Add(c.validity)
+	var revoked []pkix.RevokedCertificate
+	if c.revoked[cert.SerialNumber.String()] {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: c.revocationTime()})
+	}
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          now.Add(-time.Hour),
+		NextUpdate:          now.Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, issuer, c.issuerKey)
+}
+
+// newTestCertificateChain returns a CA and an RSA signer key and certificate issued by the CA.
+func newTestCertificateChain(t *testing.T) (*x509.Certificate, crypto.Signer, *x509.Certificate, *rsa.PrivateKey) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caData, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caData)
+	require.NoError(t, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certData)
+	require.NoError(t, err)
+	return ca, caKey, cert, key
+}
+
+// appendLTV adds the validation data of the signatures of PDF `data` fetched with `client` in a
+// new revision and returns the output.
+func appendLTV(t *testing.T, data []byte, client sighandler.RevocationClient, extraCerts []*x509.Certificate) ([]byte, error) {
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	appender, err := model.NewPdfAppender(reader)
+	require.NoError(t, err)
+	ltv, err := sighandler.NewLTV(appender, client)
+	require.NoError(t, err)
+	ltv.SkipExisting = true
+	if err := ltv.EnableAll(extraCerts); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	require.NoError(t, appender.Write(&buf))
+	return buf.Bytes(), nil
+}
+
+func TestAppenderLTV(t *testing.T) {
+	ca, caKey, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewEtsiCAdESDetached(key, cert, 0)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfFile1)
+	require.NoError(t, err)
+	signed, _, err := signWithHandler(t, input, handler, "Signature1", nil)
+	require.NoError(t, err)
+	validator, err := sighandler.NewEtsiCAdESDetached(nil, nil, 0)
+	require.NoError(t, err)
+
+	validate := func(data []byte) model.SignatureValidationResult {
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		return res[0]
+	}
+
+	// Without validation data, the revocation status is not checked.
+	res := validate(signed)
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.False(t, res.IsRevocationChecked)
+
+	// The issuer of the signer is not in the signature.
+	_, err = appendLTV(t, signed, &testRevocationClient{issuerKey: caKey}, nil)
+	require.Error(t, err)
+	// No revocation information available.
+	_, err = appendLTV(t, signed, &testRevocationClient{issuerKey: caKey, noOCSP: true, noCRL: true}, []*x509.Certificate{ca})
+	require.Error(t, err)
+
+	client := &testRevocationClient{issuerKey: caKey}
+	data, err := appendLTV(t, signed, client, []*x509.Certificate{ca})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(tempFile("appender_ltv.pdf"), data, 0644))
+
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	dss, err := reader.GetDSS()
+	require.NoError(t, err)
+	require.NotNil(t, dss)
+	require.Len(t, dss.Certs, 2)
+	require.Len(t, dss.OCSPs, 1)
+	require.Len(t, dss.CRLs, 0)
+	sigField, ok := reader.AcroForm.AllFields()[0].GetContext().(*model.PdfFieldSignature)
+	require.True(t, ok)
+	vri := dss.GetSignatureVRI(sigField.V)
+	require.NotNil(t, vri)
+	require.Len(t, vri.Cert, 2)
+	require.Len(t, vri.OCSP, 1)
+	certs, err := dss.GetCerts()
+	require.NoError(t, err)
+	require.Equal(t, cert.Raw, certs[0])
+	require.Equal(t, ca.Raw, certs[1])
+
+	res = validate(data)
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.True(t, res.IsRevocationChecked)
+	require.False(t, res.IsRevoked)
+
+	// The existing validation data is kept.
+	data2, err := appendLTV(t, data, client, nil)
+	require.NoError(t, err)
+	reader, err = model.NewPdfReader(bytes.NewReader(data2))
+	require.NoError(t, err)
+	dss, err = reader.GetDSS()
+	require.NoError(t, err)
+	require.Len(t, dss.Certs, 2)
+	require.Len(t, dss.OCSPs, 1)
+	require.Len(t, dss.VRI, 1)
+
+	// Revoked signer certificate in a CRL.
+	client = &testRevocationClient{issuerKey: caKey, noOCSP: true, revoked: map[string]bool{cert.SerialNumber.String(): true}}
+	data, err = appendLTV(t, signed, client, []*x509.Certificate{ca})
+	require.NoError(t, err)
+	reader, err = model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	dss, err = reader.GetDSS()
+	require.NoError(t, err)
+	require.Len(t, dss.OCSPs, 0)
+	require.Len(t, dss.CRLs, 1)
+	res = validate(data)
+	require.True(t, res.IsRevocationChecked)
+	require.True(t, res.IsRevoked)
+	require.NotEmpty(t, res.Errors)
+
+	// Signer certificate revoked after the signing time. The revocation is ignored only when the
+	// signing time is attested by a trusted timestamp, not when it is claimed by the signer.
+	dated, _, err := signWithHandler(t, input, handler, "Signature1", func(sig *model.PdfSignature) error {
+		sig.SetDate(time.Now().Add(-time.Minute), "")
+		return nil
+	})
+	require.NoError(t, err)
+	tsa := newTestTimestampAuthority(t, time.Now().Add(-time.Minute))
+	tsHandler, err := sighandler.NewSignatureTimestamper(handler, tsa, 0)
+	require.NoError(t, err)
+	timestamped, _, err := signWithHandler(t, input, tsHandler, "Signature1", nil)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	roots.AddCert(tsa.Certificate)
+	validateWithRoots := func(data []byte) model.SignatureValidationResult {
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignaturesWithOptions([]model.SignatureHandler{validator}, &model.SignatureValidationOptions{Roots: roots})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		return res[0]
+	}
+	for _, noOCSP := range []bool{false, true} {
+		client = &testRevocationClient{
+			issuerKey: caKey,
+			noOCSP:    noOCSP,
+			revoked:   map[string]bool{cert.SerialNumber.String(): true},
+			revokedAt: time.Now(),
+		}
+		data, err = appendLTV(t, signed, client, []*x509.Certificate{ca})
+		require.NoError(t, err)
+		require.True(t, validate(data).IsRevoked)
+
+		data, err = appendLTV(t, dated, client, []*x509.Certificate{ca})
+		require.NoError(t, err)
+		res = validate(data)
+		require.True(t, res.IsRevocationChecked)
+		require.True(t, res.IsRevoked)
+
+		data, err = appendLTV(t, timestamped, client, []*x509.Certificate{ca})
+		require.NoError(t, err)
+		res = validate(data)
+		require.Equal(t, model.SigningTimeSourceUntrustedTimestamp, res.SigningTimeSource)
+		require.True(t, res.IsRevoked)
+		res = validateWithRoots(data)
+		require.Equal(t, model.SigningTimeSourceTimestamp, res.SigningTimeSource)
+		require.True(t, res.IsVerified, "%v", res.Errors)
+		require.True(t, res.IsRevocationChecked)
+		require.False(t, res.IsRevoked)
+		require.Empty(t, res.Errors)
+	}
+
+	// Validation data produced before the signing time and expired then does not give the
+	// status at the signing time.
+	client = &testRevocationClient{issuerKey: caKey, validity: -2 * time.Hour}
+	data, err = appendLTV(t, timestamped, client, []*x509.Certificate{ca})
+	require.NoError(t, err)
+	res = validateWithRoots(data)
+	require.False(t, res.IsRevoked)
+	require.False(t, res.IsRevocationChecked)
+}
+
+func TestValidateSignaturesWithOptions(t *testing.T) {
+	ca, caKey, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfFile1)
+	require.NoError(t, err)
+	signed, _, err := signWithHandler(t, input, handler, "Signature1", nil)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+
+	validate := func(data []byte, opts *model.SignatureValidationOptions) model.SignatureValidationResult {
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignaturesWithOptions([]model.SignatureHandler{validator}, opts)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		return res[0]
+	}
+
+	// Without trusted roots, the chain is built from the available certificates.
+	res := validate(signed, nil)
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.False(t, res.IsTrusted)
+	require.Len(t, res.Certificates, 1)
+	require.Equal(t, cert.Raw, res.Certificates[0].Raw)
+	require.Equal(t, model.SigningTimeSourceSignedAttribute, res.SigningTimeSource)
+	require.WithinDuration(t, time.Now(), res.SigningTime, time.Minute)
+	require.True(t, res.CoversWholeDocument)
+	require.Equal(t, int64(len(signed)), res.SignedRevisionSize)
+	require.Empty(t, res.LaterRevisions)
+
+	res = validate(signed, &model.SignatureValidationOptions{Intermediates: []*x509.Certificate{ca}})
+	require.Len(t, res.Certificates, 2)
+	require.Equal(t, ca.Raw, res.Certificates[1].Raw)
+
+	// Trusted and untrusted roots.
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots})
+	require.True(t, res.IsTrusted, "%v", res.Errors)
+	require.Len(t, res.Certificates, 2)
+	otherCA, _, _, _ := newTestCertificateChain(t)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+	res = validate(signed, &model.SignatureValidationOptions{Roots: otherRoots})
+	require.True(t, res.IsVerified)
+	require.False(t, res.IsTrusted)
+	require.NotEmpty(t, res.Errors)
+
+	// Revocation checks.
+	client := &testRevocationClient{issuerKey: caKey}
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots, RevocationChecker: sighandler.NewRevocationChecker(client)})
+	require.True(t, res.IsRevocationChecked)
+	require.False(t, res.IsRevoked)
+	client = &testRevocationClient{issuerKey: caKey, noOCSP: true, revoked: map[string]bool{cert.SerialNumber.String(): true}}
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots, RevocationChecker: sighandler.NewRevocationChecker(client)})
+	require.True(t, res.IsRevocationChecked)
+	require.True(t, res.IsRevoked)
+	client = &testRevocationClient{issuerKey: caKey, noOCSP: true, noCRL: true}
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots, RevocationChecker: sighandler.NewRevocationChecker(client)})
+	require.False(t, res.IsRevocationChecked)
+
+	// The validation data is added in a later revision.
+	data, err := appendLTV(t, signed, &testRevocationClient{issuerKey: caKey}, []*x509.Certificate{ca})
+	require.NoError(t, err)
+	res = validate(data, nil)
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.False(t, res.CoversWholeDocument)
+	require.Equal(t, int64(len(signed)), res.SignedRevisionSize)
+	require.Len(t, res.Certificates, 2)
+	require.Len(t, res.LaterRevisions, 1)
+	revision := res.LaterRevisions[0]
+	require.Equal(t, int64(len(signed)), revision.Start)
+	require.Equal(t, int64(len(data)), revision.End)
+	require.NotEmpty(t, revision.Added)
+	var types []string
+	for _, num := range revision.Added {
+		types = append(types, revision.Types[num])
+	}
+	require.Contains(t, types, "Catalog")
+	require.Contains(t, types, "DSS")
+
+	// Signing time of a timestamped signature.
+	tsa := newTestTimestampAuthority(t, time.Now())
+	server := httptest.NewServer(tsa)
+	defer server.Close()
+	tsHandler, err := sighandler.NewSignatureTimestamper(handler, sighandler.NewHTTPTimestampClient(server.URL), 0)
+	require.NoError(t, err)
+	signed, _, err = signWithHandler(t, input, tsHandler, "Signature1", nil)
+	require.NoError(t, err)
+	res = validate(signed, nil)
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.Equal(t, model.SigningTimeSourceUntrustedTimestamp, res.SigningTimeSource)
+	require.WithinDuration(t, time.Now(), res.SigningTime, time.Minute)
+	require.Len(t, res.TimestampCertificates, 1)
+
+	// The timestamp is trusted when its authority is.
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots})
+	require.Equal(t, model.SigningTimeSourceUntrustedTimestamp, res.SigningTimeSource)
+	tsaRoots := x509.NewCertPool()
+	tsaRoots.AddCert(ca)
+	tsaRoots.AddCert(tsa.Certificate)
+	res = validate(signed, &model.SignatureValidationOptions{Roots: tsaRoots})
+	require.True(t, res.IsTrusted, "%v", res.Errors)
+	require.Equal(t, model.SigningTimeSourceTimestamp, res.SigningTimeSource)
+	require.Equal(t, tsa.Certificate.Raw, res.TimestampCertificates[0].Raw)
+
+	// Timestamp authorities without the critical time stamping extended key usage are rejected.
+	tsHandler, err = sighandler.NewSignatureTimestamper(handler, newTestTimestampAuthorityWithEKU(t, time.Now(), false), 0)
+	require.NoError(t, err)
+	signed, _, err = signWithHandler(t, input, tsHandler, "Signature1", nil)
+	require.NoError(t, err)
+	res = validate(signed, nil)
+	require.False(t, res.IsVerified)
+	require.NotEmpty(t, res.Errors)
+
+	// The chain of an expired signer certificate is verified at the time of the timestamp only
+	// when its authority is trusted.
+	signedAt := time.Now().Add(-30 * time.Minute)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Test Expired Signer"},
+		NotBefore:    signedAt.Add(-10 * time.Minute),
+		NotAfter:     signedAt.Add(10 * time.Minute),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	expired, err := x509.ParseCertificate(certData)
+	require.NoError(t, err)
+	expiredHandler, err := sighandler.NewAdobePKCS7Detached(key, expired)
+	require.NoError(t, err)
+	tsa = newTestTimestampAuthority(t, signedAt)
+	tsHandler, err = sighandler.NewSignatureTimestamper(expiredHandler, tsa, 0)
+	require.NoError(t, err)
+	signed, _, err = signWithHandler(t, input, tsHandler, "Signature1", nil)
+	require.NoError(t, err)
+	res = validate(signed, &model.SignatureValidationOptions{Roots: roots})
+	require.True(t, res.IsVerified, "%v", res.Errors)
+	require.Equal(t, model.SigningTimeSourceUntrustedTimestamp, res.SigningTimeSource)
+	require.False(t, res.IsTrusted)
+	require.NotEmpty(t, res.Errors)
+	tsaRoots.AddCert(tsa.Certificate)
+	res = validate(signed, &model.SignatureValidationOptions{Roots: tsaRoots})
+	require.Equal(t, model.SigningTimeSourceTimestamp, res.SigningTimeSource)
+	require.True(t, res.IsTrusted, "%v", res.Errors)
+}
+
+// appendPdf applies `update` to an appender of PDF `data` and returns the output.
+func appendPdf(t *testing.T, data []byte, update func(appender *model.PdfAppender) error) ([]byte, error) {
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	appender, err := model.NewPdfAppender(reader)
+	require.NoError(t, err)
+	if err := update(appender); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	require.NoError(t, appender.Write(&buf))
+	return buf.Bytes(), nil
+}
+
+func TestAppenderDocMDP(t *testing.T) {
+	_, _, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdf3pages)
+	require.NoError(t, err)
+
+	certify := func(data []byte, perm model.DocMDPPermission) []byte {
+		out, _, err := signWithHandler(t, data, handler, "Certification", func(sig *model.PdfSignature) error {
+			return sig.SetDocMDP(perm)
+		})
+		require.NoError(t, err)
+		return out
+	}
+	validate := func(data []byte) []model.SignatureValidationResult {
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		for _, r := range res {
+			require.True(t, r.IsVerified, "%v", r.Errors)
+		}
+		return res
+	}
+	addAnnotation := func(data []byte) []byte {
+		out, err := appendPdf(t, data, func(appender *model.PdfAppender) error {
+			page := appender.Reader.PageList[0]
+			annotation := model.NewPdfAnnotationSquare()
+			rect := model.PdfRectangle{Llx: 50, Lly: 50, Urx: 150, Ury: 250}
+			annotation.Rect = rect.ToPdfObject()
+			page.AddAnnotation(annotation.PdfAnnotation)
+			appender.UpdatePage(page)
+			return nil
+		})
+		require.NoError(t, err)
+		return out
+	}
+
+	sig := model.NewPdfSignature(handler)
+	require.Error(t, sig.SetDocMDP(4))
+	require.NoError(t, sig.SetDocMDP(model.DocMDPFillForms))
+	require.Error(t, sig.SetDocMDP(model.DocMDPFillForms))
+	// The transform is kept when the signature is initialized afterwards.
+	require.NoError(t, sig.Initialize())
+	perm, ok := sig.GetDocMDPPermission()
+	require.True(t, ok)
+	require.Equal(t, model.DocMDPFillForms, perm)
+
+	// Certification signature permitting form filling and signing.
+	certified := certify(input, model.DocMDPFillForms)
+	reader, err := model.NewPdfReader(bytes.NewReader(certified))
+	require.NoError(t, err)
+	trailer, err := reader.GetTrailer()
+	require.NoError(t, err)
+	catalog, ok := core.GetDict(trailer.Get("Root"))
+	require.True(t, ok)
+	perms, ok := core.GetDict(catalog.Get("Perms"))
+	require.True(t, ok)
+	require.NotNil(t, perms.Get("DocMDP"))
+	res := validate(certified)
+	require.Len(t, res, 1)
+	require.Equal(t, model.DocMDPFillForms, res[0].DocMDPPermission)
+	require.True(t, res[0].CoversWholeDocument)
+	require.Empty(t, res[0].DisallowedChanges)
+
+	// Only one certification signature, which must be the first signature.
+	_, _, err = signWithHandler(t, certified, handler, "Certification2", func(sig *model.PdfSignature) error {
+		return sig.SetDocMDP(model.DocMDPFillForms)
+	})
+	require.Error(t, err)
+	approved, _, err := signWithHandler(t, input, handler, "Approval", nil)
+	require.NoError(t, err)
+	_, _, err = signWithHandler(t, approved, handler, "Certification", func(sig *model.PdfSignature) error {
+		return sig.SetDocMDP(model.DocMDPFillForms)
+	})
+	require.Error(t, err)
+
+	// Approval signatures are permitted with P=2.
+	signed, _, err := signWithHandler(t, certified, handler, "Approval", nil)
+	require.NoError(t, err)
+	res = validate(signed)
+	require.Len(t, res, 2)
+	require.False(t, res[0].CoversWholeDocument)
+	require.Len(t, res[0].LaterRevisions, 1)
+	require.Empty(t, res[0].DisallowedChanges)
+	require.Empty(t, res[0].Errors)
+	require.Equal(t, model.DocMDPPermission(0), res[1].DocMDPPermission)
+
+	// Annotations are permitted with P=3 only.
+	res = validate(addAnnotation(certified))
+	require.Equal(t, []string{"annotation added to page 1"}, res[0].DisallowedChanges)
+	require.NotEmpty(t, res[0].Errors)
+	res = validate(addAnnotation(certify(input, model.DocMDPFillFormsAndAnnotate)))
+	require.Empty(t, res[0].DisallowedChanges)
+
+	// Pages cannot be added.
+	extraPage, err := appendPdf(t, certified, func(appender *model.PdfAppender) error {
+		appender.AddPages(model.NewPdfPage())
+		return nil
+	})
+	require.NoError(t, err)
+	res = validate(extraPage)
+	require.Len(t, res[0].DisallowedChanges, 1)
+	require.Contains(t, res[0].DisallowedChanges[0], "pages added or removed")
+
+	// No changes except validation data and document timestamps with P=1.
+	certified = certify(input, model.DocMDPNoChanges)
+	signed, _, err = signWithHandler(t, certified, handler, "Approval", nil)
+	require.NoError(t, err)
+	res = validate(signed)
+	require.Equal(t, []string{"signature field Approval added"}, res[0].DisallowedChanges)
+
+	server := httptest.NewServer(newTestTimestampAuthority(t, time.Now()))
+	defer server.Close()
+	tsHandler, err := sighandler.NewDocTimeStamp(sighandler.NewHTTPTimestampClient(server.URL), 0)
+	require.NoError(t, err)
+	timestamped, _, err := signWithHandler(t, certified, tsHandler, "Timestamp", nil)
+	require.NoError(t, err)
+	reader, err = model.NewPdfReader(bytes.NewReader(timestamped))
+	require.NoError(t, err)
+	res, err = reader.ValidateSignatures([]model.SignatureHandler{validator, tsHandler})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, model.DocMDPNoChanges, res[0].DocMDPPermission)
+	require.Empty(t, res[0].DisallowedChanges)
+}
+
+func TestAppenderFieldMDP(t *testing.T) {
+	_, _, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfAcroFormFile1)
+	require.NoError(t, err)
+
+	lock := &model.FieldMDP{Action: model.FieldMDPActionInclude, Fields: []string{"Given Name Text Box"}}
+	require.True(t, lock.IsLocked("Given Name Text Box"))
+	require.False(t, lock.IsLocked("Family Name Text Box"))
+	require.True(t, (&model.FieldMDP{Action: model.FieldMDPActionExclude, Fields: []string{"Given Name Text Box"}}).IsLocked("Family Name Text Box"))
+	require.True(t, (&model.FieldMDP{Action: model.FieldMDPActionAll}).IsLocked("Family Name Text Box"))
+	require.Error(t, model.NewPdfSignature(handler).SetFieldMDP(&model.FieldMDP{Action: "None"}))
+
+	signed, _, err := signWithHandler(t, input, handler, "Signature1", func(sig *model.PdfSignature) error {
+		return sig.SetFieldMDP(lock)
+	})
+	require.NoError(t, err)
+
+	reader, err := model.NewPdfReader(bytes.NewReader(signed))
+	require.NoError(t, err)
+	var sigField *model.PdfFieldSignature
+	for _, field := range reader.AcroForm.AllFields() {
+		if f, ok := field.GetContext().(*model.PdfFieldSignature); ok {
+			sigField = f
+		}
+	}
+	require.NotNil(t, sigField)
+	require.NotNil(t, sigField.Lock)
+	loaded, ok := sigField.V.GetFieldMDP()
+	require.True(t, ok)
+	require.Equal(t, lock, loaded)
+	_, ok = sigField.V.GetDocMDPPermission()
+	require.False(t, ok)
+
+	// The signature reference points to the catalog.
+	trailer, err := reader.GetTrailer()
+	require.NoError(t, err)
+	root, ok := trailer.Get("Root").(*core.PdfObjectReference)
+	require.True(t, ok)
+	require.NotNil(t, sigField.V.Reference)
+	sigRef, ok := core.GetDict(sigField.V.Reference.Get(0))
+	require.True(t, ok)
+	data, ok := core.GetIndirect(sigRef.Get("Data"))
+	require.True(t, ok)
+	require.Equal(t, root.ObjectNumber, data.ObjectNumber)
+
+	fill := func(name, value string) []model.SignatureValidationResult {
+		data, err := appendPdf(t, signed, func(appender *model.PdfAppender) error {
+			for _, field := range appender.Reader.AcroForm.AllFields() {
+				if fieldName, _ := field.FullName(); fieldName == name {
+					field.V = core.MakeString(value)
+				}
+			}
+			appender.ReplaceAcroForm(appender.Reader.AcroForm)
+			return nil
+		})
+		require.NoError(t, err)
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].IsVerified, "%v", res[0].Errors)
+		require.False(t, res[0].CoversWholeDocument)
+		return res
+	}
+
+	res := fill("Family Name Text Box", "Doe")
+	require.Empty(t, res[0].DisallowedChanges)
+	res = fill("Given Name Text Box", "John")
+	require.Equal(t, []string{"locked field Given Name Text Box modified"}, res[0].DisallowedChanges)
+}
+
+// updateObject appends to PDF `data` a revision replacing object `num` with `obj` and returns
+// the output.
+func updateObject(t *testing.T, data []byte, num int64, obj string) []byte {
+	lastMatch := func(pattern string) string {
+		matches := regexp.MustCompile(pattern).FindAllSubmatch(data, -1)
+		require.NotEmpty(t, matches, pattern)
+		return string(matches[len(matches)-1][1])
+	}
+	root := lastMatch(`/Root\s*(\d+\s+\d+\s+R)`)
+	size := lastMatch(`/Size\s*(\d+)`)
+	prev := lastMatch(`startxref\s*(\d+)`)
+
+	var buf bytes.Buffer
+	buf.Write(data)
+	offset := buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", num, obj)
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n%d 1\n%010d 00000 n\r\n", num, offset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size %s /Root %s /Prev %s >>\nstartxref\n%d\n%%%%EOF\n", size, root, prev, xref)
+	return buf.Bytes()
+}
+
+func TestAppenderMDPIndirectValue(t *testing.T) {
+	_, _, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdfAcroFormFile1)
+	require.NoError(t, err)
+
+	// Value of the field in an indirect object.
+	const name = "Given Name Text Box"
+	input, err = appendPdf(t, input, func(appender *model.PdfAppender) error {
+		for _, field := range appender.Reader.AcroForm.AllFields() {
+			if fieldName, _ := field.FullName(); fieldName == name {
+				field.V = core.MakeIndirectObject(core.MakeString("old"))
+			}
+		}
+		appender.ReplaceAcroForm(appender.Reader.AcroForm)
+		return nil
+	})
+	require.NoError(t, err)
+	matches := regexp.MustCompile(`(\d+) 0 obj\s*\(old\)`).FindAllSubmatch(input, -1)
+	require.Len(t, matches, 1)
+	num, err := strconv.ParseInt(string(matches[0][1]), 10, 64)
+	require.NoError(t, err)
+
+	validate := func(setup func(sig *model.PdfSignature) error) []string {
+		signed, _, err := signWithHandler(t, input, handler, "Signature1", setup)
+		require.NoError(t, err)
+		reader, err := model.NewPdfReader(bytes.NewReader(updateObject(t, signed, num, "(new)")))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].IsVerified, "%v", res[0].Errors)
+		require.False(t, res[0].CoversWholeDocument)
+		return res[0].DisallowedChanges
+	}
+
+	disallowed := validate(func(sig *model.PdfSignature) error {
+		return sig.SetDocMDP(model.DocMDPNoChanges)
+	})
+	require.Equal(t, []string{"field " + name + " filled"}, disallowed)
+
+	disallowed = validate(func(sig *model.PdfSignature) error {
+		return sig.SetFieldMDP(&model.FieldMDP{Action: model.FieldMDPActionAll})
+	})
+	require.Equal(t, []string{"locked field " + name + " modified"}, disallowed)
+
+	disallowed = validate(nil)
+	require.Empty(t, disallowed)
+}
+
+func TestAppenderMDPWidgets(t *testing.T) {
+	_, _, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdf3pages)
+	require.NoError(t, err)
+
+	// Text field with a widget annotation which is not merged with it.
+	input, err = appendPdf(t, input, func(appender *model.PdfAppender) error {
+		page := appender.Reader.PageList[0]
+		field := &model.PdfFieldText{PdfField: model.NewPdfField()}
+		field.SetContext(field)
+		field.T = core.MakeString("Name")
+		field.V = core.MakeString("old")
+		widget := model.NewPdfAnnotationWidget()
+		widget.Rect = core.MakeArrayFromFloats([]float64{50, 50, 200, 70})
+		widget.P = page.ToPdfObject()
+		widget.Parent = field.GetContainingPdfObject()
+		field.Annotations = append(field.Annotations, widget)
+		page.AddAnnotation(widget.PdfAnnotation)
+		form := model.NewPdfAcroForm()
+		*form.Fields = append(*form.Fields, field.PdfField)
+		appender.ReplaceAcroForm(form)
+		appender.UpdatePage(page)
+		return nil
+	})
+	require.NoError(t, err)
+
+	validate := func(setup func(sig *model.PdfSignature) error, update func(field *model.PdfField, widget *model.PdfAnnotationWidget)) []string {
+		signed, _, err := signWithHandler(t, input, handler, "Signature1", setup)
+		require.NoError(t, err)
+		data, err := appendPdf(t, signed, func(appender *model.PdfAppender) error {
+			for _, field := range appender.Reader.AcroForm.AllFields() {
+				if name, _ := field.FullName(); name == "Name" {
+					require.Len(t, field.Annotations, 1)
+					update(field, field.Annotations[0])
+				}
+			}
+			appender.ReplaceAcroForm(appender.Reader.AcroForm)
+			return nil
+		})
+		require.NoError(t, err)
+		reader, err := model.NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].IsVerified, "%v", res[0].Errors)
+		return res[0].DisallowedChanges
+	}
+	fillForms := func(sig *model.PdfSignature) error {
+		return sig.SetDocMDP(model.DocMDPFillForms)
+	}
+	move := func(field *model.PdfField, widget *model.PdfAnnotationWidget) {
+		widget.Rect = core.MakeArrayFromFloats([]float64{300, 50, 450, 70})
+	}
+	appearance := func(text string) *core.PdfObjectDictionary {
+		stream, err := core.MakeStream([]byte("BT /Helv 12 Tf 2 4 Td ("+text+") Tj ET"), nil)
+		require.NoError(t, err)
+		stream.Set("Type", core.MakeName("XObject"))
+		stream.Set("Subtype", core.MakeName("Form"))
+		stream.Set("BBox", core.MakeArrayFromFloats([]float64{0, 0, 150, 20}))
+		ap := core.MakeDict()
+		ap.Set("N", stream)
+		return ap
+	}
+
+	disallowed := validate(fillForms, move)
+	require.Equal(t, []string{"field Name modified"}, disallowed)
+
+	disallowed = validate(fillForms, func(field *model.PdfField, widget *model.PdfAnnotationWidget) {
+		widget.AP = appearance("other")
+	})
+	require.Equal(t, []string{"appearance of field Name modified"}, disallowed)
+
+	disallowed = validate(fillForms, func(field *model.PdfField, widget *model.PdfAnnotationWidget) {
+		field.V = core.MakeString("new")
+		widget.AP = appearance("new")
+	})
+	require.Empty(t, disallowed)
+
+	disallowed = validate(func(sig *model.PdfSignature) error {
+		return sig.SetFieldMDP(&model.FieldMDP{Action: model.FieldMDPActionAll})
+	}, move)
+	require.Equal(t, []string{"locked field Name modified"}, disallowed)
+
+	disallowed = validate(nil, move)
+	require.Empty(t, disallowed)
+}
+
+// addEmptySignatureFields adds unsigned signature fields named `names` to the first page of
+// PDF `data` and returns the output.
+func addEmptySignatureFields(t *testing.T, data []byte, names ...string) []byte {
+	out, err := appendPdf(t, data, func(appender *model.PdfAppender) error {
+		page := appender.Reader.PageList[0]
+		form := model.NewPdfAcroForm()
+		for i, name := range names {
+			field := model.NewPdfFieldSignature(nil)
+			field.T = core.MakeString(name)
+			x := float64(50 + 200*i)
+			field.Rect = core.MakeArrayFromFloats([]float64{x, 50, x + 150, 100})
+			field.P = page.ToPdfObject()
+			page.AddAnnotation(field.PdfAnnotationWidget.PdfAnnotation)
+			*form.Fields = append(*form.Fields, field.PdfField)
+		}
+		appender.ReplaceAcroForm(form)
+		appender.UpdatePage(page)
+		return nil
+	})
+	require.NoError(t, err)
+	return out
+}
+
+func TestAppenderSignField(t *testing.T) {
+	_, _, cert, key := newTestCertificateChain(t)
+	handler, err := sighandler.NewAdobePKCS7Detached(key, cert)
+	require.NoError(t, err)
+	validator, err := sighandler.NewAdobePKCS7Detached(nil, nil)
+	require.NoError(t, err)
+	input, err := ioutil.ReadFile(testPdf3pages)
+	require.NoError(t, err)
+	input = addEmptySignatureFields(t, input, "Signature1", "Signature2")
+
+	reader, err := model.NewPdfReader(bytes.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, reader.AcroForm.UnsignedSignatureFields(), 2)
+
+	signField := func(data []byte, name string, setup func(sig *model.PdfSignature) error) ([]byte, error) {
+		return appendPdf(t, data, func(appender *model.PdfAppender) error {
+			field, err := appender.GetSignatureField(name)
+			if err != nil {
+				return err
+			}
+			signature := model.NewPdfSignature(handler)
+			signature.SetName(name)
+			if err := signature.Initialize(); err != nil {
+				return err
+			}
+			if setup != nil {
+				if err := setup(signature); err != nil {
+					return err
+				}
+			}
+			field.V = signature
+			err = annotator.SetSignatureAppearance(field, []*annotator.SignatureLine{
+				annotator.NewSignatureLine("Name", name),
+				annotator.NewSignatureLine("Reason", "Approval"),
+			}, nil)
+			if err != nil {
+				return err
+			}
+			return appender.SignField(field)
+		})
+	}
+
+	// The first field is a certification signature permitting the signature of the second.
+	signed1, err := signField(input, "Signature1", func(sig *model.PdfSignature) error {
+		return sig.SetDocMDP(model.DocMDPFillForms)
+	})
+	require.NoError(t, err)
+	_, err = signField(signed1, "Signature1", nil)
+	require.Error(t, err)
+	_, err = signField(signed1, "Signature3", nil)
+	require.Error(t, err)
+
+	signed2, err := signField(signed1, "Signature2", nil)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(tempFile("appender_sign_field.pdf"), signed2, 0644))
+
+	reader, err = model.NewPdfReader(bytes.NewReader(signed2))
+	require.NoError(t, err)
+	require.Len(t, reader.AcroForm.AllFields(), 2)
+	require.Empty(t, reader.AcroForm.UnsignedSignatureFields())
+	require.NotNil(t, reader.AcroForm.SigFlags)
+	require.Equal(t, int64(3), int64(*reader.AcroForm.SigFlags))
+	for _, field := range reader.AcroForm.AllFields() {
+		sigField, ok := field.GetContext().(*model.PdfFieldSignature)
+		require.True(t, ok)
+		require.NotNil(t, sigField.V)
+		require.Len(t, sigField.Annotations, 1)
+		ap, ok := core.GetDict(sigField.Annotations[0].AP)
+		require.True(t, ok)
+		require.NotNil(t, ap.Get("N"))
+	}
+	annots, err := reader.PageList[0].GetAnnotations()
+	require.NoError(t, err)
+	require.Len(t, annots, 2)
+
+	res, err := reader.ValidateSignatures([]model.SignatureHandler{validator})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for _, r := range res {
+		require.True(t, r.IsVerified, "%v", r.Errors)
+		require.Empty(t, r.DisallowedChanges)
+	}
+	require.Equal(t, model.DocMDPFillForms, res[0].DocMDPPermission)
+	require.False(t, res[0].CoversWholeDocument)
+	require.True(t, res[1].CoversWholeDocument)
+
+	// New signature fields are added next to the existing ones.
+	signed3, _, err := signWithHandler(t, signed2, handler, "Signature3", nil)
+	require.NoError(t, err)
+	reader, err = model.NewPdfReader(bytes.NewReader(signed3))
+	require.NoError(t, err)
+	require.Len(t, reader.AcroForm.AllFields(), 3)
+	res, err = reader.ValidateSignatures([]model.SignatureHandler{validator})
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	for _, r := range res {
+		require.True(t, r.IsVerified, "%v", r.Errors)
+		require.Empty(t, r.DisallowedChanges)
+	}
+}
+
+// testOpaqueSigner hides the type of the key of a signer, as the signers of keys held in
+// hardware security modules.
+type testOpaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (s *testOpaqueSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s *testOpaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func TestAppenderSignCryptoSigner(t *testing.T) {
+	input, err := ioutil.ReadFile(testPdfFile1)
+	require.NoError(t, err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pssSigner, err := sighandler.NewRSAPSSSigner(&testOpaqueSigner{rsaKey})
+	require.NoError(t, err)
+	_, err = sighandler.NewRSAPSSSigner(p256Key)
+	require.Error(t, err)
+
+	signers := map[string]crypto.Signer{
+		"p256":     p256Key,
+		"p384":     p384Key,
+		"ed25519":  ed25519Key,
+		"rsa-pss":  pssSigner,
+		"hsm-p256": &testOpaqueSigner{p256Key},
+		"hsm-rsa":  &testOpaqueSigner{rsaKey},
+	}
+	for name, signer := range signers {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "Test " + name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		// The certificates are signed with PKCS #1 v1.5 signatures.
+		certSigner := signer
+		if name == "rsa-pss" {
+			certSigner = rsaKey
+		}
+		certData, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), certSigner)
+		require.NoError(t, err, name)
+		cert, err := x509.ParseCertificate(certData)
+		require.NoError(t, err, name)
+
+		pkcs7Handler, err := sighandler.NewAdobePKCS7Detached(signer, cert)
+		require.NoError(t, err, name)
+		cadesHandler, err := sighandler.NewEtsiCAdESDetached(signer, cert, 0)
+		require.NoError(t, err, name)
+		for i, handler := range []model.SignatureHandler{pkcs7Handler, cadesHandler} {
+			data, _, err := signWithHandler(t, input, handler, "Signature1", nil)
+			require.NoError(t, err, name)
+			outputPath := tempFile(fmt.Sprintf("appender_sign_signer_%s_%d.pdf", name, i))
+			require.NoError(t, ioutil.WriteFile(outputPath, data, 0644))
+			validateFile(t, outputPath)
+		}
+	}
+
+	// Ed25519 signatures require SHA-512 message digests.
+	_, err = sighandler.NewEtsiCAdESDetached(ed25519Key, nil, crypto.SHA256)
+	require.Error(t, err)
+
+	// adbe.x509.rsa_sha1 signatures are RSA PKCS #1 v1.5 signatures.
+	_, err = sighandler.NewAdobeX509RSASHA1(p256Key, nil)
+	require.Error(t, err)
+	_, err = sighandler.NewAdobeX509RSASHA1(pssSigner, nil)
+	require.Error(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test RSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, rsaKey.Public(), rsaKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certData)
+	require.NoError(t, err)
+	handler, err := sighandler.NewAdobeX509RSASHA1(&testOpaqueSigner{rsaKey}, cert)
+	require.NoError(t, err)
+	data, _, err := signWithHandler(t, input, handler, "Signature1", nil)
+	require.NoError(t, err)
+	outputPath := tempFile("appender_sign_signer_rsa_sha1.pdf")
+	require.NoError(t, ioutil.WriteFile(outputPath, data, 0644))
+	validateFile(t, outputPath)
+}
+
+func TestAppenderDeferredSignature(t *testing.T) {
+	pfxData, err := ioutil.ReadFile(testPKS12Key)
+	require.NoError(t, err)
+	privateKey, cert, err := pkcs12.Decode(pfxData, testPKS12KeyPassword)
+	require.NoError(t, err)
+
+	// Prepare the document with a placeholder of 4096 bytes.
+	f, err := os.Open(testPdfFile1)
+	require.NoError(t, err)
+	defer f.Close()
+	reader, err := model.NewPdfReader(f)
+	require.NoError(t, err)
+	appender, err := model.NewPdfAppender(reader)
+	require.NoError(t, err)
+	handler, err := sighandler.NewEmptyAdobePKCS7Detached(4096)
+	require.NoError(t, err)
+	signature := model.NewPdfSignature(handler)
+	signature.SetName("Deferred signature")
+	require.NoError(t, signature.Initialize())
+	sigField := model.NewPdfFieldSignature(signature)
+	sigField.T = core.MakeString("Signature1")
+	sigField.Rect = core.MakeArray(core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0), core.MakeInteger(0))
+	prepared, err := appender.PrepareExternalSignature(1, sigField)
+	require.NoError(t, err)
+	require.Equal(t, 4096, prepared.ReservedLen())
+
+	signedData, err := ioutil.ReadAll(prepared.SignedData())
+	require.NoError(t, err)
+	require.Len(t, signedData, int(prepared.ByteRange[1]+prepared.ByteRange[3]))
+	digest, err := prepared.Digest(crypto.SHA256)
+	require.NoError(t, err)
+	h := crypto.SHA256.New()
+	h.Write(signedData)
+	require.Equal(t, h.Sum(nil), digest)
+
+	// The document is stored and signed later by a remote service.
+	data := append([]byte{}, prepared.Data...)
+	loaded, err := model.LoadExternalSignature(data, "Signature1")
+	require.NoError(t, err)
+	require.Equal(t, prepared.ByteRange, loaded.ByteRange)
+	_, err = model.LoadExternalSignature(data, "Signature2")
+	require.Error(t, err)
+
+	p7, err := pkcs7.NewSignedData(signedData)
+	require.NoError(t, err)
+	p7.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	require.NoError(t, p7.AddSigner(cert, privateKey, pkcs7.SignerInfoConfig{}))
+	p7.Detach()
+	cms, err := p7.Finish()
+	require.NoError(t, err)
+
+	_, err = loaded.Inject(make([]byte, loaded.ReservedLen()+1))
+	require.Error(t, err)
+	data, err = loaded.Inject(cms)
+	require.NoError(t, err)
+	require.Len(t, data, len(prepared.Data))
+
+	outputPath := tempFile("appender_sign_deferred.pdf")
+	require.NoError(t, ioutil.WriteFile(outputPath, data, 0644))
+	validateFile(t, outputPath)
+
+	// The ETSI.CAdES.detached placeholder.
+	cadesHandler, err := sighandler.NewEmptyEtsiCAdESDetached(0)
+	require.NoError(t, err)
+	signature = model.NewPdfSignature(cadesHandler)
+	require.NoError(t, signature.Initialize())
+	require.Equal(t, "ETSI.CAdES.detached", signature.SubFilter.String())
+	require.Len(t, signature.Contents.Bytes(), 8192)
+}
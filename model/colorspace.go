@@ -12,6 +12,7 @@ import (
 
 	"github.com/zituocn/updf/common"
 	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/internal/icc"
 )
 
 // PdfColorspace interface defines the common methods of a PDF colorspace.
@@ -34,8 +35,8 @@ import (
 // - /Separation
 // - /DeviceN
 //
-// Work is in progress to support all colorspaces. At the moment ICCBased color spaces fall back to the alternate
-// colorspace which works OK in most cases. For full color support, will need fully featured ICC support.
+// Work is in progress to support all colorspaces. ICCBased color spaces are converted to RGB with their ICC
+// profiles and fall back to the alternate colorspace if the profile is not supported.
 type PdfColorspace interface {
 	// String returns the PdfColorspace's name.
 	String() string
@@ -1762,7 +1763,8 @@ func (this *PdfColorICCBased) ToInteger(bits int) []uint32 {
 // A conforming reader shall support ICC.1:2004:10 as required by PDF 1.7, which will enable it
 // to properly render all embedded ICC profiles regardless of the PDF version
 //
-// In the current implementation, we rely on the alternative colormap provided.
+// Colors are converted to RGB with the ICC profile in Data. Matrix/TRC and LUT based profiles of
+// versions 2 and 4 are supported. The alternate colorspace is used if the profile is not supported.
 type PdfColorspaceICCBased struct {
 	N         int           // Number of color components (Required). Can be 1,3, or 4.
 	Alternate PdfColorspace // Alternate colorspace for non-conforming readers.
@@ -1774,6 +1776,9 @@ type PdfColorspaceICCBased struct {
 
 	container *core.PdfIndirectObject
 	stream    *core.PdfObjectStream
+
+	profile       *icc.Transform // Transform of the ICC profile to sRGB. nil if it's not supported.
+	profileLoaded bool
 }
 
 // GetNumComponents returns the number of color components.
@@ -1990,6 +1995,11 @@ func (cs *PdfColorspaceICCBased) ColorFromPdfObjects(objects []core.PdfObject) (
 
 // ColorToRGB converts a ICCBased color to an RGB color.
 func (cs *PdfColorspaceICCBased) ColorToRGB(color PdfColor) (PdfColor, error) {
+	if t := cs.iccTransform(); t != nil {
+		if rgb, ok := iccColorToRGB(t, color); ok {
+			return rgb, nil
+		}
+	}
 	if cs.Alternate == nil {
 		common.Log.Debug("ICC Based colorspace missing alternative")
 		if cs.N == 1 {
@@ -2016,6 +2026,9 @@ func (cs *PdfColorspaceICCBased) ColorToRGB(color PdfColor) (PdfColor, error) {
 
 // ImageToRGB converts ICCBased colorspace image to RGB and returns the result.
 func (cs *PdfColorspaceICCBased) ImageToRGB(img Image) (Image, error) {
+	if t := cs.iccTransform(); t != nil {
+		return cs.iccImageToRGB(t, img), nil
+	}
 	if cs.Alternate == nil {
 		common.Log.Debug("ICC Based colorspace missing alternative")
 		if cs.N == 1 {
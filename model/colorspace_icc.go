@@ -0,0 +1,118 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"math"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/internal/icc"
+)
+
+// iccTransform returns the transform of the ICC profile of `cs` to sRGB. It returns nil if the
+// profile can't be used, in which case colors are converted by the alternate colorspace. The
+// profile is parsed on first use.
+func (cs *PdfColorspaceICCBased) iccTransform() *icc.Transform {
+	if cs.profileLoaded {
+		return cs.profile
+	}
+	cs.profileLoaded = true
+	profile, err := icc.Parse(cs.Data)
+	if err != nil {
+		common.Log.Debug("ERROR: Invalid ICC profile: %v. Using the alternate colorspace", err)
+		return nil
+	}
+	if n := profile.NumComponents(); n != cs.N {
+		common.Log.Debug("ERROR: ICC profile has %d components, N is %d. Using the alternate colorspace",
+			n, cs.N)
+		return nil
+	}
+	t, err := profile.NewTransform(icc.IntentRelativeColorimetric)
+	if err != nil {
+		common.Log.Debug("ERROR: Unsupported ICC profile: %v. Using the alternate colorspace", err)
+		return nil
+	}
+	cs.profile = t
+	return t
+}
+
+// iccColorToRGB converts `color` to RGB with ICC profile transform `t`. The bool return is false if
+// the components of `color` are not known.
+func iccColorToRGB(t *icc.Transform, color PdfColor) (PdfColor, bool) {
+	var vals []float64
+	switch c := color.(type) {
+	case *PdfColorDeviceGray:
+		vals = []float64{c.Val()}
+	case *PdfColorCalGray:
+		vals = []float64{c.Val()}
+	case *PdfColorDeviceRGB:
+		vals = c[:]
+	case *PdfColorCalRGB:
+		vals = c[:]
+	case *PdfColorDeviceCMYK:
+		vals = c[:]
+	case *PdfColorLab:
+		vals = c[:]
+	default:
+		return nil, false
+	}
+	if len(vals) != t.NumComponents() {
+		return nil, false
+	}
+	rgb := t.ToSRGB(vals)
+	return NewPdfColorDeviceRGB(rgb[0], rgb[1], rgb[2]), true
+}
+
+// iccImageToRGB converts image `img` with components in the ranges of `cs` to RGB with ICC profile
+// transform `t`.
+func (cs *PdfColorspaceICCBased) iccImageToRGB(t *icc.Transform, img Image) Image {
+	decode := img.decode
+	if len(decode) != 2*cs.N {
+		decode = cs.DecodeArray()
+	}
+	if len(decode) != 2*cs.N {
+		decode = make([]float64, 2*cs.N)
+		for i := 0; i < cs.N; i++ {
+			decode[2*i+1] = 1
+		}
+	}
+
+	samples := img.GetSamples()
+	maxVal := math.Pow(2, float64(img.BitsPerComponent)) - 1
+	// Images usually have few distinct colors and the transform may be expensive.
+	cacheable := int(img.BitsPerComponent)*cs.N <= 64
+	cache := map[uint64][3]uint32{}
+
+	vals := make([]float64, cs.N)
+	rgbSamples := make([]uint32, 0, len(samples)/cs.N*3)
+	for i := 0; i+cs.N <= len(samples); i += cs.N {
+		var key uint64
+		if cacheable {
+			for _, s := range samples[i : i+cs.N] {
+				key = key<<uint(img.BitsPerComponent) | uint64(s)
+			}
+			if rgb, ok := cache[key]; ok {
+				rgbSamples = append(rgbSamples, rgb[:]...)
+				continue
+			}
+		}
+		for j := range vals {
+			vals[j] = interpolate(float64(samples[i+j]), 0, maxVal, decode[2*j], decode[2*j+1])
+		}
+		c := t.ToSRGB(vals)
+		rgb := [3]uint32{uint32(c[0]*maxVal + 0.5), uint32(c[1]*maxVal + 0.5), uint32(c[2]*maxVal + 0.5)}
+		if cacheable {
+			cache[key] = rgb
+		}
+		rgbSamples = append(rgbSamples, rgb[:]...)
+	}
+
+	rgbImage := img
+	rgbImage.SetSamples(rgbSamples)
+	rgbImage.ColorComponents = 3
+	rgbImage.decode = nil
+	return rgbImage
+}
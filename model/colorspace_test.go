@@ -11,6 +11,9 @@ import (
 	"io/ioutil"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/zituocn/updf/core"
 	"github.com/zituocn/updf/internal/testutils"
 )
@@ -174,3 +177,82 @@ endstream endobj
 		t.Fatalf("Incorrect function obj number (got %d)", f.ObjectNumber)
 	}
 }
+
+// linearGrayProfile returns an ICC profile for gray with a linear tone reproduction curve.
+func linearGrayProfile() []byte {
+	profile := make([]byte, 144)
+	copy(profile[12:], "mntrGRAYXYZ ")
+	copy(profile[36:], "acsp")
+	copy(profile[128:], []byte{0, 0, 0, 1, 'k', 'T', 'R', 'C', 0, 0, 0, 144, 0, 0, 0, 14})
+	profile = append(profile, 'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 1, 1, 0)
+	profile[3] = byte(len(profile))
+	return profile
+}
+
+// invalidCLUTProfile returns an RGB profile whose A2B0 color lookup table has an invalid
+// precision of 0.
+func invalidCLUTProfile() []byte {
+	identity := []byte{'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 0}
+	tag := []byte{'m', 'A', 'B', ' ', 0, 0, 0, 0, 3, 3, 0, 0,
+		0, 0, 0, 32, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 68, 0, 0, 0, 136}
+	for i := 0; i < 3; i++ {
+		tag = append(tag, identity...)
+	}
+	tag = append(tag, 2, 2, 2)
+	tag = append(tag, make([]byte, 17+2*2*2*3*2)...)
+	for i := 0; i < 3; i++ {
+		tag = append(tag, identity...)
+	}
+
+	profile := make([]byte, 144)
+	profile[8] = 4
+	copy(profile[12:], "mntrRGB Lab ")
+	copy(profile[36:], "acsp")
+	copy(profile[128:], []byte{0, 0, 0, 1, 'A', '2', 'B', '0', 0, 0, 0, 144, 0, 0, 0, byte(len(tag))})
+	profile = append(profile, tag...)
+	profile[2], profile[3] = byte(len(profile)>>8), byte(len(profile))
+	return profile
+}
+
+func TestICCBasedToRGB(t *testing.T) {
+	cs, err := NewPdfColorspaceICCBased(1)
+	require.NoError(t, err)
+	cs.Alternate = NewPdfColorspaceDeviceGray()
+	cs.Data = linearGrayProfile()
+
+	// The profile's linear gray is lighter than the alternate's.
+	rgb, err := cs.ColorToRGB(NewPdfColorDeviceGray(0.5))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.735, rgb.(*PdfColorDeviceRGB).R(), 0.001)
+
+	img := Image{Width: 2, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{0, 128}}
+	rgbImg, err := cs.ImageToRGB(img)
+	require.NoError(t, err)
+	assert.Equal(t, 3, rgbImg.ColorComponents)
+	assert.Equal(t, []byte{0, 0, 0, 188, 188, 188}, rgbImg.Data)
+
+	// Invalid profiles fall back to the alternate colorspace.
+	cs, err = NewPdfColorspaceICCBased(1)
+	require.NoError(t, err)
+	cs.Alternate = NewPdfColorspaceDeviceGray()
+	cs.Data = []byte("invalid")
+	rgb, err = cs.ColorToRGB(NewPdfColorDeviceGray(0.5))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, rgb.(*PdfColorDeviceRGB).R(), 0.001)
+
+	// Malformed profiles fall back to the alternate colorspace as well.
+	cs, err = NewPdfColorspaceICCBased(3)
+	require.NoError(t, err)
+	cs.Alternate = NewPdfColorspaceDeviceRGB()
+	cs.Data = invalidCLUTProfile()
+	rgb, err = cs.ColorToRGB(NewPdfColorDeviceRGB(0.2, 0.4, 0.6))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.2, rgb.(*PdfColorDeviceRGB).R(), 0.001)
+	assert.InDelta(t, 0.4, rgb.(*PdfColorDeviceRGB).G(), 0.001)
+	assert.InDelta(t, 0.6, rgb.(*PdfColorDeviceRGB).B(), 0.001)
+
+	img = Image{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 3, Data: []byte{10, 20, 30}}
+	rgbImg, err = cs.ImageToRGB(img)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{10, 20, 30}, rgbImg.Data)
+}
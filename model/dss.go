@@ -0,0 +1,336 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// DSS represents a Document Security Store dictionary, which holds the certificates and the
+// revocation information (OCSP responses and CRLs) needed for the long-term validation of the
+// signatures of the document.
+// (ETSI EN 319 142-1 section 5.4 and ISO 32000-2 section 12.8.4.3).
+type DSS struct {
+	container *core.PdfIndirectObject
+
+	// Certs, OCSPs and CRLs are the streams of the DER encoded certificates, OCSP responses and
+	// CRLs used by any signature of the document.
+	Certs []*core.PdfObjectStream
+	OCSPs []*core.PdfObjectStream
+	CRLs  []*core.PdfObjectStream
+
+	// VRI maps the signature VRI keys (see VRIKey) to the validation data of the signatures.
+	VRI map[string]*VRI
+
+	// Streams indexed by the SHA-1 hash of their data, to avoid duplicate entries.
+	certMap map[string]*core.PdfObjectStream
+	ocspMap map[string]*core.PdfObjectStream
+	crlMap  map[string]*core.PdfObjectStream
+}
+
+// VRI represents a Validation Related Information dictionary, which references the validation
+// data of one signature in the Document Security Store.
+type VRI struct {
+	Cert []*core.PdfObjectStream
+	OCSP []*core.PdfObjectStream
+	CRL  []*core.PdfObjectStream
+
+	// TU is the time the validation data was collected.
+	TU *core.PdfObjectString
+
+	// TS is the DER encoded timestamp token of the validation data.
+	TS *core.PdfObjectStream
+}
+
+// NewDSS returns a new empty Document Security Store.
+func NewDSS() *DSS {
+	return &DSS{
+		container: core.MakeIndirectObject(core.MakeDict()),
+		VRI:       map[string]*VRI{},
+		certMap:   map[string]*core.PdfObjectStream{},
+		ocspMap:   map[string]*core.PdfObjectStream{},
+		crlMap:    map[string]*core.PdfObjectStream{},
+	}
+}
+
+// VRIKey returns the key of the VRI dictionary of signature `sig`, which is the uppercase
+// hexadecimal SHA-1 digest of the Contents of the signature.
+func VRIKey(sig *PdfSignature) string {
+	if sig == nil || sig.Contents == nil {
+		return ""
+	}
+	h := sha1.Sum(sig.Contents.Bytes())
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+// GetDSS returns the Document Security Store of the document, or nil if the document has none.
+func (r *PdfReader) GetDSS() (*DSS, error) {
+	obj := r.catalog.Get("DSS")
+	if obj == nil {
+		return nil, nil
+	}
+	return newDSSFromObject(obj)
+}
+
+// newDSSFromObject loads a DSS from `obj`, which should be a DSS dictionary or an indirect object
+// containing it.
+func newDSSFromObject(obj core.PdfObject) (*DSS, error) {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		common.Log.Debug("ERROR: DSS not a dictionary (%T)", obj)
+		return nil, ErrTypeCheck
+	}
+
+	dss := NewDSS()
+	if ind, ok := obj.(*core.PdfIndirectObject); ok {
+		dss.container = ind
+	}
+
+	var err error
+	if dss.Certs, err = loadDSSStreams(dict.Get("Certs"), dss.certMap); err != nil {
+		return nil, err
+	}
+	if dss.OCSPs, err = loadDSSStreams(dict.Get("OCSPs"), dss.ocspMap); err != nil {
+		return nil, err
+	}
+	if dss.CRLs, err = loadDSSStreams(dict.Get("CRLs"), dss.crlMap); err != nil {
+		return nil, err
+	}
+
+	if vriDict, ok := core.GetDict(dict.Get("VRI")); ok {
+		for _, key := range vriDict.Keys() {
+			d, ok := core.GetDict(vriDict.Get(key))
+			if !ok {
+				common.Log.Debug("ERROR: VRI entry %s not a dictionary", key)
+				return nil, ErrTypeCheck
+			}
+			vri := &VRI{}
+			if vri.Cert, err = loadDSSStreams(d.Get("Cert"), nil); err != nil {
+				return nil, err
+			}
+			if vri.OCSP, err = loadDSSStreams(d.Get("OCSP"), nil); err != nil {
+				return nil, err
+			}
+			if vri.CRL, err = loadDSSStreams(d.Get("CRL"), nil); err != nil {
+				return nil, err
+			}
+			vri.TU, _ = core.GetString(d.Get("TU"))
+			vri.TS, _ = core.GetStream(d.Get("TS"))
+			dss.VRI[strings.ToUpper(string(key))] = vri
+		}
+	}
+	return dss, nil
+}
+
+// loadDSSStreams returns the streams of array `obj` and indexes them in `streamMap` when not nil.
+func loadDSSStreams(obj core.PdfObject, streamMap map[string]*core.PdfObjectStream) ([]*core.PdfObjectStream, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	arr, ok := core.GetArray(obj)
+	if !ok {
+		common.Log.Debug("ERROR: DSS entry not an array (%T)", obj)
+		return nil, ErrTypeCheck
+	}
+	var streams []*core.PdfObjectStream
+	for _, o := range arr.Elements() {
+		stream, ok := core.GetStream(o)
+		if !ok {
+			common.Log.Debug("ERROR: DSS array element not a stream (%T)", o)
+			return nil, ErrTypeCheck
+		}
+		streams = append(streams, stream)
+		if streamMap != nil {
+			data, err := core.DecodeStream(stream)
+			if err != nil {
+				return nil, err
+			}
+			streamMap[dssDataKey(data)] = stream
+		}
+	}
+	return streams, nil
+}
+
+// dssDataKey returns the key of `data` in the stream maps of the DSS.
+func dssDataKey(data []byte) string {
+	h := sha1.Sum(data)
+	return string(h[:])
+}
+
+// addStreams adds the streams of `items` to `streams`, reusing the streams of the items that are
+// already in `streamMap`. It returns the updated list and the streams of `items`.
+func (d *DSS) addStreams(streams []*core.PdfObjectStream, streamMap map[string]*core.PdfObjectStream, items [][]byte) ([]*core.PdfObjectStream, []*core.PdfObjectStream, error) {
+	var added []*core.PdfObjectStream
+	for _, data := range items {
+		key := dssDataKey(data)
+		if stream, ok := streamMap[key]; ok {
+			added = append(added, stream)
+			continue
+		}
+		stream, err := core.MakeStream(data, core.NewFlateEncoder())
+		if err != nil {
+			return nil, nil, err
+		}
+		streamMap[key] = stream
+		streams = append(streams, stream)
+		added = append(added, stream)
+	}
+	return streams, added, nil
+}
+
+// AddCerts adds the DER encoded certificates `certs` to the DSS and returns their streams.
+// Certificates already in the DSS are not duplicated.
+func (d *DSS) AddCerts(certs [][]byte) ([]*core.PdfObjectStream, error) {
+	var added []*core.PdfObjectStream
+	var err error
+	d.Certs, added, err = d.addStreams(d.Certs, d.certMap, certs)
+	return added, err
+}
+
+// AddOCSPs adds the DER encoded OCSP responses `ocsps` to the DSS and returns their streams.
+// Responses already in the DSS are not duplicated.
+func (d *DSS) AddOCSPs(ocsps [][]byte) ([]*core.PdfObjectStream, error) {
+	var added []*core.PdfObjectStream
+	var err error
+	d.OCSPs, added, err = d.addStreams(d.OCSPs, d.ocspMap, ocsps)
+	return added, err
+}
+
+// AddCRLs adds the DER encoded CRLs `crls` to the DSS and returns their streams.
+// CRLs already in the DSS are not duplicated.
+func (d *DSS) AddCRLs(crls [][]byte) ([]*core.PdfObjectStream, error) {
+	var added []*core.PdfObjectStream
+	var err error
+	d.CRLs, added, err = d.addStreams(d.CRLs, d.crlMap, crls)
+	return added, err
+}
+
+// AddSignatureVRI adds the validation data of signature `sig` to the DSS: the DER encoded
+// certificates `certs`, OCSP responses `ocsps` and CRLs `crls` are added to the DSS and
+// referenced by the VRI dictionary of the signature.
+func (d *DSS) AddSignatureVRI(sig *PdfSignature, certs, ocsps, crls [][]byte) (*VRI, error) {
+	key := VRIKey(sig)
+	if key == "" {
+		return nil, ErrRequiredAttributeMissing
+	}
+	vri := &VRI{}
+	var err error
+	if vri.Cert, err = d.AddCerts(certs); err != nil {
+		return nil, err
+	}
+	if vri.OCSP, err = d.AddOCSPs(ocsps); err != nil {
+		return nil, err
+	}
+	if vri.CRL, err = d.AddCRLs(crls); err != nil {
+		return nil, err
+	}
+	d.VRI[key] = vri
+	return vri, nil
+}
+
+// GetSignatureVRI returns the VRI dictionary of signature `sig`, or nil if the DSS has none.
+func (d *DSS) GetSignatureVRI(sig *PdfSignature) *VRI {
+	return d.VRI[VRIKey(sig)]
+}
+
+// GetCerts returns the DER encoded certificates of the DSS.
+func (d *DSS) GetCerts() ([][]byte, error) {
+	return decodeDSSStreams(d.Certs)
+}
+
+// GetOCSPs returns the DER encoded OCSP responses of the DSS.
+func (d *DSS) GetOCSPs() ([][]byte, error) {
+	return decodeDSSStreams(d.OCSPs)
+}
+
+// GetCRLs returns the DER encoded CRLs of the DSS.
+func (d *DSS) GetCRLs() ([][]byte, error) {
+	return decodeDSSStreams(d.CRLs)
+}
+
+// decodeDSSStreams returns the decoded data of `streams`.
+func decodeDSSStreams(streams []*core.PdfObjectStream) ([][]byte, error) {
+	var items [][]byte
+	for _, stream := range streams {
+		data, err := core.DecodeStream(stream)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, data)
+	}
+	return items, nil
+}
+
+// makeDSSStreamArray returns an array of the streams `streams`.
+func makeDSSStreamArray(streams []*core.PdfObjectStream) *core.PdfObjectArray {
+	arr := core.MakeArray()
+	for _, stream := range streams {
+		arr.Append(stream)
+	}
+	return arr
+}
+
+// GetContainingPdfObject implements interface PdfModel.
+func (d *DSS) GetContainingPdfObject() core.PdfObject {
+	return d.container
+}
+
+// ToPdfObject implements interface PdfModel.
+func (d *DSS) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	dict.Set("Type", core.MakeName("DSS"))
+	if len(d.Certs) > 0 {
+		dict.Set("Certs", makeDSSStreamArray(d.Certs))
+	}
+	if len(d.OCSPs) > 0 {
+		dict.Set("OCSPs", makeDSSStreamArray(d.OCSPs))
+	}
+	if len(d.CRLs) > 0 {
+		dict.Set("CRLs", makeDSSStreamArray(d.CRLs))
+	}
+
+	if len(d.VRI) > 0 {
+		// Sort the keys for a deterministic output.
+		keys := make([]string, 0, len(d.VRI))
+		for key := range d.VRI {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		vriDict := core.MakeDict()
+		for _, key := range keys {
+			vri := d.VRI[key]
+			vd := core.MakeDict()
+			vd.Set("Type", core.MakeName("VRI"))
+			if len(vri.Cert) > 0 {
+				vd.Set("Cert", makeDSSStreamArray(vri.Cert))
+			}
+			if len(vri.OCSP) > 0 {
+				vd.Set("OCSP", makeDSSStreamArray(vri.OCSP))
+			}
+			if len(vri.CRL) > 0 {
+				vd.Set("CRL", makeDSSStreamArray(vri.CRL))
+			}
+			if vri.TU != nil {
+				vd.Set("TU", vri.TU)
+			}
+			if vri.TS != nil {
+				vd.Set("TS", vri.TS)
+			}
+			vriDict.Set(core.PdfObjectName(key), vd)
+		}
+		dict.Set("VRI", vriDict)
+	}
+
+	d.container.PdfObject = dict
+	return d.container
+}
@@ -320,6 +320,7 @@ func newPdfFontFromPdfObject(fontObj core.PdfObject, allowType0 bool) (*PdfFont,
 
 			simplefont.charWidths = std.charWidths
 			simplefont.fontMetrics = std.fontMetrics
+			simplefont.std14Descriptor = std.std14Descriptor
 		} else {
 			simplefont, err = newSimpleFontFromPdfObject(d, base, nil)
 			if err != nil {
@@ -506,6 +507,21 @@ func (font *PdfFont) CharcodesToUnicodeWithStats(charcodes []textencoding.CharCo
 	return runes, len(runes), numMisses
 }
 
+// RuneToCharcode returns the character code that shows rune `r` in `font`. The ToUnicode CMap is
+// searched first, then the font's encoding. The bool return flag is false if no code maps to `r`.
+func (font *PdfFont) RuneToCharcode(r rune) (textencoding.CharCode, bool) {
+	if toUnicode := font.baseFields().toUnicodeCmap; toUnicode != nil {
+		if code, ok := toUnicode.UnicodeToCharcode(r); ok {
+			return textencoding.CharCode(code), true
+		}
+	}
+	encoder := font.Encoder()
+	if encoder == nil {
+		return 0, false
+	}
+	return encoder.RuneToCharcode(r)
+}
+
 // ToPdfObject converts the PdfFont object to its PDF representation.
 func (font *PdfFont) ToPdfObject() core.PdfObject {
 	if font.context == nil {
@@ -20,6 +20,12 @@ Ch = choice
 Sig = signature
 */
 
+// Signature flags of the AcroForm (Table 219 PDF32000_2008).
+const (
+	sigFlagSignaturesExist = 1
+	sigFlagAppendOnly      = 2
+)
+
 // PdfAcroForm represents the AcroForm dictionary used for representation of form data in PDF.
 type PdfAcroForm struct {
 	Fields          *[]*PdfField
@@ -80,6 +86,17 @@ func (form *PdfAcroForm) signatureFields() []*PdfFieldSignature {
 	return sigfields
 }
 
+// UnsignedSignatureFields returns the signature fields of the form which are not signed.
+func (form *PdfAcroForm) UnsignedSignatureFields() []*PdfFieldSignature {
+	var fields []*PdfFieldSignature
+	for _, field := range form.signatureFields() {
+		if field.V == nil {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
 // newPdfAcroFormFromDict is used when loading forms from PDF files.
 func (r *PdfReader) newPdfAcroFormFromDict(container *core.PdfIndirectObject, d *core.PdfObjectDictionary) (*PdfAcroForm, error) {
 	acroForm := NewPdfAcroForm()
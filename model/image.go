@@ -50,6 +50,14 @@ func (img *Image) AlphaMap(mapFunc AlphaMapFunc) {
 	}
 }
 
+// SetAlpha sets the alpha channel data of the image to `alpha`. `alpha` holds one sample per pixel
+// with the image's BitsPerComponent bits per sample, where 0 is transparent. A nil `alpha` removes
+// the alpha channel.
+func (img *Image) SetAlpha(alpha []byte) {
+	img.alphaData = alpha
+	img.hasAlpha = alpha != nil
+}
+
 // GetSamples converts the raw byte slice into samples which are stored in a uint32 bit array.
 // Each sample is represented by BitsPerComponent consecutive bits in the raw data.
 func (img *Image) GetSamples() []uint32 {
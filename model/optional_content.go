@@ -0,0 +1,731 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// OCState is the state of an optional content group.
+type OCState string
+
+// Optional content group states.
+const (
+	OCStateOn        OCState = "ON"
+	OCStateOff       OCState = "OFF"
+	OCStateUnchanged OCState = "Unchanged" // Only valid as the BaseState of a configuration.
+)
+
+// OCVisibilityPolicy is the visibility policy of an optional content membership dictionary: the
+// condition on the states of its groups for its content to be visible.
+type OCVisibilityPolicy string
+
+// Optional content membership visibility policies.
+const (
+	OCPolicyAllOn  OCVisibilityPolicy = "AllOn"
+	OCPolicyAnyOn  OCVisibilityPolicy = "AnyOn"
+	OCPolicyAnyOff OCVisibilityPolicy = "AnyOff"
+	OCPolicyAllOff OCVisibilityPolicy = "AllOff"
+)
+
+// PdfOCG represents an optional content group (8.11.2.1 - Table 98), a layer of content that can
+// be shown or hidden.
+type PdfOCG struct {
+	Name string
+	// Intent is the intended use of the group, e.g. View or Design. View is assumed if it is empty.
+	Intent []core.PdfObjectName
+	// Usage describes the nature of the content of the group. It may be nil.
+	Usage *PdfOCUsage
+
+	container *core.PdfIndirectObject
+}
+
+// PdfOCUsage represents an optional content usage dictionary (8.11.4.4 - Table 103). The states
+// are empty if they are not specified.
+type PdfOCUsage struct {
+	Creator        string             // CreatorInfo Creator: the application that created the group.
+	CreatorSubtype core.PdfObjectName // CreatorInfo Subtype: the type of content, e.g. Artwork or Technical.
+	Lang           string             // Language Lang: the language of the content.
+	LangPreferred  bool               // Language Preferred: the group is preferred when the language matches.
+	ExportState    OCState            // Export ExportState: the state when the document is exported.
+	ViewState      OCState            // View ViewState: the state when the document is first opened.
+	PrintState     OCState            // Print PrintState: the state when the document is printed.
+	PrintSubtype   core.PdfObjectName // Print Subtype: the kind of content, e.g. Trapping, PrintersMarks or Watermark.
+	ZoomMin        float64            // Zoom min: the minimum magnification at which the group is ON.
+	ZoomMax        float64            // Zoom max: the magnification at which the group becomes OFF. 0 if unspecified.
+	PageElement    core.PdfObjectName // PageElement Subtype: HF, FG, BG or L.
+	// User is the User entry: the users for whom the group is intended.
+	User core.PdfObject
+}
+
+// PdfOCMD represents an optional content membership dictionary (8.11.2.2 - Table 99). It makes
+// content visible depending on the states of several optional content groups.
+type PdfOCMD struct {
+	OCGs []*PdfOCG
+	P    OCVisibilityPolicy // AnyOn if empty.
+	// VE is a visibility expression. It takes precedence over OCGs and P if it is set.
+	VE *core.PdfObjectArray
+
+	container *core.PdfIndirectObject
+}
+
+// PdfOCConfig represents an optional content configuration dictionary (8.11.4.3 - Table 101): the
+// initial states of the optional content groups and how they are presented in a viewer.
+type PdfOCConfig struct {
+	Name      string
+	Creator   string
+	BaseState OCState // ON if empty.
+	ON        []*PdfOCG
+	OFF       []*PdfOCG
+	Intent    []core.PdfObjectName
+	AS        []*PdfOCUsageApplication
+	Order     []*PdfOCOrderItem
+	ListMode  core.PdfObjectName // AllPages or VisiblePages.
+	RBGroups  [][]*PdfOCG
+	Locked    []*PdfOCG
+}
+
+// PdfOCUsageApplication represents a usage application dictionary (8.11.4.4 - Table 104) that
+// sets the states of groups automatically based on their usage.
+type PdfOCUsageApplication struct {
+	Event    core.PdfObjectName // View, Print or Export.
+	OCGs     []*PdfOCG
+	Category []core.PdfObjectName
+}
+
+// PdfOCOrderItem is an entry in the presentation order of optional content groups in a viewer's
+// user interface. It is either a group with optional nested Children, or a Label for a collection
+// of Children that isn't a group itself.
+type PdfOCOrderItem struct {
+	OCG      *PdfOCG
+	Label    string
+	Children []*PdfOCOrderItem
+}
+
+// PdfOCProperties represents the optional content properties dictionary of a document
+// (8.11.4.2 - Table 100).
+type PdfOCProperties struct {
+	// OCGs are all the optional content groups of the document.
+	OCGs []*PdfOCG
+	// D is the default viewing configuration.
+	D *PdfOCConfig
+	// Configs are alternate configurations.
+	Configs []*PdfOCConfig
+}
+
+// NewPdfOCG returns a new optional content group named `name`.
+func NewPdfOCG(name string) *PdfOCG {
+	return &PdfOCG{Name: name, container: core.MakeIndirectObject(core.MakeDict())}
+}
+
+// NewPdfOCMD returns a new optional content membership dictionary for `ocgs` with policy `p`.
+func NewPdfOCMD(p OCVisibilityPolicy, ocgs ...*PdfOCG) *PdfOCMD {
+	return &PdfOCMD{OCGs: ocgs, P: p, container: core.MakeIndirectObject(core.MakeDict())}
+}
+
+// NewPdfOCProperties returns a new optional content properties dictionary with an empty default
+// configuration.
+func NewPdfOCProperties() *PdfOCProperties {
+	return &PdfOCProperties{D: &PdfOCConfig{}}
+}
+
+// GetContainingPdfObject returns the indirect object that holds the group's dictionary.
+func (ocg *PdfOCG) GetContainingPdfObject() core.PdfObject {
+	return ocg.container
+}
+
+// ToPdfObject returns the group as an indirect object holding its dictionary.
+func (ocg *PdfOCG) ToPdfObject() core.PdfObject {
+	dict := ocg.dict()
+	dict.Set("Type", core.MakeName("OCG"))
+	dict.Set("Name", core.MakeString(ocg.Name))
+	dict.Remove("Intent")
+	switch len(ocg.Intent) {
+	case 0:
+	case 1:
+		dict.Set("Intent", core.MakeName(string(ocg.Intent[0])))
+	default:
+		dict.Set("Intent", makeNameArray(ocg.Intent))
+	}
+	dict.Remove("Usage")
+	if ocg.Usage != nil {
+		dict.Set("Usage", ocg.Usage.ToPdfObject())
+	}
+	return ocg.container
+}
+
+// dict returns the group's dictionary.
+func (ocg *PdfOCG) dict() *core.PdfObjectDictionary {
+	dict, ok := ocg.container.PdfObject.(*core.PdfObjectDictionary)
+	if !ok {
+		dict = core.MakeDict()
+		ocg.container.PdfObject = dict
+	}
+	return dict
+}
+
+// ToPdfObject returns the usage dictionary.
+func (u *PdfOCUsage) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	if u.Creator != "" || u.CreatorSubtype != "" {
+		info := core.MakeDict()
+		info.Set("Creator", core.MakeString(u.Creator))
+		if u.CreatorSubtype != "" {
+			info.Set("Subtype", core.MakeName(string(u.CreatorSubtype)))
+		}
+		dict.Set("CreatorInfo", info)
+	}
+	if u.Lang != "" {
+		lang := core.MakeDict()
+		lang.Set("Lang", core.MakeString(u.Lang))
+		if u.LangPreferred {
+			lang.Set("Preferred", core.MakeName("ON"))
+		}
+		dict.Set("Language", lang)
+	}
+	setState := func(key, stateKey core.PdfObjectName, state OCState, subtype core.PdfObjectName) {
+		if state == "" && subtype == "" {
+			return
+		}
+		d := core.MakeDict()
+		if state != "" {
+			d.Set(stateKey, core.MakeName(string(state)))
+		}
+		if subtype != "" {
+			d.Set("Subtype", core.MakeName(string(subtype)))
+		}
+		dict.Set(key, d)
+	}
+	setState("Export", "ExportState", u.ExportState, "")
+	setState("View", "ViewState", u.ViewState, "")
+	setState("Print", "PrintState", u.PrintState, u.PrintSubtype)
+	if u.ZoomMin != 0 || u.ZoomMax != 0 {
+		zoom := core.MakeDict()
+		if u.ZoomMin != 0 {
+			zoom.Set("min", core.MakeFloat(u.ZoomMin))
+		}
+		if u.ZoomMax != 0 {
+			zoom.Set("max", core.MakeFloat(u.ZoomMax))
+		}
+		dict.Set("Zoom", zoom)
+	}
+	if u.PageElement != "" {
+		pe := core.MakeDict()
+		pe.Set("Subtype", core.MakeName(string(u.PageElement)))
+		dict.Set("PageElement", pe)
+	}
+	dict.SetIfNotNil("User", u.User)
+	return dict
+}
+
+// GetContainingPdfObject returns the indirect object that holds the membership dictionary.
+func (ocmd *PdfOCMD) GetContainingPdfObject() core.PdfObject {
+	return ocmd.container
+}
+
+// ToPdfObject returns the membership dictionary as an indirect object.
+func (ocmd *PdfOCMD) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	dict.Set("Type", core.MakeName("OCMD"))
+	dict.Set("OCGs", makeOCGArray(ocmd.OCGs))
+	if ocmd.P != "" {
+		dict.Set("P", core.MakeName(string(ocmd.P)))
+	}
+	dict.SetIfNotNil("VE", ocmd.VE)
+	ocmd.container.PdfObject = dict
+	return ocmd.container
+}
+
+// IsVisible returns whether `ocg` is ON in configuration `c`.
+func (c *PdfOCConfig) IsVisible(ocg *PdfOCG) bool {
+	for _, g := range c.OFF {
+		if g == ocg {
+			return false
+		}
+	}
+	for _, g := range c.ON {
+		if g == ocg {
+			return true
+		}
+	}
+	return c.BaseState != OCStateOff
+}
+
+// SetVisible sets the state of `ocg` in configuration `c` to ON if `visible` is true and to OFF
+// otherwise.
+func (c *PdfOCConfig) SetVisible(ocg *PdfOCG, visible bool) {
+	c.ON = removeOCG(c.ON, ocg)
+	c.OFF = removeOCG(c.OFF, ocg)
+	if visible {
+		c.ON = append(c.ON, ocg)
+	} else {
+		c.OFF = append(c.OFF, ocg)
+	}
+}
+
+// ToPdfObject returns the configuration dictionary.
+func (c *PdfOCConfig) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	if c.Name != "" {
+		dict.Set("Name", core.MakeString(c.Name))
+	}
+	if c.Creator != "" {
+		dict.Set("Creator", core.MakeString(c.Creator))
+	}
+	if c.BaseState != "" {
+		dict.Set("BaseState", core.MakeName(string(c.BaseState)))
+	}
+	if len(c.ON) > 0 {
+		dict.Set("ON", makeOCGArray(c.ON))
+	}
+	if len(c.OFF) > 0 {
+		dict.Set("OFF", makeOCGArray(c.OFF))
+	}
+	if len(c.Intent) > 0 {
+		dict.Set("Intent", makeNameArray(c.Intent))
+	}
+	if len(c.AS) > 0 {
+		arr := core.MakeArray()
+		for _, app := range c.AS {
+			d := core.MakeDict()
+			d.Set("Event", core.MakeName(string(app.Event)))
+			d.Set("OCGs", makeOCGArray(app.OCGs))
+			d.Set("Category", makeNameArray(app.Category))
+			arr.Append(d)
+		}
+		dict.Set("AS", arr)
+	}
+	if len(c.Order) > 0 {
+		dict.Set("Order", makeOrderArray(c.Order))
+	}
+	if c.ListMode != "" {
+		dict.Set("ListMode", core.MakeName(string(c.ListMode)))
+	}
+	if len(c.RBGroups) > 0 {
+		arr := core.MakeArray()
+		for _, group := range c.RBGroups {
+			arr.Append(makeOCGArray(group))
+		}
+		dict.Set("RBGroups", arr)
+	}
+	if len(c.Locked) > 0 {
+		dict.Set("Locked", makeOCGArray(c.Locked))
+	}
+	return dict
+}
+
+// GetOCGByName returns the first optional content group of `p` named `name` or nil if there is
+// none.
+func (p *PdfOCProperties) GetOCGByName(name string) *PdfOCG {
+	for _, ocg := range p.OCGs {
+		if ocg.Name == name {
+			return ocg
+		}
+	}
+	return nil
+}
+
+// AddOCG adds `ocg` to the groups of `p` and to the end of the presentation order of the default
+// configuration.
+func (p *PdfOCProperties) AddOCG(ocg *PdfOCG) {
+	p.OCGs = append(p.OCGs, ocg)
+	if p.D == nil {
+		p.D = &PdfOCConfig{}
+	}
+	p.D.Order = append(p.D.Order, &PdfOCOrderItem{OCG: ocg})
+}
+
+// RemoveOCG removes `ocg` from `p` and from all its configurations. Content that refers to the
+// group should be removed or flattened first, see contentstream.DeleteLayers and
+// contentstream.FlattenLayers.
+func (p *PdfOCProperties) RemoveOCG(ocg *PdfOCG) {
+	p.OCGs = removeOCG(p.OCGs, ocg)
+	configs := p.Configs
+	if p.D != nil {
+		configs = append([]*PdfOCConfig{p.D}, configs...)
+	}
+	for _, c := range configs {
+		c.ON = removeOCG(c.ON, ocg)
+		c.OFF = removeOCG(c.OFF, ocg)
+		c.Locked = removeOCG(c.Locked, ocg)
+		for i := range c.RBGroups {
+			c.RBGroups[i] = removeOCG(c.RBGroups[i], ocg)
+		}
+		for _, app := range c.AS {
+			app.OCGs = removeOCG(app.OCGs, ocg)
+		}
+		c.Order = removeOrderOCG(c.Order, ocg)
+	}
+}
+
+// Visibility returns a function that reports whether the optional content group with dictionary
+// `ocg` is visible in configuration `config` of `p`. The default configuration is used if `config`
+// is nil. The function has the type of contentstream.OCGVisibility. Groups that are not in `p` are
+// visible.
+func (p *PdfOCProperties) Visibility(config *PdfOCConfig) func(ocg *core.PdfObjectDictionary) bool {
+	if config == nil {
+		config = p.D
+	}
+	if config == nil {
+		config = &PdfOCConfig{}
+	}
+	states := map[*core.PdfObjectDictionary]bool{}
+	for _, ocg := range p.OCGs {
+		states[ocg.dict()] = config.IsVisible(ocg)
+	}
+	return func(ocg *core.PdfObjectDictionary) bool {
+		if visible, ok := states[ocg]; ok {
+			return visible
+		}
+		return true
+	}
+}
+
+// ToPdfObject returns the optional content properties dictionary.
+func (p *PdfOCProperties) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	dict.Set("OCGs", makeOCGArray(p.OCGs))
+	d := p.D
+	if d == nil {
+		d = &PdfOCConfig{}
+	}
+	dict.Set("D", d.ToPdfObject())
+	if len(p.Configs) > 0 {
+		arr := core.MakeArray()
+		for _, c := range p.Configs {
+			arr.Append(c.ToPdfObject())
+		}
+		dict.Set("Configs", arr)
+	}
+	return dict
+}
+
+// NewPdfOCPropertiesFromPdfObject loads an optional content properties dictionary from `obj`, for
+// example the object returned by PdfReader.GetOCProperties.
+func NewPdfOCPropertiesFromPdfObject(obj core.PdfObject) (*PdfOCProperties, error) {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return nil, errors.New("optional content properties not a dictionary")
+	}
+	l := ocLoader{ocgs: map[*core.PdfObjectDictionary]*PdfOCG{}}
+	p := &PdfOCProperties{}
+	arr, ok := core.GetArray(dict.Get("OCGs"))
+	if !ok {
+		return nil, errors.New("optional content properties without OCGs")
+	}
+	for _, obj := range arr.Elements() {
+		if ocg := l.loadOCG(obj); ocg != nil {
+			p.OCGs = append(p.OCGs, ocg)
+		}
+	}
+	if d, ok := core.GetDict(dict.Get("D")); ok {
+		p.D = l.loadConfig(d)
+	} else {
+		common.Log.Debug("ERROR: Optional content properties without default configuration")
+		p.D = &PdfOCConfig{}
+	}
+	if configs, ok := core.GetArray(dict.Get("Configs")); ok {
+		for _, obj := range configs.Elements() {
+			if c, ok := core.GetDict(obj); ok {
+				p.Configs = append(p.Configs, l.loadConfig(c))
+			}
+		}
+	}
+	return p, nil
+}
+
+// NewPdfOCMDFromPdfObject loads an optional content membership dictionary from `obj`. The groups
+// are looked up in `props` so that they are the same objects.
+func NewPdfOCMDFromPdfObject(obj core.PdfObject, props *PdfOCProperties) (*PdfOCMD, error) {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return nil, errors.New("optional content membership not a dictionary")
+	}
+	if typ, ok := core.GetName(dict.Get("Type")); !ok || *typ != "OCMD" {
+		return nil, errors.New("not an optional content membership dictionary")
+	}
+	l := ocLoader{ocgs: map[*core.PdfObjectDictionary]*PdfOCG{}}
+	if props != nil {
+		for _, ocg := range props.OCGs {
+			l.ocgs[ocg.dict()] = ocg
+		}
+	}
+	ocmd := &PdfOCMD{container: containerOf(obj)}
+	if _, ok := core.GetDict(dict.Get("OCGs")); ok {
+		if ocg := l.loadOCG(dict.Get("OCGs")); ocg != nil {
+			ocmd.OCGs = append(ocmd.OCGs, ocg)
+		}
+	} else {
+		ocmd.OCGs = l.loadOCGs(dict.Get("OCGs"))
+	}
+	if p, ok := core.GetName(dict.Get("P")); ok {
+		ocmd.P = OCVisibilityPolicy(*p)
+	}
+	ocmd.VE, _ = core.GetArray(dict.Get("VE"))
+	return ocmd, nil
+}
+
+// GetOptionalContentProperties returns the document's optional content properties, or nil if it
+// has none.
+func (r *PdfReader) GetOptionalContentProperties() (*PdfOCProperties, error) {
+	obj, err := r.GetOCProperties()
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, nil
+	}
+	return NewPdfOCPropertiesFromPdfObject(obj)
+}
+
+// ocLoader loads optional content objects, keeping one PdfOCG for each group dictionary.
+type ocLoader struct {
+	ocgs map[*core.PdfObjectDictionary]*PdfOCG
+}
+
+// loadOCG returns the group of `obj` or nil if it isn't an optional content group.
+func (l ocLoader) loadOCG(obj core.PdfObject) *PdfOCG {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return nil
+	}
+	if ocg, ok := l.ocgs[dict]; ok {
+		return ocg
+	}
+	if typ, ok := core.GetName(dict.Get("Type")); !ok || *typ != "OCG" {
+		common.Log.Debug("ERROR: Not an optional content group: %s", dict)
+		return nil
+	}
+	ocg := &PdfOCG{container: containerOf(obj)}
+	ocg.Name, _ = core.GetStringVal(dict.Get("Name"))
+	ocg.Intent = nameList(dict.Get("Intent"))
+	if usage, ok := core.GetDict(dict.Get("Usage")); ok {
+		ocg.Usage = newPdfOCUsageFromDict(usage)
+	}
+	l.ocgs[dict] = ocg
+	return ocg
+}
+
+// loadOCGs returns the groups in array `obj`.
+func (l ocLoader) loadOCGs(obj core.PdfObject) []*PdfOCG {
+	arr, ok := core.GetArray(obj)
+	if !ok {
+		return nil
+	}
+	var ocgs []*PdfOCG
+	for _, o := range arr.Elements() {
+		if ocg := l.loadOCG(o); ocg != nil {
+			ocgs = append(ocgs, ocg)
+		}
+	}
+	return ocgs
+}
+
+// loadConfig returns the configuration of dictionary `dict`.
+func (l ocLoader) loadConfig(dict *core.PdfObjectDictionary) *PdfOCConfig {
+	c := &PdfOCConfig{}
+	c.Name, _ = core.GetStringVal(dict.Get("Name"))
+	c.Creator, _ = core.GetStringVal(dict.Get("Creator"))
+	if base, ok := core.GetName(dict.Get("BaseState")); ok {
+		c.BaseState = OCState(*base)
+	}
+	c.ON = l.loadOCGs(dict.Get("ON"))
+	c.OFF = l.loadOCGs(dict.Get("OFF"))
+	c.Intent = nameList(dict.Get("Intent"))
+	if arr, ok := core.GetArray(dict.Get("AS")); ok {
+		for _, obj := range arr.Elements() {
+			d, ok := core.GetDict(obj)
+			if !ok {
+				continue
+			}
+			app := &PdfOCUsageApplication{OCGs: l.loadOCGs(d.Get("OCGs")), Category: nameList(d.Get("Category"))}
+			if event, ok := core.GetName(d.Get("Event")); ok {
+				app.Event = *event
+			}
+			c.AS = append(c.AS, app)
+		}
+	}
+	if arr, ok := core.GetArray(dict.Get("Order")); ok {
+		c.Order = l.loadOrder(arr, 0)
+	}
+	if mode, ok := core.GetName(dict.Get("ListMode")); ok {
+		c.ListMode = *mode
+	}
+	if arr, ok := core.GetArray(dict.Get("RBGroups")); ok {
+		for _, obj := range arr.Elements() {
+			c.RBGroups = append(c.RBGroups, l.loadOCGs(obj))
+		}
+	}
+	c.Locked = l.loadOCGs(dict.Get("Locked"))
+	return c
+}
+
+// maxOrderDepth limits the nesting of the presentation order.
+const maxOrderDepth = 32
+
+// loadOrder returns the presentation order items of Order array `arr` at nesting `depth`. An
+// array that follows a group holds the group's children. An array that starts with a string is
+// a labelled collection.
+func (l ocLoader) loadOrder(arr *core.PdfObjectArray, depth int) []*PdfOCOrderItem {
+	if depth > maxOrderDepth {
+		common.Log.Debug("ERROR: Optional content order nested too deeply")
+		return nil
+	}
+	var items []*PdfOCOrderItem
+	for _, obj := range arr.Elements() {
+		sub, ok := core.GetArray(obj)
+		if !ok {
+			if ocg := l.loadOCG(obj); ocg != nil {
+				items = append(items, &PdfOCOrderItem{OCG: ocg})
+			}
+			continue
+		}
+		if sub.Len() > 0 {
+			if label, ok := core.GetStringVal(sub.Get(0)); ok {
+				rest := core.MakeArray(sub.Elements()[1:]...)
+				items = append(items, &PdfOCOrderItem{Label: label, Children: l.loadOrder(rest, depth+1)})
+				continue
+			}
+		}
+		children := l.loadOrder(sub, depth+1)
+		if n := len(items); n > 0 && items[n-1].OCG != nil && items[n-1].Children == nil {
+			items[n-1].Children = children
+		} else {
+			items = append(items, &PdfOCOrderItem{Children: children})
+		}
+	}
+	return items
+}
+
+// newPdfOCUsageFromDict returns the usage of usage dictionary `dict`.
+func newPdfOCUsageFromDict(dict *core.PdfObjectDictionary) *PdfOCUsage {
+	u := &PdfOCUsage{}
+	sub := func(key core.PdfObjectName) *core.PdfObjectDictionary {
+		d, ok := core.GetDict(dict.Get(key))
+		if !ok {
+			return core.MakeDict()
+		}
+		return d
+	}
+	name := func(obj core.PdfObject) core.PdfObjectName {
+		if n, ok := core.GetName(obj); ok {
+			return *n
+		}
+		return ""
+	}
+	info := sub("CreatorInfo")
+	u.Creator, _ = core.GetStringVal(info.Get("Creator"))
+	u.CreatorSubtype = name(info.Get("Subtype"))
+	lang := sub("Language")
+	u.Lang, _ = core.GetStringVal(lang.Get("Lang"))
+	u.LangPreferred = name(lang.Get("Preferred")) == "ON"
+	u.ExportState = OCState(name(sub("Export").Get("ExportState")))
+	u.ViewState = OCState(name(sub("View").Get("ViewState")))
+	prt := sub("Print")
+	u.PrintState = OCState(name(prt.Get("PrintState")))
+	u.PrintSubtype = name(prt.Get("Subtype"))
+	zoom := sub("Zoom")
+	u.ZoomMin, _ = core.GetNumberAsFloat(zoom.Get("min"))
+	u.ZoomMax, _ = core.GetNumberAsFloat(zoom.Get("max"))
+	u.PageElement = name(sub("PageElement").Get("Subtype"))
+	u.User = dict.Get("User")
+	return u
+}
+
+// containerOf returns the indirect object of `obj`, or a new indirect object holding `obj` if it is
+// a direct object.
+func containerOf(obj core.PdfObject) *core.PdfIndirectObject {
+	if ind, ok := core.GetIndirect(obj); ok {
+		return ind
+	}
+	return core.MakeIndirectObject(core.TraceToDirectObject(obj))
+}
+
+// nameList returns the names of `obj`, which is a name or an array of names.
+func nameList(obj core.PdfObject) []core.PdfObjectName {
+	if name, ok := core.GetName(obj); ok {
+		return []core.PdfObjectName{*name}
+	}
+	arr, ok := core.GetArray(obj)
+	if !ok {
+		return nil
+	}
+	var names []core.PdfObjectName
+	for _, o := range arr.Elements() {
+		if name, ok := core.GetName(o); ok {
+			names = append(names, *name)
+		}
+	}
+	return names
+}
+
+// makeNameArray returns an array of `names`.
+func makeNameArray(names []core.PdfObjectName) *core.PdfObjectArray {
+	arr := core.MakeArray()
+	for _, name := range names {
+		arr.Append(core.MakeName(string(name)))
+	}
+	return arr
+}
+
+// makeOCGArray returns an array of `ocgs`.
+func makeOCGArray(ocgs []*PdfOCG) *core.PdfObjectArray {
+	arr := core.MakeArray()
+	for _, ocg := range ocgs {
+		arr.Append(ocg.ToPdfObject())
+	}
+	return arr
+}
+
+// makeOrderArray returns the Order array of presentation order `items`.
+func makeOrderArray(items []*PdfOCOrderItem) *core.PdfObjectArray {
+	arr := core.MakeArray()
+	for _, item := range items {
+		switch {
+		case item.OCG != nil:
+			arr.Append(item.OCG.ToPdfObject())
+			if len(item.Children) > 0 {
+				arr.Append(makeOrderArray(item.Children))
+			}
+		case item.Label != "":
+			sub := core.MakeArray(core.MakeString(item.Label))
+			sub.Append(makeOrderArray(item.Children).Elements()...)
+			arr.Append(sub)
+		default:
+			arr.Append(makeOrderArray(item.Children))
+		}
+	}
+	return arr
+}
+
+// removeOCG returns `ocgs` without `ocg`.
+func removeOCG(ocgs []*PdfOCG, ocg *PdfOCG) []*PdfOCG {
+	var kept []*PdfOCG
+	for _, g := range ocgs {
+		if g != ocg {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
+// removeOrderOCG returns presentation order `items` without `ocg`. The children of its items are
+// moved up to its place.
+func removeOrderOCG(items []*PdfOCOrderItem, ocg *PdfOCG) []*PdfOCOrderItem {
+	var kept []*PdfOCOrderItem
+	for _, item := range items {
+		item.Children = removeOrderOCG(item.Children, ocg)
+		if item.OCG == ocg {
+			kept = append(kept, item.Children...)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
@@ -0,0 +1,93 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+)
+
+func TestOCPropertiesRoundTrip(t *testing.T) {
+	props := NewPdfOCProperties()
+	base, dims, notes := NewPdfOCG("Base"), NewPdfOCG("Dimensions"), NewPdfOCG("Notes")
+	dims.Intent = []core.PdfObjectName{"View", "Design"}
+	notes.Usage = &PdfOCUsage{Creator: "updf", CreatorSubtype: "Technical", PrintState: OCStateOff,
+		PrintSubtype: "Watermark", ZoomMax: 4}
+	props.AddOCG(base)
+	props.AddOCG(dims)
+	props.AddOCG(notes)
+	props.D.Name = "Default"
+	props.D.SetVisible(notes, false)
+	props.D.RBGroups = [][]*PdfOCG{{dims, notes}}
+	props.D.Order = []*PdfOCOrderItem{
+		{OCG: base, Children: []*PdfOCOrderItem{{OCG: dims}}},
+		{Label: "Annotations", Children: []*PdfOCOrderItem{{OCG: notes}}},
+	}
+	props.Configs = []*PdfOCConfig{{Name: "Print", BaseState: OCStateOff, ON: []*PdfOCG{base}}}
+
+	obj := props.ToPdfObject()
+	dict, ok := core.GetDict(obj)
+	require.True(t, ok)
+	d, ok := core.GetDict(dict.Get("D"))
+	require.True(t, ok)
+	// The groups are not numbered before they are written.
+	assert.Equal(t, `[0 0 R [0 0 R] [(Annotations) 0 0 R]]`, d.Get("Order").WriteString())
+
+	loaded, err := NewPdfOCPropertiesFromPdfObject(obj)
+	require.NoError(t, err)
+	require.Len(t, loaded.OCGs, 3)
+	// The groups are loaded from the same objects.
+	assert.Equal(t, []*core.PdfIndirectObject{base.container, dims.container, notes.container},
+		[]*core.PdfIndirectObject{loaded.OCGs[0].container, loaded.OCGs[1].container, loaded.OCGs[2].container})
+	lbase, ldims, lnotes := loaded.OCGs[0], loaded.GetOCGByName("Dimensions"), loaded.GetOCGByName("Notes")
+	assert.Equal(t, dims.Intent, ldims.Intent)
+	assert.Equal(t, notes.Usage, lnotes.Usage)
+	assert.Equal(t, "Default", loaded.D.Name)
+	assert.True(t, loaded.D.IsVisible(lbase))
+	assert.False(t, loaded.D.IsVisible(lnotes))
+	assert.Equal(t, [][]*PdfOCG{{ldims, lnotes}}, loaded.D.RBGroups)
+	require.Len(t, loaded.D.Order, 2)
+	assert.Equal(t, lbase, loaded.D.Order[0].OCG)
+	assert.Equal(t, ldims, loaded.D.Order[0].Children[0].OCG)
+	assert.Equal(t, "Annotations", loaded.D.Order[1].Label)
+	require.Len(t, loaded.Configs, 1)
+	assert.False(t, loaded.Configs[0].IsVisible(ldims))
+	assert.True(t, loaded.Configs[0].IsVisible(lbase))
+
+	visible := loaded.Visibility(nil)
+	assert.True(t, visible(lbase.dict()))
+	assert.False(t, visible(lnotes.dict()))
+	assert.True(t, visible(core.MakeDict()))
+	assert.False(t, loaded.Visibility(loaded.Configs[0])(ldims.dict()))
+
+	loaded.RemoveOCG(lbase)
+	assert.Equal(t, []*PdfOCG{ldims, lnotes}, loaded.OCGs)
+	// The children of a removed group take its place.
+	require.Len(t, loaded.D.Order, 2)
+	assert.Equal(t, ldims, loaded.D.Order[0].OCG)
+	assert.Empty(t, loaded.Configs[0].ON)
+}
+
+func TestOCMDFromPdfObject(t *testing.T) {
+	props := NewPdfOCProperties()
+	a, b := NewPdfOCG("A"), NewPdfOCG("B")
+	props.AddOCG(a)
+	props.AddOCG(b)
+	props.ToPdfObject()
+
+	ocmd := NewPdfOCMD(OCPolicyAllOn, a, b)
+	loaded, err := NewPdfOCMDFromPdfObject(ocmd.ToPdfObject(), props)
+	require.NoError(t, err)
+	assert.Equal(t, []*PdfOCG{a, b}, loaded.OCGs)
+	assert.Equal(t, OCPolicyAllOn, loaded.P)
+
+	_, err = NewPdfOCMDFromPdfObject(a.ToPdfObject(), props)
+	assert.Error(t, err)
+}
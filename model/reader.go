@@ -6,6 +6,8 @@
 package model
 
 import (
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -150,6 +152,27 @@ func (r *PdfReader) Decrypt(password []byte) (bool, error) {
 	return true, nil
 }
 
+// DecryptWithCertificate decrypts the PDF file encrypted for certificates (public-key security
+// handler) with certificate `cert` and its private key `key`. Returns true if successful, false
+// if the document was not encrypted for the certificate.
+func (r *PdfReader) DecryptWithCertificate(cert *x509.Certificate, key crypto.Decrypter) (bool, error) {
+	success, err := r.parser.DecryptWithCertificate(cert, key)
+	if err != nil {
+		return false, err
+	}
+	if !success {
+		return false, nil
+	}
+
+	err = r.loadStructure()
+	if err != nil {
+		common.Log.Debug("ERROR: Fail to load structure (%s)", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
 // CheckAccessRights checks access rights and permissions for a specified password.  If either user/owner
 // password is specified,  full rights are granted, otherwise the access rights are specified by the
 // Permissions flag.
@@ -160,6 +160,43 @@ func (r *PdfPageResources) HasExtGState(keyName core.PdfObjectName) bool {
 	return has
 }
 
+// GetPropertiesByName gets the marked-content property list specified by keyName (14.6.2).
+// Returns a bool indicating whether it was found or not.
+func (r *PdfPageResources) GetPropertiesByName(keyName core.PdfObjectName) (core.PdfObject, bool) {
+	if r.Properties == nil {
+		return nil, false
+	}
+
+	dict, ok := core.TraceToDirectObject(r.Properties).(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ERROR: Invalid Properties entry - not a dict (got %T)", r.Properties)
+		return nil, false
+	}
+	if obj := dict.Get(keyName); obj != nil {
+		return obj, true
+	}
+
+	return nil, false
+}
+
+// SetPropertiesByName sets the marked-content property list `obj` under the name keyName. The
+// property list can be specified either directly as a dictionary or an indirect object containing
+// a dictionary, e.g. an optional content group.
+func (r *PdfPageResources) SetPropertiesByName(keyName core.PdfObjectName, obj core.PdfObject) error {
+	if r.Properties == nil {
+		r.Properties = core.MakeDict()
+	}
+
+	dict, ok := core.TraceToDirectObject(r.Properties).(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Properties type error (got %T/%T)", r.Properties, core.TraceToDirectObject(r.Properties))
+		return core.ErrTypeError
+	}
+
+	dict.Set(keyName, obj)
+	return nil
+}
+
 // GetShadingByName gets the shading specified by keyName. Returns nil if not existing.
 // The bool flag indicated whether it was found or not.
 func (r *PdfPageResources) GetShadingByName(keyName core.PdfObjectName) (*PdfShading, bool) {
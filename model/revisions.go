@@ -0,0 +1,651 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// RevisionChanges describes the objects added and modified by an incremental update of a
+// document (Section 7.5.6 "Incremental Updates" PDF32000_2008).
+type RevisionChanges struct {
+	// Start and End are the offsets of the data of the revision in the document.
+	Start int64
+	End   int64
+
+	// Added and Modified are the numbers of the objects added and modified by the revision.
+	Added    []int
+	Modified []int
+
+	// Types maps the numbers of the added and modified objects to their Type, or to their
+	// Subtype if they have no Type. Objects which are not dictionaries or streams, or have
+	// neither, are not in the map.
+	Types map[int]string
+}
+
+// revisionEnds returns the offsets of the ends of the revisions of document `data`, which are
+// the offsets following the end-of-file markers and their end-of-line markers.
+func revisionEnds(data []byte) []int64 {
+	var ends []int64
+	marker := []byte("%%EOF")
+	for offset := 0; ; {
+		i := bytes.Index(data[offset:], marker)
+		if i < 0 {
+			break
+		}
+		i += offset
+		offset = i + len(marker)
+
+		// The marker must follow the startxref keyword, as end-of-file markers can be found in
+		// the data of streams.
+		from := i - 64
+		if from < 0 {
+			from = 0
+		}
+		if !bytes.Contains(data[from:i], []byte("startxref")) {
+			continue
+		}
+		end := offset
+		if end < len(data) && data[end] == '\r' {
+			end++
+		}
+		if end < len(data) && data[end] == '\n' {
+			end++
+		}
+		ends = append(ends, int64(end))
+	}
+	return ends
+}
+
+// revisionObjects returns the offsets of the objects of the revision of document `data`
+// ending at `end`, mapped by object number. The offsets of objects in object streams are the
+// offsets of the streams.
+func revisionObjects(data []byte, end int64) (*core.PdfParser, map[int]int64, error) {
+	parser, err := core.NewParser(bytes.NewReader(data[:end]))
+	if err != nil {
+		return nil, nil, err
+	}
+	xrefs := parser.GetXrefTable()
+	objects := make(map[int]int64, len(xrefs.ObjectMap))
+	for num, xref := range xrefs.ObjectMap {
+		switch xref.XType {
+		case core.XrefTypeTableEntry:
+			objects[num] = xref.Offset
+		case core.XrefTypeObjectStream:
+			if os, ok := xrefs.ObjectMap[xref.OsObjNumber]; ok {
+				objects[num] = os.Offset
+			}
+		}
+	}
+	return parser, objects, nil
+}
+
+// getRevisionChanges returns the changes of the revisions of document `data` following the
+// revision ending at offset `from`.
+func getRevisionChanges(data []byte, from int64) ([]RevisionChanges, error) {
+	_, prevObjects, err := revisionObjects(data, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []RevisionChanges
+	start := from
+	for _, end := range revisionEnds(data) {
+		if end <= from {
+			continue
+		}
+		parser, objects, err := revisionObjects(data, end)
+		if err != nil {
+			return nil, err
+		}
+
+		rc := RevisionChanges{Start: start, End: end, Types: map[int]string{}}
+		for num, offset := range objects {
+			if offset < start || offset >= end {
+				continue
+			}
+			if _, ok := prevObjects[num]; ok {
+				rc.Modified = append(rc.Modified, num)
+			} else {
+				rc.Added = append(rc.Added, num)
+			}
+			obj, err := parser.LookupByNumber(num)
+			if err != nil {
+				common.Log.Debug("ERROR: Revision object %d: %v", num, err)
+				continue
+			}
+			if typ := objectType(obj); typ != "" {
+				rc.Types[num] = typ
+			}
+		}
+		sort.Ints(rc.Added)
+		sort.Ints(rc.Modified)
+		changes = append(changes, rc)
+
+		prevObjects = objects
+		start = end
+	}
+	return changes, nil
+}
+
+// objectType returns the Type of dictionary or stream `obj`, or its Subtype if it has no Type.
+func objectType(obj core.PdfObject) string {
+	var dict *core.PdfObjectDictionary
+	if stream, ok := core.GetStream(obj); ok {
+		dict = stream.PdfObjectDictionary
+	} else if d, ok := core.GetDict(obj); ok {
+		dict = d
+	} else {
+		return ""
+	}
+	if name, ok := core.GetNameVal(dict.Get("Type")); ok {
+		return name
+	}
+	name, _ := core.GetNameVal(dict.Get("Subtype"))
+	return name
+}
+
+// checkRevisionPermissions returns the changes of the revisions of document `data` following
+// the revision ending at offset `from` which are not permitted by DocMDP permission `perm`, if
+// not 0, and by the fields locked by `lock`, if not nil.
+func checkRevisionPermissions(data []byte, from int64, perm DocMDPPermission, lock *FieldMDP) ([]string, error) {
+	prev, _, err := revisionObjects(data, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var disallowed []string
+	for _, end := range revisionEnds(data) {
+		if end <= from {
+			continue
+		}
+		next, _, err := revisionObjects(data, end)
+		if err != nil {
+			return nil, err
+		}
+		d := &revisionDiff{
+			prev:     prev,
+			next:     next,
+			visited:  map[[2]int64]bool{},
+			results:  map[[2]int64]bool{},
+			separate: map[int64]bool{},
+		}
+		disallowed = append(disallowed, d.check(perm, lock)...)
+
+		prev = next
+	}
+	return disallowed, nil
+}
+
+// revisionDiff compares consecutive revisions of a document.
+type revisionDiff struct {
+	prev *core.PdfParser
+	next *core.PdfParser
+
+	// visited are the pairs of objects of the previous and next revisions being compared, which
+	// are assumed equal on cycles.
+	visited map[[2]int64]bool
+
+	// results are the results of the comparisons of the pairs of objects of the previous and
+	// next revisions.
+	results map[[2]int64]bool
+
+	// separate are the numbers of the objects of the page trees, annotations and form fields,
+	// which are checked separately. References to them are compared by object number.
+	separate map[int64]bool
+}
+
+// inheritablePageKeys are the page attributes inherited from the page tree.
+var inheritablePageKeys = []core.PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// check returns the changes of the next revision not permitted by DocMDP permission `perm`, if
+// not 0, and by the fields locked by `lock`, if not nil.
+func (d *revisionDiff) check(perm DocMDPPermission, lock *FieldMDP) []string {
+	prevRoot, _ := core.GetDict(d.resolve(d.prev, d.prev.GetTrailer().Get("Root")))
+	nextRoot, _ := core.GetDict(d.resolve(d.next, d.next.GetTrailer().Get("Root")))
+	if prevRoot == nil || nextRoot == nil {
+		return []string{"catalog not found"}
+	}
+
+	prevForm, _ := core.GetDict(d.resolve(d.prev, prevRoot.Get("AcroForm")))
+	nextForm, _ := core.GetDict(d.resolve(d.next, nextRoot.Get("AcroForm")))
+	if prevForm == nil {
+		prevForm = core.MakeDict()
+	}
+	if nextForm == nil {
+		nextForm = core.MakeDict()
+	}
+	prevFields, _ := d.fields(d.prev, prevForm)
+	nextFields, widgets := d.fields(d.next, nextForm)
+	prevPages := d.pages(d.prev, prevRoot)
+	nextPages := d.pages(d.next, nextRoot)
+
+	var disallowed []string
+	if perm != 0 {
+		// The form and the validation data are checked separately or can be updated.
+		for _, key := range d.changedKeys(prevRoot, nextRoot, "AcroForm", "DSS", "Extensions", "Pages") {
+			disallowed = append(disallowed, fmt.Sprintf("catalog entry %s modified", key))
+		}
+		for _, key := range d.changedKeys(prevForm, nextForm, "Fields") {
+			switch {
+			case key == "SigFlags":
+			case perm >= DocMDPFillForms && (key == "DR" || key == "DA" || key == "NeedAppearances"):
+			default:
+				disallowed = append(disallowed, fmt.Sprintf("form entry %s modified", key))
+			}
+		}
+	}
+	disallowed = append(disallowed, d.checkFields(prevFields, nextFields, perm, lock)...)
+
+	if perm != 0 {
+		disallowed = append(disallowed, d.checkPages(prevPages, nextPages, perm, widgets)...)
+	}
+	return disallowed
+}
+
+// revisionField is a form field of a revision.
+type revisionField struct {
+	obj  core.PdfObject
+	dict *core.PdfObjectDictionary
+	ft   string
+
+	// widgets are the widget annotations of the field which are not merged with it.
+	widgets []core.PdfObject
+}
+
+// fields returns the fields of form `form` of the revision parsed by `parser`, mapped by fully
+// qualified name, and the numbers of the objects of the widget annotations of the fields.
+// The objects of the fields are checked separately.
+func (d *revisionDiff) fields(parser *core.PdfParser, form *core.PdfObjectDictionary) (map[string]*revisionField, map[int64]bool) {
+	fields := map[string]*revisionField{}
+	widgets := map[int64]bool{}
+	traversed := map[int64]bool{}
+
+	var walk func(objs *core.PdfObjectArray, parent *revisionField, name string, ft string)
+	walk = func(objs *core.PdfObjectArray, parent *revisionField, parentName string, ft string) {
+		if objs == nil {
+			return
+		}
+		for _, obj := range objs.Elements() {
+			ref, isRef := obj.(*core.PdfObjectReference)
+			if isRef {
+				if traversed[ref.ObjectNumber] {
+					continue
+				}
+				traversed[ref.ObjectNumber] = true
+				d.separate[ref.ObjectNumber] = true
+			}
+			dict, ok := core.GetDict(d.resolve(parser, obj))
+			if !ok {
+				continue
+			}
+			if isRef {
+				if subtype, _ := core.GetNameVal(dict.Get("Subtype")); subtype == "Widget" {
+					widgets[ref.ObjectNumber] = true
+				}
+			}
+			t, ok := core.GetString(dict.Get("T"))
+			if !ok {
+				// Widget annotation of the parent field.
+				if parent != nil {
+					parent.widgets = append(parent.widgets, obj)
+				}
+				continue
+			}
+			name := t.Decoded()
+			if parentName != "" {
+				name = parentName + "." + name
+			}
+			fieldType := ft
+			if v, ok := core.GetNameVal(dict.Get("FT")); ok {
+				fieldType = v
+			}
+			field := &revisionField{obj: obj, dict: dict, ft: fieldType}
+			fields[name] = field
+			kids, _ := core.GetArray(d.resolve(parser, dict.Get("Kids")))
+			walk(kids, field, name, fieldType)
+		}
+	}
+	fieldsArr, _ := core.GetArray(d.resolve(parser, form.Get("Fields")))
+	walk(fieldsArr, nil, "", "")
+	return fields, widgets
+}
+
+// checkFields returns the changes of the fields `prevFields` of the previous revision to the
+// fields `nextFields` of the next revision not permitted by DocMDP permission `perm`, if not 0,
+// and by the fields locked by `lock`, if not nil.
+func (d *revisionDiff) checkFields(prevFields, nextFields map[string]*revisionField, perm DocMDPPermission, lock *FieldMDP) []string {
+	var disallowed []string
+	locked := func(name string) bool {
+		return lock != nil && lock.IsLocked(name)
+	}
+
+	for _, name := range sortedFieldNames(prevFields) {
+		if _, ok := nextFields[name]; ok {
+			continue
+		}
+		if perm != 0 || locked(name) {
+			disallowed = append(disallowed, fmt.Sprintf("field %s removed", name))
+		}
+	}
+
+	for _, name := range sortedFieldNames(nextFields) {
+		next := nextFields[name]
+		prev, ok := prevFields[name]
+		if !ok {
+			switch {
+			case perm == 0:
+			case next.ft != "Sig":
+				disallowed = append(disallowed, fmt.Sprintf("field %s added", name))
+			case perm == DocMDPNoChanges && !d.isDocTimeStamp(next.dict.Get("V")):
+				disallowed = append(disallowed, fmt.Sprintf("signature field %s added", name))
+			}
+			continue
+		}
+		keys, replaced := d.changedWidgetKeys(prev, next)
+		keys = append(keys, d.changedKeys(prev.dict, next.dict, "Kids", "Parent")...)
+		var valueChanged, appearanceChanged bool
+		modified := replaced
+		for _, key := range keys {
+			switch key {
+			case "V", "AS":
+				valueChanged = true
+			case "AP":
+				appearanceChanged = true
+			default:
+				modified = true
+			}
+		}
+		switch {
+		case !valueChanged && !appearanceChanged && !modified:
+		case locked(name):
+			disallowed = append(disallowed, fmt.Sprintf("locked field %s modified", name))
+		case perm == 0:
+		case modified:
+			disallowed = append(disallowed, fmt.Sprintf("field %s modified", name))
+		case !valueChanged:
+			// Appearances can only be updated along with the values they display.
+			disallowed = append(disallowed, fmt.Sprintf("appearance of field %s modified", name))
+		case next.ft == "Sig" && prev.dict.Get("V") != nil:
+			disallowed = append(disallowed, fmt.Sprintf("signature of field %s modified", name))
+		case perm == DocMDPNoChanges && (next.ft != "Sig" || !d.isDocTimeStamp(next.dict.Get("V"))):
+			disallowed = append(disallowed, fmt.Sprintf("field %s filled", name))
+		}
+	}
+	return disallowed
+}
+
+// changedWidgetKeys returns the keys whose values differ in the widget annotations of field
+// `prev` of the previous revision and field `next` of the next revision which are not merged
+// with the fields, and whether widget annotations were added, removed or replaced.
+func (d *revisionDiff) changedWidgetKeys(prev, next *revisionField) ([]core.PdfObjectName, bool) {
+	if len(prev.widgets) != len(next.widgets) {
+		return nil, true
+	}
+	var keys []core.PdfObjectName
+	for i, nextObj := range next.widgets {
+		prevObj := prev.widgets[i]
+		prevRef, ok1 := prevObj.(*core.PdfObjectReference)
+		nextRef, ok2 := nextObj.(*core.PdfObjectReference)
+		if ok1 != ok2 || ok1 && prevRef.ObjectNumber != nextRef.ObjectNumber {
+			return nil, true
+		}
+		prevDict, _ := core.GetDict(d.resolve(d.prev, prevObj))
+		nextDict, _ := core.GetDict(d.resolve(d.next, nextObj))
+		if prevDict == nil || nextDict == nil {
+			return nil, true
+		}
+		keys = append(keys, d.changedKeys(prevDict, nextDict, "Parent")...)
+	}
+	return keys, false
+}
+
+// checkPages returns the changes of the pages `prevPages` of the previous revision to the pages
+// `nextPages` of the next revision not permitted by DocMDP permission `perm`. The annotations
+// whose object numbers are in `widgets` are the widgets of the form fields, whose changes are
+// checked with the fields.
+func (d *revisionDiff) checkPages(prevPages, nextPages []*core.PdfObjectDictionary, perm DocMDPPermission, widgets map[int64]bool) []string {
+	if len(prevPages) != len(nextPages) {
+		return []string{fmt.Sprintf("pages added or removed (%d to %d pages)", len(prevPages), len(nextPages))}
+	}
+
+	var disallowed []string
+	for i := range nextPages {
+		prevPage, nextPage := prevPages[i], nextPages[i]
+		modified := len(d.changedKeys(prevPage, nextPage, "Annots", "Parent", "Resources", "MediaBox", "CropBox", "Rotate")) > 0
+		for _, key := range inheritablePageKeys {
+			if !d.equal(d.inheritedEntry(d.prev, prevPage, key), d.inheritedEntry(d.next, nextPage, key)) {
+				modified = true
+			}
+		}
+		if modified {
+			disallowed = append(disallowed, fmt.Sprintf("page %d modified", i+1))
+		}
+		if perm >= DocMDPFillFormsAndAnnotate {
+			continue
+		}
+
+		prevAnnots := d.annotations(d.prev, prevPage)
+		nextAnnots := d.annotations(d.next, nextPage)
+		var added, changed, removed bool
+		for num, obj := range nextAnnots {
+			if widgets[num] {
+				continue
+			}
+			if prevObj, ok := prevAnnots[num]; !ok {
+				added = true
+			} else if !d.equalObjects(d.resolve(d.prev, prevObj), d.resolve(d.next, obj)) {
+				changed = true
+			}
+		}
+		for num := range prevAnnots {
+			if _, ok := nextAnnots[num]; !ok {
+				removed = true
+			}
+		}
+		if added {
+			disallowed = append(disallowed, fmt.Sprintf("annotation added to page %d", i+1))
+		}
+		if changed {
+			disallowed = append(disallowed, fmt.Sprintf("annotation modified on page %d", i+1))
+		}
+		if removed {
+			disallowed = append(disallowed, fmt.Sprintf("annotation removed from page %d", i+1))
+		}
+	}
+	return disallowed
+}
+
+// pages returns the page dictionaries of catalog `root` of the revision parsed by `parser`.
+// The objects of the page tree and of the annotations of the pages are checked separately.
+func (d *revisionDiff) pages(parser *core.PdfParser, root *core.PdfObjectDictionary) []*core.PdfObjectDictionary {
+	var pages []*core.PdfObjectDictionary
+	traversed := map[int64]bool{}
+
+	var walk func(obj core.PdfObject)
+	walk = func(obj core.PdfObject) {
+		if ref, ok := obj.(*core.PdfObjectReference); ok {
+			if traversed[ref.ObjectNumber] {
+				return
+			}
+			traversed[ref.ObjectNumber] = true
+			d.separate[ref.ObjectNumber] = true
+		}
+		dict, ok := core.GetDict(d.resolve(parser, obj))
+		if !ok {
+			return
+		}
+		if typ, _ := core.GetNameVal(dict.Get("Type")); typ == "Page" {
+			pages = append(pages, dict)
+			d.annotations(parser, dict)
+			return
+		}
+		if kids, ok := core.GetArray(d.resolve(parser, dict.Get("Kids"))); ok {
+			for _, kid := range kids.Elements() {
+				walk(kid)
+			}
+		}
+	}
+	walk(root.Get("Pages"))
+	return pages
+}
+
+// inheritedEntry returns the entry `key` of page `page` of the revision parsed by `parser`,
+// which may be inherited from the page tree.
+func (d *revisionDiff) inheritedEntry(parser *core.PdfParser, page *core.PdfObjectDictionary, key core.PdfObjectName) core.PdfObject {
+	dict := page
+	// The depth is bounded to stop on cyclic page trees.
+	for depth := 0; dict != nil && depth < 32; depth++ {
+		if obj := dict.Get(key); obj != nil {
+			return obj
+		}
+		dict, _ = core.GetDict(d.resolve(parser, dict.Get("Parent")))
+	}
+	return nil
+}
+
+// annotations returns the annotations of page `page` of the revision parsed by `parser`, mapped
+// by object number, which are checked separately. Direct annotations are not returned.
+func (d *revisionDiff) annotations(parser *core.PdfParser, page *core.PdfObjectDictionary) map[int64]core.PdfObject {
+	annots := map[int64]core.PdfObject{}
+	arr, ok := core.GetArray(d.resolve(parser, page.Get("Annots")))
+	if !ok {
+		return annots
+	}
+	for _, obj := range arr.Elements() {
+		if ref, ok := obj.(*core.PdfObjectReference); ok {
+			annots[ref.ObjectNumber] = obj
+			d.separate[ref.ObjectNumber] = true
+		}
+	}
+	return annots
+}
+
+// isDocTimeStamp returns true if `obj` of the next revision is a document timestamp.
+func (d *revisionDiff) isDocTimeStamp(obj core.PdfObject) bool {
+	dict, ok := core.GetDict(d.resolve(d.next, obj))
+	if !ok {
+		return false
+	}
+	typ, _ := core.GetNameVal(dict.Get("Type"))
+	return typ == "DocTimeStamp"
+}
+
+// resolve returns the object referenced by `obj` in the revision parsed by `parser`, or `obj`
+// itself if it is not a reference. Indirect objects are returned as their direct objects.
+func (d *revisionDiff) resolve(parser *core.PdfParser, obj core.PdfObject) core.PdfObject {
+	if ref, ok := obj.(*core.PdfObjectReference); ok {
+		resolved, err := parser.LookupByReference(*ref)
+		if err != nil {
+			common.Log.Debug("ERROR: Revision object %d: %v", ref.ObjectNumber, err)
+			return nil
+		}
+		obj = resolved
+	}
+	if ind, ok := obj.(*core.PdfIndirectObject); ok {
+		return ind.PdfObject
+	}
+	return obj
+}
+
+// changedKeys returns the keys whose values differ in dictionary `prev` of the previous
+// revision and dictionary `next` of the next revision, except for the keys `ignore`.
+func (d *revisionDiff) changedKeys(prev, next *core.PdfObjectDictionary, ignore ...core.PdfObjectName) []core.PdfObjectName {
+	ignored := func(key core.PdfObjectName) bool {
+		for _, k := range ignore {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	var keys []core.PdfObjectName
+	for _, key := range prev.Keys() {
+		if !ignored(key) && !d.equal(prev.Get(key), next.Get(key)) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range next.Keys() {
+		if !ignored(key) && prev.Get(key) == nil && next.Get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// equal returns true if object `prev` of the previous revision and object `next` of the next
+// revision are equal. The objects referenced by both are compared, even if unchanged in the next
+// revision, as the objects they reference may have changed, except for the objects checked
+// separately.
+func (d *revisionDiff) equal(prev, next core.PdfObject) bool {
+	prevRef, ok1 := prev.(*core.PdfObjectReference)
+	nextRef, ok2 := next.(*core.PdfObjectReference)
+	if !ok1 || !ok2 {
+		return d.equalObjects(d.resolve(d.prev, prev), d.resolve(d.next, next))
+	}
+
+	if d.separate[prevRef.ObjectNumber] || d.separate[nextRef.ObjectNumber] {
+		return prevRef.ObjectNumber == nextRef.ObjectNumber
+	}
+	key := [2]int64{prevRef.ObjectNumber, nextRef.ObjectNumber}
+	if eq, ok := d.results[key]; ok {
+		return eq
+	}
+	if d.visited[key] {
+		// Cycle: the objects are equal if the rest of the comparison finds no difference.
+		return true
+	}
+	d.visited[key] = true
+	eq := d.equalObjects(d.resolve(d.prev, prev), d.resolve(d.next, next))
+	delete(d.visited, key)
+	d.results[key] = eq
+	return eq
+}
+
+// equalObjects returns true if the resolved object `prev` of the previous revision and the
+// resolved object `next` of the next revision are equal.
+func (d *revisionDiff) equalObjects(prev, next core.PdfObject) bool {
+	if prev == nil || next == nil {
+		return prev == nil && next == nil
+	}
+	switch p := prev.(type) {
+	case *core.PdfObjectDictionary:
+		n, ok := next.(*core.PdfObjectDictionary)
+		return ok && len(d.changedKeys(p, n)) == 0
+	case *core.PdfObjectStream:
+		n, ok := next.(*core.PdfObjectStream)
+		return ok && bytes.Equal(p.Stream, n.Stream) &&
+			len(d.changedKeys(p.PdfObjectDictionary, n.PdfObjectDictionary)) == 0
+	case *core.PdfObjectArray:
+		n, ok := next.(*core.PdfObjectArray)
+		if !ok || p.Len() != n.Len() {
+			return false
+		}
+		for i := 0; i < p.Len(); i++ {
+			if !d.equal(p.Get(i), n.Get(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return prev.WriteString() == next.WriteString()
+}
+
+// sortedFieldNames returns the names of `fields` in lexical order.
+func sortedFieldNames(fields map[string]*revisionField) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
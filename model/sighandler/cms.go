@@ -0,0 +1,544 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	// Register the digest algorithms of CMS signatures.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Object identifiers used in CMS signatures (RFC 5652, RFC 5035, RFC 8017, RFC 5758 and
+// RFC 8419).
+var (
+	oidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	oidAttributeContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidAttributeSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+
+	oidDigestSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSAWithSHA1     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidRSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidRSAWithSHA384   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidRSAWithSHA512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidRSASSAPSS       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// rsaPSSParameters is the RSASSA-PSS-params type (RFC 4055 section 3.1).
+type rsaPSSParameters struct {
+	HashAlgorithm    pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MaskGenAlgorithm pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength       int                      `asn1:"explicit,tag:2"`
+	TrailerField     int                      `asn1:"optional,explicit,tag:3,default:1"`
+}
+
+// cmsContentInfo is the ContentInfo type (RFC 5652 section 3).
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// cmsSignedData is the SignedData type (RFC 5652 section 5.1).
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+// cmsSignerInfo is the SignerInfo type (RFC 5652 section 5.3). The signed and unsigned attributes
+// are kept encoded, as the signature covers the encoding of the signed attributes.
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// cmsIssuerAndSerial is the IssuerAndSerialNumber type (RFC 5652 section 10.2.4).
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// cmsAttribute is the Attribute type (RFC 5652 section 5.3).
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// essCertIDv2 is the ESSCertIDv2 type of the signing-certificate-v2 attribute (RFC 5035 section 4).
+// The hash algorithm is SHA-256 when omitted.
+type essCertIDv2 struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"`
+	CertHash      []byte
+	IssuerSerial  asn1.RawValue `asn1:"optional"`
+}
+
+// signingCertificateV2 is the SigningCertificateV2 type (RFC 5035 section 3).
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// newCMSAttribute returns the attribute of type `oid` with the single value `value`.
+func newCMSAttribute(oid asn1.ObjectIdentifier, value interface{}) (cmsAttribute, error) {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return cmsAttribute{}, err
+	}
+	return cmsAttribute{
+		Type:   oid,
+		Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: data},
+	}, nil
+}
+
+// marshalCMSAttributes returns the DER encoding of `attrs` as a SET OF Attribute, with the
+// attributes sorted by their encoding.
+func marshalCMSAttributes(attrs []cmsAttribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		data, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+}
+
+// parseCMSAttributes parses the attributes of implicitly tagged SET OF Attribute `raw`. It
+// returns nil if `raw` is absent.
+func parseCMSAttributes(raw asn1.RawValue) ([]cmsAttribute, error) {
+	var attrs []cmsAttribute
+	for rest := raw.Bytes; len(rest) > 0; {
+		var attr cmsAttribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// findCMSAttribute decodes the first value of the attribute of type `oid` in `attrs` into `out`.
+// It returns false if there is no such attribute.
+func findCMSAttribute(attrs []cmsAttribute, oid asn1.ObjectIdentifier, out interface{}) (bool, error) {
+	for _, attr := range attrs {
+		if attr.Type.Equal(oid) {
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, out); err != nil {
+				return true, fmt.Errorf("invalid attribute %s: %v", oid, err)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// digestAlgorithmOID returns the object identifier of digest algorithm `hash`.
+func digestAlgorithmOID(hash crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch hash {
+	case crypto.SHA1:
+		return oidDigestSHA1, nil
+	case crypto.SHA256:
+		return oidDigestSHA256, nil
+	case crypto.SHA384:
+		return oidDigestSHA384, nil
+	case crypto.SHA512:
+		return oidDigestSHA512, nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %v", hash)
+}
+
+// digestAlgorithmHash returns the digest algorithm with object identifier `oid`.
+func digestAlgorithmHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidDigestSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidDigestSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidDigestSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidDigestSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+// signatureAlgorithmIdentifier returns the identifier of the algorithm of the signatures made
+// by `signer` on digests computed with `hash`.
+func signatureAlgorithmIdentifier(signer crypto.Signer, hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	if _, ok := signer.(*rsaPSSSigner); ok {
+		return rsaPSSAlgorithmIdentifier(hash)
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		oids := map[crypto.Hash]asn1.ObjectIdentifier{
+			crypto.SHA1:   oidECDSAWithSHA1,
+			crypto.SHA256: oidECDSAWithSHA256,
+			crypto.SHA384: oidECDSAWithSHA384,
+			crypto.SHA512: oidECDSAWithSHA512,
+		}
+		if oid, ok := oids[hash]; ok {
+			return pkix.AlgorithmIdentifier{Algorithm: oid}, nil
+		}
+	case ed25519.PublicKey:
+		// The message digest of Ed25519 signers must be computed with SHA-512 (RFC 8419).
+		if hash == crypto.SHA512 {
+			return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, nil
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signing key %T with digest %v", signer.Public(), hash)
+}
+
+// rsaPSSAlgorithmIdentifier returns the identifier of the RSASSA-PSS signatures on digests
+// computed with `hash`, with MGF1 using the same digest algorithm and a salt of the length of
+// the digest.
+func rsaPSSAlgorithmIdentifier(hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	oid, err := digestAlgorithmOID(hash)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	hashAlg := pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue}
+	mgfParams, err := asn1.Marshal(hashAlg)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	params, err := asn1.Marshal(rsaPSSParameters{
+		HashAlgorithm:    hashAlg,
+		MaskGenAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+		SaltLength:       hash.Size(),
+		TrailerField:     1,
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}}, nil
+}
+
+// x509SignatureAlgorithm returns the x509 signature algorithm of signature algorithm
+// identifier `alg` with digest algorithm `hash`.
+func x509SignatureAlgorithm(alg pkix.AlgorithmIdentifier, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	oid := alg.Algorithm
+	switch {
+	case oid.Equal(oidRSAEncryption), oid.Equal(oidRSAWithSHA1), oid.Equal(oidRSAWithSHA256),
+		oid.Equal(oidRSAWithSHA384), oid.Equal(oidRSAWithSHA512):
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, nil
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case oid.Equal(oidRSASSAPSS):
+		// The digest algorithm of the signature is the one of its parameters.
+		var params rsaPSSParameters
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return x509.UnknownSignatureAlgorithm, fmt.Errorf("invalid RSASSA-PSS parameters: %v", err)
+		}
+		pssHash, err := digestAlgorithmHash(params.HashAlgorithm.Algorithm)
+		if err != nil {
+			return x509.UnknownSignatureAlgorithm, err
+		}
+		switch pssHash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSAPSS, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSAPSS, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSAPSS, nil
+		}
+		hash = pssHash
+	case oid.Equal(oidECPublicKey), oid.Equal(oidECDSAWithSHA1), oid.Equal(oidECDSAWithSHA256),
+		oid.Equal(oidECDSAWithSHA384), oid.Equal(oidECDSAWithSHA512):
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1, nil
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	case oid.Equal(oidEd25519):
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s with digest %v", oid, hash)
+}
+
+// cmsSigner creates CMS SignedData structures with a single signer and detached content.
+type cmsSigner struct {
+	signer      crypto.Signer
+	certificate *x509.Certificate
+	chain       []*x509.Certificate
+	hash        crypto.Hash
+}
+
+// signingCertificateV2Attribute returns the signing-certificate-v2 attribute identifying the
+// certificate of `s` by its hash.
+func (s *cmsSigner) signingCertificateV2Attribute() (cmsAttribute, error) {
+	certHash := s.hash.New()
+	certHash.Write(s.certificate.Raw)
+	id := essCertIDv2{CertHash: certHash.Sum(nil)}
+	if s.hash != crypto.SHA256 {
+		oid, err := digestAlgorithmOID(s.hash)
+		if err != nil {
+			return cmsAttribute{}, err
+		}
+		id.HashAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oid}
+	}
+	return newCMSAttribute(oidAttributeSigningCertificateV2, signingCertificateV2{Certs: []essCertIDv2{id}})
+}
+
+// sign returns the detached SignedData with the signature of the data with digest
+// `digest`. The signed attributes are the content type, the message digest and `attrs`.
+func (s *cmsSigner) sign(digest []byte, attrs ...cmsAttribute) (*cmsSignedData, error) {
+	return s.signContent(oidData, nil, digest, attrs...)
+}
+
+// signEncapsulated returns the SignedData encapsulating `content` of type `contentType` with its
+// signature. The signed attributes are the content type, the message digest and `attrs`.
+func (s *cmsSigner) signEncapsulated(contentType asn1.ObjectIdentifier, content []byte, attrs ...cmsAttribute) (*cmsSignedData, error) {
+	h := s.hash.New()
+	h.Write(content)
+	return s.signContent(contentType, content, h.Sum(nil), attrs...)
+}
+
+// signContent returns the SignedData of content of type `contentType` with digest `digest`. The
+// content is detached if `content` is nil.
+func (s *cmsSigner) signContent(contentType asn1.ObjectIdentifier, content, digest []byte, attrs ...cmsAttribute) (*cmsSignedData, error) {
+	digestOID, err := digestAlgorithmOID(s.hash)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := signatureAlgorithmIdentifier(s.signer, s.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	contentTypeAttr, err := newCMSAttribute(oidAttributeContentType, contentType)
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newCMSAttribute(oidAttributeMessageDigest, digest)
+	if err != nil {
+		return nil, err
+	}
+	signedAttrs, err := marshalCMSAttributes(append([]cmsAttribute{contentTypeAttr, messageDigest}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signData(s.signer, s.hash, signedAttrs)
+	if err != nil {
+		return nil, err
+	}
+
+	sid, err := asn1.Marshal(cmsIssuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: s.certificate.RawIssuer},
+		SerialNumber: s.certificate.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var certs []byte
+	for _, cert := range append([]*x509.Certificate{s.certificate}, s.chain...) {
+		certs = append(certs, cert.Raw...)
+	}
+
+	var attrsValue asn1.RawValue
+	if _, err := asn1.Unmarshal(signedAttrs, &attrsValue); err != nil {
+		return nil, err
+	}
+	sd := &cmsSignedData{Version: 1, EncapContentInfo: cmsContentInfo{ContentType: contentType}}
+	if !contentType.Equal(oidData) {
+		sd.Version = 3
+	}
+	if content != nil {
+		octets, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.EncapContentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets}
+	}
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: digestOID}
+	sd.DigestAlgorithms = []pkix.AlgorithmIdentifier{digestAlg}
+	sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs}
+	sd.SignerInfos = []cmsSignerInfo{{
+		Version:            1,
+		SID:                asn1.RawValue{FullBytes: sid},
+		DigestAlgorithm:    digestAlg,
+		SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrsValue.Bytes},
+		SignatureAlgorithm: sigAlg,
+		Signature:          signature,
+	}}
+	return sd, nil
+}
+
+// marshal returns the DER encoding of `sd` wrapped in a ContentInfo.
+func (sd *cmsSignedData) marshal() ([]byte, error) {
+	inner, err := asn1.Marshal(*sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// parseCMSSignedData parses the SignedData in ContentInfo `data`. Trailing data, such as the zero
+// padding of signature Contents, is ignored.
+func parseCMSSignedData(data []byte) (*cmsSignedData, error) {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected content type %s", ci.ContentType)
+	}
+	sd := &cmsSignedData{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, errors.New("signed data has no signers")
+	}
+	return sd, nil
+}
+
+// content returns the encapsulated content of `sd`. It returns nil if the content is detached.
+func (sd *cmsSignedData) content() ([]byte, error) {
+	if len(sd.EncapContentInfo.Content.Bytes) == 0 {
+		return nil, nil
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.Content.Bytes, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// certificates returns the certificates of `sd`.
+func (sd *cmsSignedData) certificates() ([]*x509.Certificate, error) {
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, nil
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
+
+// signerCertificate returns the certificate in `certs` identified by the sid of `si`.
+func (si *cmsSignerInfo) signerCertificate(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if si.SID.Class == asn1.ClassContextSpecific && si.SID.Tag == 0 {
+		// subjectKeyIdentifier.
+		for _, cert := range certs {
+			if bytes.Equal(cert.SubjectKeyId, si.SID.Bytes) {
+				return cert, nil
+			}
+		}
+		return nil, errors.New("signer certificate not found")
+	}
+	var ias cmsIssuerAndSerial
+	if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cert.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("signer certificate not found")
+}
+
+// verify checks the signature of `si` by `cert` on content of type `contentType` with digest
+// `digest`. The returned signed attributes are checked for the content type and message digest
+// only.
+func (si *cmsSignerInfo) verify(cert *x509.Certificate, contentType asn1.ObjectIdentifier, digest []byte) ([]cmsAttribute, error) {
+	hash, err := digestAlgorithmHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := x509SignatureAlgorithm(si.SignatureAlgorithm, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return nil, errors.New("signed attributes missing")
+	}
+	attrs, err := parseCMSAttributes(si.SignedAttrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var signedType asn1.ObjectIdentifier
+	if found, err := findCMSAttribute(attrs, oidAttributeContentType, &signedType); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errors.New("content-type attribute missing")
+	}
+	if !signedType.Equal(contentType) {
+		return nil, fmt.Errorf("unexpected content type %s", signedType)
+	}
+	var messageDigest []byte
+	if found, err := findCMSAttribute(attrs, oidAttributeMessageDigest, &messageDigest); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errors.New("message-digest attribute missing")
+	}
+	if !bytes.Equal(messageDigest, digest) {
+		return nil, errors.New("message digest mismatch")
+	}
+
+	// The signature is computed on the SET OF encoding of the implicitly tagged attributes.
+	signed := append([]byte{}, si.SignedAttrs.FullBytes...)
+	signed[0] = 0x31
+	if err := cert.CheckSignature(sigAlg, signed, si.Signature); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
@@ -0,0 +1,466 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/model"
+)
+
+// RevocationClient is the interface of the clients fetching the revocation information of
+// certificates.
+type RevocationClient interface {
+	// GetOCSP returns the DER encoded OCSP response for certificate `cert` issued by `issuer`.
+	GetOCSP(cert, issuer *x509.Certificate) ([]byte, error)
+
+	// GetCRL returns the DER encoded CRL of `issuer` covering certificate `cert`.
+	GetCRL(cert, issuer *x509.Certificate) ([]byte, error)
+}
+
+// HTTPRevocationClient fetches the revocation information of certificates from the OCSP
+// responders and CRL distribution points of the certificates over HTTP.
+type HTTPRevocationClient struct {
+	// HTTPClient is used for the requests. A client with a timeout of 30 seconds is used when nil.
+	HTTPClient *http.Client
+}
+
+// NewHTTPRevocationClient returns a new HTTP revocation client.
+func NewHTTPRevocationClient() *HTTPRevocationClient {
+	return &HTTPRevocationClient{}
+}
+
+// httpClient returns the HTTP client of the requests.
+func (c *HTTPRevocationClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// GetOCSP returns the DER encoded OCSP response for certificate `cert` issued by `issuer` from
+// the first OCSP responder of `cert` which returns a valid response.
+func (c *HTTPRevocationClient) GetOCSP(cert, issuer *x509.Certificate) ([]byte, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("certificate has no OCSP responder")
+	}
+	reqData, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, url := range cert.OCSPServer {
+		resp, err := c.httpClient().Post(url, "application/ocsp-request", bytes.NewReader(reqData))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("OCSP responder returned HTTP status %d", resp.StatusCode)
+			continue
+		}
+		if _, err := ocsp.ParseResponseForCert(data, cert, issuer); err != nil {
+			lastErr = fmt.Errorf("invalid OCSP response: %v", err)
+			continue
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// GetCRL returns the DER encoded CRL of `issuer` from the first HTTP distribution point of
+// certificate `cert` which returns a valid CRL.
+func (c *HTTPRevocationClient) GetCRL(cert, issuer *x509.Certificate) ([]byte, error) {
+	lastErr := errors.New("certificate has no HTTP CRL distribution point")
+	for _, url := range cert.CRLDistributionPoints {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		resp, err := c.httpClient().Get(url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("CRL distribution point returned HTTP status %d", resp.StatusCode)
+			continue
+		}
+		if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			lastErr = fmt.Errorf("invalid CRL: %v", err)
+			continue
+		}
+		if err := issuer.CheckCRLSignature(crl); err != nil {
+			lastErr = fmt.Errorf("invalid CRL: %v", err)
+			continue
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// LTV adds the validation data of the signatures of a document to its Document Security Store,
+// so that the signatures can be validated without network access (long-term validation).
+// The validation data is written in the revision appended by the appender.
+type LTV struct {
+	// Client fetches the revocation information of the certificates.
+	Client RevocationClient
+
+	// SkipExisting skips the signatures which already have a VRI dictionary when set.
+	SkipExisting bool
+
+	appender *model.PdfAppender
+	dss      *model.DSS
+}
+
+// NewLTV returns a new LTV adding validation data fetched with `client` to the Document Security
+// Store of the document of `appender`. The existing DSS of the document is extended, if any.
+func NewLTV(appender *model.PdfAppender, client RevocationClient) (*LTV, error) {
+	if appender == nil {
+		return nil, errors.New("appender must not be nil")
+	}
+	if client == nil {
+		return nil, errors.New("revocation client must not be nil")
+	}
+	dss, err := appender.Reader.GetDSS()
+	if err != nil {
+		return nil, err
+	}
+	if dss == nil {
+		dss = model.NewDSS()
+	}
+	appender.SetDSS(dss)
+
+	return &LTV{
+		Client:   client,
+		appender: appender,
+		dss:      dss,
+	}, nil
+}
+
+// DSS returns the Document Security Store updated by the LTV.
+func (l *LTV) DSS() *model.DSS {
+	return l.dss
+}
+
+// EnableAll adds the validation data of all the signatures and document timestamps of the
+// document. See Enable.
+func (l *LTV) EnableAll(extraCerts []*x509.Certificate) error {
+	acroForm := l.appender.Reader.AcroForm
+	if acroForm == nil {
+		return nil
+	}
+	for _, field := range acroForm.AllFields() {
+		sigField, ok := field.GetContext().(*model.PdfFieldSignature)
+		if !ok || sigField.V == nil || sigField.V.Contents == nil {
+			continue
+		}
+		if err := l.Enable(sigField.V, extraCerts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enable adds the validation data of signature `sig` to the Document Security Store: the
+// certificate chains of the signer and of the signature timestamps, with the revocation
+// information of the certificates of the chains. The chains are built from the certificates
+// of the signature and `extraCerts`, which should contain the issuer certificates missing from
+// the signature. An error is returned when no revocation information is available for a
+// certificate which is not self-signed.
+func (l *LTV) Enable(sig *model.PdfSignature, extraCerts []*x509.Certificate) error {
+	if sig == nil || sig.Contents == nil {
+		return errors.New("signature has no contents")
+	}
+	if l.SkipExisting && l.dss.GetSignatureVRI(sig) != nil {
+		return nil
+	}
+
+	dssCerts, err := l.dssCertificates()
+	if err != nil {
+		return err
+	}
+	pool := make([]*x509.Certificate, 0, len(extraCerts)+len(dssCerts))
+	pool = append(pool, extraCerts...)
+	pool = append(pool, dssCerts...)
+
+	chains, err := signatureChains(sig.Contents.Bytes(), pool)
+	if err != nil {
+		return err
+	}
+
+	var certs, ocsps, crls [][]byte
+	added := map[*x509.Certificate]struct{}{}
+	for _, chain := range chains {
+		for i, cert := range chain {
+			if _, ok := added[cert]; ok {
+				continue
+			}
+			added[cert] = struct{}{}
+			certs = append(certs, cert.Raw)
+
+			if model.IsSelfSignedCertificate(cert) {
+				continue
+			}
+			if i+1 >= len(chain) {
+				return fmt.Errorf("issuer of certificate %q not found", cert.Subject.CommonName)
+			}
+			issuer := chain[i+1]
+			data, err := l.Client.GetOCSP(cert, issuer)
+			if err == nil {
+				ocsps = append(ocsps, data)
+				continue
+			}
+			common.Log.Debug("OCSP of %q not available: %v", cert.Subject.CommonName, err)
+			data, err = l.Client.GetCRL(cert, issuer)
+			if err != nil {
+				return fmt.Errorf("no revocation information for certificate %q: %v", cert.Subject.CommonName, err)
+			}
+			crls = append(crls, data)
+		}
+	}
+
+	_, err = l.dss.AddSignatureVRI(sig, certs, ocsps, crls)
+	return err
+}
+
+// dssCertificates returns the certificates of the Document Security Store.
+func (l *LTV) dssCertificates() ([]*x509.Certificate, error) {
+	return parseDSSCertificates(l.dss)
+}
+
+// parseDSSCertificates returns the certificates of `dss`. Invalid certificates are skipped.
+func parseDSSCertificates(dss *model.DSS) ([]*x509.Certificate, error) {
+	items, err := dss.GetCerts()
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, data := range items {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			common.Log.Debug("ERROR: invalid DSS certificate: %v", err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// signatureChains returns the certificate chains of the signer of CMS signature `data` and of
+// the signers of its signature timestamps. The chains are built from the certificates of the
+// signatures and `pool`.
+func signatureChains(data []byte, pool []*x509.Certificate) ([][]*x509.Certificate, error) {
+	sd, err := parseCMSSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := signerChain(sd, pool)
+	if err != nil {
+		return nil, err
+	}
+	chains := [][]*x509.Certificate{chain}
+
+	attrs, err := parseCMSAttributes(sd.SignerInfos[0].UnsignedAttrs)
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if !attr.Type.Equal(oidAttributeSignatureTimeStampToken) {
+			continue
+		}
+		tsd, err := parseCMSSignedData(attr.Values.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := signerChain(tsd, pool)
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// signerChain returns the certificate chain of the signer of `sd`, built from the certificates
+// of `sd` and `pool`. The chain ends at a self-signed certificate or at the last certificate
+// whose issuer was found.
+func signerChain(sd *cmsSignedData, pool []*x509.Certificate) ([]*x509.Certificate, error) {
+	certs, err := sd.certificates()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := sd.SignerInfos[0].signerCertificate(certs)
+	if err != nil {
+		return nil, err
+	}
+	return model.BuildCertificateChain(cert, append(certs, pool...)), nil
+}
+
+// revocationStatus returns the revocation status of certificate `cert` issued by `issuer` at
+// time `at` according to OCSP responses `ocsps` and CRLs `crls`. `at` must be a trusted time, and
+// the revocations after `at` are ignored. When `at` is zero, the status is the current status and
+// any revocation counts. `found` is false if none of the OCSP responses and CRLs covering the
+// time of the status gives the status of the certificate.
+func revocationStatus(cert, issuer *x509.Certificate, ocsps, crls [][]byte, at time.Time) (found, revoked bool) {
+	statusTime := at
+	if statusTime.IsZero() {
+		statusTime = time.Now()
+	}
+	revokedAt := func(t time.Time) bool {
+		return at.IsZero() || !t.After(at)
+	}
+	// The status of the OCSP responses and CRLs produced after the status time still holds at
+	// the status time, as revocations are not undone. The older ones must be current then.
+	covers := func(thisUpdate, nextUpdate time.Time) bool {
+		return !thisUpdate.Before(statusTime) || (!nextUpdate.IsZero() && !nextUpdate.Before(statusTime))
+	}
+	for _, data := range ocsps {
+		resp, err := ocsp.ParseResponseForCert(data, cert, issuer)
+		if err != nil {
+			continue
+		}
+		switch resp.Status {
+		case ocsp.Good:
+			if covers(resp.ThisUpdate, resp.NextUpdate) {
+				found = true
+			}
+		case ocsp.Revoked:
+			if revokedAt(resp.RevokedAt) {
+				return true, true
+			}
+			found = true
+		}
+	}
+	for _, data := range crls {
+		crl, err := x509.ParseCRL(data)
+		if err != nil || issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		listed := false
+		for _, entry := range crl.TBSCertList.RevokedCertificates {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+				continue
+			}
+			if revokedAt(entry.RevocationTime) {
+				return true, true
+			}
+			listed = true
+		}
+		if listed || covers(crl.TBSCertList.ThisUpdate, crl.TBSCertList.NextUpdate) {
+			found = true
+		}
+	}
+	return found, false
+}
+
+// onlineRevocationChecker is a model.RevocationChecker fetching the revocation data with a
+// revocation client.
+type onlineRevocationChecker struct {
+	client RevocationClient
+}
+
+// NewRevocationChecker returns a revocation checker for the signature validation options,
+// which checks the revocation status of the certificates with the OCSP responses, or the CRLs
+// if the OCSP responses are unavailable, fetched by `client`.
+func NewRevocationChecker(client RevocationClient) model.RevocationChecker {
+	return &onlineRevocationChecker{client: client}
+}
+
+// CheckRevocation returns true if certificate `cert` issued by `issuer` is revoked.
+func (c *onlineRevocationChecker) CheckRevocation(cert, issuer *x509.Certificate) (bool, error) {
+	if data, err := c.client.GetOCSP(cert, issuer); err == nil {
+		if found, revoked := revocationStatus(cert, issuer, [][]byte{data}, nil, time.Time{}); found {
+			return revoked, nil
+		}
+	} else {
+		common.Log.Debug("OCSP response of %q unavailable: %v", cert.Subject.CommonName, err)
+	}
+	data, err := c.client.GetCRL(cert, issuer)
+	if err != nil {
+		return false, err
+	}
+	found, revoked := revocationStatus(cert, issuer, nil, [][]byte{data}, time.Time{})
+	if !found {
+		return false, fmt.Errorf("revocation status of certificate %q unknown", cert.Subject.CommonName)
+	}
+	return revoked, nil
+}
+
+// checkRevocation checks the revocation status of the certificate chain of the signer of
+// signature `sig` at time `at` with the validation data of `dss`, and sets the revocation fields
+// of `result`. The revocations after `at`, which must be a trusted time, do not invalidate the
+// signature. Any revocation counts when `at` is zero.
+func checkRevocation(result *model.SignatureValidationResult, sig *model.PdfSignature, dss *model.DSS, at time.Time) error {
+	sd, err := parseCMSSignedData(sig.Contents.Bytes())
+	if err != nil {
+		return err
+	}
+	pool, err := parseDSSCertificates(dss)
+	if err != nil {
+		return err
+	}
+	chain, err := signerChain(sd, pool)
+	if err != nil {
+		return err
+	}
+	ocsps, err := dss.GetOCSPs()
+	if err != nil {
+		return err
+	}
+	crls, err := dss.GetCRLs()
+	if err != nil {
+		return err
+	}
+
+	checked := true
+	for i, cert := range chain {
+		if model.IsSelfSignedCertificate(cert) {
+			break
+		}
+		if i+1 >= len(chain) {
+			checked = false
+			break
+		}
+		found, revoked := revocationStatus(cert, chain[i+1], ocsps, crls, at)
+		if revoked {
+			result.IsRevoked = true
+			result.Errors = append(result.Errors, fmt.Sprintf("certificate %q is revoked", cert.Subject.CommonName))
+		}
+		if !found {
+			checked = false
+		}
+	}
+	result.IsRevocationChecked = checked
+	return nil
+}
@@ -0,0 +1,252 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// defaultSignatureLen is the default size reserved for the Contents of CMS signatures.
+const defaultSignatureLen = 8192
+
+// ETSI CAdES detached (PAdES) signature handler.
+type etsiCAdESDetached struct {
+	signer      crypto.Signer
+	certificate *x509.Certificate
+	hash        crypto.Hash
+
+	emptySignature    bool
+	emptySignatureLen int
+}
+
+// NewEmptyEtsiCAdESDetached creates a new Adobe.PPKLite ETSI.CAdES.detached signature handler.
+// The generated signature is empty and of size signatureLen, for injecting a signature created
+// externally (see model.PdfAppender.PrepareExternalSignature).
+func NewEmptyEtsiCAdESDetached(signatureLen int) (model.SignatureHandler, error) {
+	return &etsiCAdESDetached{
+		hash:              crypto.SHA256,
+		emptySignature:    true,
+		emptySignatureLen: signatureLen,
+	}, nil
+}
+
+// NewEtsiCAdESDetached creates a new Adobe.PPKLite ETSI.CAdES.detached signature handler, which
+// creates PAdES baseline signatures (ETSI EN 319 142-1) with digest algorithm `hash`. SHA-256,
+// SHA-384 and SHA-512 are supported and a hash of 0 selects SHA-256, or SHA-512 for Ed25519
+// signers. The signer may be an RSA, ECDSA or Ed25519 private key, a signer returned by
+// NewRSAPSSSigner or the signer of a key held in a hardware security module. The signer and
+// certificate may be nil for the signature validation.
+func NewEtsiCAdESDetached(signer crypto.Signer, certificate *x509.Certificate, hash crypto.Hash) (model.SignatureHandler, error) {
+	hash, err := signerDefaultHash(signer, hash)
+	if err != nil {
+		return nil, err
+	}
+	switch hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %v", hash)
+	}
+	if isNilSigner(signer) {
+		signer = nil
+	}
+	return &etsiCAdESDetached{
+		signer:      signer,
+		certificate: certificate,
+		hash:        hash,
+	}, nil
+}
+
+// InitSignature initialises the PdfSignature.
+func (a *etsiCAdESDetached) InitSignature(sig *model.PdfSignature) error {
+	if !a.emptySignature {
+		if a.certificate == nil {
+			return errors.New("certificate must not be nil")
+		}
+		if a.signer == nil {
+			return errors.New("signer must not be nil")
+		}
+	}
+
+	handler := *a
+	sig.Handler = &handler
+	sig.Filter = core.MakeName("Adobe.PPKLite")
+	sig.SubFilter = core.MakeName("ETSI.CAdES.detached")
+	sig.Contents = nil
+
+	digest, err := handler.NewDigest(sig)
+	if err != nil {
+		return err
+	}
+	digest.Write([]byte("calculate the Contents field size"))
+	return handler.Sign(sig, digest)
+}
+
+// NewDigest creates a new digest. The digest algorithm is the one of the signer of the signature
+// Contents when set, as for the validation.
+func (a *etsiCAdESDetached) NewDigest(sig *model.PdfSignature) (model.Hasher, error) {
+	if sig.Contents != nil {
+		if sd, err := parseCMSSignedData(sig.Contents.Bytes()); err == nil {
+			h, err := digestAlgorithmHash(sd.SignerInfos[0].DigestAlgorithm.Algorithm)
+			if err != nil {
+				return nil, err
+			}
+			return h.New(), nil
+		}
+	}
+	return a.hash.New(), nil
+}
+
+// Sign sets the Contents fields of the PdfSignature. The signature is padded to the size of the
+// Contents set by InitSignature.
+func (a *etsiCAdESDetached) Sign(sig *model.PdfSignature, digest model.Hasher) error {
+	if a.emptySignature {
+		sigLen := a.emptySignatureLen
+		if sigLen <= 0 {
+			sigLen = defaultSignatureLen
+		}
+		sig.Contents = core.MakeHexString(string(make([]byte, sigLen)))
+		return nil
+	}
+
+	h, ok := digest.(hash.Hash)
+	if !ok {
+		return errors.New("hash type error")
+	}
+	signer := &cmsSigner{signer: a.signer, certificate: a.certificate, hash: a.hash}
+	signingCert, err := signer.signingCertificateV2Attribute()
+	if err != nil {
+		return err
+	}
+	sd, err := signer.sign(h.Sum(nil), signingCert)
+	if err != nil {
+		return err
+	}
+	data, err := sd.marshal()
+	if err != nil {
+		return err
+	}
+	return setSignatureContents(sig, data, reservedSignatureLen(sig))
+}
+
+// Validate validates PdfSignature.
+func (a *etsiCAdESDetached) Validate(sig *model.PdfSignature, digest model.Hasher) (model.SignatureValidationResult, error) {
+	h, ok := digest.(hash.Hash)
+	if !ok {
+		return model.SignatureValidationResult{}, errors.New("hash type error")
+	}
+	sd, err := parseCMSSignedData(sig.Contents.Bytes())
+	if err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+	certs, err := sd.certificates()
+	if err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+
+	result := model.SignatureValidationResult{IsSigned: true}
+	si := sd.SignerInfos[0]
+	cert, err := si.signerCertificate(certs)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil
+	}
+	attrs, err := si.verify(cert, oidData, h.Sum(nil))
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil
+	}
+	if err := checkSigningCertificateV2(attrs, cert); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil
+	}
+	genTime, tsaCerts, err := si.verifySignatureTimestamp()
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil
+	}
+	setSignerDetails(&result, cert, certs, attrs, genTime, tsaCerts)
+	result.IsVerified = true
+	return result, nil
+}
+
+// CheckRevocationWithDSS checks the revocation status of the signer of PdfSignature at time `at`
+// with the validation data of the Document Security Store `dss`.
+func (a *etsiCAdESDetached) CheckRevocationWithDSS(result *model.SignatureValidationResult, sig *model.PdfSignature, dss *model.DSS, at time.Time) error {
+	return checkRevocation(result, sig, dss, at)
+}
+
+// IsApplicable returns true if the signature handler is applicable for the PdfSignature.
+func (a *etsiCAdESDetached) IsApplicable(sig *model.PdfSignature) bool {
+	if sig == nil || sig.Filter == nil || sig.SubFilter == nil {
+		return false
+	}
+	return (*sig.Filter == "Adobe.PPKMS" || *sig.Filter == "Adobe.PPKLite") && *sig.SubFilter == "ETSI.CAdES.detached"
+}
+
+// checkSigningCertificateV2 checks that the signing-certificate-v2 attribute in signed attributes
+// `attrs` identifies certificate `cert`, as required for CAdES signatures.
+func checkSigningCertificateV2(attrs []cmsAttribute, cert *x509.Certificate) error {
+	var signingCert signingCertificateV2
+	found, err := findCMSAttribute(attrs, oidAttributeSigningCertificateV2, &signingCert)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("signing-certificate-v2 attribute missing")
+	}
+	if len(signingCert.Certs) == 0 {
+		return errors.New("signing-certificate-v2 attribute is empty")
+	}
+	id := signingCert.Certs[0]
+	h := crypto.SHA256
+	if len(id.HashAlgorithm.Algorithm) > 0 {
+		if h, err = digestAlgorithmHash(id.HashAlgorithm.Algorithm); err != nil {
+			return err
+		}
+	}
+	certHash := h.New()
+	certHash.Write(cert.Raw)
+	if !bytes.Equal(certHash.Sum(nil), id.CertHash) {
+		return errors.New("signing certificate hash mismatch")
+	}
+	return nil
+}
+
+// reservedSignatureLen returns the size of the Contents of `sig`, which is 0 if not set.
+func reservedSignatureLen(sig *model.PdfSignature) int {
+	if sig.Contents == nil {
+		return 0
+	}
+	return len(sig.Contents.Bytes())
+}
+
+// setSignatureContents sets the Contents of `sig` to signature `data` padded with zeros to `size`
+// bytes, which is the size reserved by InitSignature so that the signature fits in the space
+// reserved for it when the document is written. A size is chosen when `size` is 0.
+func setSignatureContents(sig *model.PdfSignature, data []byte, size int) error {
+	if size == 0 {
+		size = defaultSignatureLen
+		if len(data)+1024 > size {
+			size = len(data) + 1024
+		}
+	}
+	if len(data) > size {
+		return fmt.Errorf("signature of %d bytes exceeds the reserved %d bytes", len(data), size)
+	}
+	contents := make([]byte, size)
+	copy(contents, data)
+	sig.Contents = core.MakeHexString(string(contents))
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"crypto"
+	"errors"
+	"hash"
+	"time"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// ETSI RFC 3161 document timestamp handler.
+type docTimeStamp struct {
+	client TimestampClient
+	hash   crypto.Hash
+}
+
+// NewDocTimeStamp creates a new Adobe.PPKLite ETSI.RFC3161 document timestamp handler, which
+// timestamps the document with `client`. The message imprint is computed with `hash` and a hash
+// of 0 selects SHA-256. The client may be nil for the validation.
+func NewDocTimeStamp(client TimestampClient, hash crypto.Hash) (model.SignatureHandler, error) {
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	if _, err := digestAlgorithmOID(hash); err != nil {
+		return nil, err
+	}
+	return &docTimeStamp{client: client, hash: hash}, nil
+}
+
+// InitSignature initialises the PdfSignature.
+func (a *docTimeStamp) InitSignature(sig *model.PdfSignature) error {
+	if a.client == nil {
+		return errors.New("timestamp client must not be nil")
+	}
+
+	handler := *a
+	sig.Handler = &handler
+	sig.Type = core.MakeName("DocTimeStamp")
+	sig.Filter = core.MakeName("Adobe.PPKLite")
+	sig.SubFilter = core.MakeName("ETSI.RFC3161")
+	sig.Reference = nil
+
+	// The token is requested when the document is signed: only its space is reserved.
+	size := timestampTokenLen(handler.client, handler.hash)
+	sig.Contents = core.MakeHexString(string(make([]byte, size)))
+	return nil
+}
+
+// NewDigest creates a new digest. The digest algorithm is the one of the message imprint of the
+// timestamp token in the Contents when set, as for the validation.
+func (a *docTimeStamp) NewDigest(sig *model.PdfSignature) (model.Hasher, error) {
+	return a.digestHash(sig).New(), nil
+}
+
+// digestHash returns the digest algorithm of the message imprint of the timestamp token in the
+// Contents of `sig` when set, or the digest algorithm of the handler.
+func (a *docTimeStamp) digestHash(sig *model.PdfSignature) crypto.Hash {
+	if sig.Contents != nil {
+		if h, err := timestampDigestHash(sig.Contents.Bytes()); err == nil {
+			return h
+		}
+	}
+	return a.hash
+}
+
+// Sign sets the Contents fields of the PdfSignature to the timestamp token of the digest.
+func (a *docTimeStamp) Sign(sig *model.PdfSignature, digest model.Hasher) error {
+	h, ok := digest.(hash.Hash)
+	if !ok {
+		return errors.New("hash type error")
+	}
+	token, err := a.client.GetTimestamp(h.Sum(nil), a.hash)
+	if err != nil {
+		return err
+	}
+	return setSignatureContents(sig, token, reservedSignatureLen(sig))
+}
+
+// Validate validates PdfSignature. The date of the result is the time of the timestamp.
+func (a *docTimeStamp) Validate(sig *model.PdfSignature, digest model.Hasher) (model.SignatureValidationResult, error) {
+	h, ok := digest.(hash.Hash)
+	if !ok {
+		return model.SignatureValidationResult{}, errors.New("hash type error")
+	}
+
+	result := model.SignatureValidationResult{IsSigned: true}
+	info, tsaCerts, err := verifyTimestampToken(sig.Contents.Bytes(), h.Sum(nil), a.digestHash(sig))
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil
+	}
+	if result.Date, err = model.NewPdfDateFromTime(info.GenTime); err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+	setSignerDetails(&result, tsaCerts[0], tsaCerts[1:], nil, info.GenTime, tsaCerts)
+	result.IsVerified = true
+	return result, nil
+}
+
+// CheckRevocationWithDSS checks the revocation status of the signer of PdfSignature at time `at`
+// with the validation data of the Document Security Store `dss`.
+func (a *docTimeStamp) CheckRevocationWithDSS(result *model.SignatureValidationResult, sig *model.PdfSignature, dss *model.DSS, at time.Time) error {
+	return checkRevocation(result, sig, dss, at)
+}
+
+// IsApplicable returns true if the signature handler is applicable for the PdfSignature.
+func (a *docTimeStamp) IsApplicable(sig *model.PdfSignature) bool {
+	if sig == nil || sig.Filter == nil || sig.SubFilter == nil {
+		return false
+	}
+	return *sig.SubFilter == "ETSI.RFC3161"
+}
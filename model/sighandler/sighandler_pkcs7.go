@@ -7,9 +7,10 @@ package sighandler
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"errors"
+	"time"
 
 	"github.com/gunnsth/pkcs7"
 
@@ -19,8 +20,9 @@ import (
 
 // Adobe PKCS7 detached signature handler.
 type adobePKCS7Detached struct {
-	privateKey  *rsa.PrivateKey
+	signer      crypto.Signer
 	certificate *x509.Certificate
+	hash        crypto.Hash
 
 	emptySignature    bool
 	emptySignatureLen int
@@ -37,11 +39,21 @@ func NewEmptyAdobePKCS7Detached(signatureLen int) (model.SignatureHandler, error
 }
 
 // NewAdobePKCS7Detached creates a new Adobe.PPKMS/Adobe.PPKLite adbe.pkcs7.detached signature handler.
-// Both parameters may be nil for the signature validation.
-func NewAdobePKCS7Detached(privateKey *rsa.PrivateKey, certificate *x509.Certificate) (model.SignatureHandler, error) {
+// The signer may be an RSA, ECDSA or Ed25519 private key, a signer returned by NewRSAPSSSigner or
+// the signer of a key held in a hardware security module. The digests are computed with SHA-256,
+// or SHA-512 for Ed25519 signers. Both parameters may be nil for the signature validation.
+func NewAdobePKCS7Detached(signer crypto.Signer, certificate *x509.Certificate) (model.SignatureHandler, error) {
+	hash, err := signerDefaultHash(signer, 0)
+	if err != nil {
+		return nil, err
+	}
+	if isNilSigner(signer) {
+		signer = nil
+	}
 	return &adobePKCS7Detached{
 		certificate: certificate,
-		privateKey:  privateKey,
+		signer:      signer,
+		hash:        hash,
 	}, nil
 }
 
@@ -51,8 +63,8 @@ func (a *adobePKCS7Detached) InitSignature(sig *model.PdfSignature) error {
 		if a.certificate == nil {
 			return errors.New("certificate must not be nil")
 		}
-		if a.privateKey == nil {
-			return errors.New("privateKey must not be nil")
+		if a.signer == nil {
+			return errors.New("signer must not be nil")
 		}
 	}
 
@@ -60,7 +72,7 @@ func (a *adobePKCS7Detached) InitSignature(sig *model.PdfSignature) error {
 	sig.Handler = &handler
 	sig.Filter = core.MakeName("Adobe.PPKLite")
 	sig.SubFilter = core.MakeName("adbe.pkcs7.detached")
-	sig.Reference = nil
+	sig.Contents = nil
 
 	digest, err := handler.NewDigest(sig)
 	if err != nil {
@@ -91,21 +103,62 @@ func (a *adobePKCS7Detached) NewDigest(sig *model.PdfSignature) (model.Hasher, e
 // Validate validates PdfSignature.
 func (a *adobePKCS7Detached) Validate(sig *model.PdfSignature, digest model.Hasher) (model.SignatureValidationResult, error) {
 	signed := sig.Contents.Bytes()
-	p7, err := pkcs7.Parse(signed)
+	buffer := digest.(*bytes.Buffer)
+
+	sd, err := parseCMSSignedData(signed)
+	if err != nil || len(sd.SignerInfos[0].SignedAttrs.FullBytes) == 0 {
+		// Signatures without signed attributes are signatures of the content itself.
+		p7, err := pkcs7.Parse(signed)
+		if err != nil {
+			return model.SignatureValidationResult{}, err
+		}
+		p7.Content = buffer.Bytes()
+		if err = p7.Verify(); err != nil {
+			return model.SignatureValidationResult{}, err
+		}
+		result := model.SignatureValidationResult{
+			IsSigned:   true,
+			IsVerified: true,
+		}
+		if signer := p7.GetOnlySigner(); signer != nil {
+			setSignerDetails(&result, signer, p7.Certificates, nil, time.Time{}, nil)
+		}
+		return result, nil
+	}
+
+	certs, err := sd.certificates()
 	if err != nil {
 		return model.SignatureValidationResult{}, err
 	}
-
-	buffer := digest.(*bytes.Buffer)
-	p7.Content = buffer.Bytes()
-	if err = p7.Verify(); err != nil {
+	si := sd.SignerInfos[0]
+	cert, err := si.signerCertificate(certs)
+	if err != nil {
 		return model.SignatureValidationResult{}, err
 	}
+	hash, err := digestAlgorithmHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+	h := hash.New()
+	h.Write(buffer.Bytes())
+	attrs, err := si.verify(cert, oidData, h.Sum(nil))
+	if err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+	genTime, tsaCerts, err := si.verifySignatureTimestamp()
+	if err != nil {
+		return model.SignatureValidationResult{
+			IsSigned: true,
+			Errors:   []string{err.Error()},
+		}, nil
+	}
 
-	return model.SignatureValidationResult{
+	result := model.SignatureValidationResult{
 		IsSigned:   true,
 		IsVerified: true,
-	}, nil
+	}
+	setSignerDetails(&result, cert, certs, attrs, genTime, tsaCerts)
+	return result, nil
 }
 
 // Sign sets the Contents fields.
@@ -121,30 +174,29 @@ func (a *adobePKCS7Detached) Sign(sig *model.PdfSignature, digest model.Hasher)
 	}
 
 	buffer := digest.(*bytes.Buffer)
-	signedData, err := pkcs7.NewSignedData(buffer.Bytes())
+	h := a.hash.New()
+	h.Write(buffer.Bytes())
+
+	signingTime, err := newCMSAttribute(oidAttributeSigningTime, time.Now().UTC())
 	if err != nil {
 		return err
 	}
-
-	// Add the signing cert and private key
-	if err := signedData.AddSigner(a.certificate, a.privateKey, pkcs7.SignerInfoConfig{}); err != nil {
+	signer := &cmsSigner{signer: a.signer, certificate: a.certificate, hash: a.hash}
+	sd, err := signer.sign(h.Sum(nil), signingTime)
+	if err != nil {
 		return err
 	}
-
-	// Call Detach() is you want to remove content from the signature
-	// and generate an S/MIME detached signature
-	signedData.Detach()
-	// Finish() to obtain the signature bytes
-	detachedSignature, err := signedData.Finish()
+	data, err := sd.marshal()
 	if err != nil {
 		return err
 	}
+	return setSignatureContents(sig, data, reservedSignatureLen(sig))
+}
 
-	data := make([]byte, 8192)
-	copy(data, detachedSignature)
-
-	sig.Contents = core.MakeHexString(string(data))
-	return nil
+// CheckRevocationWithDSS checks the revocation status of the signer of PdfSignature at time `at`
+// with the validation data of the Document Security Store `dss`.
+func (a *adobePKCS7Detached) CheckRevocationWithDSS(result *model.SignatureValidationResult, sig *model.PdfSignature, dss *model.DSS, at time.Time) error {
+	return checkRevocation(result, sig, dss, at)
 }
 
 // IsApplicable returns true if the signature handler is applicable for the PdfSignature
@@ -24,7 +24,7 @@ type SignFunc func(sig *model.PdfSignature, digest model.Hasher) ([]byte, error)
 
 // Adobe X509 RSA SHA1 signature handler.
 type adobeX509RSASHA1 struct {
-	privateKey  *rsa.PrivateKey
+	signer      crypto.Signer
 	certificate *x509.Certificate
 	signFunc    SignFunc
 }
@@ -36,9 +36,20 @@ func NewAdobeX509RSASHA1Custom(certificate *x509.Certificate, signFunc SignFunc)
 }
 
 // NewAdobeX509RSASHA1 creates a new Adobe.PPKMS/Adobe.PPKLite adbe.x509.rsa_sha1 signature handler.
+// The signer must create RSA PKCS #1 v1.5 signatures, as required by the sub filter: it may be an
+// *rsa.PrivateKey or the signer of an RSA key held in a hardware security module.
 // Both parameters may be nil for the signature validation.
-func NewAdobeX509RSASHA1(privateKey *rsa.PrivateKey, certificate *x509.Certificate) (model.SignatureHandler, error) {
-	return &adobeX509RSASHA1{certificate: certificate, privateKey: privateKey}, nil
+func NewAdobeX509RSASHA1(signer crypto.Signer, certificate *x509.Certificate) (model.SignatureHandler, error) {
+	if isNilSigner(signer) {
+		return &adobeX509RSASHA1{certificate: certificate}, nil
+	}
+	if _, ok := signer.(*rsaPSSSigner); ok {
+		return nil, errors.New("adbe.x509.rsa_sha1 signatures must be PKCS #1 v1.5 signatures")
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return nil, errors.New("adbe.x509.rsa_sha1 signatures require an RSA key")
+	}
+	return &adobeX509RSASHA1{certificate: certificate, signer: signer}, nil
 }
 
 // InitSignature initialises the PdfSignature.
@@ -46,8 +57,8 @@ func (a *adobeX509RSASHA1) InitSignature(sig *model.PdfSignature) error {
 	if a.certificate == nil {
 		return errors.New("certificate must not be nil")
 	}
-	if a.privateKey == nil && a.signFunc == nil {
-		return errors.New("must provide either a private key or a signing function")
+	if a.signer == nil && a.signFunc == nil {
+		return errors.New("must provide either a signer or a signing function")
 	}
 
 	handler := *a
@@ -55,7 +66,6 @@ func (a *adobeX509RSASHA1) InitSignature(sig *model.PdfSignature) error {
 	sig.Filter = core.MakeName("Adobe.PPKLite")
 	sig.SubFilter = core.MakeName("adbe.x509.rsa_sha1")
 	sig.Cert = core.MakeString(string(handler.certificate.Raw))
-	sig.Reference = nil
 
 	digest, err := handler.NewDigest(sig)
 	if err != nil {
@@ -120,7 +130,7 @@ func (a *adobeX509RSASHA1) Validate(sig *model.PdfSignature, digest model.Hasher
 	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), ha, h.Sum(nil), sigHash); err != nil {
 		return model.SignatureValidationResult{}, err
 	}
-	return model.SignatureValidationResult{IsSigned: true, IsVerified: true}, nil
+	return model.SignatureValidationResult{IsSigned: true, IsVerified: true, Certificates: certs}, nil
 }
 
 // Sign sets the Contents fields for the PdfSignature.
@@ -140,7 +150,7 @@ func (a *adobeX509RSASHA1) Sign(sig *model.PdfSignature, digest model.Hasher) er
 		}
 		ha, _ := getHashFromSignatureAlgorithm(a.certificate.SignatureAlgorithm)
 
-		data, err = rsa.SignPKCS1v15(rand.Reader, a.privateKey, ha, h.Sum(nil))
+		data, err = a.signer.Sign(rand.Reader, h.Sum(nil), ha)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,198 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/model"
+)
+
+// timestampAttributeLen is the size reserved for the unsigned attribute containing a signature
+// timestamp token, in addition to the size of the token.
+const timestampAttributeLen = 64
+
+// Signature timestamp handler, adding signature timestamps to the CMS signatures of a handler.
+type signatureTimestamper struct {
+	handler model.SignatureHandler
+	client  TimestampClient
+	hash    crypto.Hash
+}
+
+// NewSignatureTimestamper wraps signature handler `handler`, which must create CMS signatures
+// (adbe.pkcs7.detached or ETSI.CAdES.detached), so that its signatures contain a signature
+// timestamp from `client` as unsigned attribute (RFC 3161 appendix A). The message imprint of the
+// timestamp is computed with `hash` and a hash of 0 selects SHA-256.
+func NewSignatureTimestamper(handler model.SignatureHandler, client TimestampClient, hash crypto.Hash) (model.SignatureHandler, error) {
+	if handler == nil {
+		return nil, errors.New("signature handler must not be nil")
+	}
+	if client == nil {
+		return nil, errors.New("timestamp client must not be nil")
+	}
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	if _, err := digestAlgorithmOID(hash); err != nil {
+		return nil, err
+	}
+	return &signatureTimestamper{handler: handler, client: client, hash: hash}, nil
+}
+
+// InitSignature initialises the PdfSignature.
+func (a *signatureTimestamper) InitSignature(sig *model.PdfSignature) error {
+	if err := a.handler.InitSignature(sig); err != nil {
+		return err
+	}
+	if sig.SubFilter == nil || (*sig.SubFilter != "adbe.pkcs7.detached" && *sig.SubFilter != "ETSI.CAdES.detached") {
+		return fmt.Errorf("signature timestamps are not supported for SubFilter %v", sig.SubFilter)
+	}
+
+	// The handler of the signature is the copy made by the wrapped handler.
+	handler := *a
+	handler.handler = sig.Handler
+	sig.Handler = &handler
+
+	// The token is requested when the document is signed: its space and the space of the
+	// unsigned attribute containing it are added to the space reserved by the wrapped handler.
+	size := reservedSignatureLen(sig)
+	if size == 0 {
+		size = defaultSignatureLen
+	}
+	size += timestampTokenLen(handler.client, handler.hash) + timestampAttributeLen
+	sig.Contents = core.MakeHexString(string(make([]byte, size)))
+	return nil
+}
+
+// NewDigest creates a new digest.
+func (a *signatureTimestamper) NewDigest(sig *model.PdfSignature) (model.Hasher, error) {
+	return a.handler.NewDigest(sig)
+}
+
+// Sign sets the Contents fields of the PdfSignature to the signature of the wrapped handler with
+// a signature timestamp.
+func (a *signatureTimestamper) Sign(sig *model.PdfSignature, digest model.Hasher) error {
+	size := reservedSignatureLen(sig)
+	if err := a.handler.Sign(sig, digest); err != nil {
+		return err
+	}
+	sd, err := parseCMSSignedData(sig.Contents.Bytes())
+	if err != nil {
+		return err
+	}
+	si := &sd.SignerInfos[0]
+
+	h := a.hash.New()
+	h.Write(si.Signature)
+	token, err := a.client.GetTimestamp(h.Sum(nil), a.hash)
+	if err != nil {
+		return err
+	}
+	attrs, err := parseCMSAttributes(si.UnsignedAttrs)
+	if err != nil {
+		return err
+	}
+	attrs = append(attrs, cmsAttribute{
+		Type:   oidAttributeSignatureTimeStampToken,
+		Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: token},
+	})
+	unsignedAttrs, err := marshalCMSAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	var attrsValue asn1.RawValue
+	if _, err := asn1.Unmarshal(unsignedAttrs, &attrsValue); err != nil {
+		return err
+	}
+	si.UnsignedAttrs = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: attrsValue.Bytes}
+
+	data, err := sd.marshal()
+	if err != nil {
+		return err
+	}
+	return setSignatureContents(sig, data, size)
+}
+
+// Validate validates PdfSignature.
+func (a *signatureTimestamper) Validate(sig *model.PdfSignature, digest model.Hasher) (model.SignatureValidationResult, error) {
+	return a.handler.Validate(sig, digest)
+}
+
+// CheckRevocationWithDSS checks the revocation status of the signer of PdfSignature at time `at`
+// with the validation data of the Document Security Store `dss`.
+func (a *signatureTimestamper) CheckRevocationWithDSS(result *model.SignatureValidationResult, sig *model.PdfSignature, dss *model.DSS, at time.Time) error {
+	return checkRevocation(result, sig, dss, at)
+}
+
+// IsApplicable returns true if the signature handler is applicable for the PdfSignature.
+func (a *signatureTimestamper) IsApplicable(sig *model.PdfSignature) bool {
+	return a.handler.IsApplicable(sig)
+}
+
+// verifySignatureTimestamp checks the signature timestamps of `si`, if any, and returns the
+// time of the latest one and the certificates of its timestamp authority, or the zero time when
+// `si` has no signature timestamp.
+func (si *cmsSignerInfo) verifySignatureTimestamp() (time.Time, []*x509.Certificate, error) {
+	var genTime time.Time
+	var tsaCerts []*x509.Certificate
+	attrs, err := parseCMSAttributes(si.UnsignedAttrs)
+	if err != nil {
+		return genTime, nil, err
+	}
+	for _, attr := range attrs {
+		if !attr.Type.Equal(oidAttributeSignatureTimeStampToken) {
+			continue
+		}
+		hash, err := timestampDigestHash(attr.Values.Bytes)
+		if err != nil {
+			return genTime, nil, fmt.Errorf("invalid signature timestamp: %v", err)
+		}
+		h := hash.New()
+		h.Write(si.Signature)
+		info, certs, err := verifyTimestampToken(attr.Values.Bytes, h.Sum(nil), hash)
+		if err != nil {
+			return genTime, nil, fmt.Errorf("invalid signature timestamp: %v", err)
+		}
+		if info.GenTime.After(genTime) {
+			genTime = info.GenTime
+			tsaCerts = certs
+		}
+	}
+	return genTime, tsaCerts, nil
+}
+
+// setSignerDetails sets the certificates and the signing time of the validation result `result`
+// of a CMS signature by `cert`. The other certificates of the signature `certs` follow the
+// signer certificate. The signing time is the time of the timestamp `genTime` by the authority
+// with certificates `tsaCerts`, unless zero, or the signing-time attribute of the signed
+// attributes `attrs`. The timestamp is untrusted until the certificate chain of its authority is
+// verified with the trusted roots of the validation.
+func setSignerDetails(result *model.SignatureValidationResult, cert *x509.Certificate, certs []*x509.Certificate, attrs []cmsAttribute, genTime time.Time, tsaCerts []*x509.Certificate) {
+	result.Certificates = []*x509.Certificate{cert}
+	for _, c := range certs {
+		if c != cert {
+			result.Certificates = append(result.Certificates, c)
+		}
+	}
+
+	if !genTime.IsZero() {
+		result.SigningTime = genTime
+		result.SigningTimeSource = model.SigningTimeSourceUntrustedTimestamp
+		result.TimestampCertificates = tsaCerts
+		return
+	}
+	var signingTime time.Time
+	if found, err := findCMSAttribute(attrs, oidAttributeSigningTime, &signingTime); err == nil && found {
+		result.SigningTime = signingTime
+		result.SigningTimeSource = model.SigningTimeSourceSignedAttribute
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// rsaPSSSigner is a crypto.Signer creating RSASSA-PSS signatures with the RSA key of the wrapped
+// signer.
+type rsaPSSSigner struct {
+	crypto.Signer
+}
+
+// NewRSAPSSSigner returns a signer creating RSASSA-PSS signatures, with a salt of the length of
+// the digest, with the RSA key of `signer`. The signatures of `signer` are PKCS #1 v1.5
+// signatures otherwise. `signer` may be an *rsa.PrivateKey or a signer of a key held in a
+// hardware security module, which must accept rsa.PSSOptions.
+func NewRSAPSSSigner(signer crypto.Signer) (crypto.Signer, error) {
+	if isNilSigner(signer) {
+		return nil, errors.New("signer must not be nil")
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return nil, errors.New("RSASSA-PSS requires an RSA key")
+	}
+	return &rsaPSSSigner{Signer: signer}, nil
+}
+
+// Sign signs `digest` with RSASSA-PSS.
+func (s *rsaPSSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); !ok {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: opts.HashFunc()}
+	}
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+// isNilSigner returns true if `signer` is nil or a nil pointer, such as a nil *rsa.PrivateKey
+// passed to the handler constructors for the signature validation.
+func isNilSigner(signer crypto.Signer) bool {
+	if signer == nil {
+		return true
+	}
+	v := reflect.ValueOf(signer)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// isEd25519Signer returns true if `signer` creates Ed25519 signatures.
+func isEd25519Signer(signer crypto.Signer) bool {
+	_, ok := signer.Public().(ed25519.PublicKey)
+	return ok
+}
+
+// signerDefaultHash returns the digest algorithm `hash` of the signatures of `signer`, or its
+// default one when `hash` is 0: SHA-512 for Ed25519 (RFC 8419) and SHA-256 otherwise.
+func signerDefaultHash(signer crypto.Signer, hash crypto.Hash) (crypto.Hash, error) {
+	if isNilSigner(signer) || !isEd25519Signer(signer) {
+		if hash == 0 {
+			hash = crypto.SHA256
+		}
+		return hash, nil
+	}
+	if hash != 0 && hash != crypto.SHA512 {
+		return 0, errors.New("Ed25519 signatures require the SHA-512 digest algorithm")
+	}
+	return crypto.SHA512, nil
+}
+
+// signData returns the signature of `data` by `signer` with digest algorithm `hash`. Ed25519
+// signers sign `data` itself.
+func signData(signer crypto.Signer, hash crypto.Hash, data []byte) ([]byte, error) {
+	if isEd25519Signer(signer) {
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	h := hash.New()
+	h.Write(data)
+	return signer.Sign(rand.Reader, h.Sum(nil), hash)
+}
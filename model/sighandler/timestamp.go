@@ -0,0 +1,317 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Object identifiers of RFC 3161 timestamps.
+var (
+	oidContentTypeTSTInfo               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttributeSignatureTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+	oidExtensionExtendedKeyUsage        = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// TimestampClient is the interface of the clients of RFC 3161 timestamp authorities.
+type TimestampClient interface {
+	// GetTimestamp returns the DER encoded TimeStampToken of the data with digest `digest`
+	// computed with `hash`.
+	GetTimestamp(digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+// TimestampSizeEstimator is an optional interface of the timestamp clients which estimate the size
+// of their timestamp tokens. The space of the tokens is reserved in the signatures before they
+// are requested, with the estimate of the client or defaultTimestampTokenLen.
+type TimestampSizeEstimator interface {
+	// EstimateTimestampLen returns the maximum size in bytes of the DER encoded TimeStampToken
+	// of a digest computed with `hash`, or 0 for the default size.
+	EstimateTimestampLen(hash crypto.Hash) int
+}
+
+// defaultTimestampTokenLen is the default size reserved for timestamp tokens, which covers the
+// tokens of authorities including a few certificates.
+const defaultTimestampTokenLen = 8192
+
+// timestampTokenLen returns the size reserved for the timestamp tokens of `client` of digests
+// computed with `hash`. The token is not requested.
+func timestampTokenLen(client TimestampClient, hash crypto.Hash) int {
+	if estimator, ok := client.(TimestampSizeEstimator); ok {
+		if size := estimator.EstimateTimestampLen(hash); size > 0 {
+			return size
+		}
+	}
+	return defaultTimestampTokenLen
+}
+
+// messageImprint is the MessageImprint type (RFC 3161 section 2.4.1).
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// timeStampReq is the TimeStampReq type (RFC 3161 section 2.4.1).
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+// pkiStatusInfo is the PKIStatusInfo type (RFC 3161 section 2.4.2).
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// timeStampResp is the TimeStampResp type (RFC 3161 section 2.4.2).
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// tstAccuracy is the Accuracy type (RFC 3161 section 2.4.2).
+type tstAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tstInfo is the TSTInfo type (RFC 3161 section 2.4.2).
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       tstAccuracy      `asn1:"optional"`
+	Ordering       bool             `asn1:"optional,default:false"`
+	Nonce          *big.Int         `asn1:"optional"`
+	TSA            asn1.RawValue    `asn1:"optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+// newMessageImprint returns the message imprint of digest `digest` computed with `hash`.
+func newMessageImprint(digest []byte, hash crypto.Hash) (messageImprint, error) {
+	oid, err := digestAlgorithmOID(hash)
+	if err != nil {
+		return messageImprint{}, err
+	}
+	return messageImprint{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue},
+		HashedMessage: digest,
+	}, nil
+}
+
+// verifyTimestampToken checks the signature of TimeStampToken `token` and the certificate of the
+// timestamp authority, and returns its TSTInfo and the certificates of the token, starting with
+// the certificate of the authority. If `digest` is not nil, the message imprint of the token must
+// be `digest` computed with `hash`. The certificate chain of the authority is not verified.
+func verifyTimestampToken(token []byte, digest []byte, hash crypto.Hash) (*tstInfo, []*x509.Certificate, error) {
+	sd, err := parseCMSSignedData(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sd.EncapContentInfo.ContentType.Equal(oidContentTypeTSTInfo) {
+		return nil, nil, fmt.Errorf("unexpected timestamp content type %s", sd.EncapContentInfo.ContentType)
+	}
+	content, err := sd.content()
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &tstInfo{}
+	if _, err := asn1.Unmarshal(content, info); err != nil {
+		return nil, nil, err
+	}
+	if digest != nil {
+		oid, err := digestAlgorithmOID(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oid) {
+			return nil, nil, fmt.Errorf("timestamp message imprint algorithm %s does not match %v", info.MessageImprint.HashAlgorithm.Algorithm, hash)
+		}
+		if !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+			return nil, nil, errors.New("timestamp message imprint mismatch")
+		}
+	}
+
+	certs, err := sd.certificates()
+	if err != nil {
+		return nil, nil, err
+	}
+	si := sd.SignerInfos[0]
+	cert, err := si.signerCertificate(certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkTimestampCertificate(cert); err != nil {
+		return nil, nil, err
+	}
+	signerHash, err := digestAlgorithmHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := signerHash.New()
+	h.Write(content)
+	if _, err := si.verify(cert, oidContentTypeTSTInfo, h.Sum(nil)); err != nil {
+		return nil, nil, fmt.Errorf("invalid timestamp signature: %v", err)
+	}
+
+	tsaCerts := []*x509.Certificate{cert}
+	for _, c := range certs {
+		if c != cert {
+			tsaCerts = append(tsaCerts, c)
+		}
+	}
+	return info, tsaCerts, nil
+}
+
+// checkTimestampCertificate checks that the certificate of a timestamp authority `cert` has the
+// time stamping extended key usage only, in a critical extension (RFC 3161 section 2.3).
+func checkTimestampCertificate(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageTimeStamping || len(cert.UnknownExtKeyUsage) != 0 {
+		return fmt.Errorf("certificate %q is not a timestamp authority certificate", cert.Subject.CommonName)
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionExtendedKeyUsage) && !ext.Critical {
+			return fmt.Errorf("extended key usage of timestamp authority certificate %q is not critical", cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// timestampDigestHash returns the digest algorithm of the message imprint of TimeStampToken
+// `token`.
+func timestampDigestHash(token []byte) (crypto.Hash, error) {
+	sd, err := parseCMSSignedData(token)
+	if err != nil {
+		return 0, err
+	}
+	content, err := sd.content()
+	if err != nil {
+		return 0, err
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return 0, err
+	}
+	return digestAlgorithmHash(info.MessageImprint.HashAlgorithm.Algorithm)
+}
+
+// HTTPTimestampClient requests timestamps from an RFC 3161 timestamp authority over HTTP
+// (RFC 3161 section 3.4).
+type HTTPTimestampClient struct {
+	// URL of the timestamp authority.
+	URL string
+
+	// Username and Password are sent with HTTP basic authentication when Username is set.
+	Username string
+	Password string
+
+	// Policy requested for the timestamps. Optional.
+	Policy asn1.ObjectIdentifier
+
+	// HTTPClient is used for the requests. A client with a timeout of 30 seconds is used when nil.
+	HTTPClient *http.Client
+
+	// TokenLen is the size in bytes reserved in the signatures for the timestamp tokens of the
+	// authority. 8192 bytes are reserved when 0.
+	TokenLen int
+}
+
+// NewHTTPTimestampClient returns a client of the timestamp authority at `url`.
+func NewHTTPTimestampClient(url string) *HTTPTimestampClient {
+	return &HTTPTimestampClient{URL: url}
+}
+
+// EstimateTimestampLen implements TimestampSizeEstimator interface.
+func (c *HTTPTimestampClient) EstimateTimestampLen(hash crypto.Hash) int {
+	return c.TokenLen
+}
+
+// GetTimestamp returns the DER encoded TimeStampToken of the data with digest `digest` computed
+// with `hash`. The token returned by the timestamp authority is checked to match the request.
+func (c *HTTPTimestampClient) GetTimestamp(digest []byte, hash crypto.Hash) ([]byte, error) {
+	imprint, err := newMessageImprint(digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	reqData, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: imprint,
+		ReqPolicy:      c.Policy,
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(reqData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/timestamp-query")
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp authority returned HTTP status %d", resp.StatusCode)
+	}
+
+	var tsResp timeStampResp
+	if _, err := asn1.Unmarshal(respData, &tsResp); err != nil {
+		return nil, fmt.Errorf("invalid timestamp response: %v", err)
+	}
+	// Status 0 is granted and 1 is granted with modifications.
+	if status := tsResp.Status; status.Status > 1 {
+		return nil, fmt.Errorf("timestamp request rejected with status %d %v", status.Status, status.StatusString)
+	}
+	token := tsResp.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, errors.New("timestamp response has no token")
+	}
+	info, _, err := verifyTimestampToken(token, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("timestamp nonce mismatch")
+	}
+	return token, nil
+}
@@ -0,0 +1,147 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package sighandler
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LocalTimestampAuthority is an in-process RFC 3161 timestamp authority, for tests and for signing
+// without network access. It implements TimestampClient and serves timestamp requests over HTTP
+// as http.Handler.
+type LocalTimestampAuthority struct {
+	// Signer and Certificate of the authority. The certificate should have the critical
+	// time stamping extended key usage.
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+
+	// Hash is the digest algorithm of the token signatures. SHA-256 is used when 0.
+	Hash crypto.Hash
+
+	// Policy of the timestamps. An arbitrary policy under the private enterprise arc is used when
+	// nil.
+	Policy asn1.ObjectIdentifier
+
+	// Now returns the time of the timestamps. time.Now is used when nil.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	serial int64
+}
+
+// NewLocalTimestampAuthority returns a timestamp authority issuing timestamps signed with `signer`
+// and `certificate`.
+func NewLocalTimestampAuthority(signer crypto.Signer, certificate *x509.Certificate) *LocalTimestampAuthority {
+	return &LocalTimestampAuthority{Signer: signer, Certificate: certificate}
+}
+
+// GetTimestamp returns the DER encoded TimeStampToken of the data with digest `digest` computed
+// with `hash`.
+func (tsa *LocalTimestampAuthority) GetTimestamp(digest []byte, hash crypto.Hash) ([]byte, error) {
+	imprint, err := newMessageImprint(digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	return tsa.timestamp(timeStampReq{Version: 1, MessageImprint: imprint})
+}
+
+// ServeHTTP responds to the RFC 3161 timestamp request of `r`.
+func (tsa *LocalTimestampAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp timeStampResp
+	var req timeStampReq
+	if _, err := asn1.Unmarshal(data, &req); err != nil {
+		// Rejection with failure info badDataFormat.
+		resp.Status = pkiStatusInfo{Status: 2, StatusString: []string{err.Error()}, FailInfo: asn1.BitString{Bytes: []byte{0x04}, BitLength: 6}}
+	} else if token, err := tsa.timestamp(req); err != nil {
+		// Rejection with failure info badAlg.
+		resp.Status = pkiStatusInfo{Status: 2, StatusString: []string{err.Error()}, FailInfo: asn1.BitString{Bytes: []byte{0x80}, BitLength: 1}}
+	} else {
+		resp.TimeStampToken = asn1.RawValue{FullBytes: token}
+	}
+	respData, err := asn1.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(respData)
+}
+
+// timestamp returns the TimeStampToken responding to `req`.
+func (tsa *LocalTimestampAuthority) timestamp(req timeStampReq) ([]byte, error) {
+	if tsa.Signer == nil || tsa.Certificate == nil {
+		return nil, errors.New("timestamp authority signer and certificate must not be nil")
+	}
+	imprintHash, err := digestAlgorithmHash(req.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.MessageImprint.HashedMessage) != imprintHash.Size() {
+		return nil, errors.New("invalid message imprint length")
+	}
+
+	hash := tsa.Hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	policy := tsa.Policy
+	if policy == nil {
+		policy = req.ReqPolicy
+	}
+	if policy == nil {
+		policy = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	}
+	now := time.Now
+	if tsa.Now != nil {
+		now = tsa.Now
+	}
+	tsa.mu.Lock()
+	tsa.serial++
+	serial := tsa.serial
+	tsa.mu.Unlock()
+
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   big.NewInt(serial),
+		GenTime:        now().UTC().Truncate(time.Second),
+		Accuracy:       tstAccuracy{Seconds: 1},
+		Nonce:          req.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &cmsSigner{signer: tsa.Signer, certificate: tsa.Certificate, hash: hash}
+	signingCert, err := signer.signingCertificateV2Attribute()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := signer.signEncapsulated(oidContentTypeTSTInfo, info, signingCert)
+	if err != nil {
+		return nil, err
+	}
+	return sd.marshal()
+}
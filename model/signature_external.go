@@ -0,0 +1,141 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// ExternalSignature is a document prepared for a deferred signature: the Contents of one of its
+// signatures is a placeholder reserved for a signature created externally (for example by a
+// remote signing service), which is injected in the document without serializing it again.
+type ExternalSignature struct {
+	// Data is the prepared document.
+	Data []byte
+
+	// ByteRange is the byte range of the signature: the offsets and lengths of the data before
+	// and after the Contents.
+	ByteRange [4]int64
+}
+
+// PrepareExternalSignature signs page `pageNum` with signature field `field` and writes the
+// document with the appender. The handler of the signature of `field` must reserve the
+// Contents of the signature, as the handler of sighandler.NewEmptyAdobePKCS7Detached. The
+// document is returned with the byte range of the signature, whose digest is signed externally.
+func (a *PdfAppender) PrepareExternalSignature(pageNum int, field *PdfFieldSignature) (*ExternalSignature, error) {
+	if err := a.Sign(pageNum, field); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		return nil, err
+	}
+	return newExternalSignature(buf.Bytes(), field.V)
+}
+
+// LoadExternalSignature returns the external signature of the signature field named
+// `fieldName` in document `data` prepared by PrepareExternalSignature, for injecting the
+// signature in a later step.
+func LoadExternalSignature(data []byte, fieldName string) (*ExternalSignature, error) {
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if reader.AcroForm == nil {
+		return nil, errors.New("document has no form")
+	}
+	for _, field := range reader.AcroForm.AllFields() {
+		name, err := field.FullName()
+		if err != nil {
+			return nil, err
+		}
+		if name != fieldName {
+			continue
+		}
+		sigField, ok := field.GetContext().(*PdfFieldSignature)
+		if !ok || sigField.V == nil {
+			return nil, fmt.Errorf("field %s is not a signed signature field", fieldName)
+		}
+		return newExternalSignature(data, sigField.V)
+	}
+	return nil, fmt.Errorf("signature field %s not found", fieldName)
+}
+
+// newExternalSignature returns the external signature of signature `sig` of document `data`.
+func newExternalSignature(data []byte, sig *PdfSignature) (*ExternalSignature, error) {
+	if sig == nil || sig.ByteRange == nil || sig.ByteRange.Len() != 4 {
+		return nil, errors.New("signature byte range not set")
+	}
+	es := &ExternalSignature{Data: data}
+	for i := range es.ByteRange {
+		v, err := core.GetNumberAsInt64(sig.ByteRange.Get(i))
+		if err != nil {
+			return nil, err
+		}
+		es.ByteRange[i] = v
+	}
+
+	br := es.ByteRange
+	start, end := br[0]+br[1], br[2]
+	if br[0] != 0 || br[1] < 0 || br[3] < 0 || end-start < 2 || br[2]+br[3] != int64(len(data)) {
+		common.Log.Debug("ERROR: Invalid byte range %v (document size %d)", br, len(data))
+		return nil, errors.New("invalid signature byte range")
+	}
+	if data[start] != '<' || data[end-1] != '>' {
+		return nil, errors.New("signature contents is not a hexadecimal string")
+	}
+	return es, nil
+}
+
+// ReservedLen returns the maximum size in bytes of the signature which can be injected.
+func (es *ExternalSignature) ReservedLen() int {
+	return int(es.ByteRange[2]-es.ByteRange[1]-2) / 2
+}
+
+// SignedData returns a reader of the data covered by the signature, which is the document
+// without the signature Contents.
+func (es *ExternalSignature) SignedData() io.Reader {
+	br := es.ByteRange
+	return io.MultiReader(
+		bytes.NewReader(es.Data[br[0]:br[0]+br[1]]),
+		bytes.NewReader(es.Data[br[2]:br[2]+br[3]]),
+	)
+}
+
+// Digest returns the digest of the data covered by the signature computed with `hash`, which is
+// the message digest of the detached CMS signature to inject.
+func (es *ExternalSignature) Digest(hash crypto.Hash) ([]byte, error) {
+	if !hash.Available() {
+		return nil, fmt.Errorf("unavailable digest algorithm %v", hash)
+	}
+	h := hash.New()
+	if _, err := io.Copy(h, es.SignedData()); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Inject writes signature `contents` in the space reserved for the signature Contents in the
+// document. The reserved space left is padded with zeros. The signed document is returned.
+func (es *ExternalSignature) Inject(contents []byte) ([]byte, error) {
+	if len(contents) > es.ReservedLen() {
+		return nil, fmt.Errorf("signature of %d bytes exceeds the reserved %d bytes", len(contents), es.ReservedLen())
+	}
+	dst := es.Data[es.ByteRange[1]+1 : es.ByteRange[2]-1]
+	for i := range dst {
+		dst[i] = '0'
+	}
+	hex.Encode(dst, contents)
+	return es.Data, nil
+}
@@ -7,8 +7,10 @@ package model
 
 import (
 	"bytes"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/zituocn/updf/common"
 	"github.com/zituocn/updf/core"
@@ -30,6 +32,20 @@ type SignatureHandler interface {
 	Sign(sig *PdfSignature, digest Hasher) error
 }
 
+// LTVSignatureHandler is implemented by the signature handlers which can check the revocation
+// status of the signer certificates with the validation data of the Document Security Store of
+// the document, without network access.
+type LTVSignatureHandler interface {
+	SignatureHandler
+
+	// CheckRevocationWithDSS checks the revocation status of the signer certificate chain of
+	// signature `sig`, validated as `result`, with the certificates, OCSP responses and CRLs of
+	// `dss`, and sets the revocation fields of `result`. The status is checked at time `at`, the
+	// signing time attested by a trusted timestamp, and the later revocations are ignored. When
+	// `at` is zero, the current status is checked and any revocation counts.
+	CheckRevocationWithDSS(result *SignatureValidationResult, sig *PdfSignature, dss *DSS, at time.Time) error
+}
+
 // SignatureValidationResult defines the response from the signature validation handler.
 type SignatureValidationResult struct {
 	// List of errors when validating the signature.
@@ -44,9 +60,85 @@ type SignatureValidationResult struct {
 	Location    string
 	ContactInfo string
 
-	// TODO(gunnsth): Add more fields such as ability to access the certificate information (name, CN, etc).
-	// TODO: Also add flags to indicate whether the signature covers the entire file, or the entire portion of
-	// a revision (if incremental updates used).
+	// IsRevocationChecked is true when the revocation status of the signer certificate chain was
+	// checked with the validation data of the document, and IsRevoked when a certificate of the
+	// chain is revoked.
+	IsRevocationChecked bool
+	IsRevoked           bool
+
+	// Certificates is the certificate chain of the signer, starting with the signer certificate.
+	// It is the chain verified with the trusted roots when IsTrusted is true.
+	Certificates []*x509.Certificate
+
+	// SigningTime is the signing time from the most reliable source of the signature, which is
+	// SigningTimeSource.
+	SigningTime       time.Time
+	SigningTimeSource SigningTimeSource
+
+	// TimestampCertificates is the certificate chain of the timestamp authority of the signing
+	// time when it is the time of a timestamp, starting with the authority certificate. It is the
+	// chain verified with the trusted roots when SigningTimeSource is SigningTimeSourceTimestamp.
+	TimestampCertificates []*x509.Certificate
+
+	// CoversWholeDocument is true when the ByteRange of the signature covers the whole document
+	// except for the signature Contents, i.e. the document was not updated after the signature.
+	CoversWholeDocument bool
+
+	// SignedRevisionSize is the size of the revision of the document covered by the signature.
+	SignedRevisionSize int64
+
+	// LaterRevisions describes the incremental updates of the document after the signed
+	// revision.
+	LaterRevisions []RevisionChanges
+
+	// DocMDPPermission is the access permission granted by a certification signature, or 0 for
+	// approval signatures.
+	DocMDPPermission DocMDPPermission
+
+	// DisallowedChanges describes the changes of the later revisions which are not permitted by
+	// the DocMDP permission or the fields locked by the FieldMDP transform of the signature.
+	DisallowedChanges []string
+}
+
+// SigningTimeSource represents the source of the signing time of a signature.
+type SigningTimeSource int
+
+// Signing time sources, by increasing reliability.
+const (
+	// SigningTimeSourceNone indicates that the signing time is unknown.
+	SigningTimeSourceNone SigningTimeSource = iota
+
+	// SigningTimeSourceSignatureDictionary indicates the M entry of the signature dictionary,
+	// claimed by the signer.
+	SigningTimeSourceSignatureDictionary
+
+	// SigningTimeSourceSignedAttribute indicates the signing-time attribute of the CMS signature,
+	// claimed by the signer.
+	SigningTimeSourceSignedAttribute
+
+	// SigningTimeSourceUntrustedTimestamp indicates the time of a valid RFC 3161 timestamp of the
+	// signature or of a document timestamp, whose timestamp authority is not trusted.
+	SigningTimeSourceUntrustedTimestamp
+
+	// SigningTimeSourceTimestamp indicates the time of an RFC 3161 timestamp of the signature
+	// or of a document timestamp, attested by a timestamp authority whose certificate chain was
+	// verified with the trusted roots of the validation.
+	SigningTimeSourceTimestamp
+)
+
+// String returns the name of the signing time source.
+func (s SigningTimeSource) String() string {
+	switch s {
+	case SigningTimeSourceSignatureDictionary:
+		return "signature dictionary"
+	case SigningTimeSourceSignedAttribute:
+		return "signed attribute"
+	case SigningTimeSourceUntrustedTimestamp:
+		return "untrusted timestamp"
+	case SigningTimeSourceTimestamp:
+		return "timestamp"
+	}
+	return "none"
 }
 
 func (v SignatureValidationResult) String() string {
@@ -88,12 +180,43 @@ func (v SignatureValidationResult) String() string {
 	} else {
 		buf.WriteString("Trusted: Untrusted certificate\n")
 	}
+	if v.SigningTimeSource != SigningTimeSourceNone {
+		buf.WriteString(fmt.Sprintf("Signing time: %s (%s)\n", v.SigningTime.String(), v.SigningTimeSource))
+	}
+	if len(v.Certificates) > 0 {
+		buf.WriteString(fmt.Sprintf("Signer: %s\n", v.Certificates[0].Subject.CommonName))
+	}
+	if v.CoversWholeDocument {
+		buf.WriteString("Coverage: Signature covers the whole document\n")
+	} else {
+		buf.WriteString(fmt.Sprintf("Coverage: Signature covers the revision of %d bytes, %d later revisions\n", v.SignedRevisionSize, len(v.LaterRevisions)))
+	}
+	if v.DocMDPPermission != 0 {
+		buf.WriteString(fmt.Sprintf("Certification: DocMDP permission %d\n", v.DocMDPPermission))
+	}
+	if len(v.DisallowedChanges) > 0 {
+		buf.WriteString(fmt.Sprintf("Modifications: %d changes not permitted\n", len(v.DisallowedChanges)))
+	}
+	switch {
+	case v.IsRevoked:
+		buf.WriteString("Revocation: Certificate is revoked\n")
+	case v.IsRevocationChecked:
+		buf.WriteString("Revocation: Certificate is not revoked\n")
+	default:
+		buf.WriteString("Revocation: Not checked\n")
+	}
 
 	return buf.String()
 }
 
-// ValidateSignatures validates digital signatures in the document.
+// ValidateSignatures validates digital signatures and document timestamps in the document.
 func (r *PdfReader) ValidateSignatures(handlers []SignatureHandler) ([]SignatureValidationResult, error) {
+	return r.ValidateSignaturesWithOptions(handlers, nil)
+}
+
+// ValidateSignaturesWithOptions validates digital signatures and document timestamps in the
+// document with the validation options `opts`, which may be nil.
+func (r *PdfReader) ValidateSignaturesWithOptions(handlers []SignatureHandler, opts *SignatureValidationOptions) ([]SignatureValidationResult, error) {
 	if r.AcroForm == nil {
 		return nil, nil
 	}
@@ -112,7 +235,7 @@ func (r *PdfReader) ValidateSignatures(handlers []SignatureHandler) ([]Signature
 			continue
 		}
 		if d, found := core.GetDict(f.V); found {
-			if name, ok := core.GetNameVal(d.Get("Type")); ok && name == "Sig" {
+			if name, ok := core.GetNameVal(d.Get("Type")); ok && (name == "Sig" || name == "DocTimeStamp") {
 				ind, found := core.GetIndirect(f.V)
 				if !found {
 					common.Log.Debug("ERROR: Signature container is nil")
@@ -142,6 +265,17 @@ func (r *PdfReader) ValidateSignatures(handlers []SignatureHandler) ([]Signature
 		}
 	}
 
+	// The revocation data of the Document Security Store is used for the offline validation.
+	dss, err := r.GetDSS()
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := r.newSignatureValidator(dss, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	var results []SignatureValidationResult
 	for _, pair := range pairs {
 		defaultResult := SignatureValidationResult{
@@ -196,6 +330,9 @@ func (r *PdfReader) ValidateSignatures(handlers []SignatureHandler) ([]Signature
 		}
 		result.ContactInfo = pair.sig.ContactInfo.Decoded()
 		result.Location = pair.sig.Location.Decoded()
+		if err := validator.complete(&result, pair.sig, pair.handler); err != nil {
+			return nil, err
+		}
 
 		result.Fields = defaultResult.Fields
 		results = append(results, result)
@@ -0,0 +1,231 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zituocn/updf/core"
+)
+
+// DocMDPPermission represents the access permissions granted by a certification signature
+// (Section 12.8.2.2 "DocMDP" PDF32000_2008).
+type DocMDPPermission int64
+
+// DocMDP access permissions.
+const (
+	// DocMDPNoChanges permits no changes to the document.
+	DocMDPNoChanges DocMDPPermission = 1
+
+	// DocMDPFillForms permits filling in forms, instantiating page templates and signing.
+	DocMDPFillForms DocMDPPermission = 2
+
+	// DocMDPFillFormsAndAnnotate permits the changes of DocMDPFillForms, as well as creating,
+	// deleting and modifying annotations.
+	DocMDPFillFormsAndAnnotate DocMDPPermission = 3
+)
+
+// FieldMDPAction represents the fields locked by a FieldMDP transform.
+type FieldMDPAction string
+
+// FieldMDP actions.
+const (
+	// FieldMDPActionAll locks all the fields of the document.
+	FieldMDPActionAll FieldMDPAction = "All"
+
+	// FieldMDPActionInclude locks the fields listed in Fields only.
+	FieldMDPActionInclude FieldMDPAction = "Include"
+
+	// FieldMDPActionExclude locks all the fields except the fields listed in Fields.
+	FieldMDPActionExclude FieldMDPAction = "Exclude"
+)
+
+// FieldMDP represents the fields locked by a signature (Section 12.8.2.4 "FieldMDP"
+// PDF32000_2008).
+type FieldMDP struct {
+	Action FieldMDPAction
+
+	// Fields are the fully qualified names of the fields of the Include and Exclude actions.
+	Fields []string
+}
+
+// IsLocked returns true if the field with fully qualified name `name` is locked.
+func (l *FieldMDP) IsLocked(name string) bool {
+	listed := false
+	for _, field := range l.Fields {
+		if field == name {
+			listed = true
+			break
+		}
+	}
+	switch l.Action {
+	case FieldMDPActionInclude:
+		return listed
+	case FieldMDPActionExclude:
+		return !listed
+	}
+	return true
+}
+
+// ToPdfObject returns the signature field lock dictionary of the FieldMDP, which is set as
+// the Lock of signature fields.
+func (l *FieldMDP) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	dict.Set("Type", core.MakeName("SigFieldLock"))
+	l.setEntries(dict)
+	return dict
+}
+
+// setEntries sets the Action and Fields of the FieldMDP in `dict`.
+func (l *FieldMDP) setEntries(dict *core.PdfObjectDictionary) {
+	dict.Set("Action", core.MakeName(string(l.Action)))
+	if l.Action != FieldMDPActionAll {
+		fields := core.MakeArray()
+		for _, field := range l.Fields {
+			fields.Append(core.MakeString(field))
+		}
+		dict.Set("Fields", fields)
+	}
+}
+
+// newFieldMDPFromDict loads a FieldMDP from the transform parameters or signature field lock
+// dictionary `dict`.
+func newFieldMDPFromDict(dict *core.PdfObjectDictionary) (*FieldMDP, error) {
+	action, ok := core.GetNameVal(dict.Get("Action"))
+	if !ok {
+		return nil, errors.New("FieldMDP Action missing")
+	}
+	lock := &FieldMDP{Action: FieldMDPAction(action)}
+	switch lock.Action {
+	case FieldMDPActionAll, FieldMDPActionInclude, FieldMDPActionExclude:
+	default:
+		return nil, fmt.Errorf("invalid FieldMDP Action %s", action)
+	}
+	if fields, ok := core.GetArray(dict.Get("Fields")); ok {
+		for _, obj := range fields.Elements() {
+			if field, ok := core.GetString(obj); ok {
+				lock.Fields = append(lock.Fields, field.Decoded())
+			}
+		}
+	}
+	return lock, nil
+}
+
+// SetDocMDP makes the signature a certification signature granting the access permissions
+// `perm` by adding a DocMDP transform to its Reference. The appender sets the signature as the
+// DocMDP signature of the document. A document has one certification signature at most, which
+// must be its first signature. The transform is kept when the signature is initialized, so it
+// can be added before or after calling Initialize.
+func (sig *PdfSignature) SetDocMDP(perm DocMDPPermission) error {
+	if perm < DocMDPNoChanges || perm > DocMDPFillFormsAndAnnotate {
+		return fmt.Errorf("invalid DocMDP permission %d", perm)
+	}
+	if _, ok := sig.GetDocMDPPermission(); ok {
+		return errors.New("signature already has a DocMDP transform")
+	}
+
+	params := core.MakeDict()
+	params.Set("Type", core.MakeName("TransformParams"))
+	params.Set("P", core.MakeInteger(int64(perm)))
+	params.Set("V", core.MakeName("1.2"))
+	sig.addReference("DocMDP", params)
+	return nil
+}
+
+// SetFieldMDP locks the fields of `lock` by adding a FieldMDP transform to the Reference of the
+// signature. The appender sets the lock as the Lock of the signature field, unless already set,
+// and the document catalog as the Data of the signature reference. Like SetDocMDP, it can be
+// called before or after Initialize.
+func (sig *PdfSignature) SetFieldMDP(lock *FieldMDP) error {
+	if lock == nil {
+		return errors.New("lock cannot be nil")
+	}
+	switch lock.Action {
+	case FieldMDPActionAll, FieldMDPActionInclude, FieldMDPActionExclude:
+	default:
+		return fmt.Errorf("invalid FieldMDP Action %s", lock.Action)
+	}
+
+	params := core.MakeDict()
+	params.Set("Type", core.MakeName("TransformParams"))
+	lock.setEntries(params)
+	params.Set("V", core.MakeName("1.2"))
+	sig.addReference("FieldMDP", params)
+	return nil
+}
+
+// addReference adds a signature reference dictionary with transform method `method` and
+// transform parameters `params` to the Reference of the signature.
+func (sig *PdfSignature) addReference(method string, params *core.PdfObjectDictionary) {
+	ref := core.MakeDict()
+	ref.Set("Type", core.MakeName("SigRef"))
+	ref.Set("TransformMethod", core.MakeName(method))
+	ref.Set("TransformParams", params)
+	if sig.Reference == nil {
+		sig.Reference = core.MakeArray()
+	}
+	sig.Reference.Append(ref)
+}
+
+// getReference returns the signature reference with transform method `method`, if any.
+func (sig *PdfSignature) getReference(method string) (*core.PdfObjectDictionary, bool) {
+	if sig.Reference == nil {
+		return nil, false
+	}
+	for _, obj := range sig.Reference.Elements() {
+		ref, ok := core.GetDict(obj)
+		if !ok {
+			continue
+		}
+		if name, _ := core.GetNameVal(ref.Get("TransformMethod")); name == method {
+			return ref, true
+		}
+	}
+	return nil, false
+}
+
+// getTransformParams returns the transform parameters of the signature reference with
+// transform method `method`, if any.
+func (sig *PdfSignature) getTransformParams(method string) (*core.PdfObjectDictionary, bool) {
+	ref, ok := sig.getReference(method)
+	if !ok {
+		return nil, false
+	}
+	params, ok := core.GetDict(ref.Get("TransformParams"))
+	if !ok {
+		params = core.MakeDict()
+	}
+	return params, true
+}
+
+// GetDocMDPPermission returns the access permissions granted by the signature if it is a
+// certification signature.
+func (sig *PdfSignature) GetDocMDPPermission() (DocMDPPermission, bool) {
+	params, ok := sig.getTransformParams("DocMDP")
+	if !ok {
+		return 0, false
+	}
+	perm, ok := core.GetIntVal(params.Get("P"))
+	if !ok || perm < int(DocMDPNoChanges) || perm > int(DocMDPFillFormsAndAnnotate) {
+		// The default permission is 2.
+		return DocMDPFillForms, true
+	}
+	return DocMDPPermission(perm), true
+}
+
+// GetFieldMDP returns the fields locked by the signature, if any.
+func (sig *PdfSignature) GetFieldMDP() (*FieldMDP, bool) {
+	params, ok := sig.getTransformParams("FieldMDP")
+	if !ok {
+		return nil, false
+	}
+	lock, err := newFieldMDPFromDict(params)
+	if err != nil {
+		return nil, false
+	}
+	return lock, true
+}
@@ -0,0 +1,340 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// SignatureValidationOptions defines the options of the signature validation.
+type SignatureValidationOptions struct {
+	// Roots are the trusted root certificates. The certificate chains of the signers are
+	// verified with the roots when set, and IsTrusted is set for the trusted signers.
+	Roots *x509.CertPool
+
+	// Intermediates are intermediate certificates for building the certificate chains, in
+	// addition to the certificates of the signatures and of the Document Security Store.
+	Intermediates []*x509.Certificate
+
+	// CurrentTime is the time at which the certificate chains are verified. When zero, the
+	// signing time is used if it is attested by a trusted timestamp, and the current time
+	// otherwise. The certificate chains of the timestamp authorities are verified with the roots
+	// at the time of their timestamps.
+	CurrentTime time.Time
+
+	// RevocationChecker checks the revocation status of the certificates of the chains, in
+	// addition to the validation data of the Document Security Store. Optional.
+	RevocationChecker RevocationChecker
+}
+
+// RevocationChecker is the interface of the revocation status checks of certificates.
+type RevocationChecker interface {
+	// CheckRevocation returns true if certificate `cert` issued by `issuer` is revoked. An error
+	// is returned when the revocation status cannot be determined.
+	CheckRevocation(cert, issuer *x509.Certificate) (bool, error)
+}
+
+// signatureValidator completes the results of the signature handlers with the information
+// which does not depend on the signature format.
+type signatureValidator struct {
+	opts     SignatureValidationOptions
+	data     []byte
+	dss      *DSS
+	dssCerts []*x509.Certificate
+}
+
+// newSignatureValidator returns a validator of the signatures of the document with options
+// `opts`, which may be nil, and the Document Security Store `dss`, which may be nil.
+func (r *PdfReader) newSignatureValidator(dss *DSS, opts *SignatureValidationOptions) (*signatureValidator, error) {
+	v := &signatureValidator{dss: dss}
+	if opts != nil {
+		v.opts = *opts
+	}
+	if _, err := r.rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.rs)
+	if err != nil {
+		return nil, err
+	}
+	v.data = data
+
+	if dss != nil {
+		certs, err := dss.GetCerts()
+		if err != nil {
+			return nil, err
+		}
+		for _, certData := range certs {
+			cert, err := x509.ParseCertificate(certData)
+			if err != nil {
+				common.Log.Debug("ERROR: Invalid DSS certificate: %v", err)
+				continue
+			}
+			v.dssCerts = append(v.dssCerts, cert)
+		}
+	}
+	return v, nil
+}
+
+// complete sets the signing time, coverage, certificate chain and revocation status of result
+// `result` of the validation of signature `sig` with `handler`.
+func (v *signatureValidator) complete(result *SignatureValidationResult, sig *PdfSignature, handler SignatureHandler) error {
+	if result.SigningTimeSource == SigningTimeSourceUntrustedTimestamp {
+		v.checkTimestamp(result)
+	}
+	if result.SigningTimeSource == SigningTimeSourceNone && sig.M != nil {
+		if date, err := NewPdfDate(sig.M.String()); err == nil {
+			result.SigningTime = date.ToGoTime()
+			result.SigningTimeSource = SigningTimeSourceSignatureDictionary
+		}
+	}
+
+	if err := v.checkCoverage(result, sig); err != nil {
+		return err
+	}
+	v.checkPermissions(result, sig)
+	if len(result.Certificates) > 0 {
+		v.checkChain(result)
+		v.checkDSSRevocation(result, sig, handler)
+		v.checkRevocation(result)
+	}
+	return nil
+}
+
+// checkCoverage sets the coverage of the document by signature `sig` in `result`. The ByteRange
+// of the signature must start at the beginning of the document and exclude the signature
+// Contents only.
+func (v *signatureValidator) checkCoverage(result *SignatureValidationResult, sig *PdfSignature) error {
+	byteRange := sig.ByteRange
+	if byteRange == nil || byteRange.Len() < 2 || byteRange.Len()%2 != 0 {
+		result.Errors = append(result.Errors, "invalid ByteRange")
+		return nil
+	}
+
+	valid := true
+	var end int64
+	for i := 0; i < byteRange.Len(); i += 2 {
+		start, err1 := core.GetNumberAsInt64(byteRange.Get(i))
+		length, err2 := core.GetNumberAsInt64(byteRange.Get(i + 1))
+		if err1 != nil || err2 != nil || start < end || length < 0 || start+length > int64(len(v.data)) {
+			result.Errors = append(result.Errors, "invalid ByteRange")
+			return nil
+		}
+		if i == 0 {
+			valid = start == 0
+		} else if start-end < 2 || v.data[end] != '<' || v.data[start-1] != '>' {
+			// The gaps of the byte range must be the signature Contents strings.
+			valid = false
+		}
+		end = start + length
+	}
+	if !valid {
+		result.Errors = append(result.Errors, "ByteRange does not exclude the signature Contents only")
+	}
+	result.SignedRevisionSize = end
+	result.CoversWholeDocument = valid && end == int64(len(v.data))
+
+	if end < int64(len(v.data)) {
+		changes, err := getRevisionChanges(v.data, end)
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load the revisions: %v", err)
+			result.Errors = append(result.Errors, fmt.Sprintf("unable to load the later revisions: %v", err))
+			return nil
+		}
+		result.LaterRevisions = changes
+	}
+	return nil
+}
+
+// checkPermissions checks that the changes of the revisions following the revision signed by
+// `sig` are permitted by its DocMDP and FieldMDP transforms, if any.
+func (v *signatureValidator) checkPermissions(result *SignatureValidationResult, sig *PdfSignature) {
+	perm, _ := sig.GetDocMDPPermission()
+	lock, _ := sig.GetFieldMDP()
+	result.DocMDPPermission = perm
+	if len(result.LaterRevisions) == 0 || (perm == 0 && lock == nil) {
+		return
+	}
+
+	disallowed, err := checkRevisionPermissions(v.data, result.SignedRevisionSize, perm, lock)
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to check the revisions: %v", err)
+		result.Errors = append(result.Errors, fmt.Sprintf("unable to check the later revisions: %v", err))
+		return
+	}
+	result.DisallowedChanges = disallowed
+	for _, change := range disallowed {
+		result.Errors = append(result.Errors, fmt.Sprintf("modification not permitted: %s", change))
+	}
+}
+
+// checkTimestamp verifies the certificate chain of the timestamp authority of the signing time of
+// `result` with the trusted roots, if any, at the signing time. The signing time source becomes
+// SigningTimeSourceTimestamp when the authority is trusted.
+func (v *signatureValidator) checkTimestamp(result *SignatureValidationResult) {
+	if v.opts.Roots == nil || len(result.TimestampCertificates) == 0 {
+		return
+	}
+	tsa := result.TimestampCertificates[0]
+	chains, err := tsa.Verify(x509.VerifyOptions{
+		Roots:         v.opts.Roots,
+		Intermediates: v.intermediates(result.TimestampCertificates[1:]),
+		CurrentTime:   result.SigningTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		common.Log.Debug("Untrusted timestamp authority %q: %v", tsa.Subject.CommonName, err)
+		return
+	}
+	result.SigningTimeSource = SigningTimeSourceTimestamp
+	result.TimestampCertificates = chains[0]
+}
+
+// intermediates returns the pool of the intermediate certificates `certs`, of the options and of
+// the Document Security Store.
+func (v *signatureValidator) intermediates(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range v.chainCertificates(certs) {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// chainCertificates returns the certificates `certs` followed by the intermediate certificates of
+// the options and the certificates of the Document Security Store.
+func (v *signatureValidator) chainCertificates(certs []*x509.Certificate) []*x509.Certificate {
+	var all []*x509.Certificate
+	all = append(all, certs...)
+	all = append(all, v.opts.Intermediates...)
+	return append(all, v.dssCerts...)
+}
+
+// checkChain builds the certificate chain of the signer of `result` and verifies it with the
+// trusted roots, if any.
+func (v *signatureValidator) checkChain(result *SignatureValidationResult) {
+	signer := result.Certificates[0]
+	certs := v.chainCertificates(result.Certificates[1:])
+	if v.opts.Roots == nil {
+		result.Certificates = BuildCertificateChain(signer, certs)
+		return
+	}
+
+	// The signing time is only used when attested by a timestamp authority verified by
+	// checkTimestamp, as the other sources are claimed by the signer.
+	currentTime := v.opts.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+		if result.SigningTimeSource == SigningTimeSourceTimestamp {
+			currentTime = result.SigningTime
+		}
+	}
+	chains, err := signer.Verify(x509.VerifyOptions{
+		Roots:         v.opts.Roots,
+		Intermediates: v.intermediates(result.Certificates[1:]),
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("untrusted certificate: %v", err))
+		result.Certificates = BuildCertificateChain(signer, certs)
+		return
+	}
+	result.IsTrusted = true
+	result.Certificates = chains[0]
+}
+
+// checkDSSRevocation checks the revocation status of the certificate chain of `result` with the
+// validation data of the Document Security Store, if `handler` supports it. The status is checked
+// at the signing time when it is attested by a trusted timestamp, and at the current time
+// otherwise.
+func (v *signatureValidator) checkDSSRevocation(result *SignatureValidationResult, sig *PdfSignature, handler SignatureHandler) {
+	ltvHandler, ok := handler.(LTVSignatureHandler)
+	if !ok || v.dss == nil || !result.IsVerified {
+		return
+	}
+	var at time.Time
+	if result.SigningTimeSource == SigningTimeSourceTimestamp {
+		at = result.SigningTime
+	}
+	if err := ltvHandler.CheckRevocationWithDSS(result, sig, v.dss, at); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+}
+
+// checkRevocation checks the revocation status of the certificate chain of `result` with the
+// revocation checker of the options, if any.
+func (v *signatureValidator) checkRevocation(result *SignatureValidationResult) {
+	checker := v.opts.RevocationChecker
+	if checker == nil || result.IsRevoked {
+		return
+	}
+	chain := result.Certificates
+	checked := true
+	for i, cert := range chain {
+		if IsSelfSignedCertificate(cert) {
+			break
+		}
+		if i+1 >= len(chain) {
+			checked = false
+			break
+		}
+		revoked, err := checker.CheckRevocation(cert, chain[i+1])
+		if err != nil {
+			common.Log.Debug("Revocation status of %q unknown: %v", cert.Subject.CommonName, err)
+			checked = false
+			continue
+		}
+		if revoked {
+			result.IsRevoked = true
+			result.Errors = append(result.Errors, fmt.Sprintf("certificate %q is revoked", cert.Subject.CommonName))
+		}
+	}
+	if checked {
+		result.IsRevocationChecked = true
+	}
+}
+
+// BuildCertificateChain returns the chain of certificate `cert` built from the certificates
+// `certs`, starting with `cert`. The chain ends at a self-signed certificate or at the last
+// certificate whose issuer was found. The signatures of the chain are checked but not its
+// validity periods, usages or trust.
+func BuildCertificateChain(cert *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{cert}
+	// The length is bounded to stop on cyclic chains.
+	for len(chain) <= len(certs) && !IsSelfSignedCertificate(cert) {
+		issuer := issuerCertificate(cert, certs)
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+	return chain
+}
+
+// issuerCertificate returns the certificate of `certs` which issued `cert`, or nil if not found.
+func issuerCertificate(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, c := range certs {
+		if bytes.Equal(c.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// IsSelfSignedCertificate returns true if certificate `cert` is self-signed.
+func IsSelfSignedCertificate(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
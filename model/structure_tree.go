@@ -0,0 +1,228 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zituocn/updf/common"
+	"github.com/zituocn/updf/core"
+)
+
+// PdfStructTreeRoot represents the structure tree root of a tagged PDF document
+// (14.7.2 - Table 322). The structure tree describes the logical structure of the document:
+// headings, paragraphs, lists, tables, figures etc. and the page content that belongs to them.
+type PdfStructTreeRoot struct {
+	// Kids are the top level structure elements.
+	Kids []*PdfStructElement
+	// RoleMap maps the structure types used in the document to standard structure types.
+	RoleMap map[string]string
+}
+
+// PdfStructElement represents a structure element (14.7.2 - Table 323).
+type PdfStructElement struct {
+	// S is the structure type of the element, e.g. "P" or "H1". It may be a non-standard type that
+	// is mapped to a standard type by the structure tree root's RoleMap.
+	S string
+	// Parent is the element's parent. It is nil for top level elements.
+	Parent *PdfStructElement
+	// ID is the element identifier.
+	ID string
+	// Page is the page on which the element's content is drawn, if it is all drawn on one page.
+	// It is inherited from the parent element if the element has no Pg entry.
+	Page *core.PdfIndirectObject
+	// T is the element title.
+	T string
+	// Lang is the language of the element's content.
+	Lang string
+	// Alt is the alternate description of the element, e.g. the description of a figure.
+	Alt string
+	// ActualText is the replacement text of the element's content.
+	ActualText string
+	// Kids are the element's kids in logical order.
+	Kids []*PdfStructKid
+}
+
+// PdfStructKid is a kid of a structure element. It is one of
+//   - a structure element (Element is set),
+//   - a marked-content sequence identified by its marked-content identifier (MCID >= 0), or
+//   - a PDF object such as an annotation or an XObject (Object is set).
+type PdfStructKid struct {
+	// Element is the structure element if the kid is a structure element.
+	Element *PdfStructElement
+	// MCID is the marked-content identifier if the kid is a marked-content sequence, otherwise -1.
+	MCID int
+	// Page is the page that contains the marked-content sequence or object.
+	Page *core.PdfIndirectObject
+	// Stream is the content stream that contains the marked-content sequence if it is not the
+	// content stream of Page, e.g. a form XObject.
+	Stream core.PdfObject
+	// Object is the referenced object if the kid is an object reference.
+	Object core.PdfObject
+}
+
+// StandardType returns the standard structure type of structure type `s` by following the role
+// map. `s` is returned if it isn't mapped.
+func (root *PdfStructTreeRoot) StandardType(s string) string {
+	seen := map[string]bool{}
+	for !seen[s] {
+		seen[s] = true
+		mapped, ok := root.RoleMap[s]
+		if !ok {
+			break
+		}
+		s = mapped
+	}
+	return s
+}
+
+// GetStructTreeRoot returns the structure tree root of a tagged PDF, or nil if the document has
+// no structure tree.
+func (r *PdfReader) GetStructTreeRoot() (*PdfStructTreeRoot, error) {
+	if r.parser.GetCrypter() != nil && !r.parser.IsAuthenticated() {
+		return nil, fmt.Errorf("file need to be decrypted first")
+	}
+	obj := core.ResolveReference(r.catalog.Get("StructTreeRoot"))
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return nil, nil
+	}
+
+	root := &PdfStructTreeRoot{RoleMap: map[string]string{}}
+	if roleMap, ok := core.GetDict(core.ResolveReference(dict.Get("RoleMap"))); ok {
+		for _, key := range roleMap.Keys() {
+			if s, ok := core.GetNameVal(roleMap.Get(key)); ok {
+				root.RoleMap[string(key)] = s
+			}
+		}
+	}
+
+	b := structTreeBuilder{visited: map[*core.PdfObjectDictionary]struct{}{}}
+	for _, kid := range kidObjects(dict.Get("K")) {
+		elemDict, ok := core.GetDict(kid)
+		if !ok {
+			continue
+		}
+		elem, err := b.newStructElement(elemDict, nil)
+		if err != nil {
+			return nil, err
+		}
+		if elem != nil {
+			root.Kids = append(root.Kids, elem)
+		}
+	}
+	return root, nil
+}
+
+// structTreeBuilder builds the structure tree. It guards against cycles in malformed files.
+type structTreeBuilder struct {
+	visited map[*core.PdfObjectDictionary]struct{}
+}
+
+// maxStructTreeDepth is the maximum nesting depth of structure elements that we load.
+const maxStructTreeDepth = 1000
+
+// newStructElement returns the structure element for dictionary `dict` with parent `parent`.
+// It returns nil if `dict` has already been loaded.
+func (b *structTreeBuilder) newStructElement(dict *core.PdfObjectDictionary,
+	parent *PdfStructElement) (*PdfStructElement, error) {
+	if _, ok := b.visited[dict]; ok {
+		common.Log.Debug("ERROR: Structure tree cycle. Skipping element")
+		return nil, nil
+	}
+	b.visited[dict] = struct{}{}
+
+	depth := 0
+	for p := parent; p != nil; p = p.Parent {
+		depth++
+	}
+	if depth > maxStructTreeDepth {
+		return nil, errors.New("structure tree too deep")
+	}
+
+	elem := &PdfStructElement{Parent: parent}
+	elem.S, _ = core.GetNameVal(dict.Get("S"))
+	elem.ID = decodedString(dict.Get("ID"))
+	elem.T = decodedString(dict.Get("T"))
+	elem.Lang = decodedString(dict.Get("Lang"))
+	elem.Alt = decodedString(dict.Get("Alt"))
+	elem.ActualText = decodedString(dict.Get("ActualText"))
+	elem.Page, _ = core.GetIndirect(core.ResolveReference(dict.Get("Pg")))
+	if elem.Page == nil && parent != nil {
+		elem.Page = parent.Page
+	}
+
+	for _, obj := range kidObjects(dict.Get("K")) {
+		kid := &PdfStructKid{MCID: -1, Page: elem.Page}
+		if mcid, ok := core.GetIntVal(obj); ok {
+			// A marked-content sequence on the element's page.
+			kid.MCID = mcid
+			elem.Kids = append(elem.Kids, kid)
+			continue
+		}
+		kidDict, ok := core.GetDict(obj)
+		if !ok {
+			common.Log.Debug("ERROR: Invalid structure element kid %T", obj)
+			continue
+		}
+		if pg, ok := core.GetIndirect(core.ResolveReference(kidDict.Get("Pg"))); ok {
+			kid.Page = pg
+		}
+		typ, _ := core.GetNameVal(kidDict.Get("Type"))
+		switch typ {
+		case "MCR":
+			// Marked-content reference (14.7.4.2 - Table 324).
+			mcid, ok := core.GetIntVal(kidDict.Get("MCID"))
+			if !ok {
+				common.Log.Debug("ERROR: Marked-content reference without MCID")
+				continue
+			}
+			kid.MCID = mcid
+			kid.Stream = core.ResolveReference(kidDict.Get("Stm"))
+		case "OBJR":
+			// Object reference (14.7.4.3 - Table 325).
+			kid.Object = core.ResolveReference(kidDict.Get("Obj"))
+		default:
+			child, err := b.newStructElement(kidDict, elem)
+			if err != nil {
+				return nil, err
+			}
+			if child == nil {
+				continue
+			}
+			kid.Element = child
+		}
+		elem.Kids = append(elem.Kids, kid)
+	}
+	return elem, nil
+}
+
+// kidObjects returns the kids in the K entry `obj` of a structure tree node. K may be a single
+// kid or an array of kids.
+func kidObjects(obj core.PdfObject) []core.PdfObject {
+	obj = core.ResolveReference(obj)
+	if obj == nil {
+		return nil
+	}
+	if arr, ok := core.GetArray(obj); ok {
+		kids := make([]core.PdfObject, 0, arr.Len())
+		for _, kid := range arr.Elements() {
+			kids = append(kids, core.ResolveReference(kid))
+		}
+		return kids
+	}
+	return []core.PdfObject{obj}
+}
+
+// decodedString returns the decoded text string in `obj` or "" if `obj` isn't a string.
+func decodedString(obj core.PdfObject) string {
+	str, ok := core.GetString(core.ResolveReference(obj))
+	if !ok {
+		return ""
+	}
+	return str.Decoded()
+}
@@ -395,6 +395,18 @@ func (w *PdfWriter) SetVersion(majorVersion, minorVersion int) {
 	w.minorVersion = minorVersion
 }
 
+// SetOptionalContentProperties sets the optional content properties of the document to `props`.
+// The PDF version is raised to 1.5 if it is lower, as optional content requires it.
+func (w *PdfWriter) SetOptionalContentProperties(props *PdfOCProperties) error {
+	if props == nil {
+		return nil
+	}
+	if w.majorVersion == 1 && w.minorVersion < 5 {
+		w.minorVersion = 5
+	}
+	return w.SetOCProperties(props.ToPdfObject())
+}
+
 // SetOCProperties sets the optional content properties.
 func (w *PdfWriter) SetOCProperties(ocProperties core.PdfObject) error {
 	dict := w.catalog
@@ -409,6 +421,17 @@ func (w *PdfWriter) SetOCProperties(ocProperties core.PdfObject) error {
 	return nil
 }
 
+// SetCatalogMetadata sets the Metadata entry of the PDF catalog to the document metadata (XMP)
+// stream `meta`.
+func (w *PdfWriter) SetCatalogMetadata(meta core.PdfObject) error {
+	if meta == nil {
+		return nil
+	}
+	common.Log.Trace("Setting catalog Metadata...")
+	w.catalog.Set("Metadata", meta)
+	return w.addObjects(meta)
+}
+
 // SetNamedDestinations sets the Names entry in the PDF catalog.
 // See section 12.3.2.3 "Named Destinations" (p. 367 PDF32000_2008).
 func (w *PdfWriter) SetNamedDestinations(names core.PdfObject) error {
@@ -849,8 +872,42 @@ func (w *PdfWriter) updateObjectNumbers() {
 type EncryptOptions struct {
 	Permissions security.Permissions
 	Algorithm   EncryptionAlgorithm
+
+	// Recipients encrypts the document for the certificates of the recipients with the
+	// public-key security handler instead of the passwords, which are then ignored along
+	// with Permissions. Each recipient is granted its own permissions.
+	Recipients []security.Recipient
+
+	// StreamFilter, StringFilter and EmbeddedFileFilter select the crypt filters of the
+	// streams, the strings and the embedded file streams of the document. CryptFilterRC4 and
+	// CryptFilterAESV2 require RC4_128bit or AES_128bit, and CryptFilterAESV3 requires
+	// AES_256bit, as the filters share the encryption key of the document.
+	StreamFilter       CryptFilter
+	StringFilter       CryptFilter
+	EmbeddedFileFilter CryptFilter
+
+	// UnencryptedMetadata leaves the document metadata (XMP) stream unencrypted, so that it can be
+	// read without decrypting the document.
+	UnencryptedMetadata bool
 }
 
+// CryptFilter is used in EncryptOptions to select the crypt filter of a class of objects.
+// Filters other than CryptFilterDefault make RC4_128bit documents use crypt filters (PDF 1.5).
+type CryptFilter int
+
+const (
+	// CryptFilterDefault encrypts the objects with the encryption algorithm.
+	CryptFilterDefault = CryptFilter(iota)
+	// CryptFilterIdentity leaves the objects unencrypted.
+	CryptFilterIdentity
+	// CryptFilterRC4 encrypts the objects with RC4 (128 bit, V2 crypt filter method).
+	CryptFilterRC4
+	// CryptFilterAESV2 encrypts the objects with AES (128 bit).
+	CryptFilterAESV2
+	// CryptFilterAESV3 encrypts the objects with AES (256 bit).
+	CryptFilterAESV3
+)
+
 // EncryptionAlgorithm is used in EncryptOptions to change the default algorithm used to encrypt the document.
 type EncryptionAlgorithm int
 
@@ -863,7 +920,8 @@ const (
 	AES_256bit
 )
 
-// Encrypt encrypts the output file with a specified user/owner password.
+// Encrypt encrypts the output file with a specified user/owner password, or for the certificates
+// of the recipients of the options, if any.
 func (w *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptions) error {
 	algo := RC4_128bit
 	if options != nil {
@@ -885,7 +943,41 @@ func (w *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptions)
 	default:
 		return fmt.Errorf("unsupported algorithm: %v", options.Algorithm)
 	}
-	crypter, info, err := core.PdfCryptNewEncrypt(cf, userPass, ownerPass, perm)
+	var opts core.CryptOptions
+	if options != nil {
+		for _, f := range []struct {
+			filter CryptFilter
+			cf     *crypt.Filter
+		}{
+			{options.StreamFilter, &opts.StreamFilter},
+			{options.StringFilter, &opts.StringFilter},
+			{options.EmbeddedFileFilter, &opts.EmbeddedFileFilter},
+		} {
+			switch f.filter {
+			case CryptFilterDefault:
+			case CryptFilterIdentity:
+				*f.cf = crypt.NewIdentity()
+			case CryptFilterRC4:
+				*f.cf = crypt.NewFilterV2(16)
+			case CryptFilterAESV2:
+				*f.cf = crypt.NewFilterAESV2()
+			case CryptFilterAESV3:
+				*f.cf = crypt.NewFilterAESV3()
+			default:
+				return fmt.Errorf("unsupported crypt filter: %v", f.filter)
+			}
+		}
+		opts.UnencryptedMetadata = options.UnencryptedMetadata
+	}
+
+	var crypter *core.PdfCrypt
+	var info *core.EncryptInfo
+	var err error
+	if options != nil && len(options.Recipients) > 0 {
+		crypter, info, err = core.PdfCryptNewEncryptPubSecWithOptions(cf, options.Recipients, &opts)
+	} else {
+		crypter, info, err = core.PdfCryptNewEncryptWithOptions(cf, userPass, ownerPass, perm, &opts)
+	}
 	if err != nil {
 		return err
 	}
@@ -1051,6 +1143,17 @@ func (w *PdfWriter) Write(writer io.Writer) error {
 		}
 	}
 
+	// The document metadata is left unencrypted if EncryptMetadata is false, and the embedded
+	// files are encrypted with their own filter.
+	if w.crypter != nil {
+		if catalog, ok := core.GetDict(w.root); ok {
+			if metadata, ok := core.GetStream(catalog.Get("Metadata")); ok {
+				w.crypter.SetDocumentMetadata(metadata)
+			}
+		}
+		w.crypter.SetDocumentObjects(w.objects)
+	}
+
 	// Write out indirect/stream objects that are not in object streams.
 	for _, obj := range w.objects {
 		if skip := objectsInObjectStreams[obj]; skip {
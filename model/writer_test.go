@@ -7,10 +7,19 @@ package model
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/zituocn/updf/core"
+	"github.com/zituocn/updf/core/security"
 )
 
 // Tests loading annotations from file, writing back out and reloading.
@@ -104,3 +113,349 @@ func TestReadWriteAnnotations(t *testing.T) {
 		checkAnnots(reader, false)
 	}
 }
+
+// newTestRecipient returns a self-signed certificate with an RSA key and the key.
+func newTestRecipient(t *testing.T, serial int64, name string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certData)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// Tests encrypting a document for certificates and decrypting it with the private keys.
+func TestEncryptRecipients(t *testing.T) {
+	cert1, key1 := newTestRecipient(t, 1, "Owner")
+	cert2, key2 := newTestRecipient(t, 2, "Reader")
+	other, otherKey := newTestRecipient(t, 3, "Other")
+
+	const content = "BT /F1 12 Tf 10 10 Td (Hello World) Tj ET"
+	const perms = security.PermPrinting | security.PermFullPrintQuality
+	recipients := []security.Recipient{
+		{Certificates: []*x509.Certificate{cert1}, Permissions: security.PermOwner},
+		{Certificates: []*x509.Certificate{cert2}, Permissions: perms},
+	}
+
+	for _, algo := range []EncryptionAlgorithm{RC4_128bit, AES_128bit, AES_256bit} {
+		w := NewPdfWriter()
+		page := NewPdfPage()
+		require.NoError(t, page.AddContentStreamByString(content))
+		require.NoError(t, w.AddPage(page))
+		err := w.Encrypt(nil, nil, &EncryptOptions{Algorithm: algo, Recipients: recipients})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, w.Write(&buf))
+		require.NotContains(t, buf.String(), "Hello World")
+
+		read := func(cert *x509.Certificate, key *rsa.PrivateKey) (*PdfReader, bool) {
+			reader, err := NewPdfReader(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			isEnc, err := reader.IsEncrypted()
+			require.NoError(t, err)
+			require.True(t, isEnc)
+			ok, err := reader.DecryptWithCertificate(cert, key)
+			require.NoError(t, err)
+			return reader, ok
+		}
+
+		for _, c := range []struct {
+			cert *x509.Certificate
+			key  *rsa.PrivateKey
+			perm security.Permissions
+		}{
+			{cert1, key1, security.PermOwner},
+			{cert2, key2, perms},
+		} {
+			reader, ok := read(c.cert, c.key)
+			require.True(t, ok)
+			_, perm, err := reader.CheckAccessRights(nil)
+			require.NoError(t, err)
+			require.Equal(t, c.perm, perm)
+
+			page, err := reader.GetPage(1)
+			require.NoError(t, err)
+			str, err := page.GetAllContentStreams()
+			require.NoError(t, err)
+			require.Contains(t, str, content)
+		}
+
+		_, ok := read(other, otherKey)
+		require.False(t, ok)
+
+		reader, err := NewPdfReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		_, err = reader.Decrypt([]byte(""))
+		require.Error(t, err)
+	}
+}
+
+// Tests encrypting the streams, strings, embedded files and metadata with separate crypt filters.
+func TestEncryptCryptFilters(t *testing.T) {
+	const (
+		content  = "BT /F1 12 Tf 10 10 Td (Hello World) Tj ET"
+		note     = "Annotation note"
+		attached = "Attached file contents"
+		named    = "Named file contents"
+		xmp      = "<x:xmpmeta xmlns:x='adobe:ns:meta/'>Test metadata</x:xmpmeta>"
+	)
+	cert, key := newTestRecipient(t, 1, "Recipient")
+
+	// The Type of the embedded file stream is optional.
+	write := func(options *EncryptOptions, untypedFile bool) ([]byte, error) {
+		w := NewPdfWriter()
+		page := NewPdfPage()
+		require.NoError(t, page.AddContentStreamByString(content))
+
+		file, err := core.MakeStream([]byte(attached), nil)
+		require.NoError(t, err)
+		if !untypedFile {
+			file.Set("Type", core.MakeName("EmbeddedFile"))
+		}
+		fs := core.MakeDict()
+		fs.Set("Type", core.MakeName("Filespec"))
+		fs.Set("F", core.MakeString("attached.txt"))
+		ef := core.MakeDict()
+		ef.Set("F", file)
+		fs.Set("EF", ef)
+		annot := NewPdfAnnotationFileAttachment()
+		annot.Rect = core.MakeArrayFromFloats([]float64{10, 10, 30, 30})
+		annot.Contents = core.MakeString(note)
+		annot.FS = fs
+		page.AddAnnotation(annot.PdfAnnotation)
+		require.NoError(t, w.AddPage(page))
+
+		// Untyped embedded file of the EmbeddedFiles name tree.
+		namedFile, err := core.MakeStream([]byte(named), nil)
+		require.NoError(t, err)
+		namedEF := core.MakeDict()
+		namedEF.Set("F", namedFile)
+		namedFS := core.MakeDict()
+		namedFS.Set("Type", core.MakeName("Filespec"))
+		namedFS.Set("F", core.MakeString("named.txt"))
+		namedFS.Set("EF", namedEF)
+		tree := core.MakeDict()
+		tree.Set("Names", core.MakeArray(core.MakeString("named.txt"), core.MakeIndirectObject(namedFS)))
+		names := core.MakeDict()
+		names.Set("EmbeddedFiles", tree)
+		require.NoError(t, w.SetNamedDestinations(names))
+
+		metadata, err := core.MakeStream([]byte(xmp), nil)
+		require.NoError(t, err)
+		metadata.Set("Type", core.MakeName("Metadata"))
+		metadata.Set("Subtype", core.MakeName("XML"))
+		require.NoError(t, w.SetCatalogMetadata(metadata))
+
+		if len(options.Recipients) == 0 {
+			err = w.Encrypt([]byte("password"), []byte("password"), options)
+		} else {
+			err = w.Encrypt(nil, nil, options)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		require.NoError(t, w.Write(&buf))
+		return buf.Bytes(), nil
+	}
+
+	read := func(data []byte, pubSec bool) (string, string, string, string, string) {
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		var ok bool
+		if pubSec {
+			ok, err = reader.DecryptWithCertificate(cert, key)
+		} else {
+			ok, err = reader.Decrypt([]byte("password"))
+		}
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		resolve := func(obj core.PdfObject) core.PdfObject {
+			obj, err := reader.parser.Resolve(obj)
+			require.NoError(t, err)
+			return obj
+		}
+
+		page, err := reader.GetPage(1)
+		require.NoError(t, err)
+		str, err := page.GetAllContentStreams()
+		require.NoError(t, err)
+
+		annots, err := page.GetAnnotations()
+		require.NoError(t, err)
+		require.Len(t, annots, 1)
+		annot, ok := annots[0].GetContext().(*PdfAnnotationFileAttachment)
+		require.True(t, ok)
+		fs, ok := core.GetDict(resolve(annot.FS))
+		require.True(t, ok)
+		ef, ok := core.GetDict(resolve(fs.Get("EF")))
+		require.True(t, ok)
+		file, ok := core.GetStream(resolve(ef.Get("F")))
+		require.True(t, ok)
+
+		trailer, err := reader.GetTrailer()
+		require.NoError(t, err)
+		catalog, ok := core.GetDict(resolve(trailer.Get("Root")))
+		require.True(t, ok)
+		metadata, ok := core.GetStream(resolve(catalog.Get("Metadata")))
+		require.True(t, ok)
+
+		names, ok := core.GetDict(resolve(catalog.Get("Names")))
+		require.True(t, ok)
+		tree, ok := core.GetDict(resolve(names.Get("EmbeddedFiles")))
+		require.True(t, ok)
+		arr, ok := core.GetArray(resolve(tree.Get("Names")))
+		require.True(t, ok)
+		fs, ok = core.GetDict(resolve(arr.Get(1)))
+		require.True(t, ok)
+		ef, ok = core.GetDict(resolve(fs.Get("EF")))
+		require.True(t, ok)
+		namedFile, ok := core.GetStream(resolve(ef.Get("F")))
+		require.True(t, ok)
+
+		return str, annot.Contents.String(), string(file.Stream), string(metadata.Stream), string(namedFile.Stream)
+	}
+
+	for _, c := range []struct {
+		name        string
+		options     *EncryptOptions
+		untypedFile bool
+		// plain lists the objects which are not encrypted: content, note, attached, metadata.
+		plain [4]bool
+		// encrypt lists entries of the Encrypt dictionary.
+		encrypt []string
+	}{
+		{
+			name: "embedded files only",
+			options: &EncryptOptions{
+				Algorithm:    AES_128bit,
+				StreamFilter: CryptFilterIdentity,
+				StringFilter: CryptFilterIdentity,
+			},
+			plain: [4]bool{true, true, false, true},
+		},
+		{
+			name: "all but embedded files",
+			options: &EncryptOptions{
+				Algorithm:          AES_256bit,
+				EmbeddedFileFilter: CryptFilterIdentity,
+			},
+			plain: [4]bool{false, false, true, false},
+		},
+		{
+			name: "untyped embedded files only",
+			options: &EncryptOptions{
+				Algorithm:    AES_128bit,
+				StreamFilter: CryptFilterIdentity,
+				StringFilter: CryptFilterIdentity,
+			},
+			untypedFile: true,
+			plain:       [4]bool{true, true, false, true},
+		},
+		{
+			name: "all but untyped embedded files",
+			options: &EncryptOptions{
+				Algorithm:          AES_256bit,
+				EmbeddedFileFilter: CryptFilterIdentity,
+			},
+			untypedFile: true,
+			plain:       [4]bool{false, false, true, false},
+		},
+		{
+			name: "unencrypted metadata AESV2",
+			options: &EncryptOptions{
+				Algorithm:           AES_128bit,
+				UnencryptedMetadata: true,
+			},
+			plain: [4]bool{false, false, false, true},
+		},
+		{
+			name: "unencrypted metadata AESV3",
+			options: &EncryptOptions{
+				Algorithm:           AES_256bit,
+				UnencryptedMetadata: true,
+			},
+			plain: [4]bool{false, false, false, true},
+		},
+		{
+			name: "unencrypted metadata for recipients",
+			options: &EncryptOptions{
+				Algorithm:           AES_128bit,
+				Recipients:          []security.Recipient{{Certificates: []*x509.Certificate{cert}, Permissions: security.PermOwner}},
+				UnencryptedMetadata: true,
+				StringFilter:        CryptFilterIdentity,
+			},
+			plain: [4]bool{false, true, false, true},
+		},
+		{
+			name: "RC4 strings with AESV2 streams",
+			options: &EncryptOptions{
+				Algorithm:    AES_128bit,
+				StringFilter: CryptFilterRC4,
+			},
+			plain:   [4]bool{false, false, false, false},
+			encrypt: []string{"/CFM /AESV2", "/CFM /V2", "/StrF /V2", "/StmF /StdCF"},
+		},
+		{
+			name: "AESV2 embedded files with RC4",
+			options: &EncryptOptions{
+				Algorithm:          RC4_128bit,
+				EmbeddedFileFilter: CryptFilterAESV2,
+			},
+			untypedFile: true,
+			plain:       [4]bool{false, false, false, false},
+			encrypt:     []string{"/V 4", "/R 4", "/CFM /V2", "/CFM /AESV2", "/EFF /AESV2"},
+		},
+		{
+			name: "unencrypted metadata RC4",
+			options: &EncryptOptions{
+				Algorithm:           RC4_128bit,
+				UnencryptedMetadata: true,
+			},
+			plain: [4]bool{false, false, false, true},
+		},
+		{
+			name: "all but embedded files RC4",
+			options: &EncryptOptions{
+				Algorithm:          RC4_128bit,
+				EmbeddedFileFilter: CryptFilterIdentity,
+			},
+			plain: [4]bool{false, false, true, false},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := write(c.options, c.untypedFile)
+			require.NoError(t, err)
+			for _, entry := range c.encrypt {
+				require.Contains(t, string(data), entry)
+			}
+			for i, s := range []string{"Hello World", note, attached, xmp} {
+				require.Equal(t, c.plain[i], bytes.Contains(data, []byte(s)), s)
+			}
+			require.Equal(t, c.plain[2], bytes.Contains(data, []byte(named)), named)
+
+			str, contents, file, metadata, namedFile := read(data, len(c.options.Recipients) > 0)
+			require.Contains(t, str, content)
+			require.Equal(t, note, contents)
+			require.Equal(t, attached, file)
+			require.Equal(t, xmp, metadata)
+			require.Equal(t, named, namedFile)
+		})
+	}
+
+	// The filters share the encryption key of the document.
+	_, err := write(&EncryptOptions{Algorithm: AES_256bit, StreamFilter: CryptFilterAESV2}, false)
+	require.Error(t, err)
+	_, err = write(&EncryptOptions{Algorithm: RC4_128bit, StringFilter: CryptFilterAESV3}, false)
+	require.Error(t, err)
+	_, err = write(&EncryptOptions{Algorithm: AES_128bit, StringFilter: CryptFilter(-1)}, false)
+	require.Error(t, err)
+}